@@ -2,11 +2,14 @@ package cryptopuff
 
 import (
 	"bytes"
+	"crypto/ecdsa"
 	"crypto/md5"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"database/sql/driver"
 	"encoding/base64"
+	"fmt"
 
 	"github.com/pkg/errors"
 )
@@ -16,10 +19,74 @@ type Version int
 const (
 	V1 Version = iota
 	V2
+	// V3 addresses are the SHA-256 hash of the public key followed by a
+	// checksum, so AddressFromString can reject mistyped addresses.
+	V3
+	// V4 addresses are for ECDSA P-256 keys, which unlike the default RSA
+	// keys can't be factored. They are laid out like V3 addresses, after a
+	// prefix byte that sets them apart, and hash the key's PKIX encoding.
+	V4
 )
 
 const DefaultVersion = V1
 
+const (
+	addressLengthV1 = 2
+	addressLengthV2 = md5.Size
+	addressLengthV3 = sha256.Size + addressChecksumSize
+	addressLengthV4 = 1 + sha256.Size + addressChecksumSize
+
+	addressChecksumSize = 4
+	addressPrefixV4     = 0x04
+)
+
+func (v Version) String() string {
+	switch v {
+	case V1:
+		return "v1"
+	case V2:
+		return "v2"
+	case V3:
+		return "v3"
+	case V4:
+		return "v4"
+	default:
+		return fmt.Sprintf("Version(%d)", int(v))
+	}
+}
+
+// KeyType returns the type of key addresses of the given version belong to.
+func (v Version) KeyType() KeyType {
+	if v == V4 {
+		return KeyECDSA
+	}
+	return KeyRSA
+}
+
+// DetectVersion infers the format of an address from its length.
+func DetectVersion(a Address) (Version, error) {
+	switch len(a) {
+	case addressLengthV1:
+		return V1, nil
+	case addressLengthV2:
+		return V2, nil
+	case addressLengthV3:
+		return V3, nil
+	case addressLengthV4:
+		if a[0] != addressPrefixV4 {
+			return 0, errors.Errorf("cryptopuff: invalid v4 address prefix %#x", a[0])
+		}
+		return V4, nil
+	default:
+		return 0, errors.Errorf("cryptopuff: invalid address length %v, expected %v (v1), %v (v2), %v (v3) or %v (v4)", len(a), addressLengthV1, addressLengthV2, addressLengthV3, addressLengthV4)
+	}
+}
+
+func addressChecksum(hash []byte) []byte {
+	sum := sha256.Sum256(hash)
+	return sum[:addressChecksumSize]
+}
+
 type Address []byte
 
 func AddressFromString(str string) (Address, error) {
@@ -27,18 +94,55 @@ func AddressFromString(str string) (Address, error) {
 	if err != nil {
 		return nil, err
 	}
+	version, err := DetectVersion(b)
+	if err != nil {
+		return nil, err
+	}
+	if version == V3 || version == V4 {
+		n := len(b) - addressChecksumSize
+		if !bytes.Equal(b[n:], addressChecksum(b[:n])) {
+			return nil, errors.Errorf("cryptopuff: invalid %v address checksum, the address may be mistyped", version)
+		}
+	}
 	return Address(b), nil
 }
 
 func AddressFromKey(version Version, k *rsa.PublicKey) Address {
-	hash := md5.Sum(x509.MarshalPKCS1PublicKey(k))
-	if version == V1 {
-		return Address(hash[:2])
+	der := x509.MarshalPKCS1PublicKey(k)
+	switch version {
+	case V1:
+		hash := md5.Sum(der)
+		return Address(hash[:addressLengthV1])
+	case V3:
+		hash := sha256.Sum256(der)
+		return Address(append(hash[:], addressChecksum(hash[:])...))
+	default:
+		hash := md5.Sum(der)
+		return Address(hash[:])
+	}
+}
+
+// AddressFromECDSAKey returns the V4 address of an ECDSA key.
+func AddressFromECDSAKey(k *ecdsa.PublicKey) (Address, error) {
+	der, err := x509.MarshalPKIXPublicKey(k)
+	if err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: failed to marshal public key")
 	}
-	return Address(hash[:])
+
+	hash := sha256.Sum256(der)
+	a := append([]byte{addressPrefixV4}, hash[:]...)
+	return Address(append(a, addressChecksum(a)...)), nil
 }
 
+// Scan decodes an address stored by Value. Value encodes nil and empty
+// addresses the same way, so both scan back as nil, which marshals to the same
+// JSON as the zero Address.
 func (a *Address) Scan(value interface{}) error {
+	if value == nil {
+		*a = nil
+		return nil
+	}
+
 	v, ok := value.([]byte)
 	if !ok {
 		return errors.Errorf("cryptopuff: can't convert %T to Address, expected %T", value, v)
@@ -49,6 +153,10 @@ func (a *Address) Scan(value interface{}) error {
 		return errors.Wrap(err, "cryptopuff: failed to base64 decode address")
 	}
 
+	if len(b) == 0 {
+		*a = nil
+		return nil
+	}
 	*a = b
 	return nil
 }
@@ -70,3 +178,16 @@ type AddressState struct {
 	PublicKey []byte
 	Balance   int64
 }
+
+// AddressActivity summarises the history of any address in the best chain:
+// the transactions to or from it and the blocks whose reward it was paid. The
+// heights are those of the first and last of either, and are nil if there are
+// none, as zero is the genesis block's height.
+type AddressActivity struct {
+	Address     Address
+	Balance     int64
+	TxCount     int64
+	BlocksMined int64
+	FirstHeight *int64
+	LastHeight  *int64
+}
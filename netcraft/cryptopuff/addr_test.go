@@ -0,0 +1,131 @@
+package cryptopuff
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func testAddressRoundTrip(t *testing.T, a Address) {
+	raw, err := json.Marshal(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fromJSON Address
+	if err := json.Unmarshal(raw, &fromJSON); err != nil {
+		t.Fatal(err)
+	}
+	if !fromJSON.Equal(a) || (a == nil) != (fromJSON == nil) {
+		t.Errorf("JSON round trip of %#v gave %#v", a, fromJSON)
+	}
+
+	// Nil and empty addresses are stored the same way, and both scan back as
+	// nil.
+	var fromSQL Address
+	sqlRoundTrip(t, a, &fromSQL)
+	if !fromSQL.Equal(a) || (len(a) == 0 && fromSQL != nil) {
+		t.Errorf("SQL round trip of %#v gave %#v", a, fromSQL)
+	}
+}
+
+func TestAddressRoundTrip(t *testing.T) {
+	k := testKey(t, 1)
+	ek, err := GenerateECDSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v4, err := AddressFromECDSAKey(&ek.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addrs := []Address{
+		nil,
+		{},
+		AddressFromKey(V1, &k.PublicKey),
+		AddressFromKey(V2, &k.PublicKey),
+		AddressFromKey(V3, &k.PublicKey),
+		v4,
+	}
+	for _, a := range addrs {
+		testAddressRoundTrip(t, a)
+	}
+
+	for _, a := range addrs[2:] {
+		fromString, err := AddressFromString(a.String())
+		if err != nil {
+			t.Errorf("AddressFromString(%q): %v", a, err)
+		} else if !fromString.Equal(a) {
+			t.Errorf("string round trip of %v gave %v", a, fromString)
+		}
+	}
+}
+
+func TestDetectVersion(t *testing.T) {
+	k := testKey(t, 1)
+	ek := testECDSAKey(t)
+	v4, err := AddressFromECDSAKey(&ek.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for want, a := range map[Version]Address{
+		V1: AddressFromKey(V1, &k.PublicKey),
+		V2: AddressFromKey(V2, &k.PublicKey),
+		V3: AddressFromKey(V3, &k.PublicKey),
+		V4: v4,
+	} {
+		if got, err := DetectVersion(a); err != nil || got != want {
+			t.Errorf("DetectVersion(%v) = %v, %v, want %v", a, got, err, want)
+		}
+	}
+
+	// A v4-length address needs the v4 prefix, and no other lengths are
+	// addresses.
+	wrongPrefix := append(Address(nil), v4...)
+	wrongPrefix[0] ^= 0xff
+	for _, a := range []Address{nil, {0x01}, make(Address, addressLengthV2+1), wrongPrefix} {
+		if v, err := DetectVersion(a); err == nil {
+			t.Errorf("DetectVersion(%#v) = %v, want an error", a, v)
+		}
+	}
+}
+
+func TestAddressFromStringChecksum(t *testing.T) {
+	a := AddressFromKey(V3, &testKey(t, 1).PublicKey)
+	mistyped := append(Address(nil), a...)
+	mistyped[0] ^= 0x01
+	if _, err := AddressFromString(mistyped.String()); err == nil {
+		t.Error("mistyped address accepted")
+	}
+}
+
+func FuzzAddressRoundTrip(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{0x12, 0x34})
+	f.Add(bytes.Repeat([]byte{0xff}, addressLengthV4))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		testAddressRoundTrip(t, Address(b))
+	})
+}
+
+// FuzzAddressFromString checks that any address AddressFromString accepts
+// survives being printed and parsed again.
+func FuzzAddressFromString(f *testing.F) {
+	f.Add("EjQ=")
+	f.Add("")
+	f.Fuzz(func(t *testing.T, str string) {
+		a, err := AddressFromString(str)
+		if err != nil {
+			return
+		}
+		fromString, err := AddressFromString(a.String())
+		if err != nil {
+			t.Fatalf("AddressFromString(%q): %v", a, err)
+		}
+		if !fromString.Equal(a) {
+			t.Errorf("string round trip of %v gave %v", a, fromString)
+		}
+		testAddressRoundTrip(t, a)
+	})
+}
@@ -5,7 +5,10 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"sync"
+	"time"
 
+	"github.com/JohnCGriffin/overflow"
 	"github.com/pkg/errors"
 )
 
@@ -18,10 +21,134 @@ func init() {
 }
 
 const (
+	// MaxBlockReward caps the reward claimed by blocks older than
+	// BlockVersion4, which could claim any amount up to it.
 	MaxBlockReward          = 1000
 	MaxTransactionsPerBlock = 100
+
+	// InitialBlockSubsidy is the reward BlockVersion4 blocks claim until the
+	// first halving.
+	InitialBlockSubsidy = 100
+
+	// SubsidyHalvingInterval is the number of blocks after which the subsidy
+	// halves.
+	SubsidyHalvingInterval = 100000
+
+	// MaxFutureBlockTime is how far ahead of our clock a block's timestamp
+	// may be.
+	MaxFutureBlockTime = 2 * time.Hour
+
+	validatedBlocksSize = 10000
+)
+
+// validatedBlocks remembers blocks whose transactions have already been
+// verified, so a block that reappears on a different candidate chain (e.g.
+// during a reorg or re-download) doesn't have every signature checked again.
+// Blocks are remembered by their validationKey. Only checks that depend
+// solely on the block's contents, which the key commits to, are skipped.
+// Checks against the previous block or the difficulty target always run.
+var validatedBlocks = newHashSet(validatedBlocksSize)
+
+type hashSet struct {
+	mu     sync.Mutex
+	size   int
+	hashes map[Hash]struct{}
+	order  []Hash
+}
+
+func newHashSet(size int) *hashSet {
+	return &hashSet{
+		size:   size,
+		hashes: make(map[Hash]struct{}),
+	}
+}
+
+func (h *hashSet) contains(hash Hash) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	_, ok := h.hashes[hash]
+	return ok
+}
+
+func (h *hashSet) len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.order)
+}
+
+func (h *hashSet) add(hash Hash) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.hashes[hash]; ok {
+		return
+	}
+
+	for len(h.order) >= h.size {
+		delete(h.hashes, h.order[0])
+		h.order = h.order[1:]
+	}
+
+	h.hashes[hash] = struct{}{}
+	h.order = append(h.order, hash)
+}
+
+// BlockVersion determines how a block is hashed.
+type BlockVersion int
+
+const (
+	// BlockVersion1 blocks are hashed with MD5.
+	BlockVersion1 BlockVersion = iota
+	// BlockVersion2 blocks hash their header and Merkle tree with SHA-256
+	// and must have a Merkle root.
+	BlockVersion2
+	// BlockVersion3 blocks' payouts can't be spent until they mature (see
+	// CoinbaseMaturity).
+	BlockVersion3
+	// BlockVersion4 blocks must claim exactly the scheduled subsidy (see
+	// BlockSubsidy), rather than whatever their miner chose.
+	BlockVersion4
 )
 
+// BlockVersion3Height and BlockVersion4Height are the heights from which
+// blocks must have at least BlockVersion3 and BlockVersion4 respectively.
+// Blocks below them can't use those versions, so nodes that predate a version
+// agree on the chain until its activation height, giving them time to
+// upgrade.
+const (
+	BlockVersion3Height = 50000
+	BlockVersion4Height = 50000
+)
+
+// BlockVersionForHeight returns the version blocks at the given height are
+// created with: the newest one active at that height.
+func BlockVersionForHeight(height int64) BlockVersion {
+	switch {
+	case height >= BlockVersion4Height:
+		return BlockVersion4
+	case height >= BlockVersion3Height:
+		return BlockVersion3
+	default:
+		return BlockVersion2
+	}
+}
+
+// CoinbaseMaturity is the number of blocks a BlockVersion3 block's payout
+// takes to mature: the payout of a block at height H can be spent once the
+// tip is at height H+CoinbaseMaturity. Until then a reorg can orphan the
+// block, and with it the coins, so they mustn't reach anyone else.
+const CoinbaseMaturity = 100
+
+// HashAlgo returns the digest blocks of the given version are hashed with.
+func (v BlockVersion) HashAlgo() HashAlgo {
+	if v >= BlockVersion2 {
+		return HashSHA256
+	}
+	return HashMD5
+}
+
 type Block struct {
 	Hash         Hash `json:"-"`
 	PreviousHash Hash
@@ -29,19 +156,69 @@ type Block struct {
 	Nonce        int64
 	RewardOutput TxOutput
 	Transactions []SignedTx
+
+	// Timestamp is the Unix time at which the block was mined. Blocks created
+	// before timestamps were introduced have a zero Timestamp, which is left
+	// out of both the JSON encoding and the hash so that their hashes don't
+	// change.
+	Timestamp int64 `json:",omitempty"`
+
+	// MerkleRoot is the root of the Merkle tree over the transaction hashes,
+	// which the block hash commits to in place of a hash of the whole
+	// transaction list. Blocks created before Merkle roots were introduced
+	// have an empty MerkleRoot and keep their original hashes.
+	MerkleRoot Hash
+
+	// Target is the difficulty the block was mined at, which must match
+	// TargetForHeight. It is zero, and left out of the JSON encoding and the
+	// hash, until the chain's first retarget, meaning DefaultTarget.
+	Target Target `json:",omitempty"`
+
+	// Version is zero for blocks created before block versions were
+	// introduced, which keeps it out of their JSON encoding and hash.
+	Version BlockVersion `json:",omitempty"`
+}
+
+// BlockSubsidy returns the reward a BlockVersion4 block at the given height
+// claims: InitialBlockSubsidy, halved every SubsidyHalvingInterval blocks. The
+// block's payout is the subsidy plus the fees of its transactions.
+func BlockSubsidy(height int64) int64 {
+	halvings := height / SubsidyHalvingInterval
+	if halvings >= 63 {
+		return 0
+	}
+	return InitialBlockSubsidy >> uint(halvings)
 }
 
-func NewBlock(previous *Block, nonce int64, addr Address, blockReward int64, stxs []SignedTx) (*Block, error) {
+// NewBlock creates a block on top of previous with the version active at its
+// height (see BlockVersionForHeight) and the given target (see
+// TargetForHeight), claiming the scheduled subsidy and timestamped with the
+// current time or, if the clock is behind previous's timestamp, one second
+// after it. Blocks older than BlockVersion4 may claim any reward up to
+// MaxBlockReward, so claiming the subsidy keeps them valid too.
+func NewBlock(previous *Block, target Target, nonce int64, addr Address, stxs []SignedTx) (*Block, error) {
+	timestamp := time.Now().Unix()
+	if timestamp <= previous.Timestamp {
+		timestamp = previous.Timestamp + 1
+	}
+
 	b := &Block{
 		PreviousHash: previous.Hash,
 		Height:       previous.Height + 1,
 		Nonce:        nonce,
 		RewardOutput: TxOutput{
 			Destination: addr,
-			Amount:      blockReward,
+			Amount:      BlockSubsidy(previous.Height + 1),
 		},
 		Transactions: stxs,
+		Timestamp:    timestamp,
+		Target:       target,
+		Version:      BlockVersionForHeight(previous.Height + 1),
+	}
+	if err := b.updateTxHashes(); err != nil {
+		return nil, err
 	}
+	b.MerkleRoot = MerkleRoot(b.Version.HashAlgo(), b.txHashes())
 	if err := b.UpdateHash(); err != nil {
 		return nil, errors.Wrap(err, "cryptopuff: failed to update block hash")
 	}
@@ -59,33 +236,113 @@ func DecodeBlock(in []byte) (*Block, error) {
 	return &b, nil
 }
 
-func (b *Block) UpdateHash() error {
-	raw, err := json.Marshal(b.Transactions)
+// BlockHeader is the part of a block needed to recompute its hash, with the
+// transactions replaced by their Merkle root or, for blocks without one, the
+// hash of the transaction list.
+type BlockHeader struct {
+	Hash         Hash
+	PreviousHash Hash
+	Height       int64
+	Nonce        int64
+	RewardOutput TxOutput
+	TxListHash   Hash
+	Timestamp    int64 `json:",omitempty"`
+	MerkleRoot   Hash
+	Target       Target       `json:",omitempty"`
+	Version      BlockVersion `json:",omitempty"`
+}
+
+func hashTxList(stxs []SignedTx) (Hash, error) {
+	raw, err := json.Marshal(stxs)
 	if err != nil {
-		return errors.Wrap(err, "cryptopuff: failed to marshal transactions")
+		return Hash{}, errors.Wrap(err, "cryptopuff: failed to marshal transactions")
+	}
+	return Hash(md5.Sum(raw)), nil
+}
+
+// ComputeHash returns the block hash committed to by the header's fields,
+// ignoring h.Hash.
+func (h BlockHeader) ComputeHash() Hash {
+	algo := h.Version.HashAlgo()
+	d := algo.New()
+	d.Write(h.PreviousHash[:])
+	binary.Write(d, binary.BigEndian, h.Height)
+	binary.Write(d, binary.BigEndian, h.Nonce)
+	binary.Write(d, binary.BigEndian, int64(len(h.RewardOutput.Destination)))
+	d.Write(h.RewardOutput.Destination)
+	binary.Write(d, binary.BigEndian, h.RewardOutput.Amount)
+	if h.MerkleRoot != EmptyHash {
+		d.Write(h.MerkleRoot[:])
+	} else {
+		d.Write(h.TxListHash[:])
+	}
+	if h.Timestamp != 0 {
+		binary.Write(d, binary.BigEndian, h.Timestamp)
+	}
+	if h.Target != 0 {
+		binary.Write(d, binary.BigEndian, int64(h.Target))
+	}
+	if h.Version != BlockVersion1 {
+		binary.Write(d, binary.BigEndian, int64(h.Version))
 	}
-	txListHash := Hash(md5.Sum(raw))
 
-	h := md5.New()
-	h.Write(b.PreviousHash[:])
-	binary.Write(h, binary.BigEndian, b.Height)
-	binary.Write(h, binary.BigEndian, b.Nonce)
-	binary.Write(h, binary.BigEndian, int64(len(b.RewardOutput.Destination)))
-	h.Write(b.RewardOutput.Destination)
-	binary.Write(h, binary.BigEndian, b.RewardOutput.Amount)
-	h.Write(txListHash[:])
-	copy(b.Hash[:], h.Sum(nil))
+	var hash Hash
+	copy(hash[:], d.Sum(nil))
+	return hash
+}
 
+func (b *Block) Header() (BlockHeader, error) {
+	header := BlockHeader{
+		Hash:         b.Hash,
+		PreviousHash: b.PreviousHash,
+		Height:       b.Height,
+		Nonce:        b.Nonce,
+		RewardOutput: b.RewardOutput,
+		Timestamp:    b.Timestamp,
+		MerkleRoot:   b.MerkleRoot,
+		Target:       b.Target,
+		Version:      b.Version,
+	}
+	if b.MerkleRoot == EmptyHash {
+		var err error
+		header.TxListHash, err = hashTxList(b.Transactions)
+		if err != nil {
+			return BlockHeader{}, err
+		}
+	}
+	return header, nil
+}
+
+func (b *Block) UpdateHash() error {
+	if err := b.updateTxHashes(); err != nil {
+		return err
+	}
+
+	header, err := b.Header()
+	if err != nil {
+		return err
+	}
+	b.Hash = header.ComputeHash()
+	return nil
+}
+
+func (b *Block) updateTxHashes() error {
 	for i := range b.Transactions {
 		if err := b.Transactions[i].UpdateHash(); err != nil {
 			return errors.Wrap(err, "cryptopuff: failed to update transaction hash")
 		}
 	}
-
 	return nil
 }
 
-func (b *Block) Valid(previous *Block) error {
+// Valid checks the block against its ancestors, given newest first starting
+// with its parent, which must include as many as TargetForHeight needs.
+func (b *Block) Valid(ancestors []Block) error {
+	if len(ancestors) == 0 {
+		return errors.New("cryptopuff: no previous block to validate against")
+	}
+	previous := &ancestors[0]
+
 	if b.PreviousHash != previous.Hash {
 		return InvalidBlockError{Message: fmt.Sprintf("cryptopuff: previous hash mismatch (expected %v, got %v)", previous.Height, b.PreviousHash)}
 	}
@@ -94,11 +351,19 @@ func (b *Block) Valid(previous *Block) error {
 		return InvalidBlockError{Message: fmt.Sprintf("cryptopuff: height mismatch (expected %v, got %v)", previous.Height+1, b.Height)}
 	}
 
-	if !b.Hash.Valid() {
+	if target := TargetForHeight(ancestors); b.Target != target {
+		return InvalidBlockError{Message: fmt.Sprintf("cryptopuff: target mismatch (expected %v, got %v)", target, b.Target)}
+	}
+
+	if !b.Hash.MeetsTarget(b.RequiredTarget()) {
 		return InvalidBlockError{Message: "cryptopuff: hash doesn't meet difficulty requirement"}
 	}
 
-	if b.RewardOutput.Amount < 0 || b.RewardOutput.Amount > MaxBlockReward {
+	if b.Version >= BlockVersion4 {
+		if subsidy := BlockSubsidy(b.Height); b.RewardOutput.Amount != subsidy {
+			return InvalidBlockError{Message: fmt.Sprintf("cryptopuff: reward amount %v doesn't match the subsidy of %v", b.RewardOutput.Amount, subsidy)}
+		}
+	} else if b.RewardOutput.Amount < 0 || b.RewardOutput.Amount > MaxBlockReward {
 		return InvalidBlockError{Message: "cryptopuff: reward amount negative or greater than maximum"}
 	}
 
@@ -106,11 +371,98 @@ func (b *Block) Valid(previous *Block) error {
 		return InvalidBlockError{Message: "cryptopuff: number of transactions greater than maximum"}
 	}
 
-	for _, t := range b.Transactions {
+	// Once a chain is timestamped every later block must be too, with
+	// strictly increasing timestamps.
+	if b.Timestamp == 0 && previous.Timestamp != 0 {
+		return InvalidBlockError{Message: "cryptopuff: missing timestamp after timestamped previous block"}
+	}
+	if b.Timestamp != 0 {
+		if limit := time.Now().Add(MaxFutureBlockTime).Unix(); b.Timestamp > limit {
+			return InvalidBlockError{Message: fmt.Sprintf("cryptopuff: timestamp %v too far in the future", b.Timestamp)}
+		}
+		if b.Timestamp <= previous.Timestamp {
+			return InvalidBlockError{Message: fmt.Sprintf("cryptopuff: timestamp %v not after previous block's %v", b.Timestamp, previous.Timestamp)}
+		}
+	}
+
+	if b.Version < BlockVersion1 || b.Version > BlockVersion4 {
+		return InvalidBlockError{Message: fmt.Sprintf("cryptopuff: unknown block version %d", int(b.Version))}
+	}
+	if active := BlockVersionForHeight(b.Height); b.Version > active {
+		return InvalidBlockError{Message: fmt.Sprintf("cryptopuff: block version %d not active at height %v", int(b.Version), b.Height)}
+	} else if active >= BlockVersion3 && b.Version < active {
+		return InvalidBlockError{Message: fmt.Sprintf("cryptopuff: block version %d older than the version %d required at height %v", int(b.Version), int(active), b.Height)}
+	}
+	if b.Version < previous.Version {
+		return InvalidBlockError{Message: fmt.Sprintf("cryptopuff: block version %d older than previous block's %d", int(b.Version), int(previous.Version))}
+	}
+
+	// The hash commits to the Merkle root rather than the transactions, so
+	// the root must be checked even if the block was validated before.
+	if b.MerkleRoot == EmptyHash && (previous.MerkleRoot != EmptyHash || b.Version >= BlockVersion2) {
+		return InvalidBlockError{Message: "cryptopuff: missing Merkle root"}
+	}
+	if b.MerkleRoot != EmptyHash && b.MerkleRoot != MerkleRoot(b.Version.HashAlgo(), b.txHashes()) {
+		return InvalidBlockError{Message: "cryptopuff: Merkle root doesn't match transactions"}
+	}
+
+	key := b.validationKey()
+	if validatedBlocks.contains(key) {
+		return nil
+	}
+
+	for i, t := range b.Transactions {
 		if err := t.Valid(); err != nil {
-			return err
+			return invalidBlockTxError(b, i, err)
 		}
 	}
 
+	if _, err := b.Payout(); err != nil {
+		return InvalidBlockError{Message: "cryptopuff: invalid payout", Cause: err}
+	}
+
+	validatedBlocks.add(key)
 	return nil
 }
+
+// validationKey returns the key validatedBlocks remembers the block by: a
+// digest of its hash and its transactions' signatures. From TxVersion4
+// onwards a transaction's hash, and so the block's, leaves out the signature,
+// so the hash alone would let a peer resend a block we've validated with the
+// signatures stripped or forged.
+func (b *Block) validationKey() Hash {
+	d := HashSHA256.New()
+	d.Write(b.Hash[:])
+	for _, stx := range b.Transactions {
+		binary.Write(d, binary.BigEndian, int64(stx.Algorithm))
+		binary.Write(d, binary.BigEndian, int64(len(stx.Signature)))
+		d.Write(stx.Signature)
+	}
+	return HashSHA256.hash(d)
+}
+
+// Work returns the expected number of hashes needed to mine the block. The
+// best chain is the one with the most accumulated work, which isn't
+// necessarily the highest one once the difficulty has been retargeted.
+func (b *Block) Work() int64 {
+	t := b.RequiredTarget()
+	if t < 0 || t > MaxTarget {
+		t = MaxTarget
+	}
+	return 1 << uint(t)
+}
+
+// Payout returns the amount credited to the reward output's destination: the
+// block reward the miner claimed plus the fees of every transaction. Fees are
+// implicit; RewardOutput.Amount never includes them.
+func (b *Block) Payout() (int64, error) {
+	payout := b.RewardOutput.Amount
+	for _, stx := range b.Transactions {
+		var ok bool
+		payout, ok = overflow.Add64(payout, stx.Fee)
+		if !ok {
+			return 0, errors.New("cryptopuff: block reward plus fees overflows")
+		}
+	}
+	return payout, nil
+}
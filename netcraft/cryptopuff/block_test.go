@@ -0,0 +1,338 @@
+package cryptopuff
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+)
+
+var testRewardAddress = Address{0x12, 0x34}
+
+// testParent returns a block at the given height to build test blocks on. Its
+// MinTarget carries over to its children, which keeps them quick to mine.
+func testParent(t testing.TB, height int64) *Block {
+	b := &Block{
+		Height:    height,
+		Timestamp: time.Now().Add(-time.Hour).Unix(),
+		Target:    MinTarget,
+		Version:   BlockVersion2,
+	}
+	b.MerkleRoot = MerkleRoot(b.Version.HashAlgo(), nil)
+	if err := b.UpdateHash(); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// mineTestBlock mines a block on top of previous with the given version, or
+// the one active at its height if version is zero.
+func mineTestBlock(t testing.TB, previous *Block, version BlockVersion, stxs []SignedTx) *Block {
+	return mineTestBlockTo(t, previous, version, testRewardAddress, stxs)
+}
+
+// mineTestBlockTo is like mineTestBlock, but pays the reward to addr.
+func mineTestBlockTo(t testing.TB, previous *Block, version BlockVersion, addr Address, stxs []SignedTx) *Block {
+	b, err := NewBlock(previous, previous.Target, 0, addr, stxs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 0 {
+		b.Version = version
+		b.MerkleRoot = MerkleRoot(b.Version.HashAlgo(), b.txHashes())
+	}
+	remineTestBlock(t, b)
+	return b
+}
+
+// remineTestBlock finds a nonce for b again after its header was changed.
+func remineTestBlock(t testing.TB, b *Block) {
+	for {
+		if err := b.UpdateHash(); err != nil {
+			t.Fatal(err)
+		}
+		if b.Hash.MeetsTarget(b.RequiredTarget()) {
+			return
+		}
+		b.Nonce++
+	}
+}
+
+func TestBlockVersionForHeight(t *testing.T) {
+	tests := []struct {
+		height int64
+		want   BlockVersion
+	}{
+		{1, BlockVersion2},
+		{BlockVersion3Height - 1, BlockVersion2},
+		{BlockVersion4Height, BlockVersion4},
+		{BlockVersion4Height + 1, BlockVersion4},
+	}
+	for _, test := range tests {
+		if got := BlockVersionForHeight(test.height); got != test.want {
+			t.Errorf("BlockVersionForHeight(%v) = %v, want %v", test.height, got, test.want)
+		}
+	}
+}
+
+func TestNewBlockVersion(t *testing.T) {
+	for _, height := range []int64{1, BlockVersion4Height - 1, BlockVersion4Height} {
+		parent := testParent(t, height-1)
+		b, err := NewBlock(parent, parent.Target, 0, testRewardAddress, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := BlockVersionForHeight(height); b.Version != want {
+			t.Errorf("NewBlock at height %v has version %v, want %v", height, b.Version, want)
+		}
+	}
+}
+
+func TestBlockValidVersionActivation(t *testing.T) {
+	tests := []struct {
+		height  int64
+		version BlockVersion
+		valid   bool
+	}{
+		{BlockVersion3Height - 1, BlockVersion2, true},
+		{BlockVersion3Height - 1, BlockVersion3, false},
+		{BlockVersion4Height - 1, BlockVersion4, false},
+		{BlockVersion4Height, BlockVersion4, true},
+		{BlockVersion4Height, BlockVersion2, false},
+		{BlockVersion4Height, BlockVersion3, false},
+	}
+	for _, test := range tests {
+		parent := testParent(t, test.height-1)
+		b := mineTestBlock(t, parent, test.version, nil)
+		err := b.Valid([]Block{*parent})
+		if test.valid && err != nil {
+			t.Errorf("version %v block at height %v: %v", test.version, test.height, err)
+		}
+		if !test.valid {
+			if _, ok := err.(InvalidBlockError); !ok {
+				t.Errorf("version %v block at height %v: got %v, want InvalidBlockError", test.version, test.height, err)
+			}
+		}
+	}
+}
+
+func TestBlockValidTamperedAfterValidation(t *testing.T) {
+	k := testKey(t, 3)
+	stxs := []SignedTx{*signTestTx(t, k, TxVersion3, 10, 1), *signTestTx(t, k, TxVersion3, 20, 2)}
+
+	parent := testParent(t, 1)
+	b := mineTestBlock(t, parent, 0, stxs)
+	if err := b.Valid([]Block{*parent}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Swapping a transaction leaves the header, and so the hash, alone.
+	tampered := *b
+	tampered.Transactions = []SignedTx{stxs[0], *signTestTx(t, k, TxVersion3, 1000, 2)}
+	if err := tampered.UpdateHash(); err != nil {
+		t.Fatal(err)
+	}
+	if tampered.Hash != b.Hash {
+		t.Fatalf("tampered block hash %v differs from %v", tampered.Hash, b.Hash)
+	}
+	if _, ok := tampered.Valid([]Block{*parent}).(InvalidBlockError); !ok {
+		t.Error("tampered block wasn't rejected")
+	}
+
+	if err := b.Valid([]Block{*parent}); err != nil {
+		t.Errorf("original block after tampering: %v", err)
+	}
+}
+
+func TestBlockValidFeesOverflow(t *testing.T) {
+	k := testKey(t, 5)
+	fee := int64(math.MaxInt64/2 + 1)
+	stxs := []SignedTx{*signTestTx(t, k, TxVersion3, 1, fee), *signTestTx(t, k, TxVersion3, 1, fee)}
+
+	parent := testParent(t, 1)
+	b := mineTestBlock(t, parent, 0, stxs)
+	if _, ok := b.Valid([]Block{*parent}).(InvalidBlockError); !ok {
+		t.Error("block whose fees overflow wasn't rejected")
+	}
+}
+
+func TestBlockValidReward(t *testing.T) {
+	k := testKey(t, 5)
+	stxs := []SignedTx{*signTestTx(t, k, TxVersion3, 10, 3)}
+
+	for _, test := range []struct {
+		name    string
+		version BlockVersion
+		reward  func(height int64) int64
+		valid   bool
+	}{
+		{"subsidy", BlockVersion4, BlockSubsidy, true},
+		{"over subsidy", BlockVersion4, func(h int64) int64 { return BlockSubsidy(h) + 1 }, false},
+		{"under subsidy", BlockVersion4, func(h int64) int64 { return BlockSubsidy(h) - 1 }, false},
+		// Fees are credited on top of the reward, so claiming them too
+		// would count them twice.
+		{"subsidy and fees", BlockVersion4, func(h int64) int64 { return BlockSubsidy(h) + 3 }, false},
+		// Before BlockVersion4, miners chose their reward up to a cap.
+		{"legacy maximum", BlockVersion2, func(int64) int64 { return MaxBlockReward }, true},
+		{"legacy over maximum", BlockVersion2, func(int64) int64 { return MaxBlockReward + 1 }, false},
+	} {
+		height := int64(BlockVersion4Height)
+		if test.version < BlockVersion4 {
+			height = BlockVersion3Height - 1
+		}
+		parent := testParent(t, height-1)
+		b := mineTestBlock(t, parent, test.version, stxs)
+		b.RewardOutput.Amount = test.reward(b.Height)
+		remineTestBlock(t, b)
+
+		err := b.Valid([]Block{*parent})
+		if test.valid && err != nil {
+			t.Errorf("%v: %v", test.name, err)
+		}
+		if _, ok := err.(InvalidBlockError); !test.valid && !ok {
+			t.Errorf("%v: got %v, want InvalidBlockError", test.name, err)
+		}
+	}
+}
+
+func TestBlockValidTimestamp(t *testing.T) {
+	parent := testParent(t, 1)
+	for _, test := range []struct {
+		name      string
+		timestamp int64
+		valid     bool
+	}{
+		{"after parent", parent.Timestamp + 1, true},
+		{"near future", time.Now().Add(MaxFutureBlockTime - time.Minute).Unix(), true},
+		{"too far in the future", time.Now().Add(MaxFutureBlockTime + time.Minute).Unix(), false},
+		{"same as parent", parent.Timestamp, false},
+		{"older than parent", parent.Timestamp - 1, false},
+		{"missing", 0, false},
+	} {
+		b := mineTestBlock(t, parent, 0, nil)
+		b.Timestamp = test.timestamp
+		remineTestBlock(t, b)
+
+		err := b.Valid([]Block{*parent})
+		if test.valid && err != nil {
+			t.Errorf("%v: %v", test.name, err)
+		}
+		if _, ok := err.(InvalidBlockError); !test.valid && !ok {
+			t.Errorf("%v: got %v, want InvalidBlockError", test.name, err)
+		}
+	}
+}
+
+func BenchmarkBlockValid(b *testing.B) {
+	k := testKey(b, 4)
+	stxs := make([]SignedTx, MaxTransactionsPerBlock)
+	for i := range stxs {
+		stxs[i] = *signTestTx(b, k, TxVersion4, 10, 1)
+	}
+	parent := testParent(b, 1)
+	block := mineTestBlock(b, parent, 0, stxs)
+	ancestors := []Block{*parent}
+
+	b.Run("uncached", func(b *testing.B) {
+		defer func(cache *hashSet) {
+			validatedBlocks = cache
+		}(validatedBlocks)
+
+		for i := 0; i < b.N; i++ {
+			validatedBlocks = newHashSet(validatedBlocksSize)
+			if err := block.Valid(ancestors); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("cached", func(b *testing.B) {
+		if err := block.Valid(ancestors); err != nil {
+			b.Fatal(err)
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := block.Valid(ancestors); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// testBlockRoundTrip checks that a block decoded from its JSON encoding, the
+// form it is relayed and stored in, hashes and encodes the same.
+func testBlockRoundTrip(t *testing.T, b *Block) {
+	if err := b.UpdateHash(); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := DecodeBlock(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Hash != b.Hash {
+		t.Errorf("decoded block hash %v differs from %v", decoded.Hash, b.Hash)
+	}
+	for i := range b.Transactions {
+		if decoded.Transactions[i].Hash != b.Transactions[i].Hash {
+			t.Errorf("decoded transaction %v hash %v differs from %v", i, decoded.Transactions[i].Hash, b.Transactions[i].Hash)
+		}
+	}
+
+	again, err := json.Marshal(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again, raw) {
+		t.Errorf("decoded block encodes as %s, want %s", again, raw)
+	}
+}
+
+func TestBlockRoundTrip(t *testing.T) {
+	testBlockRoundTrip(t, GenesisBlock)
+	testBlockRoundTrip(t, &Block{})
+
+	k := testKey(t, 1)
+	stxs := []SignedTx{*signTestTx(t, k, TxVersion1, 10, 1), *signTestTx(t, k, TxVersion4, 20, 2)}
+	for _, height := range []int64{1, BlockVersion4Height} {
+		b, err := NewBlock(testParent(t, height-1), MinTarget, 42, testRewardAddress, stxs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testBlockRoundTrip(t, b)
+	}
+}
+
+func FuzzBlockRoundTrip(f *testing.F) {
+	f.Add([]byte{}, int64(1), int64(39611433), []byte{0x12, 0x34}, int64(100), int64(0), 0, 0, []byte{0x01}, int64(10), 0)
+	f.Add([]byte{0xff}, int64(50000), int64(-1), []byte(nil), int64(0), int64(1500000000), 30, 4, []byte(nil), int64(-5), 4)
+	f.Fuzz(func(t *testing.T, previous []byte, height, nonce int64, dest []byte, amount, timestamp int64, target, version int, txDest []byte, txAmount int64, txVersion int) {
+		b := &Block{
+			Height:       height,
+			Nonce:        nonce,
+			RewardOutput: TxOutput{Destination: dest, Amount: amount},
+			Transactions: []SignedTx{{
+				Tx: Tx{
+					TxOutput: TxOutput{Destination: txDest, Amount: txAmount},
+					Version:  TxVersion(txVersion),
+				},
+			}},
+			Timestamp: timestamp,
+			Target:    Target(target),
+			Version:   BlockVersion(version),
+		}
+		copy(b.PreviousHash[:], previous)
+		if err := b.updateTxHashes(); err != nil {
+			t.Fatal(err)
+		}
+		if b.Version >= BlockVersion2 {
+			b.MerkleRoot = MerkleRoot(b.Version.HashAlgo(), b.txHashes())
+		}
+		testBlockRoundTrip(t, b)
+	})
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"gitlab.netcraft.com/netcraft/recruitment/cryptopuff"
+)
+
+// jsonOutput is set by -json, making subcommands print JSON for scripts
+// instead of tables for people. Addresses are printed as the same strings the
+// tables use, rather than the node API's base64.
+var jsonOutput bool
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+type balanceJSON struct {
+	Address string `json:"address"`
+	Balance int64  `json:"balance"`
+}
+
+type balancesJSON struct {
+	Addresses []balanceJSON `json:"addresses"`
+	Total     int64         `json:"total"`
+}
+
+func newBalancesJSON(addrs []cryptopuff.AddressState) balancesJSON {
+	balances := balancesJSON{Addresses: newBalanceListJSON(addrs)}
+	for _, addr := range addrs {
+		balances.Total += addr.Balance
+	}
+	return balances
+}
+
+func newBalanceListJSON(addrs []cryptopuff.AddressState) []balanceJSON {
+	balances := make([]balanceJSON, len(addrs))
+	for i, addr := range addrs {
+		balances[i] = balanceJSON{Address: addr.Address.String(), Balance: addr.Balance}
+	}
+	return balances
+}
+
+type txJSON struct {
+	Hash        cryptopuff.Hash `json:"hash"`
+	ID          cryptopuff.TxID `json:"id"`
+	Source      string          `json:"source"`
+	Destination string          `json:"destination"`
+	Amount      int64           `json:"amount"`
+	Fee         int64           `json:"fee"`
+}
+
+func newTxJSON(stx *cryptopuff.SignedTx) txJSON {
+	return txJSON{
+		Hash:        stx.Hash,
+		ID:          stx.ID,
+		Source:      stx.Source.String(),
+		Destination: stx.Destination.String(),
+		Amount:      stx.Amount,
+		Fee:         stx.Fee,
+	}
+}
+
+func newTxListJSON(stxs []cryptopuff.SignedTx) []txJSON {
+	txs := make([]txJSON, len(stxs))
+	for i := range stxs {
+		txs[i] = newTxJSON(&stxs[i])
+	}
+	return txs
+}
+
+// personalTxJSON leaves out Height while the transaction is pending.
+type personalTxJSON struct {
+	txJSON
+	Included bool  `json:"included"`
+	Height   int64 `json:"height,omitempty"`
+}
+
+func newPersonalTxJSON(ptx *cryptopuff.PersonalTx) personalTxJSON {
+	tx := personalTxJSON{
+		txJSON:   newTxJSON(&ptx.SignedTx),
+		Included: ptx.Included,
+	}
+	if ptx.Included {
+		tx.Height = ptx.Height
+	}
+	return tx
+}
+
+func newPersonalTxListJSON(ptxs []cryptopuff.PersonalTx) []personalTxJSON {
+	txs := make([]personalTxJSON, len(ptxs))
+	for i := range ptxs {
+		txs[i] = newPersonalTxJSON(&ptxs[i])
+	}
+	return txs
+}
+
+type statusJSON struct {
+	Tip          cryptopuff.Hash `json:"tip"`
+	Height       int64           `json:"height"`
+	Peers        int             `json:"peers"`
+	PendingTxs   int             `json:"pendingTxs"`
+	HashesPerSec uint64          `json:"hashesPerSec"`
+}
+
+type summaryJSON struct {
+	Tip        cryptopuff.Hash  `json:"tip"`
+	Height     int64            `json:"height"`
+	PendingTxs int              `json:"pendingTxs"`
+	Balances   balancesJSON     `json:"balances"`
+	Txs        []personalTxJSON `json:"txs"`
+}
+
+// blockJSON leaves out Timestamp for blocks mined before timestamps were
+// introduced.
+type blockJSON struct {
+	Hash              cryptopuff.Hash `json:"hash"`
+	Height            int64           `json:"height"`
+	PreviousHash      cryptopuff.Hash `json:"previousHash"`
+	Nonce             int64           `json:"nonce"`
+	Reward            int64           `json:"reward"`
+	RewardDestination string          `json:"rewardDestination"`
+	Timestamp         int64           `json:"timestamp,omitempty"`
+	Transactions      []txJSON        `json:"transactions"`
+}
+
+type etaJSON struct {
+	Pending bool  `json:"pending"`
+	Rank    int   `json:"rank"`
+	Blocks  int64 `json:"blocks"`
+	Seconds int64 `json:"seconds"`
+}
+
+type proofJSON struct {
+	Hash   cryptopuff.Hash `json:"hash"`
+	Block  cryptopuff.Hash `json:"block"`
+	Height int64           `json:"height"`
+}
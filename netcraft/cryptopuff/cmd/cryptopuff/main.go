@@ -1,16 +1,31 @@
 package main
 
 import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/big"
 	"net"
 	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
 	"strconv"
+	"strings"
+	"syscall"
 	"text/tabwriter"
 	"time"
 
+	"github.com/pkg/errors"
+	"github.com/skip2/go-qrcode"
 	"gitlab.netcraft.com/netcraft/recruitment/cryptopuff"
 	"golang.org/x/text/language"
 	"golang.org/x/text/message"
@@ -18,6 +33,17 @@ import (
 
 var englishPrinter = message.NewPrinter(language.BritishEnglish)
 
+// wallet holds private keys and signs transactions: either the node's wallet,
+// or a local keystore when the node isn't trusted with keys.
+type wallet interface {
+	AddKey(k *rsa.PrivateKey, v cryptopuff.Version) (cryptopuff.Address, error)
+	AddKeys(keys []*rsa.PrivateKey, v cryptopuff.Version) ([]cryptopuff.Address, error)
+	Key(addr cryptopuff.Address) (*rsa.PrivateKey, error)
+	AddECDSAKeys(keys []*ecdsa.PrivateKey) ([]cryptopuff.Address, error)
+	ECDSAKey(addr cryptopuff.Address) (*ecdsa.PrivateKey, error)
+	SignTx(tx *cryptopuff.Tx) (*cryptopuff.SignedTx, error)
+}
+
 func main() {
 	defaultAddr := net.JoinHostPort("localhost", cryptopuff.DefaultPort)
 
@@ -27,7 +53,21 @@ func main() {
 		bits     = flag.Int("bits", cryptopuff.DefaultKeyLength, "RSA key length in bits")
 		seed     = flag.Int64("seed", time.Now().Unix(), "random number generator seed")
 		v2       = flag.Bool("v2", false, "use new v2 address format")
+		v3       = flag.Bool("v3", false, "use v3 address format, which has a checksum to catch typos")
+		v4       = flag.Bool("v4", false, "use v4 address format, for ECDSA P-256 keys which can't be factored like RSA keys (genkey ignores -bits and -seed)")
+		format   = flag.String("format", "pem", "private key format used by importkey, exportkey and recoverkey (pem, der or jwk)")
+		rotation = flag.String("rotation", "roundrobin", "how setmineraddr rotates between multiple addresses (roundrobin or random)")
+		qr       = flag.Bool("qr", false, "print a QR code for each address listed by balance")
+		encrypt  = flag.Bool("encrypt", false, "encrypt the PEM key printed by exportkey with a passphrase")
+		keyPass  = flag.String("keyPassword", "", "passphrase for encrypted PEM keys read by importkey or written by exportkey -encrypt (prompted for if empty)")
+		private  = flag.Bool("private", false, "have send's transaction mined only by the local node, without relaying it, so its public key isn't revealed until it is mined")
+		keystore = flag.String("keystore", "", "directory to keep private keys in locally, signing transactions here instead of on the node (the node is still used for chain data)")
+		interval = flag.Duration("interval", 5*time.Second, "how often watch polls the node for the balance")
+		yes      bool
 	)
+	flag.BoolVar(&yes, "yes", false, "send without asking for confirmation")
+	flag.BoolVar(&yes, "y", false, "shorthand for -yes")
+	flag.BoolVar(&jsonOutput, "json", false, "print JSON instead of tables, for scripts")
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
 		flag.PrintDefaults()
@@ -35,17 +75,43 @@ func main() {
 		fmt.Fprintln(os.Stderr, "  genkey")
 		fmt.Fprintln(os.Stderr, "    generates a new private key and prints its address")
 		fmt.Fprintln(os.Stderr, "  importkey <file>")
-		fmt.Fprintln(os.Stderr, "    imports an existing private key from <file> and prints its address")
+		fmt.Fprintln(os.Stderr, "    imports the private key(s) in <file> and prints their addresses (a bundle of PEM keys is imported all-or-nothing)")
 		fmt.Fprintln(os.Stderr, "  exportkey <address>")
-		fmt.Fprintln(os.Stderr, "    exports the private key for <address> and prints it")
-		fmt.Fprintln(os.Stderr, "  setmineraddr <address>")
-		fmt.Fprintln(os.Stderr, "    sets the block reward destination address for blocks mined by this node")
-		fmt.Fprintln(os.Stderr, "  balance")
-		fmt.Fprintln(os.Stderr, "    prints the balance of each address in your wallet")
+		fmt.Fprintln(os.Stderr, "    exports the private key for <address> and prints it (unencrypted unless -encrypt is set)")
+		fmt.Fprintln(os.Stderr, "  recoverkey <public key> <p> <q>")
+		fmt.Fprintln(os.Stderr, "    reconstructs the private key for the base64 PKCS #1 <public key> from the prime factors <p> and <q> of its modulus and prints it")
+		fmt.Fprintln(os.Stderr, "  setmineraddr <address>...")
+		fmt.Fprintln(os.Stderr, "    sets the block reward destination address(es) for blocks mined by this node, which must hold their keys")
+		fmt.Fprintln(os.Stderr, "  balance [<address>]")
+		fmt.Fprintln(os.Stderr, "    prints the balance of <address>, which needn't be yours, or of each address in your wallet (or keystore)")
+		fmt.Fprintln(os.Stderr, "  watch <address>")
+		fmt.Fprintln(os.Stderr, "    prints the balance of <address>, then each change to it, polling every -interval until interrupted")
+		fmt.Fprintln(os.Stderr, "  rescan")
+		fmt.Fprintln(os.Stderr, "    rebuilds your wallet's balances from the blockchain and prints them (not supported with -keystore)")
+		fmt.Fprintln(os.Stderr, "  qr <address>")
+		fmt.Fprintln(os.Stderr, "    prints <address> as a QR code")
 		fmt.Fprintln(os.Stderr, "  txs")
-		fmt.Fprintln(os.Stderr, "    prints all transactions to or from addresses in your wallet")
+		fmt.Fprintln(os.Stderr, "    prints all transactions to or from addresses in your wallet (not supported with -keystore)")
+		fmt.Fprintln(os.Stderr, "  richlist [<n>]")
+		fmt.Fprintln(os.Stderr, "    prints the <n> addresses with the highest balances (default: the node's maximum)")
+		fmt.Fprintln(os.Stderr, "  mempool")
+		fmt.Fprintln(os.Stderr, "    prints all pending transactions known to the node, highest fee first")
+		fmt.Fprintln(os.Stderr, "  status")
+		fmt.Fprintln(os.Stderr, "    prints the node's best block, peer and pending transaction counts and hash rate on one line")
+		fmt.Fprintln(os.Stderr, "  summary")
+		fmt.Fprintln(os.Stderr, "    prints the chain tip, your wallet's balances and its most recent transactions")
 		fmt.Fprintln(os.Stderr, "  send <source> <destination> <amount> <fee>")
-		fmt.Fprintln(os.Stderr, "    sends <amount> coins from <source> to <destination> with a miner fee of <fee>")
+		fmt.Fprintln(os.Stderr, "    sends <amount> coins from <source> to <destination> with a miner fee of <fee> (only to the local node's miner with -private)")
+		fmt.Fprintln(os.Stderr, "  sendall <destination> <amount> <fee>")
+		fmt.Fprintln(os.Stderr, "    sends <amount> coins to <destination> from as many of your addresses as needed, largest balance first, paying <fee> per transaction")
+		fmt.Fprintln(os.Stderr, "  getblock <hash>")
+		fmt.Fprintln(os.Stderr, "    prints block <hash> and its transactions")
+		fmt.Fprintln(os.Stderr, "  tx <hash>")
+		fmt.Fprintln(os.Stderr, "    prints transaction <hash> and whether it has been mined")
+		fmt.Fprintln(os.Stderr, "  eta <hash>")
+		fmt.Fprintln(os.Stderr, "    estimates how long the pending transaction <hash> will take to be mined")
+		fmt.Fprintln(os.Stderr, "  proof <hash>")
+		fmt.Fprintln(os.Stderr, "    fetches and verifies a proof that transaction <hash> is included in the blockchain")
 		fmt.Fprintln(os.Stdout, "  peers")
 		fmt.Fprintln(os.Stdout, "    prints all peers connected to this node")
 		os.Exit(1)
@@ -58,8 +124,25 @@ func main() {
 
 	client := cryptopuff.NewRPCClient(*addr, *password)
 
+	var (
+		w  wallet = client
+		ks *cryptopuff.Keystore
+	)
+	if *keystore != "" {
+		var err error
+		ks, err = cryptopuff.OpenKeystore(*keystore)
+		if err != nil {
+			fatal(err)
+		}
+		w = ks
+	}
+
 	var version cryptopuff.Version
-	if *v2 {
+	if *v4 {
+		version = cryptopuff.V4
+	} else if *v3 {
+		version = cryptopuff.V3
+	} else if *v2 {
 		version = cryptopuff.V2
 	} else {
 		version = cryptopuff.V1
@@ -67,8 +150,8 @@ func main() {
 
 	switch flag.Arg(0) {
 	case "genkey":
-		if err := generateKey(client, version, *bits, *seed); err != nil {
-			log.Fatalln(err)
+		if err := generateKey(w, version, *bits, *seed); err != nil {
+			fatal(err)
 		}
 	case "importkey":
 		var path string
@@ -80,121 +163,614 @@ func main() {
 			path = flag.Arg(1)
 		}
 
-		if err := importKey(client, path, version); err != nil {
-			log.Fatalln(err)
+		if err := importKey(w, path, version, *format, *keyPass); err != nil {
+			fatal(err)
 		}
 	case "exportkey":
 		if flag.NArg() < 2 {
 			flag.Usage()
 		}
 
-		if err := exportKey(client, flag.Arg(1)); err != nil {
-			log.Fatalln(err)
+		if err := exportKey(w, flag.Arg(1), *format, *encrypt, *keyPass); err != nil {
+			fatal(err)
+		}
+	case "recoverkey":
+		if flag.NArg() < 4 {
+			flag.Usage()
+		}
+
+		if err := recoverKey(flag.Arg(1), flag.Arg(2), flag.Arg(3), *format); err != nil {
+			fatal(err)
 		}
 	case "setmineraddr":
 		if flag.NArg() < 2 {
 			flag.Usage()
 		}
 
-		if err := setMinerAddress(client, flag.Arg(1)); err != nil {
-			log.Fatalln(err)
+		if err := setMinerAddress(client, flag.Args()[1:], *rotation); err != nil {
+			fatal(err)
 		}
 	case "balance":
-		if err := balance(client); err != nil {
-			log.Fatalln(err)
+		if flag.NArg() >= 2 {
+			if err := addressBalance(client, flag.Arg(1), *qr); err != nil {
+				fatal(err)
+			}
+		} else if ks != nil {
+			if err := keystoreBalance(client, ks, *qr); err != nil {
+				fatal(err)
+			}
+		} else if err := balance(client, *qr); err != nil {
+			fatal(err)
+		}
+	case "watch":
+		if flag.NArg() < 2 {
+			flag.Usage()
+		}
+
+		if err := watch(client, flag.Arg(1), *interval); err != nil {
+			fatal(err)
+		}
+	case "rescan":
+		if ks != nil {
+			log.Fatalln("rescan isn't supported with -keystore")
+		}
+
+		if err := rescan(client); err != nil {
+			fatal(err)
+		}
+	case "qr":
+		if flag.NArg() < 2 {
+			flag.Usage()
+		}
+
+		if err := printQR(flag.Arg(1)); err != nil {
+			fatal(err)
 		}
 	case "txs":
+		if ks != nil {
+			log.Fatalln("txs isn't supported with -keystore")
+		}
+
 		if err := txs(client); err != nil {
-			log.Fatalln(err)
+			fatal(err)
+		}
+	case "richlist":
+		var limit int
+		if flag.NArg() >= 2 {
+			var err error
+			limit, err = strconv.Atoi(flag.Arg(1))
+			if err != nil {
+				fatal(err)
+			}
+		}
+
+		if err := richList(client, limit); err != nil {
+			fatal(err)
+		}
+	case "mempool":
+		if err := mempool(client); err != nil {
+			fatal(err)
+		}
+	case "status":
+		if err := status(client); err != nil {
+			fatal(err)
+		}
+	case "summary":
+		if ks != nil {
+			log.Fatalln("summary isn't supported with -keystore")
+		}
+
+		if err := summary(client); err != nil {
+			fatal(err)
 		}
 	case "send":
 		if flag.NArg() < 4 {
 			flag.Usage()
 		}
 
-		if err := send(client, flag.Arg(1), flag.Arg(2), flag.Arg(3), flag.Arg(4)); err != nil {
-			log.Fatalln(err)
+		if err := send(client, w, flag.Arg(1), flag.Arg(2), flag.Arg(3), flag.Arg(4), *private, yes); err != nil {
+			fatal(err)
+		}
+	case "sendall":
+		if flag.NArg() < 4 {
+			flag.Usage()
+		}
+
+		if err := sendAll(client, w, ks, flag.Arg(1), flag.Arg(2), flag.Arg(3), *private); err != nil {
+			fatal(err)
+		}
+	case "getblock":
+		if flag.NArg() < 2 {
+			flag.Usage()
+		}
+
+		if err := getBlock(client, flag.Arg(1)); err != nil {
+			fatal(err)
+		}
+	case "tx":
+		if flag.NArg() < 2 {
+			flag.Usage()
+		}
+
+		if err := tx(client, flag.Arg(1)); err != nil {
+			fatal(err)
+		}
+	case "eta":
+		if flag.NArg() < 2 {
+			flag.Usage()
+		}
+
+		if err := eta(client, flag.Arg(1)); err != nil {
+			fatal(err)
+		}
+	case "proof":
+		if flag.NArg() < 2 {
+			flag.Usage()
+		}
+
+		if err := proof(client, flag.Arg(1)); err != nil {
+			fatal(err)
 		}
 	case "peers":
 		if err := peers(client); err != nil {
-			log.Fatalln(err)
+			fatal(err)
 		}
 	default:
 		flag.Usage()
 	}
 }
 
-func generateKey(client *cryptopuff.RPCClient, v cryptopuff.Version, bits int, seed int64) error {
+func generateKey(w wallet, v cryptopuff.Version, bits int, seed int64) error {
+	if v.KeyType() == cryptopuff.KeyECDSA {
+		k, err := cryptopuff.GenerateECDSAKey()
+		if err != nil {
+			return err
+		}
+
+		addrs, err := w.AddECDSAKeys([]*ecdsa.PrivateKey{k})
+		if err != nil {
+			return err
+		}
+
+		return printAddresses(addrs)
+	}
+
 	k, err := cryptopuff.GenerateKey(bits, seed)
 	if err != nil {
 		return err
 	}
 
-	addr, err := client.AddKey(k, v)
+	addr, err := w.AddKey(k, v)
 	if err != nil {
 		return err
 	}
 
-	fmt.Println(addr)
-	return nil
+	return printAddresses([]cryptopuff.Address{addr})
 }
 
-func importKey(client *cryptopuff.RPCClient, file string, v cryptopuff.Version) error {
+func importKey(w wallet, file string, v cryptopuff.Version, format string, passphrase string) error {
 	b, err := ioutil.ReadFile(file)
 	if err != nil {
 		return err
 	}
 
-	k, err := cryptopuff.DecodePrivateKeyPEM(b)
+	if v.KeyType() == cryptopuff.KeyECDSA {
+		return importECDSAKeys(w, b, format)
+	}
+
+	var k *rsa.PrivateKey
+	switch format {
+	case "pem":
+		keys, err := cryptopuff.DecryptPrivateKeyPEMs(b, []byte(passphrase))
+		if errors.Cause(err) == cryptopuff.ErrKeyEncrypted {
+			passphrase, err = readPassphrase("Key passphrase: ")
+			if err != nil {
+				return err
+			}
+			keys, err = cryptopuff.DecryptPrivateKeyPEMs(b, []byte(passphrase))
+		}
+		if err != nil {
+			return err
+		}
+		if len(keys) > 1 {
+			return importKeys(w, keys, v)
+		}
+		k = keys[0]
+	case "der":
+		k, err = cryptopuff.DecodePrivateKeyDER(b)
+	case "jwk":
+		k, err = cryptopuff.DecodePrivateKeyJWK(b)
+	default:
+		err = fmt.Errorf("unknown key format %q", format)
+	}
+	if err != nil {
+		return err
+	}
+
+	addr, err := w.AddKey(k, v)
 	if err != nil {
 		return err
 	}
 
-	addr, err := client.AddKey(k, v)
+	return printAddresses([]cryptopuff.Address{addr})
+}
+
+func importKeys(w wallet, keys []*rsa.PrivateKey, v cryptopuff.Version) error {
+	addrs, err := w.AddKeys(keys, v)
 	if err != nil {
 		return err
 	}
 
-	fmt.Println(addr)
+	return printAddresses(addrs)
+}
+
+// importECDSAKeys imports one or more unencrypted PEM ECDSA keys, the only form
+// they are supported in.
+func importECDSAKeys(w wallet, b []byte, format string) error {
+	if format != "pem" {
+		return fmt.Errorf("v4 keys are only supported in the pem format, not %q", format)
+	}
+
+	keys, err := cryptopuff.DecodeECDSAPrivateKeyPEMs(b)
+	if err != nil {
+		return err
+	}
+
+	addrs, err := w.AddECDSAKeys(keys)
+	if err != nil {
+		return err
+	}
+
+	return printAddresses(addrs)
+}
+
+// printAddresses prints one address per line, or with -json an array of them.
+func printAddresses(addrs []cryptopuff.Address) error {
+	if jsonOutput {
+		strs := make([]string, len(addrs))
+		for i, addr := range addrs {
+			strs[i] = addr.String()
+		}
+		return printJSON(strs)
+	}
+
+	for _, addr := range addrs {
+		fmt.Println(addr)
+	}
 	return nil
 }
 
-func exportKey(client *cryptopuff.RPCClient, addrStr string) error {
+func exportKey(w wallet, addrStr string, format string, encrypt bool, passphrase string) error {
 	addr, err := cryptopuff.AddressFromString(addrStr)
 	if err != nil {
 		return err
 	}
 
-	key, err := client.Key(addr)
+	if encrypt && format != "pem" {
+		return fmt.Errorf("-encrypt is only supported with the pem format, not %q", format)
+	}
+
+	version, err := cryptopuff.DetectVersion(addr)
 	if err != nil {
 		return err
 	}
+	if version.KeyType() == cryptopuff.KeyECDSA {
+		return exportECDSAKey(w, addr, format, encrypt)
+	}
 
-	os.Stdout.Write(cryptopuff.EncodePrivateKeyPEM(key))
+	key, err := w.Key(addr)
+	if err != nil {
+		return err
+	}
+
+	if !encrypt {
+		fmt.Fprintln(os.Stderr, "WARNING: printing the private key unencrypted. Anyone who sees it can spend your coins; use -encrypt to protect it with a passphrase.")
+		return printPrivateKey(key, format)
+	}
+
+	if passphrase == "" {
+		passphrase, err = readPassphrase("New key passphrase: ")
+		if err != nil {
+			return err
+		}
+		confirm, err := readPassphrase("Repeat passphrase: ")
+		if err != nil {
+			return err
+		}
+		if passphrase != confirm {
+			return errors.New("passphrases don't match")
+		}
+	}
+
+	b, err := cryptopuff.EncodePrivateKeyPEMEncrypted(key, []byte(passphrase))
+	if err != nil {
+		return err
+	}
+	os.Stdout.Write(b)
 	return nil
 }
 
-func setMinerAddress(client *cryptopuff.RPCClient, addrStr string) error {
-	addr, err := cryptopuff.AddressFromString(addrStr)
+// exportECDSAKey prints the key for a V4 address, which is only supported as
+// an unencrypted PEM key.
+func exportECDSAKey(w wallet, addr cryptopuff.Address, format string, encrypt bool) error {
+	if format != "pem" {
+		return fmt.Errorf("v4 keys are only supported in the pem format, not %q", format)
+	}
+	if encrypt {
+		return errors.New("-encrypt isn't supported for v4 keys")
+	}
+
+	key, err := w.ECDSAKey(addr)
 	if err != nil {
 		return err
 	}
 
-	// XXX(gpe): somewhat hacky way to check that the address is one we know
-	// the key for, to prevent people losing out due to typos
-	if _, err := client.Key(addr); err != nil {
+	b, err := cryptopuff.EncodeECDSAPrivateKeyPEM(key)
+	if err != nil {
 		return err
 	}
+	fmt.Fprintln(os.Stderr, "WARNING: printing the private key unencrypted. Anyone who sees it can spend your coins.")
+	os.Stdout.Write(b)
+	return nil
+}
+
+// confirm asks a yes or no question on stdin, printing the prompt to out and
+// defaulting to no. It fails rather than waiting for an answer if stdin isn't
+// a terminal, so a script that forgot -yes doesn't hang.
+func confirm(out io.Writer, prompt string) (bool, error) {
+	fi, err := os.Stdin.Stat()
+	if err != nil {
+		return false, errors.Wrap(err, "failed to stat stdin")
+	}
+	if fi.Mode()&os.ModeCharDevice == 0 {
+		return false, errors.New("stdin isn't a terminal to confirm on, use -yes")
+	}
+
+	fmt.Fprint(out, prompt)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false, errors.Wrap(err, "failed to read confirmation")
+	}
+
+	switch strings.ToLower(strings.TrimSpace(line)) {
+	case "y", "yes":
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// readPassphrase prompts for a passphrase on the terminal, with echo turned
+// off, so that it can't end up in the shell history.
+func readPassphrase(prompt string) (string, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", errors.Wrap(err, "no terminal to read the passphrase from, use -keyPassword")
+	}
+	defer tty.Close()
 
-	return client.SetMinerAddress(addr)
+	stty := func(arg string) error {
+		cmd := exec.Command("stty", arg)
+		cmd.Stdin = tty
+		return cmd.Run()
+	}
+	if err := stty("-echo"); err != nil {
+		return "", errors.Wrap(err, "failed to turn off terminal echo")
+	}
+	defer stty("echo")
+
+	fmt.Fprint(tty, prompt)
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	fmt.Fprintln(tty)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read passphrase")
+	}
+
+	passphrase := strings.TrimRight(line, "\r\n")
+	if passphrase == "" {
+		return "", errors.New("passphrase must not be empty")
+	}
+	return passphrase, nil
 }
 
-func balance(client *cryptopuff.RPCClient) error {
+func recoverKey(publicKeyStr, pStr, qStr string, format string) error {
+	b, err := base64.StdEncoding.DecodeString(publicKeyStr)
+	if err != nil {
+		return err
+	}
+
+	publicKey, err := x509.ParsePKCS1PublicKey(b)
+	if err != nil {
+		return err
+	}
+
+	p, ok := new(big.Int).SetString(pStr, 10)
+	if !ok {
+		return fmt.Errorf("invalid factor %q", pStr)
+	}
+
+	q, ok := new(big.Int).SetString(qStr, 10)
+	if !ok {
+		return fmt.Errorf("invalid factor %q", qStr)
+	}
+
+	key, err := cryptopuff.ReconstructPrivateKey(publicKey, p, q)
+	if err != nil {
+		return err
+	}
+
+	return printPrivateKey(key, format)
+}
+
+func printPrivateKey(key *rsa.PrivateKey, format string) error {
+	switch format {
+	case "pem":
+		os.Stdout.Write(cryptopuff.EncodePrivateKeyPEM(key))
+	case "der":
+		os.Stdout.Write(cryptopuff.EncodePrivateKeyDER(key))
+	case "jwk":
+		b, err := cryptopuff.EncodePrivateKeyJWK(key)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+	default:
+		return fmt.Errorf("unknown key format %q", format)
+	}
+	return nil
+}
+
+func setMinerAddress(client *cryptopuff.RPCClient, addrStrs []string, rotationStr string) error {
+	rotation, err := cryptopuff.ParseRewardRotation(rotationStr)
+	if err != nil {
+		return err
+	}
+
+	var addrs []cryptopuff.Address
+	for _, addrStr := range addrStrs {
+		addr, err := cryptopuff.AddressFromString(addrStr)
+		if err != nil {
+			return err
+		}
+		addrs = append(addrs, addr)
+	}
+
+	return client.SetMinerAddresses(addrs, rotation)
+}
+
+func balance(client *cryptopuff.RPCClient, qr bool) error {
 	addrs, err := client.Addresses()
 	if err != nil {
 		return err
 	}
 
+	return printBalances(addrs, qr)
+}
+
+// addressBalance prints the balance of a single address, which may be anyone's.
+func addressBalance(client *cryptopuff.RPCClient, addrStr string, qr bool) error {
+	addr, err := cryptopuff.AddressFromString(addrStr)
+	if err != nil {
+		return err
+	}
+
+	balance, err := client.Balance(addr)
+	if err != nil {
+		return err
+	}
+
+	return printBalances([]cryptopuff.AddressState{{Address: addr, Balance: balance.Balance}}, qr)
+}
+
+type balanceChangeJSON struct {
+	Height  int64 `json:"height"`
+	Balance int64 `json:"balance"`
+	Delta   int64 `json:"delta"`
+}
+
+// watch prints the balance of an address, then a line for each change seen
+// by polling every interval, until interrupted. Errors after the first poll
+// are printed rather than fatal, so the watch survives the node restarting.
+func watch(client *cryptopuff.RPCClient, addrStr string, interval time.Duration) error {
+	addr, err := cryptopuff.AddressFromString(addrStr)
+	if err != nil {
+		return err
+	}
+	if interval <= 0 {
+		return errors.New("interval must be positive")
+	}
+
+	last, err := client.Balance(addr)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	if jsonOutput {
+		enc.Encode(balanceChangeJSON{Height: last.Height, Balance: last.Balance})
+	} else {
+		englishPrinter.Printf("Height %v: balance %v\n", last.Height, last.Balance)
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-interrupt:
+			return nil
+		case <-t.C:
+		}
+
+		balance, err := client.Balance(addr)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if balance.Balance == last.Balance {
+			continue
+		}
+
+		delta := balance.Balance - last.Balance
+		if jsonOutput {
+			enc.Encode(balanceChangeJSON{Height: balance.Height, Balance: balance.Balance, Delta: delta})
+		} else {
+			englishPrinter.Printf("Height %v: balance %v (%+d)\n", balance.Height, balance.Balance, delta)
+		}
+		last = balance
+	}
+}
+
+// keystoreBalance prints the balances of the addresses in the local keystore,
+// as known to the node.
+func keystoreBalance(client *cryptopuff.RPCClient, ks *cryptopuff.Keystore, qr bool) error {
+	states, err := keystoreStates(client, ks)
+	if err != nil {
+		return err
+	}
+
+	return printBalances(states, qr)
+}
+
+func keystoreStates(client *cryptopuff.RPCClient, ks *cryptopuff.Keystore) ([]cryptopuff.AddressState, error) {
+	addrs, err := ks.Addresses()
+	if err != nil {
+		return nil, err
+	}
+
+	var states []cryptopuff.AddressState
+	for _, addr := range addrs {
+		balance, err := client.Balance(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		states = append(states, cryptopuff.AddressState{
+			Address: addr,
+			Balance: balance.Balance,
+		})
+	}
+	return states, nil
+}
+
+func rescan(client *cryptopuff.RPCClient) error {
+	addrs, err := client.Rescan()
+	if err != nil {
+		return err
+	}
+
+	return printBalances(addrs, false)
+}
+
+func printBalances(addrs []cryptopuff.AddressState, qr bool) error {
+	if jsonOutput {
+		return printJSON(newBalancesJSON(addrs))
+	}
+
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 8, ' ', 0)
 	fmt.Fprintln(w, "Address\tBalance")
 	fmt.Fprintln(w, "--------\t--------")
@@ -208,6 +784,31 @@ func balance(client *cryptopuff.RPCClient) error {
 	fmt.Fprintln(w, "--------\t--------")
 	englishPrinter.Fprintf(w, "Total:\t%v\n", total)
 	w.Flush()
+
+	if qr {
+		for _, addr := range addrs {
+			fmt.Println()
+			if err := printQR(addr.Address.String()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func printQR(addrStr string) error {
+	addr, err := cryptopuff.AddressFromString(addrStr)
+	if err != nil {
+		return err
+	}
+
+	q, err := qrcode.New(addr.String(), qrcode.Medium)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(addr)
+	fmt.Print(q.ToSmallString(false))
 	return nil
 }
 
@@ -217,6 +818,15 @@ func txs(client *cryptopuff.RPCClient) error {
 		return err
 	}
 
+	if jsonOutput {
+		return printJSON(newPersonalTxListJSON(txs))
+	}
+
+	printTxs(txs)
+	return nil
+}
+
+func printTxs(txs []cryptopuff.PersonalTx) {
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 8, ' ', 0)
 	fmt.Fprintln(w, "Source\tDestination\tAmount\tFee\tIncluded at block height")
 	fmt.Fprintln(w, "--------\t--------\t--------\t--------\t--------")
@@ -232,10 +842,106 @@ func txs(client *cryptopuff.RPCClient) error {
 	}
 
 	w.Flush()
+}
+
+func richList(client *cryptopuff.RPCClient, limit int) error {
+	addrs, err := client.RichList(limit)
+	if err != nil {
+		return err
+	}
+
+	if jsonOutput {
+		return printJSON(newBalanceListJSON(addrs))
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 8, ' ', 0)
+	fmt.Fprintln(w, "Address\tBalance")
+	fmt.Fprintln(w, "--------\t--------")
+
+	for _, addr := range addrs {
+		englishPrinter.Fprintf(w, "%v\t%v\n", addr.Address, addr.Balance)
+	}
+
+	w.Flush()
+	return nil
+}
+
+func mempool(client *cryptopuff.RPCClient) error {
+	stxs, err := client.PendingTxs()
+	if err != nil {
+		return err
+	}
+
+	sort.SliceStable(stxs, func(i, j int) bool {
+		return stxs[i].Fee > stxs[j].Fee
+	})
+
+	if jsonOutput {
+		return printJSON(newTxListJSON(stxs))
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 8, ' ', 0)
+	fmt.Fprintln(w, "Source\tDestination\tAmount\tFee\tID")
+	fmt.Fprintln(w, "--------\t--------\t--------\t--------\t--------")
+
+	for _, stx := range stxs {
+		englishPrinter.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", stx.Source, stx.Destination, stx.Amount, stx.Fee, stx.ID)
+	}
+
+	w.Flush()
+	return nil
+}
+
+func status(client *cryptopuff.RPCClient) error {
+	status, err := client.Status()
+	if err != nil {
+		return err
+	}
+
+	if jsonOutput {
+		return printJSON(statusJSON{
+			Tip:          status.Tip,
+			Height:       status.Height,
+			Peers:        status.Peers,
+			PendingTxs:   status.PendingTxs,
+			HashesPerSec: status.HashesPerSec,
+		})
+	}
+
+	englishPrinter.Printf("Best block %v at height %v, %v peer(s), %v pending transaction(s), %v hashes per second\n", status.Tip, status.Height, status.Peers, status.PendingTxs, status.HashesPerSec)
+	return nil
+}
+
+func summary(client *cryptopuff.RPCClient) error {
+	summary, err := client.Summary()
+	if err != nil {
+		return err
+	}
+
+	if jsonOutput {
+		return printJSON(summaryJSON{
+			Tip:        summary.Tip,
+			Height:     summary.Height,
+			PendingTxs: summary.PendingTxs,
+			Balances:   newBalancesJSON(summary.Addresses),
+			Txs:        newPersonalTxListJSON(summary.Txs),
+		})
+	}
+
+	englishPrinter.Printf("Best block: %v at height %v\n", summary.Tip, summary.Height)
+	englishPrinter.Printf("Pending transactions: %v\n", summary.PendingTxs)
+	fmt.Println()
+
+	if err := printBalances(summary.Addresses, false); err != nil {
+		return err
+	}
+	fmt.Println()
+
+	printTxs(summary.Txs)
 	return nil
 }
 
-func send(client *cryptopuff.RPCClient, srcStr, destStr, amountStr, feeStr string) error {
+func send(client *cryptopuff.RPCClient, w wallet, srcStr, destStr, amountStr, feeStr string, private, yes bool) error {
 	src, err := cryptopuff.AddressFromString(srcStr)
 	if err != nil {
 		return err
@@ -256,25 +962,342 @@ func send(client *cryptopuff.RPCClient, srcStr, destStr, amountStr, feeStr strin
 		return err
 	}
 
-	stx, err := client.SignTx(&cryptopuff.Tx{
+	tx := cryptopuff.Tx{
 		Source:   src,
 		TxOutput: cryptopuff.TxOutput{Destination: dest, Amount: amount},
 		Fee:      fee,
-	})
+	}
+	if !yes {
+		ok, err := confirmTx(&tx)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("not sent")
+		}
+	}
+
+	stx, err := w.SignTx(&tx)
+	if err != nil {
+		return err
+	}
+	if private {
+		err = client.BroadcastPrivateTx(stx)
+	} else {
+		err = client.BroadcastTx(stx)
+	}
 	if err != nil {
 		return err
 	}
+
+	if jsonOutput {
+		return printJSON(newTxJSON(stx))
+	}
+	return nil
+}
+
+// confirmTx prints the transaction and asks whether to send it. With -json the
+// summary and prompt go to stderr, leaving stdout for the JSON result, and the
+// amounts are printed unformatted.
+func confirmTx(tx *cryptopuff.Tx) (bool, error) {
+	out := io.Writer(os.Stdout)
+	printf := func(format string, a ...interface{}) {
+		englishPrinter.Fprintf(out, format, a...)
+	}
+	if jsonOutput {
+		out = os.Stderr
+		printf = func(format string, a ...interface{}) {
+			fmt.Fprintf(out, format, a...)
+		}
+	}
+
+	printf("Source: %v\n", tx.Source)
+	printf("Destination: %v\n", tx.Destination)
+	printf("Amount: %v\n", tx.Amount)
+	printf("Fee: %v\n", tx.Fee)
+	printf("Total debit: %v\n", tx.RequiredBalance())
+
+	return confirm(out, "Send? [y/N] ")
+}
+
+// sendAll covers amount with one transaction per source address, as a
+// transaction only has one source. Every transaction is signed before any is
+// broadcast, so a shortfall is reported without sending anything.
+func sendAll(client *cryptopuff.RPCClient, w wallet, ks *cryptopuff.Keystore, destStr, amountStr, feeStr string, private bool) error {
+	dest, err := cryptopuff.AddressFromString(destStr)
+	if err != nil {
+		return err
+	}
+
+	amount, err := strconv.ParseInt(amountStr, 10, 64)
+	if err != nil {
+		return err
+	}
+	if amount <= 0 {
+		return errors.New("amount must be positive")
+	}
+
+	fee, err := strconv.ParseInt(feeStr, 10, 64)
+	if err != nil {
+		return err
+	}
+
+	var addrs []cryptopuff.AddressState
+	if ks != nil {
+		addrs, err = keystoreStates(client, ks)
+	} else {
+		addrs, err = client.Addresses()
+	}
+	if err != nil {
+		return err
+	}
+
+	sort.SliceStable(addrs, func(i, j int) bool {
+		return addrs[i].Balance > addrs[j].Balance
+	})
+
+	var (
+		txs       []cryptopuff.Tx
+		remaining = amount
+	)
+	for _, addr := range addrs {
+		if remaining == 0 {
+			break
+		}
+		if addr.Address.Equal(dest) || addr.Balance <= fee {
+			continue
+		}
+
+		send := addr.Balance - fee
+		if send > remaining {
+			send = remaining
+		}
+		txs = append(txs, cryptopuff.Tx{
+			Source:   addr.Address,
+			TxOutput: cryptopuff.TxOutput{Destination: dest, Amount: send},
+			Fee:      fee,
+		})
+		remaining -= send
+	}
+	if remaining > 0 {
+		return errors.New(englishPrinter.Sprintf("insufficient balance: %v short of %v after fees", remaining, amount))
+	}
+
+	stxs := make([]*cryptopuff.SignedTx, len(txs))
+	for i := range txs {
+		stxs[i], err = w.SignTx(&txs[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	if jsonOutput {
+		// Print whatever was sent, even if a later broadcast fails.
+		sent := []txJSON{}
+		defer func() {
+			printJSON(sent)
+		}()
+
+		for _, stx := range stxs {
+			if err := broadcast(client, stx, private); err != nil {
+				return err
+			}
+			sent = append(sent, newTxJSON(stx))
+		}
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 8, ' ', 0)
+	fmt.Fprintln(tw, "Source\tAmount\tFee\tID\tHash")
+	fmt.Fprintln(tw, "--------\t--------\t--------\t--------\t--------")
+	defer tw.Flush()
+
+	for _, stx := range stxs {
+		if err := broadcast(client, stx, private); err != nil {
+			return err
+		}
+		englishPrinter.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\n", stx.Source, stx.Amount, stx.Fee, stx.ID, stx.Hash)
+	}
+	return nil
+}
+
+func broadcast(client *cryptopuff.RPCClient, stx *cryptopuff.SignedTx, private bool) error {
+	if private {
+		return client.BroadcastPrivateTx(stx)
+	}
 	return client.BroadcastTx(stx)
 }
 
+func getBlock(client *cryptopuff.RPCClient, hashStr string) error {
+	hash, err := cryptopuff.HashFromString(hashStr)
+	if err != nil {
+		return err
+	}
+
+	block, err := client.Block(hash)
+	if err != nil {
+		return err
+	}
+
+	if jsonOutput {
+		return printJSON(blockJSON{
+			Hash:              block.Hash,
+			Height:            block.Height,
+			PreviousHash:      block.PreviousHash,
+			Nonce:             block.Nonce,
+			Reward:            block.RewardOutput.Amount,
+			RewardDestination: block.RewardOutput.Destination.String(),
+			Timestamp:         block.Timestamp,
+			Transactions:      newTxListJSON(block.Transactions),
+		})
+	}
+
+	englishPrinter.Printf("Hash: %v\n", block.Hash)
+	englishPrinter.Printf("Height: %v\n", block.Height)
+	englishPrinter.Printf("Previous hash: %v\n", block.PreviousHash)
+	fmt.Printf("Nonce: %v\n", block.Nonce)
+	englishPrinter.Printf("Reward: %v to %v\n", block.RewardOutput.Amount, block.RewardOutput.Destination)
+	if block.Timestamp != 0 {
+		fmt.Printf("Mined at: %v\n", time.Unix(block.Timestamp, 0))
+	}
+	englishPrinter.Printf("Transactions: %v\n", len(block.Transactions))
+
+	if len(block.Transactions) == 0 {
+		return nil
+	}
+	fmt.Println()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 8, ' ', 0)
+	fmt.Fprintln(w, "Source\tDestination\tAmount\tFee\tID")
+	fmt.Fprintln(w, "--------\t--------\t--------\t--------\t--------")
+
+	for _, stx := range block.Transactions {
+		englishPrinter.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", stx.Source, stx.Destination, stx.Amount, stx.Fee, stx.ID)
+	}
+
+	w.Flush()
+	return nil
+}
+
+func tx(client *cryptopuff.RPCClient, hashStr string) error {
+	hash, err := cryptopuff.HashFromString(hashStr)
+	if err != nil {
+		return err
+	}
+
+	ptx, err := client.Tx(hash)
+	if err != nil {
+		return err
+	}
+
+	if jsonOutput {
+		return printJSON(newPersonalTxJSON(ptx))
+	}
+
+	fmt.Printf("Hash: %v\n", ptx.Hash)
+	fmt.Printf("ID: %v\n", ptx.ID)
+	fmt.Printf("Source: %v\n", ptx.Source)
+	fmt.Printf("Destination: %v\n", ptx.Destination)
+	englishPrinter.Printf("Amount: %v\n", ptx.Amount)
+	englishPrinter.Printf("Fee: %v\n", ptx.Fee)
+	if ptx.Included {
+		englishPrinter.Printf("Included at block height: %v\n", ptx.Height)
+	} else {
+		fmt.Println("Pending")
+	}
+	return nil
+}
+
+func eta(client *cryptopuff.RPCClient, hashStr string) error {
+	hash, err := cryptopuff.HashFromString(hashStr)
+	if err != nil {
+		return err
+	}
+
+	eta, err := client.TxETA(hash)
+	if err != nil {
+		return err
+	}
+
+	if jsonOutput {
+		return printJSON(etaJSON{
+			Pending: eta.Pending,
+			Rank:    eta.Rank,
+			Blocks:  eta.Blocks,
+			Seconds: eta.Seconds,
+		})
+	}
+
+	if !eta.Pending {
+		fmt.Println("Transaction already included in the blockchain")
+		return nil
+	}
+
+	englishPrinter.Printf("%v higher fee transaction(s) ahead\n", eta.Rank)
+	if eta.Seconds > 0 {
+		englishPrinter.Printf("Expected to be mined in %v block(s) (about %v)\n", eta.Blocks, time.Duration(eta.Seconds)*time.Second)
+	} else {
+		englishPrinter.Printf("Expected to be mined in %v block(s)\n", eta.Blocks)
+	}
+	return nil
+}
+
+func proof(client *cryptopuff.RPCClient, hashStr string) error {
+	hash, err := cryptopuff.HashFromString(hashStr)
+	if err != nil {
+		return err
+	}
+
+	inclusion, err := client.TxProof(hash)
+	if err != nil {
+		return err
+	}
+
+	stx := inclusion.Tx
+	if err := stx.UpdateHash(); err != nil {
+		return err
+	}
+	if stx.Hash != hash {
+		return fmt.Errorf("proof is for transaction %v, not %v", stx.Hash, hash)
+	}
+
+	if err := cryptopuff.VerifyInclusion(inclusion.Header, &stx, &inclusion.Proof); err != nil {
+		return err
+	}
+
+	if jsonOutput {
+		return printJSON(proofJSON{
+			Hash:   hash,
+			Block:  inclusion.Header.Hash,
+			Height: inclusion.Header.Height,
+		})
+	}
+
+	fmt.Printf("Transaction %v is included in block %v at height %v\n", hash, inclusion.Header.Hash, inclusion.Header.Height)
+	return nil
+}
+
 func peers(client *cryptopuff.RPCClient) error {
 	peers, err := client.Peers()
 	if err != nil {
 		return err
 	}
 
+	if jsonOutput {
+		return printJSON(peers)
+	}
+
 	for _, peer := range peers {
 		fmt.Println(peer)
 	}
 	return nil
 }
+
+// fatal prints err and exits. If the node rejected the request, only the
+// reason it gave is printed.
+func fatal(err error) {
+	if rpcErr, ok := errors.Cause(err).(*cryptopuff.RPCError); ok {
+		log.Fatalf("node responded with status %v: %v\n", rpcErr.StatusCode, rpcErr.Message)
+	}
+	log.Fatalln(err)
+}
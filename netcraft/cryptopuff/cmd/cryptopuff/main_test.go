@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/skip2/go-qrcode"
+	"gitlab.netcraft.com/netcraft/recruitment/cryptopuff"
+)
+
+// capture returns what f prints to stdout and stderr.
+func capture(t *testing.T, f func()) (stdout, stderr string) {
+	read := func(file **os.File) func() string {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		orig := *file
+		*file = w
+
+		out := make(chan string)
+		go func() {
+			b, _ := io.ReadAll(r)
+			out <- string(b)
+		}()
+		return func() string {
+			*file = orig
+			w.Close()
+			return <-out
+		}
+	}
+
+	stdoutDone, stderrDone := read(&os.Stdout), read(&os.Stderr)
+	f()
+	return stdoutDone(), stderrDone()
+}
+
+func TestConfirmTx(t *testing.T) {
+	defer func(orig bool) {
+		jsonOutput = orig
+	}(jsonOutput)
+
+	// /dev/null passes for a terminal, so confirm prompts, then fails when it
+	// reads nothing.
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devNull.Close()
+	defer func(orig *os.File) {
+		os.Stdin = orig
+	}(os.Stdin)
+	os.Stdin = devNull
+
+	tx := &cryptopuff.Tx{TxOutput: cryptopuff.TxOutput{Amount: 1000000}, Fee: 1000}
+	for _, test := range []struct {
+		json   bool
+		amount string
+	}{
+		{false, "Amount: 1,000,000\n"},
+		{true, "Amount: 1000000\n"},
+	} {
+		jsonOutput = test.json
+		stdout, stderr := capture(t, func() {
+			if _, err := confirmTx(tx); err == nil {
+				t.Error("confirmed without an answer")
+			}
+		})
+
+		// With -json, stdout is kept for the JSON result.
+		out, other := stdout, stderr
+		if test.json {
+			out, other = stderr, stdout
+		}
+		if other != "" {
+			t.Errorf("json %v: printed %q to the wrong stream", test.json, other)
+		}
+		for _, want := range []string{test.amount, "Send? [y/N] "} {
+			if !strings.Contains(out, want) {
+				t.Errorf("json %v: printed %q, want it to contain %q", test.json, out, want)
+			}
+		}
+	}
+}
+
+func TestPrintQR(t *testing.T) {
+	addr := cryptopuff.Address{0x12, 0x34}
+	stdout, _ := capture(t, func() {
+		if err := printQR(addr.String()); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	lines := strings.Split(strings.TrimSuffix(stdout, "\n"), "\n")
+	if lines[0] != addr.String() {
+		t.Errorf("first line is %q, want the address %q", lines[0], addr.String())
+	}
+
+	// Each line packs two rows of modules into half blocks, drawing the
+	// light ones so the code reads on a dark terminal.
+	q, err := qrcode.New(addr.String(), qrcode.Medium)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bitmap := q.Bitmap()
+	code := lines[1:]
+	if len(code) != (len(bitmap)+1)/2 {
+		t.Fatalf("printed %v lines, want %v for %v rows", len(code), (len(bitmap)+1)/2, len(bitmap))
+	}
+	for i, line := range code {
+		runes := []rune(line)
+		if len(runes) != len(bitmap) {
+			t.Fatalf("line %v is %v wide, want %v", i, len(runes), len(bitmap))
+		}
+		for j, r := range runes {
+			topLight := !bitmap[2*i][j]
+			bottomLight := 2*i+1 < len(bitmap) && !bitmap[2*i+1][j]
+			want := map[[2]bool]rune{{true, true}: '█', {true, false}: '▀', {false, true}: '▄', {false, false}: ' '}[[2]bool{topLight, bottomLight}]
+			if r != want {
+				t.Fatalf("module pair %v, %v is %q, want %q", i, j, r, want)
+			}
+		}
+	}
+
+	stdout, _ = capture(t, func() {
+		if err := printQR("not an address"); err == nil {
+			t.Error("printed a QR code for an invalid address")
+		}
+	})
+	if stdout != "" {
+		t.Errorf("printed %q for an invalid address", stdout)
+	}
+}
+
+func TestRecoverKey(t *testing.T) {
+	k, err := cryptopuff.GenerateKey(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := base64.StdEncoding.EncodeToString(x509.MarshalPKCS1PublicKey(&k.PublicKey))
+	p, q := k.Primes[0].String(), k.Primes[1].String()
+
+	stdout, _ := capture(t, func() {
+		if err := recoverKey(pub, p, q, "pem"); err != nil {
+			t.Fatal(err)
+		}
+	})
+	recovered, err := cryptopuff.DecodePrivateKeyPEM([]byte(stdout))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !recovered.Equal(k) {
+		t.Error("recovered a different key")
+	}
+
+	stdout, _ = capture(t, func() {
+		if err := recoverKey(pub, p, p, "pem"); err == nil {
+			t.Error("recovered a key from factors that don't multiply to the modulus")
+		}
+	})
+	if stdout != "" {
+		t.Errorf("printed %q for the wrong factors", stdout)
+	}
+}
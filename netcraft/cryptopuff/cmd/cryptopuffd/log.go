@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"log/syslog"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// dialSyslog connects to the system logger. Tests replace it.
+var dialSyslog = func() (io.Writer, error) {
+	return syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "cryptopuffd")
+}
+
+// newLogger builds the logger shared by the server and the database. Logs go
+// to syslog if useSyslog is set, otherwise to path (or stderr if path is
+// empty), as either plain text or one JSON object per line.
+func newLogger(path, format string, useSyslog bool) (*log.Logger, error) {
+	var (
+		w     io.Writer
+		flags = log.LstdFlags
+	)
+	switch {
+	case useSyslog:
+		sw, err := dialSyslog()
+		if err != nil {
+			return nil, errors.Wrap(err, "cryptopuffd: failed to connect to syslog")
+		}
+		w = sw
+		// syslog timestamps messages itself.
+		flags = 0
+	case path != "":
+		f, err := openLogFile(path)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	default:
+		w = os.Stderr
+	}
+
+	switch format {
+	case "text":
+		return log.New(w, "", flags), nil
+	case "json":
+		return log.New(&jsonLogWriter{w: w}, "", 0), nil
+	default:
+		return nil, errors.Errorf("cryptopuffd: unknown log format %q", format)
+	}
+}
+
+// logFile is an append-only log file that is reopened on SIGHUP, so it can be
+// rotated by moving it aside and signalling the process (as logrotate does).
+type logFile struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+func openLogFile(path string) (*logFile, error) {
+	l := &logFile{path: path}
+	if err := l.reopen(); err != nil {
+		return nil, err
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			if err := l.reopen(); err != nil {
+				log.Printf("failed to reopen log file: %v\n", err)
+			}
+		}
+	}()
+
+	return l, nil
+}
+
+func (l *logFile) reopen() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Wrap(err, "cryptopuffd: failed to open log file")
+	}
+
+	l.mu.Lock()
+	old := l.f
+	l.f = f
+	l.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+func (l *logFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.f.Write(p)
+}
+
+// jsonLogWriter wraps each message written by a log.Logger in a JSON object.
+// log.Logger calls Write once per message.
+type jsonLogWriter struct {
+	w io.Writer
+}
+
+type jsonLogEntry struct {
+	Time    string `json:"time"`
+	Message string `json:"message"`
+}
+
+func (j *jsonLogWriter) Write(p []byte) (int, error) {
+	b, err := json.Marshal(jsonLogEntry{
+		Time:    time.Now().UTC().Format(time.RFC3339Nano),
+		Message: strings.TrimSuffix(string(p), "\n"),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := j.w.Write(append(b, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log/syslog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func readLog(t *testing.T, path string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestLogFileText(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cryptopuffd.log")
+	logger, err := newLogger(path, "text", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger.Printf("mined block %v\n", 42)
+	if got := readLog(t, path); !strings.HasSuffix(got, "mined block 42\n") {
+		t.Errorf("log file contains %q, want a line ending in %q", got, "mined block 42")
+	}
+}
+
+func TestLogFileJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cryptopuffd.log")
+	logger, err := newLogger(path, "json", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger.Printf("mined block %v\n", 42)
+	logger.Printf("added peer %v\n", "127.0.0.1:8080")
+
+	lines := strings.Split(strings.TrimSuffix(readLog(t, path), "\n"), "\n")
+	want := []string{"mined block 42", "added peer 127.0.0.1:8080"}
+	if len(lines) != len(want) {
+		t.Fatalf("log file has %v lines, want %v", len(lines), len(want))
+	}
+	for i, line := range lines {
+		var entry jsonLogEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("line %v: %v", i, err)
+		}
+		if entry.Message != want[i] {
+			t.Errorf("line %v has message %q, want %q", i, entry.Message, want[i])
+		}
+		if _, err := time.Parse(time.RFC3339Nano, entry.Time); err != nil {
+			t.Errorf("line %v: %v", i, err)
+		}
+	}
+}
+
+func TestLogFileReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "cryptopuffd.log")
+	rotated := filepath.Join(dir, "cryptopuffd.log.1")
+	logger, err := newLogger(path, "text", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger.Println("before rotation")
+	if err := os.Rename(path, rotated); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file is recreated once the signal has been handled.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("log file wasn't reopened after SIGHUP")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	logger.Println("after rotation")
+
+	if got := readLog(t, rotated); !strings.Contains(got, "before rotation") || strings.Contains(got, "after rotation") {
+		t.Errorf("rotated log file contains %q", got)
+	}
+	if got := readLog(t, path); !strings.Contains(got, "after rotation") {
+		t.Errorf("new log file contains %q", got)
+	}
+}
+
+func TestLogSyslog(t *testing.T) {
+	// Unix socket paths are limited in length, which t.TempDir can exceed.
+	dir, err := ioutil.TempDir("", "cryptopuffd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sock := filepath.Join(dir, "log")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: sock, Net: "unixgram"})
+	if err != nil {
+		t.Skipf("syslog socket unavailable: %v", err)
+	}
+	defer conn.Close()
+
+	defer func(dial func() (io.Writer, error)) {
+		dialSyslog = dial
+	}(dialSyslog)
+	dialSyslog = func() (io.Writer, error) {
+		return syslog.Dial("unixgram", sock, syslog.LOG_INFO|syslog.LOG_DAEMON, "cryptopuffd")
+	}
+
+	logger, err := newLogger("", "text", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Printf("mined block %v\n", 42)
+
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(buf[:n])
+	if !strings.Contains(got, "cryptopuffd") || !strings.HasSuffix(got, "mined block 42\n") {
+		t.Errorf("syslog received %q", got)
+	}
+}
+
+func TestLogUnknownFormat(t *testing.T) {
+	if _, err := newLogger("", "xml", false); err == nil {
+		t.Error("unknown log format was accepted")
+	}
+}
@@ -5,8 +5,13 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"os/signal"
 	"os/user"
+	"runtime"
 	"strings"
+	"syscall"
+	"time"
 
 	"gitlab.netcraft.com/netcraft/recruitment/cryptopuff"
 )
@@ -17,9 +22,12 @@ func main() {
 		log.Fatalln(err)
 	}
 
+	// Only the default for -extAddr depends on the IP, so a node that can't
+	// detect it may still be started with -extAddr set.
 	ip, err := cryptopuff.DetectIP()
 	if err != nil {
-		log.Fatalln(err)
+		log.Printf("%v, defaulting to loopback\n", err)
+		ip = net.IPv4(127, 0, 0, 1)
 	}
 
 	defaultAddr := net.JoinHostPort("", cryptopuff.DefaultPort)
@@ -28,27 +36,172 @@ func main() {
 	defaultPeers := net.JoinHostPort("cryptopuff.netcraft.com", cryptopuff.DefaultPort)
 
 	var (
-		addr        = flag.String("addr", defaultAddr, "address to bind to (changing this will break the scoring system)")
-		extAddr     = flag.String("extAddr", defaultExtAddr, "address peers can use to reach this node (changing this will break the scoring system)")
-		dsn         = flag.String("db", defaultDSN, "path to the database file (do not delete this file, it contains your private keys)")
-		peers       = flag.String("peers", defaultPeers, "comma-separated list of well-known peer addresses")
-		password    = flag.String("password", cryptopuff.DefaultPassword, "password for restricting access to this node's wallet")
-		blockReward = flag.Int64("blockReward", 100, "block reward to claim in blocks mined by this node")
+		configFile     = flag.String("config", "", "JSON file setting addr, extAddr, db, peers (as an array) and password, which flags given on the command line override")
+		addr           = flag.String("addr", defaultAddr, "address to bind to (changing this will break the scoring system)")
+		extAddr        = flag.String("extAddr", defaultExtAddr, "address peers can use to reach this node (changing this will break the scoring system)")
+		dsn            = flag.String("db", defaultDSN, "path to the database file (do not delete this file, it contains your private keys)")
+		peers          = flag.String("peers", defaultPeers, "comma-separated list of well-known peer addresses")
+		password       = flag.String("password", cryptopuff.DefaultPassword, "password for restricting access to this node's wallet")
+		blockReward    = flag.Int64("blockReward", 0, "deprecated and ignored: mined blocks claim the scheduled subsidy")
+		mine           = flag.Bool("mine", true, "mine blocks (set to false for a node that only syncs and relays)")
+		miners         = flag.Int("miners", runtime.NumCPU(), "number of mining goroutines")
+		orphanPoolSize = flag.Int("orphanPoolSize", cryptopuff.DefaultOrphanPoolSize, "maximum number of blocks with unknown parents to hold in memory")
+		maxInflight    = flag.Int("maxInflightBlocks", cryptopuff.DefaultMaxInflightBlocks, "maximum number of blocks to commit in a single transaction during sync")
+		notifications  = flag.Int("maxPeerNotifications", cryptopuff.DefaultMaxPeerNotifications, "maximum number of concurrent requests used to relay blocks and transactions to peers")
+		txsPerSource   = flag.Int("maxPendingTxsPerSource", cryptopuff.DefaultMaxPendingTxsPerSource, "maximum number of pending transactions per source address (0 for no limit)")
+		mempoolTxs     = flag.Int("maxMempoolTxs", cryptopuff.DefaultMaxMempoolTxs, "maximum number of pending transactions, beyond which the lowest fee one is evicted (0 for no limit)")
+		dustThreshold  = flag.Int64("dustThreshold", cryptopuff.DefaultDustThreshold, "minimum transaction amount to relay or mine (0 for no limit)")
+		floorCapacity  = flag.Int("feeFloorCapacity", 0, "number of pending transactions at which the mempool's fee floor reaches -maxFeeFloor, rising as the mempool fills (0 to disable)")
+		maxFeeFloor    = flag.Int64("maxFeeFloor", cryptopuff.DefaultMaxFeeFloor, "highest fee floor, charged once -feeFloorCapacity transactions are pending")
+		strictDust     = flag.Bool("strictDust", false, "also reject blocks containing transactions below the dust threshold (nodes that disagree will fork)")
+		relayOnlyValid = flag.Bool("relayOnlyValid", false, "only accept and relay transactions that are valid on top of the best block without spending pending coins (default relays every accepted transaction)")
+		exportMetrics  = flag.Bool("exportMetricsOnExit", false, "print a summary of blocks mined, hashes computed and transactions relayed on SIGINT or SIGTERM")
+		logFile        = flag.String("logFile", "", "file to append logs to, reopened on SIGHUP for rotation (defaults to stderr)")
+		logFormat      = flag.String("logFormat", "text", "log format (text or json)")
+		logSyslog      = flag.Bool("logSyslog", false, "send logs to syslog instead of a file")
+		pruneInterval  = flag.Duration("pruneMempoolInterval", cryptopuff.DefaultMempoolPruneInterval, "how often to prune invalid transactions from the mempool (0 to disable)")
+		minerKey       = flag.Bool("requireMinerKey", true, "at startup, replace miner addresses whose keys aren't in the wallet or -keystore with a newly generated one")
+		keystore       = flag.String("keystore", "", "directory of keys, as written by cryptopuff -keystore, that may be miner addresses alongside the wallet's (empty for the wallet only)")
+		strictDecoding = flag.Bool("strictDecoding", false, "reject blocks and transactions from peers containing fields this version doesn't understand")
+		requireAuth    = flag.Bool("requireAuthForReads", false, "require the password on all endpoints and send it to peers, for private networks where every node shares the same password")
+		peerToken      = flag.String("peerToken", "", "token peers must send to sync with this node, and which is sent to other peers (empty for an open network)")
+		archive        = flag.Bool("archive", true, "keep the balances at every block, so historical balances can be queried; with -archive=false only the last -balanceHistory blocks' are kept, and the node can't follow a reorg that forks off further back than that")
+		maxBlockRate   = flag.Int("maxBlockRate", cryptopuff.DefaultMaxBlockRate, "reject timestamped chains that grew faster than this many blocks per minute (0 for no limit)")
+		balanceHistory = flag.Int64("balanceHistory", cryptopuff.DefaultBalanceHistory, "number of blocks below the tip to keep balances for with -archive=false, which is also the deepest reorg the node can follow")
+		webhookURL     = flag.String("webhookURL", "", "URL to POST JSON events to as the blockchain changes (empty to disable)")
+		webhookEvents  = flag.String("webhookEvents", "block,payment", "comma-separated webhook events to send (block, payment)")
+		syncOnce       = flag.Bool("syncOnce", false, "sync the blockchain from the highest well-known peer, print the final height and exit without mining or serving requests")
 	)
 	flag.Parse()
 
-	db, err := cryptopuff.OpenDB(*dsn)
+	if *configFile != "" {
+		config, err := cryptopuff.LoadConfig(*configFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		set := make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) {
+			set[f.Name] = true
+		})
+
+		if config.Addr != nil && !set["addr"] {
+			*addr = *config.Addr
+		}
+		if config.ExtAddr != nil && !set["extAddr"] {
+			*extAddr = *config.ExtAddr
+		}
+		if config.DB != nil && !set["db"] {
+			*dsn = *config.DB
+		}
+		if config.Peers != nil && !set["peers"] {
+			*peers = strings.Join(config.Peers, ",")
+		}
+		if config.Password != nil && !set["password"] {
+			*password = *config.Password
+		}
+		if config.BlockReward != nil && !set["blockReward"] {
+			*blockReward = *config.BlockReward
+		}
+	}
+
+	logger, err := newLogger(*logFile, *logFormat, *logSyslog)
 	if err != nil {
 		log.Fatalln(err)
 	}
+
+	if *blockReward != 0 {
+		logger.Println("blockReward is deprecated and ignored: mined blocks claim the scheduled subsidy")
+	}
+
+	dbOpts := []cryptopuff.DBOption{
+		cryptopuff.DBLogger(logger),
+		cryptopuff.MaxInflightBlocks(*maxInflight),
+		cryptopuff.MaxPendingTxsPerSource(*txsPerSource),
+		cryptopuff.MaxMempoolTxs(*mempoolTxs),
+		cryptopuff.DustThreshold(*dustThreshold),
+		cryptopuff.StrictDust(*strictDust),
+		cryptopuff.FeeFloor(*floorCapacity, *maxFeeFloor),
+		cryptopuff.RelayOnlyValid(*relayOnlyValid),
+		cryptopuff.Archive(*archive),
+		cryptopuff.BalanceHistory(*balanceHistory),
+		cryptopuff.MaxBlockRate(*maxBlockRate),
+	}
+	if *keystore != "" {
+		ks, err := cryptopuff.OpenKeystore(*keystore)
+		if err != nil {
+			logger.Fatalln(err)
+		}
+		dbOpts = append(dbOpts, cryptopuff.MinerKeystore(ks))
+	}
+
+	db, err := cryptopuff.OpenDB(*dsn, dbOpts...)
+	if err != nil {
+		logger.Fatalln(err)
+	}
 	defer db.Close()
 
-	server := cryptopuff.NewServer(*addr, *extAddr, *password, *blockReward, split(*peers, ","), db)
+	if !*mine {
+		*miners = 0
+	}
+
+	serverOpts := []cryptopuff.ServerOption{
+		cryptopuff.Miners(*miners),
+		cryptopuff.OrphanPoolSize(*orphanPoolSize),
+		cryptopuff.MaxPeerNotifications(*notifications),
+		cryptopuff.MempoolPruneInterval(*pruneInterval),
+		cryptopuff.StrictDecoding(*strictDecoding),
+		cryptopuff.RequireMinerKey(*minerKey),
+		cryptopuff.RequireAuthForReads(*requireAuth),
+		cryptopuff.PeerToken(*peerToken),
+		cryptopuff.ServerLogger(logger),
+	}
+	if *webhookURL != "" {
+		serverOpts = append(serverOpts, cryptopuff.Webhook(*webhookURL, split(*webhookEvents, ",")))
+	}
+
+	server := cryptopuff.NewServer(*addr, *extAddr, *password, split(*peers, ","), db, serverOpts...)
+	if *syncOnce {
+		height, err := server.SyncOnce()
+		if err != nil {
+			logger.Fatalln(err)
+		}
+		fmt.Println(height)
+		return
+	}
+
+	go shutdownOnSignal(server, db, logger, *exportMetrics)
+
 	if err := server.Serve(); err != nil {
-		log.Fatalln(err)
+		logger.Fatalln(err)
 	}
 }
 
+// shutdownOnSignal saves the server's in-memory state and closes the database
+// on SIGINT or SIGTERM, optionally printing a summary of the session first.
+func shutdownOnSignal(server *cryptopuff.Server, db *cryptopuff.DB, logger *log.Logger, exportMetrics bool) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	sig := <-c
+
+	logger.Printf("received %v, shutting down\n", sig)
+	if exportMetrics {
+		stats := server.Stats()
+		logger.Printf("uptime: %v\n", stats.Uptime.Round(time.Second))
+		logger.Printf("blocks mined: %v\n", stats.BlocksMined)
+		logger.Printf("hashes computed: %v (%.0f per second)\n", stats.Hashes, stats.HashesPerSec())
+		logger.Printf("transactions relayed: %v\n", stats.TxsRelayed)
+		logger.Printf("transactions pruned: %v\n", stats.TxsPruned)
+	}
+
+	if err := server.SaveState(); err != nil {
+		logger.Println(err)
+	}
+
+	db.Close()
+	os.Exit(0)
+}
+
 func split(s, sep string) []string {
 	if s == "" {
 		return nil
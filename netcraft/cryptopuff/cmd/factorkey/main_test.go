@@ -0,0 +1,31 @@
+package main
+
+import (
+	"crypto/rsa"
+	"math/big"
+	"testing"
+)
+
+func TestFactorRSARho(t *testing.T) {
+	p, _ := new(big.Int).SetString("604462909807314587365499", 10)
+	q, _ := new(big.Int).SetString("1208925819614629174607531", 10)
+	pub := &rsa.PublicKey{N: new(big.Int).Mul(p, q), E: 65537}
+
+	k, err := factorRSA(pollardRho{}, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The recovered key decrypts what the public key encrypts.
+	m := big.NewInt(42)
+	c := new(big.Int).Exp(m, big.NewInt(int64(pub.E)), pub.N)
+	if got := new(big.Int).Exp(c, k.D, pub.N); got.Cmp(m) != 0 {
+		t.Errorf("recovered key decrypts %v as %v", m, got)
+	}
+}
+
+func TestNewFactorerUnknown(t *testing.T) {
+	if _, err := newFactorer("ecm"); err == nil {
+		t.Error("unknown factoring tool was accepted")
+	}
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"math/big"
+
+	"gitlab.netcraft.com/netcraft/recruitment/cryptopuff"
+)
+
+// pollardRho factors in-process with cryptopuff.Factor256, Pollard's rho
+// followed by a quadratic sieve, so it needs no external tools. Keys of more
+// than cryptopuff.MaxFactorBits bits are refused.
+type pollardRho struct{}
+
+func (pollardRho) Factor(n *big.Int) (*big.Int, *big.Int, error) {
+	return cryptopuff.Factor256(n)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math/big"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var factorRegex = regexp.MustCompile(`P\d+ = (\d+)`)
+
+// yafu factors using the external yafu binary, which must be on the PATH.
+type yafu struct{}
+
+func (yafu) Factor(n *big.Int) (*big.Int, *big.Int, error) {
+	cmd := exec.Command("yafu")
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("factor(%v)", n))
+
+	b, err := cmd.Output()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "factorkey: yafu failed")
+	}
+
+	var factors []big.Int
+
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		m := factorRegex.FindStringSubmatch(s.Text())
+		if len(m) != 2 {
+			continue
+		}
+
+		var f big.Int
+		if _, ok := f.SetString(m[1], 10); !ok {
+			return nil, nil, errors.New("factorkey: failed to set big.Int")
+		}
+		factors = append(factors, f)
+	}
+	if err := s.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	if len(factors) != 2 {
+		return nil, nil, errors.New("factorkey: failed to find two factors in yafu output")
+	}
+	return &factors[0], &factors[1], nil
+}
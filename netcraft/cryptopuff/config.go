@@ -0,0 +1,50 @@
+package cryptopuff
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// Config holds cryptopuffd options read from a JSON file, keyed by the names
+// of the matching command-line flags, e.g.
+//
+//	{"addr": ":8080", "peers": ["example.com:8080"]}
+//
+// Options missing from the file are nil, so they can be told apart from
+// options explicitly set to their zero value.
+type Config struct {
+	Addr     *string  `json:"addr"`
+	ExtAddr  *string  `json:"extAddr"`
+	DB       *string  `json:"db"`
+	Peers    []string `json:"peers"`
+	Password *string  `json:"password"`
+
+	// BlockReward is deprecated and ignored, as blocks claim the scheduled
+	// subsidy (see BlockSubsidy). It is still accepted so that existing
+	// config files load.
+	BlockReward *int64 `json:"blockReward"`
+}
+
+// LoadConfig reads the config file at path. Unknown keys are rejected, so a
+// misspelt option isn't silently ignored.
+func LoadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: failed to open config file")
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+
+	var c Config
+	if err := dec.Decode(&c); err != nil {
+		return nil, errors.Wrapf(err, "cryptopuff: failed to parse config file %v", path)
+	}
+	if dec.More() {
+		return nil, errors.Errorf("cryptopuff: failed to parse config file %v: trailing data after config", path)
+	}
+	return &c, nil
+}
@@ -4,17 +4,29 @@ import (
 	"database/sql"
 	"log"
 	"os"
+	"sync/atomic"
 	"time"
+
+	"gitlab.netcraft.com/netcraft/recruitment/cryptopuff/retry"
 )
 
 type DB struct {
 	db         *sql.DB
+	replica    *sql.DB
 	logger     *log.Logger
 	tries      int
 	backoff    func(try int) time.Duration
 	isDeadlock func(err error) bool
+	onRetry    func(try int, err error)
+	retries    uint64
+	mode       Mode
+
+	maxOpenConns    int
+	maxIdleConns    int
+	connMaxLifetime time.Duration
 }
 
+// Mode is whether transactions may write to the database.
 type Mode int
 
 const (
@@ -39,18 +51,32 @@ func Open(driverName, dataSourceName string, isDeadlock func(err error) bool, op
 		db:         sqlDB,
 		logger:     log.New(os.Stderr, "", log.LstdFlags),
 		tries:      3,
-		backoff:    BinaryExponentialBackoff(),
+		backoff:    retry.BinaryExponentialBackoff(),
 		isDeadlock: isDeadlock,
+		mode:       Write,
+
+		// database/sql's default
+		maxIdleConns: 2,
 	}
 
 	for _, opt := range opts {
 		opt(db)
 	}
 
+	sqlDB.SetMaxOpenConns(db.maxOpenConns)
+	sqlDB.SetMaxIdleConns(db.maxIdleConns)
+	sqlDB.SetConnMaxLifetime(db.connMaxLifetime)
+
 	return db, nil
 }
 
 func (d *DB) Close() error {
+	if d.replica != nil {
+		if err := d.replica.Close(); err != nil {
+			d.db.Close()
+			return err
+		}
+	}
 	return d.db.Close()
 }
 
@@ -60,12 +86,67 @@ func Logger(l *log.Logger) Option {
 	}
 }
 
+// AccessMode sets whether transactions may write. Read begins every
+// transaction read-only, for connecting to a read-only replica. Not every
+// driver enforces it: SQLite's doesn't, so open the file read-only too.
+func AccessMode(m Mode) Option {
+	return func(db *DB) {
+		db.mode = m
+	}
+}
+
+// ReadReplica sends Read transactions (see TransactMode) to replica instead
+// of the primary database. It is closed along with the database.
+func ReadReplica(replica *sql.DB) Option {
+	return func(db *DB) {
+		db.replica = replica
+	}
+}
+
+// MaxOpenConns limits the number of open connections. Zero means no limit.
+func MaxOpenConns(n int) Option {
+	return func(db *DB) {
+		db.maxOpenConns = n
+	}
+}
+
+// MaxIdleConns sets the number of idle connections kept open, which is two
+// by default.
+func MaxIdleConns(n int) Option {
+	return func(db *DB) {
+		db.maxIdleConns = n
+	}
+}
+
+// ConnMaxLifetime closes connections once they are d old. Zero means
+// connections are reused forever.
+func ConnMaxLifetime(d time.Duration) Option {
+	return func(db *DB) {
+		db.connMaxLifetime = d
+	}
+}
+
 func Tries(n int) Option {
 	return func(db *DB) {
 		db.tries = n
 	}
 }
 
+// OnRetry sets a function called each time a transaction is retried after a
+// deadlock, with the number of the attempt that failed (starting at 1) and its
+// error.
+func OnRetry(f func(try int, err error)) Option {
+	return func(db *DB) {
+		db.onRetry = f
+	}
+}
+
+// RetryCount returns the number of times a transaction has been retried after
+// a deadlock since the database was opened.
+func (d *DB) RetryCount() uint64 {
+	return atomic.LoadUint64(&d.retries)
+}
+
 func Backoff(f func(try int) time.Duration) Option {
 	return func(db *DB) {
 		db.backoff = f
@@ -0,0 +1,101 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var errTestDeadlock = errors.New("test deadlock")
+
+func openTestDB(t *testing.T, opts ...Option) *DB {
+	isDeadlock := func(err error) bool {
+		return err == errTestDeadlock
+	}
+	opts = append([]Option{Backoff(func(try int) time.Duration { return 0 })}, opts...)
+	db, err := Open("sqlite3", ":memory:", isDeadlock, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+	})
+	return db
+}
+
+type retryCall struct {
+	try int
+	err error
+}
+
+func TestOnRetry(t *testing.T) {
+	var retries []retryCall
+	db := openTestDB(t, Tries(5), OnRetry(func(try int, err error) {
+		retries = append(retries, retryCall{try, err})
+	}))
+
+	attempts := 0
+	if err := db.TransactWithRetry(func(tx *sql.Tx) error {
+		attempts++
+		if attempts < 3 {
+			return errTestDeadlock
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []retryCall{{1, errTestDeadlock}, {2, errTestDeadlock}}
+	if len(retries) != len(want) {
+		t.Fatalf("OnRetry called %v times, want %v", len(retries), len(want))
+	}
+	for i := range want {
+		if retries[i] != want[i] {
+			t.Errorf("retry %v = %+v, want %+v", i, retries[i], want[i])
+		}
+	}
+	if n := db.RetryCount(); n != 2 {
+		t.Errorf("RetryCount() = %v, want 2", n)
+	}
+}
+
+func TestRetryCountGivingUp(t *testing.T) {
+	calls := 0
+	db := openTestDB(t, Tries(3), OnRetry(func(try int, err error) {
+		calls++
+	}))
+
+	err := db.TransactWithRetry(func(tx *sql.Tx) error {
+		return errTestDeadlock
+	})
+	if terr, ok := err.(TxError); !ok || terr.Cause() != errTestDeadlock {
+		t.Fatalf("got %v, want TxError caused by %v", err, errTestDeadlock)
+	}
+
+	// The last attempt isn't followed by a retry.
+	if calls != 2 {
+		t.Errorf("OnRetry called %v times, want 2", calls)
+	}
+	if n := db.RetryCount(); n != 2 {
+		t.Errorf("RetryCount() = %v, want 2", n)
+	}
+}
+
+func TestRetryCountOtherErrors(t *testing.T) {
+	db := openTestDB(t, OnRetry(func(try int, err error) {
+		t.Errorf("OnRetry called for attempt %v: %v", try, err)
+	}))
+
+	errOther := errors.New("not a deadlock")
+	if err := db.TransactWithRetry(func(tx *sql.Tx) error {
+		return errOther
+	}); err != errOther {
+		t.Errorf("got %v, want %v", err, errOther)
+	}
+	if n := db.RetryCount(); n != 0 {
+		t.Errorf("RetryCount() = %v, want 0", n)
+	}
+}
@@ -5,6 +5,11 @@ import (
 	"gitlab.netcraft.com/netcraft/recruitment/cryptopuff/database"
 )
 
+// Open opens a SQLite database. SQLite only allows one writer at a time, so
+// concurrent writers contend for the lock and fail with ErrBusy once the busy
+// timeout runs out. database.MaxOpenConns(1) queues them on a single
+// connection instead, but then a transaction begun while another is open on
+// the same goroutine blocks forever, so it isn't the default.
 func Open(dataSourceName string, opts ...database.Option) (*database.DB, error) {
 	db, err := database.Open("sqlite3", dataSourceName, isDeadlock, opts...)
 	if err != nil {
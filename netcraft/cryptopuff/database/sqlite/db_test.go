@@ -0,0 +1,105 @@
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"gitlab.netcraft.com/netcraft/recruitment/cryptopuff/database"
+)
+
+func openTestDB(t testing.TB, opts ...database.Option) *database.DB {
+	dsn := filepath.Join(t.TempDir(), "test.db") + "?_busy_timeout=60000"
+	db, err := Open(dsn, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+	})
+
+	if err := db.Transact(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`CREATE TABLE counters (id INTEGER PRIMARY KEY NOT NULL, n INTEGER NOT NULL)`)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// increment reads and updates a counter in one transaction, the pattern that
+// makes concurrent SQLite writers contend for the lock.
+func increment(db *database.DB, id int) error {
+	return db.TransactWithRetry(func(tx *sql.Tx) error {
+		var n int
+		err := tx.QueryRow(`SELECT n FROM counters WHERE id = ?`, id).Scan(&n)
+		if err == sql.ErrNoRows {
+			_, err = tx.Exec(`INSERT INTO counters (id, n) VALUES (?, 1)`, id)
+			return err
+		} else if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`UPDATE counters SET n = ? WHERE id = ?`, n+1, id)
+		return err
+	})
+}
+
+func incrementConcurrently(db *database.DB, workers, n int) error {
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				if err := increment(db, i%4); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+func TestConcurrentTransactWithRetry(t *testing.T) {
+	const workers, n = 8, 25
+
+	for _, maxOpenConns := range []int{0, 1} {
+		t.Run(fmt.Sprintf("MaxOpenConns=%v", maxOpenConns), func(t *testing.T) {
+			db := openTestDB(t, database.MaxOpenConns(maxOpenConns))
+			if err := incrementConcurrently(db, workers, n); err != nil {
+				t.Fatal(err)
+			}
+
+			var total int
+			if err := db.Transact(func(tx *sql.Tx) error {
+				return tx.QueryRow(`SELECT SUM(n) FROM counters`).Scan(&total)
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if total != workers*n {
+				t.Errorf("counters sum to %v, want %v", total, workers*n)
+			}
+		})
+	}
+}
+
+func BenchmarkConcurrentTransactWithRetry(b *testing.B) {
+	const workers = 8
+
+	for _, maxOpenConns := range []int{0, 1} {
+		b.Run(fmt.Sprintf("MaxOpenConns=%v", maxOpenConns), func(b *testing.B) {
+			db := openTestDB(b, database.MaxOpenConns(maxOpenConns), database.Tries(100))
+			b.ResetTimer()
+			if err := incrementConcurrently(db, workers, b.N); err != nil {
+				b.Fatal(err)
+			}
+			b.ReportMetric(float64(db.RetryCount())/float64(workers*b.N), "retries/op")
+		})
+	}
+}
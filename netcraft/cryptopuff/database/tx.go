@@ -1,9 +1,11 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,8 +22,19 @@ func (e TxError) Error() string {
 	return fmt.Sprintf("database: transaction failed after %v attempt(s): %v", e.tries, e.cause)
 }
 
-func (d *DB) Transact(f func(tx *sql.Tx) error) (err error) {
-	tx, err := d.db.Begin()
+func (d *DB) Transact(f func(tx *sql.Tx) error) error {
+	return d.TransactMode(Write, f)
+}
+
+// TransactMode is like Transact, but a Read transaction is begun read-only
+// and goes to the read replica, if there is one.
+func (d *DB) TransactMode(mode Mode, f func(tx *sql.Tx) error) (err error) {
+	db := d.db
+	if mode == Read && d.replica != nil {
+		db = d.replica
+	}
+
+	tx, err := db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: mode == Read || d.mode == Read})
 	if err != nil {
 		return err
 	}
@@ -43,6 +56,11 @@ func (d *DB) Transact(f func(tx *sql.Tx) error) (err error) {
 }
 
 func (d *DB) TransactWithRetry(f func(tx *sql.Tx) error) error {
+	return d.TransactModeWithRetry(Write, f)
+}
+
+// TransactModeWithRetry is like TransactWithRetry, but see TransactMode.
+func (d *DB) TransactModeWithRetry(mode Mode, f func(tx *sql.Tx) error) error {
 	tries := d.tries
 	if tries == 0 {
 		return errors.New("database: tries must be 1 or greater")
@@ -50,7 +68,7 @@ func (d *DB) TransactWithRetry(f func(tx *sql.Tx) error) error {
 
 	var err error
 	for i := 0; i < tries; i++ {
-		err = d.Transact(f)
+		err = d.TransactMode(mode, f)
 		if err == nil {
 			return nil
 		}
@@ -58,6 +76,11 @@ func (d *DB) TransactWithRetry(f func(tx *sql.Tx) error) error {
 			return err
 		}
 		if i != tries-1 {
+			atomic.AddUint64(&d.retries, 1)
+			if d.onRetry != nil {
+				d.onRetry(i+1, err)
+			}
+
 			duration := d.backoff(i)
 			time.Sleep(duration)
 		}
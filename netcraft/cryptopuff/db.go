@@ -1,20 +1,36 @@
 package cryptopuff
 
 import (
+	"crypto/ecdsa"
+	"crypto/rand"
 	"crypto/rsa"
-	"crypto/x509"
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"log"
+	"math"
+	"os"
+	"sync"
 	"time"
 
+	"github.com/JohnCGriffin/overflow"
 	"github.com/mattn/go-sqlite3"
 	"github.com/pkg/errors"
 	"gitlab.netcraft.com/netcraft/recruitment/cryptopuff/database"
 	"gitlab.netcraft.com/netcraft/recruitment/cryptopuff/database/sqlite"
 )
 
-var ErrUnknownParent = errors.New("cryptopuff: unknown parent block")
+var (
+	ErrUnknownParent = errors.New("cryptopuff: unknown parent block")
+	ErrUnknownBlock  = errors.New("cryptopuff: unknown block")
+	ErrNoBlocks      = errors.New("cryptopuff: no blocks in database")
+	ErrUnknownTx     = errors.New("cryptopuff: unknown transaction")
+	ErrTxNotPending  = errors.New("cryptopuff: transaction already included in blockchain")
+	ErrTxNotIncluded = errors.New("cryptopuff: transaction not included in blockchain")
+	ErrStaleTip      = errors.New("cryptopuff: block doesn't extend the best block")
+	ErrNoSuchHeight  = errors.New("cryptopuff: no block at that height in the best chain")
+	ErrPruned        = errors.New("cryptopuff: balances at that block have been pruned")
+)
 
 type InvalidBlockError struct {
 	Message string
@@ -28,12 +44,214 @@ func (i InvalidBlockError) Error() string {
 	return i.Message
 }
 
+// UnknownKeyError is returned when an operation needs the private key for an
+// address that isn't in the wallet.
+type UnknownKeyError struct {
+	Address Address
+}
+
+func (u UnknownKeyError) Error() string {
+	return fmt.Sprintf("cryptopuff: no private key for address %v in wallet", u.Address)
+}
+
+// invalidBlockTxError wraps the reason the i'th transaction of a block is
+// invalid with the block and transaction it applies to.
+func invalidBlockTxError(b *Block, i int, err error) error {
+	return InvalidBlockError{
+		Message: fmt.Sprintf("cryptopuff: invalid transaction %v (%v) in block %v at height %v", i, b.Transactions[i].Hash, b.Hash, b.Height),
+		Cause:   err,
+	}
+}
+
+const (
+	DefaultMaxInflightBlocks      = 500
+	DefaultMaxPendingTxsPerSource = 100
+	DefaultMaxMempoolTxs          = 10000
+	DefaultDustThreshold          = 0
+	DefaultMaxFeeFloor            = 10
+
+	// DefaultMaxBlockRate is the default cap on how quickly a chain of
+	// timestamped blocks may have been mined, in blocks per minute.
+	DefaultMaxBlockRate = 600
+
+	// blockRateWindow is the number of blocks over which the block rate is
+	// measured.
+	blockRateWindow = 100
+
+	// maxPendingTxDepth is how many generations of pending transactions,
+	// each spending the outputs of the one before, are selected at once.
+	maxPendingTxDepth = 8
+
+	// DefaultBalanceHistory is the number of blocks below the tip whose
+	// balances a pruned node keeps. A pruned node can't switch to a fork
+	// that branches off further back than this, so nodes only prune when
+	// asked to with Archive(false).
+	DefaultBalanceHistory = 1000
+)
+
 type DB struct {
-	db *database.DB
+	db                     *database.DB
+	maxInflightBlocks      int
+	maxPendingTxsPerSource int
+	maxMempoolTxs          int
+	dustThreshold          int64
+	strictDust             bool
+	relayOnlyValid         bool
+	feeFloorCapacity       int
+	maxFeeFloor            int64
+	archive                bool
+	maxBlockRate           int
+	balanceHistory         int64
+	minerKeystore          *Keystore
+	logger                 *log.Logger
+
+	// keys caches the result of Keys(), as it is called on every scoring
+	// request. It is invalidated by AddKey.
+	keysMu sync.Mutex
+	keys   []Key
+}
+
+type DBOption func(*DB)
+
+// MaxInflightBlocks sets the number of blocks AddBlocks commits in a single
+// transaction.
+func MaxInflightBlocks(n int) DBOption {
+	return func(d *DB) {
+		d.maxInflightBlocks = n
+	}
+}
+
+// MaxPendingTxsPerSource sets the maximum number of pending transactions a
+// single source address may have in the mempool. Zero means no limit.
+func MaxPendingTxsPerSource(n int) DBOption {
+	return func(d *DB) {
+		d.maxPendingTxsPerSource = n
+	}
+}
+
+// MaxMempoolTxs sets the maximum number of pending transactions in the
+// mempool. Once it is full a new transaction evicts the lowest fee one, if it
+// pays more. Zero means no limit.
+func MaxMempoolTxs(n int) DBOption {
+	return func(d *DB) {
+		d.maxMempoolTxs = n
+	}
+}
+
+// DustThreshold sets the smallest transaction amount accepted into the mempool
+// or picked for mining. Block rewards are exempt. Zero disables the check.
+func DustThreshold(n int64) DBOption {
+	return func(d *DB) {
+		d.dustThreshold = n
+	}
+}
+
+// StrictDust makes the dust threshold a consensus rule: blocks containing
+// transactions below it are rejected. Nodes that disagree on the threshold in
+// strict mode will fork, so it is off by default.
+func StrictDust(strict bool) DBOption {
+	return func(d *DB) {
+		d.strictDust = strict
+	}
+}
+
+// FeeFloor raises the minimum fee accepted into the mempool as it fills up.
+// With n pending transactions the floor is max * (n/capacity)^2, so it stays
+// low until the mempool is congested, reaches max at capacity, and falls again
+// as blocks drain it. Zero capacity disables the floor.
+func FeeFloor(capacity int, max int64) DBOption {
+	return func(d *DB) {
+		d.feeFloorCapacity = capacity
+		d.maxFeeFloor = max
+	}
+}
+
+// RelayOnlyValid makes the node strict about the transactions it stores and
+// relays: a new transaction must be valid on top of the best block together
+// with the source's other pending transactions, without spending coins that
+// are still pending, and peers are only served pending transactions that are
+// still valid on top of the best block. Otherwise the node is lenient and
+// relays every pending transaction it has accepted.
+func RelayOnlyValid(strict bool) DBOption {
+	return func(d *DB) {
+		d.relayOnlyValid = strict
+	}
 }
 
-func OpenDB(dsn string) (*DB, error) {
-	db, err := sqlite.Open(fmt.Sprintf("%v?_foreign_keys=on&_busy_timeout=60000", dsn))
+// Archive keeps the balances at every block, so BalanceAt can answer for any
+// height, which is the default. Otherwise the node is pruned: balances are
+// dropped for blocks more than the balance history below the tip, and the
+// node can no longer follow a reorg to a fork that branches off below that.
+func Archive(archive bool) DBOption {
+	return func(d *DB) {
+		d.archive = archive
+	}
+}
+
+// BalanceHistory sets the number of blocks below the tip whose balances a
+// pruned node keeps.
+func BalanceHistory(n int64) DBOption {
+	return func(d *DB) {
+		d.balanceHistory = n
+	}
+}
+
+// MinerKeystore lets addresses whose keys are in ks, rather than the wallet,
+// be miner addresses, so rewards can be paid to keys kept on the node's
+// machine but outside its database.
+func MinerKeystore(ks *Keystore) DBOption {
+	return func(d *DB) {
+		d.minerKeystore = ks
+	}
+}
+
+// MaxBlockRate rejects timestamped blocks that would mean the chain grew
+// faster than n blocks per minute, which stops peers making us process chains
+// with implausible heights. Zero disables the check.
+func MaxBlockRate(n int) DBOption {
+	return func(d *DB) {
+		d.maxBlockRate = n
+	}
+}
+
+// DBLogger sets the logger used by the database layer, which defaults to
+// logging to stderr.
+func DBLogger(l *log.Logger) DBOption {
+	return func(d *DB) {
+		d.logger = l
+	}
+}
+
+func OpenDB(dsn string, opts ...DBOption) (*DB, error) {
+	d := &DB{
+		maxInflightBlocks:      DefaultMaxInflightBlocks,
+		maxPendingTxsPerSource: DefaultMaxPendingTxsPerSource,
+		maxMempoolTxs:          DefaultMaxMempoolTxs,
+		dustThreshold:          DefaultDustThreshold,
+		maxFeeFloor:            DefaultMaxFeeFloor,
+		archive:                true,
+		balanceHistory:         DefaultBalanceHistory,
+		maxBlockRate:           DefaultMaxBlockRate,
+		logger:                 log.New(os.Stderr, "", log.LstdFlags),
+	}
+
+	for _, opt := range opts {
+		opt(d)
+	}
+
+	if d.maxInflightBlocks < 1 {
+		return nil, errors.New("cryptopuff: max in-flight blocks must be 1 or greater")
+	}
+	if d.balanceHistory < 1 {
+		return nil, errors.New("cryptopuff: balance history must be 1 or greater")
+	}
+
+	db, err := sqlite.Open(fmt.Sprintf("%v?_foreign_keys=on&_busy_timeout=60000", dsn),
+		database.Logger(d.logger),
+		database.OnRetry(func(try int, err error) {
+			d.logger.Printf("database: retrying transaction after attempt %v failed: %v\n", try, err)
+		}),
+	)
 	if err != nil {
 		return nil, errors.Wrap(err, "cryptopuff: opening sqlite database failed")
 	}
@@ -42,10 +260,109 @@ func OpenDB(dsn string) (*DB, error) {
 		db.Close()
 		return nil, errors.Wrap(err, "cryptopuff: migration failed")
 	}
+	d.db = db
+
+	return d, nil
+}
+
+// migrateBlocksMiner adds the miner column to blocks tables created before it
+// existed, and fills it in for any blocks that don't have it set.
+func migrateBlocksMiner(tx *sql.Tx) error {
+	var n int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('blocks') WHERE name = 'miner'`).Scan(&n); err != nil {
+		return err
+	}
+	if n == 0 {
+		if _, err := tx.Exec(`ALTER TABLE blocks ADD COLUMN miner TEXT NULL`); err != nil {
+			return err
+		}
+	}
+
+	rows, err := tx.Query(`SELECT block FROM blocks WHERE miner IS NULL`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var blocks []*Block
+	for rows.Next() {
+		var b []byte
+		if err := rows.Scan(&b); err != nil {
+			return err
+		}
+
+		block, err := DecodeBlock(b)
+		if err != nil {
+			return err
+		}
+		blocks = append(blocks, block)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	for _, block := range blocks {
+		if _, err := tx.Exec(`UPDATE blocks SET miner = ? WHERE hash = ?`, block.RewardOutput.Destination, block.Hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateBlocksWork adds the cumulative work column to blocks tables created
+// before it existed. Every block stored until then was mined at the same
+// difficulty, so a block's cumulative work follows from its height.
+func migrateBlocksWork(tx *sql.Tx) error {
+	var n int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('blocks') WHERE name = 'work'`).Scan(&n); err != nil {
+		return err
+	}
+	if n == 0 {
+		if _, err := tx.Exec(`ALTER TABLE blocks ADD COLUMN work INTEGER NULL`); err != nil {
+			return err
+		}
+	}
+
+	_, err := tx.Exec(`UPDATE blocks SET work = (height + 1) * ? WHERE work IS NULL`, GenesisBlock.Work())
+	return err
+}
+
+// migrateTxsPrivate adds the private column to txs tables created before it
+// existed.
+func migrateTxsPrivate(tx *sql.Tx) error {
+	var n int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('txs') WHERE name = 'private'`).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+
+	_, err := tx.Exec(`ALTER TABLE txs ADD COLUMN private INTEGER NOT NULL DEFAULT 0`)
+	return err
+}
+
+// migrateTxsExpiresAtHeight adds the expires_at_height column to txs tables
+// created before it existed. Transactions stored until then predate
+// Tx.ExpiresAtHeight, so leaving it NULL means they never expire.
+func migrateTxsExpiresAtHeight(tx *sql.Tx) error {
+	var n int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('txs') WHERE name = 'expires_at_height'`).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+
+	_, err := tx.Exec(`ALTER TABLE txs ADD COLUMN expires_at_height INTEGER NULL`)
+	return err
+}
 
-	return &DB{
-		db: db,
-	}, nil
+// RetryCount returns the number of database transactions retried after a
+// deadlock since the database was opened.
+func (d *DB) RetryCount() uint64 {
+	return d.db.RetryCount()
 }
 
 func migrate(db *database.DB) error {
@@ -56,16 +373,38 @@ func migrate(db *database.DB) error {
 				previous_hash TEXT NULL,
 				height INTEGER NOT NULL,
 				block TEXT NOT NULL,
+				miner TEXT NULL,
+				work INTEGER NULL,
 				FOREIGN KEY (previous_hash) REFERENCES blocks (hash)
 			)
 		`); err != nil {
 			return err
 		}
 
+		if err := migrateBlocksMiner(tx); err != nil {
+			return err
+		}
+
+		if err := migrateBlocksWork(tx); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(`CREATE INDEX IF NOT EXISTS blocks_work_hash ON blocks (work DESC, hash ASC)`); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(`CREATE INDEX IF NOT EXISTS blocks_miner ON blocks (miner, height DESC)`); err != nil {
+			return err
+		}
+
 		if _, err := tx.Exec(`CREATE INDEX IF NOT EXISTS blocks_height ON blocks (height)`); err != nil {
 			return err
 		}
 
+		if _, err := tx.Exec(`CREATE INDEX IF NOT EXISTS blocks_height_hash ON blocks (height DESC, hash ASC)`); err != nil {
+			return err
+		}
+
 		if _, err := tx.Exec(`CREATE INDEX IF NOT EXISTS blocks_previous_hash ON blocks (previous_hash)`); err != nil {
 			return err
 		}
@@ -75,9 +414,9 @@ func migrate(db *database.DB) error {
 			return err
 		}
 		if _, err := tx.Exec(`
-			INSERT OR IGNORE INTO blocks (hash, previous_hash, height, block)
-			VALUES (?, ?, ?, ?)
-		`, GenesisBlock.Hash, GenesisBlock.PreviousHash, GenesisBlock.Height, b); err != nil {
+			INSERT OR IGNORE INTO blocks (hash, previous_hash, height, block, miner, work)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, GenesisBlock.Hash, GenesisBlock.PreviousHash, GenesisBlock.Height, b, GenesisBlock.RewardOutput.Destination, GenesisBlock.Work()); err != nil {
 			return err
 		}
 
@@ -97,6 +436,52 @@ func migrate(db *database.DB) error {
 			return err
 		}
 
+		// balances_address serves lookups of an address across every block,
+		// such as everFunded's, which the primary key can't.
+		if _, err := tx.Exec(`CREATE INDEX IF NOT EXISTS balances_address ON balances (address)`); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(`
+			CREATE TABLE IF NOT EXISTS pruned_balances (
+				block_hash TEXT PRIMARY KEY NOT NULL,
+				height INTEGER NOT NULL,
+				FOREIGN KEY (block_hash) REFERENCES blocks (hash)
+			)
+		`); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(`CREATE INDEX IF NOT EXISTS pruned_balances_height ON pruned_balances (height)`); err != nil {
+			return err
+		}
+
+		// immature_rewards holds, for each block, the payouts of its
+		// ancestors (and itself) that haven't reached CoinbaseMaturity.
+		// They are included in balances, but can't be spent.
+		if _, err := tx.Exec(`
+			CREATE TABLE IF NOT EXISTS immature_rewards (
+				block_hash TEXT NOT NULL,
+				height INTEGER NOT NULL,
+				address TEXT NOT NULL,
+				amount INTEGER NOT NULL,
+				PRIMARY KEY (block_hash, height),
+				FOREIGN KEY (block_hash) REFERENCES blocks (hash)
+			)
+		`); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(`
+			CREATE TABLE IF NOT EXISTS orphans (
+				hash TEXT PRIMARY KEY NOT NULL,
+				seq INTEGER NOT NULL,
+				block BLOB NOT NULL
+			)
+		`); err != nil {
+			return err
+		}
+
 		if _, err := tx.Exec(`
 			CREATE TABLE IF NOT EXISTS keys (
 				address TEXT PRIMARY KEY NOT NULL,
@@ -114,6 +499,22 @@ func migrate(db *database.DB) error {
 			return err
 		}
 
+		if _, err := tx.Exec(`
+			CREATE TABLE IF NOT EXISTS miner_rotation (
+				rotation INTEGER NOT NULL
+			)
+		`); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(`
+			INSERT INTO miner_rotation (rotation)
+			SELECT ?
+			WHERE NOT EXISTS (SELECT 1 FROM miner_rotation)
+		`, RotationRoundRobin); err != nil {
+			return err
+		}
+
 		var unused int64
 		err = tx.QueryRow(`SELECT 1 FROM keys LIMIT 1`).Scan(&unused)
 		if err == sql.ErrNoRows {
@@ -123,7 +524,7 @@ func migrate(db *database.DB) error {
 			}
 
 			a := AddressFromKey(DefaultVersion, &k.PublicKey)
-			if err := addKey(tx, a, k); err != nil {
+			if err := addKey(tx, a, EncodePrivateKeyPEM(k)); err != nil {
 				return err
 			}
 
@@ -141,12 +542,26 @@ func migrate(db *database.DB) error {
 				destination TEXT NOT NULL,
 				amount INTEGER NOT NULL,
 				fee INTEGER NOT NULL,
-				tx TEXT NOT NULL
+				tx TEXT NOT NULL,
+				private INTEGER NOT NULL DEFAULT 0,
+				expires_at_height INTEGER NULL
 			)
 		`); err != nil {
 			return err
 		}
 
+		if err := migrateTxsPrivate(tx); err != nil {
+			return err
+		}
+
+		if err := migrateTxsExpiresAtHeight(tx); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(`CREATE INDEX IF NOT EXISTS txs_expires_at_height ON txs (expires_at_height)`); err != nil {
+			return err
+		}
+
 		if _, err := tx.Exec(`CREATE INDEX IF NOT EXISTS txs_source ON txs (source)`); err != nil {
 			return err
 		}
@@ -199,6 +614,42 @@ func migrate(db *database.DB) error {
 			return err
 		}
 
+		if _, err := tx.Exec(`
+			CREATE TABLE IF NOT EXISTS chain_events (
+				seq INTEGER PRIMARY KEY AUTOINCREMENT,
+				type TEXT NOT NULL,
+				block_hash TEXT NOT NULL,
+				height INTEGER NOT NULL,
+				deltas TEXT NOT NULL
+			)
+		`); err != nil {
+			return err
+		}
+
+		// chain_events_tip is the tip as of the last event. It starts out as
+		// the genesis block's parent, NULL, so the first call to
+		// recordChainEvents connects the whole best chain, including blocks
+		// added before the log was created.
+		if _, err := tx.Exec(`
+			CREATE TABLE IF NOT EXISTS chain_events_tip (
+				hash TEXT NULL
+			)
+		`); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(`
+			INSERT INTO chain_events_tip (hash)
+			SELECT ?
+			WHERE NOT EXISTS (SELECT 1 FROM chain_events_tip)
+		`, GenesisBlock.PreviousHash); err != nil {
+			return err
+		}
+
+		if err := recordChainEvents(tx); err != nil {
+			return err
+		}
+
 		return nil
 	})
 }
@@ -207,16 +658,18 @@ func (d *DB) BestBlock() (*Block, error) {
 	var b *Block
 	if err := d.db.TransactWithRetry(func(tx *sql.Tx) error {
 		var raw []byte
-		if err := tx.QueryRow(`
+		err := tx.QueryRow(`
 			SELECT block
 			FROM blocks
-			ORDER BY height DESC
+			ORDER BY work DESC, hash ASC
 			LIMIT 1
-		`).Scan(&raw); err != nil {
+		`).Scan(&raw)
+		if err == sql.ErrNoRows {
+			return ErrNoBlocks
+		} else if err != nil {
 			return err
 		}
 
-		var err error
 		b, err = DecodeBlock(raw)
 		return err
 	}); err != nil {
@@ -225,61 +678,243 @@ func (d *DB) BestBlock() (*Block, error) {
 	return b, nil
 }
 
-func (d *DB) Blocks() ([]Block, error) {
-	var blocks []Block
+// BlockByHash returns the block with the given hash, which needn't be on the
+// best chain, or ErrUnknownBlock.
+func (d *DB) BlockByHash(hash Hash) (*Block, error) {
+	var b *Block
 	if err := d.db.TransactWithRetry(func(tx *sql.Tx) error {
-		blocks = nil
+		var err error
+		b, err = blockByHash(tx, hash)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
 
-		rows, err := tx.Query(`
-			WITH RECURSIVE f (previous_hash, block) AS (
-				SELECT previous_hash, block FROM (
-					SELECT previous_hash, block
-					FROM blocks
-					ORDER BY height DESC
-					LIMIT 1
-				)
-				UNION
-				SELECT b.previous_hash, b.block
-				FROM blocks AS b
-				JOIN f ON f.previous_hash = b.hash
-			)
-			SELECT block FROM f;
-		`)
-		if err != nil {
-			return err
-		}
-		defer rows.Close()
+// Blocks returns up to limit blocks of the best chain, starting with the tip.
+// A limit of 0 returns the whole chain.
+func (d *DB) Blocks(limit int) ([]Block, error) {
+	var blocks []Block
+	if err := d.db.TransactModeWithRetry(database.Read, func(tx *sql.Tx) error {
+		var err error
+		blocks, err = bestChain(tx, limit)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return blocks, nil
+}
 
-		for rows.Next() {
-			var raw []byte
-			if err := rows.Scan(&raw); err != nil {
-				return err
-			}
+// MaxBlocksRange is the most blocks BlocksRange returns at once, so a page of
+// the chain fits comfortably in memory on both the node and its peer.
+const MaxBlocksRange = 500
 
-			b, err := DecodeBlock(raw)
-			if err != nil {
-				return err
-			}
-			blocks = append(blocks, *b)
-		}
+// BlocksRange returns up to limit blocks in the best chain, starting at height
+// from, in ascending height order. A limit of 0 or above MaxBlocksRange is
+// treated as MaxBlocksRange.
+func (d *DB) BlocksRange(from int64, limit int) ([]Block, error) {
+	if from < 0 {
+		return nil, errors.New("cryptopuff: negative height")
+	}
+	if limit <= 0 || limit > MaxBlocksRange {
+		limit = MaxBlocksRange
+	}
 
-		return rows.Err()
+	var blocks []Block
+	if err := d.db.TransactWithRetry(func(tx *sql.Tx) error {
+		var err error
+		blocks, err = blocksRange(tx, from, limit)
+		return err
 	}); err != nil {
 		return nil, err
 	}
 	return blocks, nil
 }
 
-func (d *DB) AddBlocks(blocks []Block) error {
-	return d.db.TransactWithRetry(func(tx *sql.Tx) error {
-		// find the index of the most recent block in the chain that is also in
-		// our local database
-		divergedAt := -1
+// blocksRange finds the best chain's block at the top of the range by walking
+// hashes down from the tip, without loading any blocks. It then loads every
+// block in the range, including those on forks, with the blocks_height index,
+// and keeps those on the best chain by following previous hashes down from the
+// top.
+func blocksRange(tx *sql.Tx, from int64, limit int) ([]Block, error) {
+	tip, err := bestBlockHash(tx)
+	if err != nil {
+		return nil, err
+	}
 
-		for i, block := range blocks {
-			var unused int
-			err := tx.QueryRow(`SELECT 1 FROM blocks WHERE hash = ?`, block.Hash).Scan(&unused)
-			if err == sql.ErrNoRows {
+	to := from + int64(limit) - 1
+	var top Hash
+	if err := tx.QueryRow(`
+		WITH RECURSIVE f (hash, previous_hash, height) AS (
+			SELECT hash, previous_hash, height
+			FROM blocks
+			WHERE hash = ?
+			UNION ALL
+			SELECT b.hash, b.previous_hash, b.height
+			FROM blocks AS b
+			JOIN f ON f.previous_hash = b.hash
+			WHERE f.height > ? AND b.height < f.height
+		)
+		SELECT hash FROM f ORDER BY height ASC LIMIT 1;
+	`, tip, to).Scan(&top); err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: failed to walk chain")
+	}
+
+	rows, err := tx.Query(`SELECT hash, block FROM blocks WHERE height >= ? AND height <= ?`, from, to)
+	if err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: failed to select blocks")
+	}
+	defer rows.Close()
+
+	raws := make(map[Hash][]byte)
+	for rows.Next() {
+		var (
+			hash Hash
+			raw  []byte
+		)
+		if err := rows.Scan(&hash, &raw); err != nil {
+			return nil, err
+		}
+		raws[hash] = raw
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var blocks []Block
+	for hash := top; ; {
+		raw, ok := raws[hash]
+		if !ok {
+			break
+		}
+		b, err := DecodeBlock(raw)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, *b)
+		hash = b.PreviousHash
+	}
+
+	for i, j := 0, len(blocks)-1; i < j; i, j = i+1, j-1 {
+		blocks[i], blocks[j] = blocks[j], blocks[i]
+	}
+	return blocks, nil
+}
+
+// ChainFrom returns the chain ending at tip, which needn't be the best block,
+// starting with the tip and ending with the genesis block, or after limit
+// blocks if limit isn't 0. It is useful for comparing competing forks.
+func (d *DB) ChainFrom(tip Hash, limit int) ([]Block, error) {
+	var blocks []Block
+	if err := d.db.TransactWithRetry(func(tx *sql.Tx) error {
+		var err error
+		blocks, err = chainFrom(tx, tip, limit)
+		if err != nil {
+			return err
+		}
+		if len(blocks) == 0 {
+			return ErrUnknownBlock
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return blocks, nil
+}
+
+// bestChain returns up to limit blocks in the best chain, or every block if
+// limit is 0, starting with the tip.
+func bestChain(tx *sql.Tx, limit int) ([]Block, error) {
+	tip, err := bestBlockHash(tx)
+	if err != nil {
+		return nil, err
+	}
+	return chainFrom(tx, tip, limit)
+}
+
+// ChainAbove returns the blocks in the chain ending at tip that are above the
+// given height, starting with the tip.
+func (d *DB) ChainAbove(tip Hash, height int64) ([]Block, error) {
+	var blocks []Block
+	if err := d.db.TransactWithRetry(func(tx *sql.Tx) error {
+		var err error
+		blocks, err = chainAbove(tx, tip, height, 0)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return blocks, nil
+}
+
+// chainFrom returns up to limit blocks in the chain ending at tip, or every
+// block if limit is 0, starting with the tip.
+func chainFrom(tx *sql.Tx, tip Hash, limit int) ([]Block, error) {
+	return chainAbove(tx, tip, -1, limit)
+}
+
+// chainAbove walks back from tip until it reaches the given height, or has
+// returned limit blocks if limit isn't 0. The walk also stops if a parent
+// isn't lower than its child, so a corrupt database can't make it loop.
+func chainAbove(tx *sql.Tx, tip Hash, height int64, limit int) ([]Block, error) {
+	rows, err := tx.Query(`
+		WITH RECURSIVE f (previous_hash, height, block, depth) AS (
+			SELECT previous_hash, height, block, 1
+			FROM blocks
+			WHERE hash = ? AND height > ?
+			UNION ALL
+			SELECT b.previous_hash, b.height, b.block, f.depth + 1
+			FROM blocks AS b
+			JOIN f ON f.previous_hash = b.hash
+			WHERE b.height > ? AND b.height < f.height AND (? = 0 OR f.depth < ?)
+		)
+		SELECT block FROM f;
+	`, tip, height, height, limit, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: failed to walk chain")
+	}
+	defer rows.Close()
+
+	var blocks []Block
+	for rows.Next() {
+		var raw []byte
+		if err := rows.Scan(&raw); err != nil {
+			return nil, err
+		}
+
+		b, err := DecodeBlock(raw)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, *b)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return blocks, nil
+}
+
+// AddBlocks adds a peer's chain, given newest first, from the point where it
+// diverges from ours. The chain is ignored unless its tip has strictly more
+// accumulated work than our best block, so a peer's competing chain with the
+// same work never makes us switch tips, however long it is.
+func (d *DB) AddBlocks(blocks []Block) error {
+	if len(blocks) == 0 {
+		return nil
+	}
+
+	// find the index of the most recent block in the chain that is also in
+	// our local database
+	divergedAt := -1
+
+	if err := d.db.TransactWithRetry(func(tx *sql.Tx) error {
+		divergedAt = -1
+
+		var ancestorWork int64
+		for i, block := range blocks {
+			err := tx.QueryRow(`SELECT work FROM blocks WHERE hash = ?`, block.Hash).Scan(&ancestorWork)
+			if err == sql.ErrNoRows {
 				continue
 			} else if err != nil {
 				return err
@@ -288,29 +923,168 @@ func (d *DB) AddBlocks(blocks []Block) error {
 			divergedAt = i
 			break
 		}
-
 		if divergedAt <= 0 {
-			// ignore this chain, there is no common ancestor
 			return nil
 		}
 
+		var bestWork int64
+		if err := tx.QueryRow(`
+			SELECT work
+			FROM blocks
+			ORDER BY work DESC, hash ASC
+			LIMIT 1
+		`).Scan(&bestWork); err != nil && err != sql.ErrNoRows {
+			return err
+		}
+
+		work := ancestorWork
 		for i := divergedAt - 1; i >= 0; i-- {
-			block := &blocks[i]
-			if err := addBlock(tx, block); err != nil {
+			var ok bool
+			work, ok = overflow.Add64(work, blocks[i].Work())
+			if !ok {
+				return InvalidBlockError{Message: "cryptopuff: cumulative chain work overflows"}
+			}
+		}
+		if work <= bestWork {
+			// no more work than our chain, so it can't become the tip
+			divergedAt = -1
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if divergedAt <= 0 {
+		// ignore this chain, there is no common ancestor or it has too little
+		// work
+		return nil
+	}
+
+	// Commit the new blocks oldest first, in batches of at most
+	// maxInflightBlocks, so the write lock isn't held for the whole import.
+	for end := divergedAt; end > 0; end -= d.maxInflightBlocks {
+		start := end - d.maxInflightBlocks
+		if start < 0 {
+			start = 0
+		}
+
+		if err := d.db.TransactWithRetry(func(tx *sql.Tx) error {
+			for i := end - 1; i >= start; i-- {
+				block := &blocks[i]
+				if err := d.addBlock(tx, block); err != nil {
+					return err
+				}
+			}
+			if err := recordChainEvents(tx); err != nil {
 				return err
 			}
+			return d.pruneBalances(tx)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NextTarget returns the target of the next block on top of previous.
+func (d *DB) NextTarget(previous *Block) (Target, error) {
+	var target Target
+	if err := d.db.TransactWithRetry(func(tx *sql.Tx) error {
+		ancestors, err := retargetAncestors(tx, previous)
+		if err != nil {
+			return err
 		}
+		target = TargetForHeight(ancestors)
 		return nil
-	})
+	}); err != nil {
+		return 0, err
+	}
+	return target, nil
+}
+
+// retargetAncestors returns the ancestors TargetForHeight needs for the block
+// after previous: just previous, unless that block is at a retarget height.
+func retargetAncestors(tx *sql.Tx, previous *Block) ([]Block, error) {
+	if retargetWindow(previous.Height+1) == 1 {
+		return []Block{*previous}, nil
+	}
+	return chainFrom(tx, previous.Hash, RetargetInterval)
+}
+
+// blockDustThreshold returns the dust threshold enforced on transactions in
+// blocks, which is zero unless strict mode is enabled.
+func (d *DB) blockDustThreshold() int64 {
+	if d.strictDust {
+		return d.dustThreshold
+	}
+	return 0
 }
 
-func addBlock(tx *sql.Tx, block *Block) error {
+func (d *DB) addBlock(tx *sql.Tx, block *Block) error {
+	if err := plausibleBlockRate(tx, block, d.maxBlockRate); err != nil {
+		return err
+	}
+	return addBlock(tx, block, d.blockDustThreshold())
+}
+
+// plausibleBlockRate checks the block wasn't mined implausibly soon after
+// its ancestor blockRateWindow blocks back. Blocks without timestamps can't
+// be checked.
+func plausibleBlockRate(tx *sql.Tx, block *Block, maxRate int) error {
+	ancestorHeight := block.Height - blockRateWindow
+	if maxRate <= 0 || block.Timestamp == 0 || ancestorHeight < 0 {
+		return nil
+	}
+
 	var raw []byte
 	err := tx.QueryRow(`
-		SELECT block
+		WITH RECURSIVE f (hash, previous_hash, height) AS (
+			SELECT hash, previous_hash, height
+			FROM blocks
+			WHERE hash = ?
+			UNION
+			SELECT b.hash, b.previous_hash, b.height
+			FROM blocks AS b
+			JOIN f ON f.previous_hash = b.hash
+			WHERE f.height > ?
+		)
+		SELECT b.block
+		FROM f
+		JOIN blocks b ON b.hash = f.hash
+		WHERE f.height = ?
+	`, block.PreviousHash, ancestorHeight, ancestorHeight).Scan(&raw)
+	if err == sql.ErrNoRows {
+		// the parent is unknown, which addBlock reports
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	ancestor, err := DecodeBlock(raw)
+	if err != nil {
+		return err
+	}
+	if ancestor.Timestamp == 0 {
+		return nil
+	}
+
+	elapsed := block.Timestamp - ancestor.Timestamp
+	if minimum := int64(blockRateWindow * 60 / maxRate); elapsed < minimum {
+		return InvalidBlockError{Message: fmt.Sprintf("cryptopuff: %v blocks mined in %vs, faster than the maximum of %v per minute", blockRateWindow, elapsed, maxRate)}
+	}
+	return nil
+}
+
+func addBlock(tx *sql.Tx, block *Block, dustThreshold int64) error {
+	var (
+		raw          []byte
+		previousWork int64
+	)
+	err := tx.QueryRow(`
+		SELECT block, work
 		FROM blocks
 		WHERE hash = ?
-	`, block.PreviousHash).Scan(&raw)
+	`, block.PreviousHash).Scan(&raw, &previousWork)
 	if err == sql.ErrNoRows {
 		return ErrUnknownParent
 	} else if err != nil {
@@ -322,14 +1096,19 @@ func addBlock(tx *sql.Tx, block *Block) error {
 		return err
 	}
 
+	work, ok := overflow.Add64(previousWork, block.Work())
+	if !ok {
+		return InvalidBlockError{Message: "cryptopuff: cumulative chain work overflows"}
+	}
+
 	raw, err = json.Marshal(block)
 	if err != nil {
 		return err
 	}
 	if _, err := tx.Exec(`
-		INSERT INTO blocks (hash, previous_hash, height, block)
-		VALUES (?, ?, ?, ?)
-	`, block.Hash, block.PreviousHash, block.Height, raw); err != nil {
+		INSERT INTO blocks (hash, previous_hash, height, block, miner, work)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, block.Hash, block.PreviousHash, block.Height, raw, block.RewardOutput.Destination, work); err != nil {
 		if serr, ok := err.(sqlite3.Error); ok {
 			if serr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey {
 				// the block already exists in our database, so let's
@@ -340,6 +1119,15 @@ func addBlock(tx *sql.Tx, block *Block) error {
 		return err
 	}
 
+	// a fork off a block whose balances were pruned can't be validated
+	var unused int
+	err = tx.QueryRow(`SELECT 1 FROM pruned_balances WHERE block_hash = ?`, block.PreviousHash).Scan(&unused)
+	if err == nil {
+		return errors.Wrapf(ErrPruned, "cryptopuff: can't add block %v", block.Hash)
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+
 	if _, err := tx.Exec(`
 		INSERT INTO balances (block_hash, address, balance)
 		SELECT ?, address, balance
@@ -349,6 +1137,15 @@ func addBlock(tx *sql.Tx, block *Block) error {
 		return err
 	}
 
+	if _, err := tx.Exec(`
+		INSERT INTO immature_rewards (block_hash, height, address, amount)
+		SELECT ?, height, address, amount
+		FROM immature_rewards
+		WHERE block_hash = ? AND height > ?
+	`, block.Hash, block.PreviousHash, block.Height-CoinbaseMaturity); err != nil {
+		return err
+	}
+
 	if _, err := tx.Exec(`
 		INSERT INTO included_txs (block_hash, tx_hash)
 		SELECT ?, tx_hash
@@ -358,15 +1155,34 @@ func addBlock(tx *sql.Tx, block *Block) error {
 		return err
 	}
 
-	if err := block.Valid(previous); err != nil {
+	ancestors, err := retargetAncestors(tx, previous)
+	if err != nil {
+		return err
+	}
+	if err := block.Valid(ancestors); err != nil {
 		return err
 	}
 
-	fee := block.RewardOutput.Amount
-	for _, stx := range block.Transactions {
-		fee += stx.Fee
+	payout, err := block.Payout()
+	if err != nil {
+		return InvalidBlockError{Message: "cryptopuff: invalid payout", Cause: err}
+	}
 
-		if err := validTx(tx, &stx, block.Hash); err != nil {
+	for i, stx := range block.Transactions {
+		err := validTx(tx, &stx, block.Hash, 0)
+		if err == nil {
+			if dustErr := stx.ValidDust(dustThreshold); dustErr != nil {
+				err = InvalidBlockError{Message: "cryptopuff: dust transaction", Cause: dustErr}
+			}
+		}
+		if err == nil {
+			if expiryErr := stx.ValidExpiry(block.Height); expiryErr != nil {
+				err = InvalidBlockError{Message: "cryptopuff: expired transaction", Cause: expiryErr}
+			}
+		}
+		if _, ok := err.(InvalidBlockError); ok {
+			return invalidBlockTxError(block, i, err)
+		} else if err != nil {
 			return err
 		}
 
@@ -391,6 +1207,12 @@ func addBlock(tx *sql.Tx, block *Block) error {
 			return err
 		}
 
+		// a mined transaction's public key is public, so it may be relayed
+		// like any other if a reorg returns it to the mempool
+		if _, err := tx.Exec(`UPDATE txs SET private = 0 WHERE hash = ? AND private != 0`, stx.Hash); err != nil {
+			return err
+		}
+
 		if _, err := tx.Exec(`
 			INSERT INTO included_txs (block_hash, tx_hash)
 			VALUES (?, ?)
@@ -406,304 +1228,339 @@ func addBlock(tx *sql.Tx, block *Block) error {
 		}
 	}
 
-	if fee > 0 {
+	if payout > 0 {
 		if _, err := tx.Exec(`
 			INSERT INTO balances (block_hash, address, balance)
 			VALUES (?, ?, ?)
 			ON CONFLICT (block_hash, address) DO UPDATE
 			SET balance = balance + excluded.balance
-		`, block.Hash, block.RewardOutput.Destination, fee); err != nil {
+		`, block.Hash, block.RewardOutput.Destination, payout); err != nil {
 			return err
 		}
+
+		if block.Version >= BlockVersion3 {
+			if _, err := tx.Exec(`
+				INSERT INTO immature_rewards (block_hash, height, address, amount)
+				VALUES (?, ?, ?, ?)
+			`, block.Hash, block.Height, block.RewardOutput.Destination, payout); err != nil {
+				return err
+			}
+		}
 	}
 
 	_, err = tx.Exec(`DELETE FROM balances WHERE balance = 0`)
 	return err
 }
 
-func (d *DB) AddBlock(block *Block) error {
+// SaveOrphans replaces the saved orphan blocks, so that blocks waiting for
+// their parent survive a restart. They aren't validated until TakeOrphans
+// returns them.
+func (d *DB) SaveOrphans(blocks []*Block) error {
 	return d.db.TransactWithRetry(func(tx *sql.Tx) error {
-		return addBlock(tx, block)
+		if _, err := tx.Exec(`DELETE FROM orphans`); err != nil {
+			return err
+		}
+
+		for i, b := range blocks {
+			raw, err := json.Marshal(b)
+			if err != nil {
+				return err
+			}
+
+			if _, err := tx.Exec(`
+				INSERT OR IGNORE INTO orphans (hash, seq, block)
+				VALUES (?, ?, ?)
+			`, b.Hash, i, raw); err != nil {
+				return err
+			}
+		}
+		return nil
 	})
 }
 
-func (d *DB) Addresses() ([]AddressState, error) {
-	var addrs []AddressState
+// TakeOrphans removes and returns the orphan blocks saved by SaveOrphans, in
+// the order they were saved.
+func (d *DB) TakeOrphans() ([]*Block, error) {
+	var blocks []*Block
 	if err := d.db.TransactWithRetry(func(tx *sql.Tx) error {
-		addrs = nil
+		blocks = nil
 
-		rows, err := tx.Query(`
-			SELECT k.address, k.private_key, COALESCE(b.balance, 0)
-			FROM keys k
-			LEFT JOIN balances b ON b.address = k.address AND b.block_hash = (
-				SELECT hash
-				FROM blocks
-				ORDER BY height DESC
-				LIMIT 1
-			)
-		`)
+		rows, err := tx.Query(`SELECT block FROM orphans ORDER BY seq ASC`)
 		if err != nil {
 			return err
 		}
 		defer rows.Close()
 
 		for rows.Next() {
-			var (
-				a       Address
-				b       []byte
-				balance int64
-			)
-			if err := rows.Scan(&a, &b, &balance); err != nil {
+			var raw []byte
+			if err := rows.Scan(&raw); err != nil {
 				return err
 			}
 
-			k, err := DecodePrivateKeyPEM(b)
+			b, err := DecodeBlock(raw)
 			if err != nil {
 				return err
 			}
+			blocks = append(blocks, b)
+		}
 
-			addrs = append(addrs, AddressState{
-				Address:   a,
-				PublicKey: x509.MarshalPKCS1PublicKey(&k.PublicKey),
-				Balance:   balance,
-			})
+		if err := rows.Err(); err != nil {
+			return err
 		}
 
-		return rows.Err()
+		_, err = tx.Exec(`DELETE FROM orphans`)
+		return err
 	}); err != nil {
 		return nil, err
 	}
-	return addrs, nil
+	return blocks, nil
 }
 
-func addKey(tx *sql.Tx, a Address, k *rsa.PrivateKey) error {
-	_, err := tx.Exec(`
-		INSERT OR IGNORE INTO keys (address, private_key)
-		VALUES (?, ?)
-	`, a, EncodePrivateKeyPEM(k))
-	return err
+func (d *DB) AddBlock(block *Block) error {
+	return d.db.TransactWithRetry(func(tx *sql.Tx) error {
+		if err := d.addBlock(tx, block); err != nil {
+			return err
+		}
+		if err := recordChainEvents(tx); err != nil {
+			return err
+		}
+		return d.pruneBalances(tx)
+	})
 }
 
-func (d *DB) AddKey(version Version, k *rsa.PrivateKey) (Address, error) {
-	a := AddressFromKey(version, &k.PublicKey)
-	if err := d.db.TransactWithRetry(func(tx *sql.Tx) error {
-		return addKey(tx, a, k)
-	}); err != nil {
-		return nil, err
-	}
-	return a, nil
-}
+// AddBlockOnTip adds a block only if its parent is still the best block,
+// returning ErrStaleTip otherwise. The miner uses it so that a block assembled
+// against a tip that has since been replaced is discarded instead of being
+// added as an immediately orphaned fork.
+func (d *DB) AddBlockOnTip(block *Block) error {
+	return d.db.TransactWithRetry(func(tx *sql.Tx) error {
+		tip, err := bestBlockHash(tx)
+		if err != nil {
+			return err
+		}
+		if tip != block.PreviousHash {
+			return ErrStaleTip
+		}
 
-func (d *DB) Key(a Address) (*rsa.PrivateKey, error) {
-	var k *rsa.PrivateKey
-	if err := d.db.TransactWithRetry(func(tx *sql.Tx) error {
-		var b []byte
-		if err := tx.QueryRow(`SELECT private_key FROM keys WHERE address = ?`, a).Scan(&b); err != nil {
+		if err := d.addBlock(tx, block); err != nil {
 			return err
 		}
+		if err := recordChainEvents(tx); err != nil {
+			return err
+		}
+		return d.pruneBalances(tx)
+	})
+}
 
-		var err error
-		k, err = DecodePrivateKeyPEM(b)
+// pruneBalances drops the balances of blocks more than the balance history
+// below the tip, unless the node is an archive node. Only blocks above the
+// previous high-water mark are considered, so each call does work
+// proportional to the number of blocks added since the last one.
+func (d *DB) pruneBalances(tx *sql.Tx) error {
+	if d.archive {
+		return nil
+	}
+
+	// The horizon is measured from the best block, not the highest: a
+	// longer fork with less work mustn't get the best chain's recent
+	// balances pruned.
+	var tipHeight, prunedHeight int64
+	if err := tx.QueryRow(`
+		SELECT
+			(SELECT height FROM blocks ORDER BY work DESC, hash ASC LIMIT 1),
+			COALESCE((SELECT MAX(height) FROM pruned_balances), -1)
+	`).Scan(&tipHeight, &prunedHeight); err != nil {
 		return err
-	}); err != nil {
-		return nil, err
 	}
-	return k, nil
-}
 
-func (d *DB) MinerAddress() (Address, error) {
-	var a Address
-	if err := d.db.TransactWithRetry(func(tx *sql.Tx) error {
-		return tx.QueryRow(`SELECT address FROM miner_address`).Scan(&a)
-	}); err != nil {
-		return nil, err
+	below := tipHeight - d.balanceHistory
+	if below <= prunedHeight+1 {
+		return nil
 	}
-	return a, nil
-}
 
-func (d *DB) SetMinerAddress(a Address) error {
-	return d.db.TransactWithRetry(func(tx *sql.Tx) error {
-		_, err := tx.Exec(`UPDATE miner_address SET address = ?`, a)
-		return err
-	})
-}
-
-func validTx(tx *sql.Tx, stx *SignedTx, tip Hash) error {
-	if err := stx.Valid(); err != nil {
-		return err
-	}
-
-	var balance int64
-	err := tx.QueryRow(`
-		SELECT balance
-		FROM balances
-		WHERE block_hash = ? AND address = ?
-	`, tip, stx.Source).Scan(&balance)
-	if err == sql.ErrNoRows {
-		balance = 0
-	} else if err != nil {
-		return err
-	}
-
-	if balance < stx.RequiredBalance() {
-		return InvalidBlockError{Message: fmt.Sprintf("cryptopuff: insufficient balance (%v coins, %v required)", balance, stx.RequiredBalance())}
-	}
-
-	var unused int64
-	err = tx.QueryRow(`
-		SELECT 1
-		FROM included_txs
-		WHERE block_hash = ? AND tx_hash = ?
-	`, tip, stx.Hash).Scan(&unused)
-	if err == sql.ErrNoRows {
-		/* ok */
-	} else if err != nil {
-		return err
-	} else {
-		return InvalidBlockError{Message: "cryptopuff: transaction already included in blockchain"}
-	}
-
-	return nil
-}
-
-func validTemporaryTx(tx *sql.Tx, stx *SignedTx) error {
-	if err := stx.Valid(); err != nil {
-		return err
-	}
-
-	var balance int64
-	err := tx.QueryRow(`
-		SELECT balance
-		FROM temp_balances
-		WHERE address = ?
-	`, stx.Source).Scan(&balance)
-	if err == sql.ErrNoRows {
-		balance = 0
-	} else if err != nil {
-		return err
-	}
-
-	if balance < stx.RequiredBalance() {
-		return InvalidBlockError{Message: fmt.Sprintf("cryptopuff: insufficient balance (%v coins, %v required)", balance, stx.RequiredBalance())}
-	}
-
-	return nil
-}
-
-func bestBlockHash(tx *sql.Tx) (Hash, error) {
-	var tip Hash
-	if err := tx.QueryRow(`
-		SELECT hash
+	if _, err := tx.Exec(`
+		INSERT OR IGNORE INTO pruned_balances (block_hash, height)
+		SELECT hash, height
 		FROM blocks
-		ORDER BY height DESC
-		LIMIT 1
-	`).Scan(&tip); err != nil {
-		return EmptyHash, err
+		WHERE height > ? AND height < ?
+	`, prunedHeight, below); err != nil {
+		return err
 	}
-	return tip, nil
-}
 
-func addTx(tx *sql.Tx, stx *SignedTx) error {
-	b, err := json.Marshal(stx)
-	if err != nil {
+	if _, err := tx.Exec(`
+		DELETE FROM balances
+		WHERE block_hash IN (
+			SELECT hash
+			FROM blocks
+			WHERE height > ? AND height < ?
+		)
+	`, prunedHeight, below); err != nil {
 		return err
 	}
 
-	_, err = tx.Exec(`
-		INSERT OR IGNORE INTO txs (hash, source, destination, amount, fee, tx)
-		VALUES (?, ?, ?, ?, ?, ?)
-	`, stx.Hash, stx.Source, stx.Destination, stx.Amount, stx.Fee, b)
+	_, err := tx.Exec(`
+		DELETE FROM immature_rewards
+		WHERE block_hash IN (
+			SELECT hash
+			FROM blocks
+			WHERE height > ? AND height < ?
+		)
+	`, prunedHeight, below)
 	return err
 }
 
-func (d *DB) AddTx(stx *SignedTx) error {
-	return d.db.TransactWithRetry(func(tx *sql.Tx) error {
+// AddressActivity returns the balance of a at the tip along with the number of
+// transactions to or from it and blocks mined to it in the best chain, and the
+// heights of the first and last of them.
+func (d *DB) AddressActivity(a Address) (*AddressActivity, error) {
+	var activity *AddressActivity
+	if err := d.db.TransactWithRetry(func(tx *sql.Tx) error {
+		activity = &AddressActivity{Address: a}
+
 		tip, err := bestBlockHash(tx)
 		if err != nil {
 			return err
 		}
 
-		if err := validTx(tx, stx, tip); err != nil {
+		err = tx.QueryRow(`
+			SELECT balance
+			FROM balances
+			WHERE block_hash = ? AND address = ?
+		`, tip, a).Scan(&activity.Balance)
+		if err != nil && err != sql.ErrNoRows {
 			return err
 		}
 
-		return addTx(tx, stx)
-	})
+		var first, last sql.NullInt64
+		if err := tx.QueryRow(`
+			WITH RECURSIVE f (hash, previous_hash, height) AS (
+				SELECT hash, previous_hash, height
+				FROM blocks
+				WHERE hash = ?1
+				UNION
+				SELECT b.hash, b.previous_hash, b.height
+				FROM blocks AS b
+				JOIN f ON f.previous_hash = b.hash
+			),
+			a (tx_hash, height) AS (
+				SELECT t.hash, f.height
+				FROM txs t
+				JOIN block_txs bt ON bt.tx_hash = t.hash
+				JOIN f ON f.hash = bt.block_hash
+				WHERE t.source = ?2 OR t.destination = ?2
+				UNION ALL
+				SELECT NULL, f.height
+				FROM blocks b
+				JOIN f ON f.hash = b.hash
+				WHERE b.miner = ?2
+			)
+			SELECT COUNT(DISTINCT tx_hash), COUNT(*) - COUNT(tx_hash), MIN(height), MAX(height)
+			FROM a
+		`, tip, a).Scan(&activity.TxCount, &activity.BlocksMined, &first, &last); err != nil {
+			return err
+		}
+		if first.Valid {
+			activity.FirstHeight = &first.Int64
+			activity.LastHeight = &last.Int64
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return activity, nil
 }
 
-func (d *DB) MyTxs() ([]PersonalTx, error) {
-	var ptxs []PersonalTx
+// BlocksByMiner returns up to limit blocks in the best chain whose reward was
+// paid to a, highest first, skipping the first offset of them. Blocks on
+// stale forks are left out, as their rewards were never credited.
+func (d *DB) BlocksByMiner(a Address, limit, offset int) ([]Block, error) {
+	var blocks []Block
 	if err := d.db.TransactWithRetry(func(tx *sql.Tx) error {
-		ptxs = nil
+		blocks = nil
 
-		hash, err := bestBlockHash(tx)
+		tip, err := bestBlockHash(tx)
 		if err != nil {
 			return err
 		}
 
 		rows, err := tx.Query(`
-			SELECT DISTINCT
-				t.tx,
-				i.tx_hash IS NOT NULL AS included,
-				b.height
-			FROM txs t
-			JOIN keys k ON k.address = t.source OR k.address = t.destination
-			LEFT JOIN included_txs i ON i.tx_hash = t.hash AND i.block_hash = ?
-			LEFT JOIN block_txs bt ON bt.tx_hash = t.hash
-			LEFT JOIN blocks b ON b.hash = bt.block_hash
-			ORDER BY included ASC, b.height DESC
-		`, hash)
+			WITH RECURSIVE f (hash, previous_hash, height) AS (
+				SELECT hash, previous_hash, height
+				FROM blocks
+				WHERE hash = ?
+				UNION
+				SELECT b.hash, b.previous_hash, b.height
+				FROM blocks AS b
+				JOIN f ON f.previous_hash = b.hash
+			)
+			SELECT b.block
+			FROM blocks b
+			JOIN f ON f.hash = b.hash
+			WHERE b.miner = ?
+			ORDER BY b.height DESC
+			LIMIT ? OFFSET ?
+		`, tip, a, limit, offset)
 		if err != nil {
 			return err
 		}
 		defer rows.Close()
 
 		for rows.Next() {
-			var (
-				b        []byte
-				included bool
-				height   sql.NullInt64
-			)
-			if err := rows.Scan(&b, &included, &height); err != nil {
+			var b []byte
+			if err := rows.Scan(&b); err != nil {
 				return err
 			}
 
-			var stx SignedTx
-			if err := json.Unmarshal(b, &stx); err != nil {
-				return err
-			}
-			if err := stx.UpdateHash(); err != nil {
+			block, err := DecodeBlock(b)
+			if err != nil {
 				return err
 			}
-			ptxs = append(ptxs, PersonalTx{
-				SignedTx: stx,
-				Included: included,
-				Height:   height.Int64,
-			})
+			blocks = append(blocks, *block)
 		}
 
 		return rows.Err()
 	}); err != nil {
 		return nil, err
 	}
-	return ptxs, nil
+	return blocks, nil
 }
 
-func (d *DB) AllPendingTxs() ([]SignedTx, error) {
-	var stxs []SignedTx
+// BalancesAt returns every non-zero balance at the given block, keyed by
+// address, or at the best block if tip is EmptyHash. Pruned nodes return
+// ErrPruned for old blocks.
+func (d *DB) BalancesAt(tip Hash) (map[string]int64, error) {
+	var balances map[string]int64
 	if err := d.db.TransactWithRetry(func(tx *sql.Tx) error {
-		stxs = nil
+		balances = make(map[string]int64)
 
-		tip, err := bestBlockHash(tx)
-		if err != nil {
+		if tip == EmptyHash {
+			var err error
+			tip, err = bestBlockHash(tx)
+			if err != nil {
+				return err
+			}
+		} else {
+			var unused int
+			err := tx.QueryRow(`SELECT 1 FROM blocks WHERE hash = ?`, tip).Scan(&unused)
+			if err == sql.ErrNoRows {
+				return ErrUnknownBlock
+			} else if err != nil {
+				return err
+			}
+		}
+
+		var unused int
+		err := tx.QueryRow(`SELECT 1 FROM pruned_balances WHERE block_hash = ?`, tip).Scan(&unused)
+		if err == nil {
+			return ErrPruned
+		} else if err != sql.ErrNoRows {
 			return err
 		}
 
 		rows, err := tx.Query(`
-			SELECT tx
-			FROM txs t
-			LEFT JOIN included_txs i ON i.tx_hash = t.hash AND i.block_hash = ?
-			WHERE i.tx_hash IS NULL
+			SELECT address, balance
+			FROM balances
+			WHERE block_hash = ? AND balance != 0
 		`, tip)
 		if err != nil {
 			return err
@@ -711,143 +1568,1886 @@ func (d *DB) AllPendingTxs() ([]SignedTx, error) {
 		defer rows.Close()
 
 		for rows.Next() {
-			var b []byte
-			if err := rows.Scan(&b); err != nil {
-				return err
-			}
-
-			var stx SignedTx
-			if err := json.Unmarshal(b, &stx); err != nil {
-				return err
-			}
-			if err := stx.UpdateHash(); err != nil {
+			var (
+				a       Address
+				balance int64
+			)
+			if err := rows.Scan(&a, &balance); err != nil {
 				return err
 			}
-			stxs = append(stxs, stx)
+			balances[a.String()] = balance
 		}
 
 		return rows.Err()
 	}); err != nil {
 		return nil, err
 	}
-	return stxs, nil
+	return balances, nil
 }
 
-func (d *DB) PendingTxs(tip Hash, limit int) ([]SignedTx, error) {
-	var stxs []SignedTx
+// BalanceAt returns the balance of a at the given height of the best chain.
+// Pruned nodes return ErrPruned for heights more than the balance history
+// below the tip.
+func (d *DB) BalanceAt(a Address, height int64) (int64, error) {
+	var balance int64
 	if err := d.db.TransactWithRetry(func(tx *sql.Tx) error {
-		stxs = nil
+		balance = 0
 
-		if _, err := tx.Exec(`DROP TABLE IF EXISTS temp_balances`); err != nil {
+		tip, err := bestBlockHash(tx)
+		if err != nil {
 			return err
 		}
 
-		if _, err := tx.Exec(`
-			CREATE TEMPORARY TABLE temp_balances (
-				address TEXT PRIMARY KEY NOT NULL,
-				balance INTEGER NOT NULL
+		var hash Hash
+		err = tx.QueryRow(`
+			WITH RECURSIVE f (hash, previous_hash, height) AS (
+				SELECT hash, previous_hash, height
+				FROM blocks
+				WHERE hash = ?
+				UNION
+				SELECT b.hash, b.previous_hash, b.height
+				FROM blocks AS b
+				JOIN f ON f.previous_hash = b.hash
+				WHERE f.height > ?
 			)
-		`); err != nil {
+			SELECT hash
+			FROM f
+			WHERE height = ?
+		`, tip, height, height).Scan(&hash)
+		if err == sql.ErrNoRows {
+			return ErrNoSuchHeight
+		} else if err != nil {
 			return err
 		}
 
-		if _, err := tx.Exec(`
-			INSERT INTO temp_balances (address, balance)
-			SELECT address, balance
-			FROM balances
-			WHERE block_hash = ?
-		`, tip); err != nil {
+		var unused int
+		err = tx.QueryRow(`SELECT 1 FROM pruned_balances WHERE block_hash = ?`, hash).Scan(&unused)
+		if err == nil {
+			return ErrPruned
+		} else if err != sql.ErrNoRows {
 			return err
 		}
 
-		rows, err := tx.Query(`
-			SELECT tx
-			FROM txs t
-			LEFT JOIN included_txs i ON i.tx_hash = t.hash AND i.block_hash = ?
-			WHERE i.tx_hash IS NULL
-		`, tip)
+		balance, err = balanceAt(tx, hash, a)
+		return err
+	}); err != nil {
+		return 0, err
+	}
+	return balance, nil
+}
+
+// Balance returns the balance of a at the best block, which is zero for an
+// address that has never held coins.
+func (d *DB) Balance(a Address) (int64, error) {
+	var balance int64
+	if err := d.db.TransactWithRetry(func(tx *sql.Tx) error {
+		tip, err := bestBlockHash(tx)
 		if err != nil {
 			return err
 		}
-		defer rows.Close()
-
-		for rows.Next() {
-			var b []byte
-			if err := rows.Scan(&b); err != nil {
-				return err
-			}
-
-			var stx SignedTx
-			if err := json.Unmarshal(b, &stx); err != nil {
-				return err
-			}
-			if err := stx.UpdateHash(); err != nil {
-				return err
-			}
-
-			// Re-validate the transaction - the source balance could have
-			// changed.
-			err := validTemporaryTx(tx, &stx)
-			if _, ok := err.(InvalidBlockError); ok {
-				if _, err := tx.Exec(`
-					DELETE FROM txs
-					WHERE hash = ?
-					AND NOT EXISTS (
-						SELECT 1
-						FROM block_txs
-						WHERE tx_hash = ?
-					)
-					AND NOT EXISTS (
-						SELECT 1
-						FROM included_txs
-						WHERE tx_hash = ?
-					)
-				`, stx.Hash, stx.Hash, stx.Hash); err != nil {
-					return err
-				}
-				continue
-			} else if err != nil {
-				return err
-			}
-			stxs = append(stxs, stx)
-
-			if _, err := tx.Exec(`
-				UPDATE temp_balances
-				SET balance = balance - ?
-				WHERE address = ?
-			`, stx.RequiredBalance(), stx.Source); err != nil {
-				return err
-			}
 
-			if _, err := tx.Exec(`
-				INSERT INTO temp_balances (address, balance)
-				VALUES (?, ?)
-				ON CONFLICT (address) DO UPDATE
-				SET balance = balance + excluded.balance
-			`, stx.Destination, stx.Amount); err != nil {
-				return err
-			}
+		balance, err = balanceAt(tx, tip, a)
+		return err
+	}); err != nil {
+		return 0, err
+	}
+	return balance, nil
+}
 
-			if len(stxs) >= limit {
-				break
-			}
-		}
+func balanceAt(tx *sql.Tx, block Hash, a Address) (int64, error) {
+	var balance int64
+	err := tx.QueryRow(`
+		SELECT balance
+		FROM balances
+		WHERE block_hash = ? AND address = ?
+	`, block, a).Scan(&balance)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return balance, err
+}
 
-		if err := rows.Err(); err != nil {
+func (d *DB) Addresses() ([]AddressState, error) {
+	var addrs []AddressState
+	if err := d.db.TransactModeWithRetry(database.Read, func(tx *sql.Tx) error {
+		tip, err := bestBlockHash(tx)
+		if err != nil {
 			return err
 		}
 
-		_, err = tx.Exec(`DROP TABLE temp_balances`)
+		addrs, err = addresses(tx, tip)
 		return err
 	}); err != nil {
 		return nil, err
 	}
-	return stxs, nil
+	return addrs, nil
 }
 
-func (d *DB) Peers() ([]string, error) {
-	var peers []string
+// RichList returns the limit addresses with the highest balances at the best
+// block, highest first. Addresses without a balance aren't included.
+func (d *DB) RichList(limit int) ([]AddressState, error) {
+	var addrs []AddressState
 	if err := d.db.TransactWithRetry(func(tx *sql.Tx) error {
+		tip, err := bestBlockHash(tx)
+		if err != nil {
+			return err
+		}
+
+		rows, err := tx.Query(`
+			SELECT address, balance
+			FROM balances
+			WHERE block_hash = ? AND balance > 0
+			ORDER BY balance DESC, address ASC
+			LIMIT ?
+		`, tip, limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		addrs = nil
+		for rows.Next() {
+			var state AddressState
+			if err := rows.Scan(&state.Address, &state.Balance); err != nil {
+				return err
+			}
+			addrs = append(addrs, state)
+		}
+		return rows.Err()
+	}); err != nil {
+		return nil, err
+	}
+	return addrs, nil
+}
+
+func addresses(tx *sql.Tx, tip Hash) ([]AddressState, error) {
+	rows, err := tx.Query(`
+		SELECT k.address, k.private_key, COALESCE(b.balance, 0)
+		FROM keys k
+		LEFT JOIN balances b ON b.address = k.address AND b.block_hash = ?
+	`, tip)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var addrs []AddressState
+	for rows.Next() {
+		var (
+			a       Address
+			b       []byte
+			balance int64
+		)
+		if err := rows.Scan(&a, &b, &balance); err != nil {
+			return nil, err
+		}
+
+		k, err := decodeWalletKeyPEM(a, b)
+		if err != nil {
+			return nil, err
+		}
+		pub, err := k.publicKeyDER()
+		if err != nil {
+			return nil, err
+		}
+
+		addrs = append(addrs, AddressState{
+			Address:   a,
+			PublicKey: pub,
+			Balance:   balance,
+		})
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return addrs, nil
+}
+
+// Rescan re-derives the balance of every wallet address at the tip by
+// replaying the best chain, and restores any of the chain's transactions
+// missing from the txs table. This is useful after importing a key with
+// existing on-chain activity. The replayed balances are returned, not written
+// back: the balances table is consensus state that only addBlock maintains.
+// A replayed balance that disagrees with it is logged.
+func (d *DB) Rescan() ([]AddressState, error) {
+	var addrs []AddressState
+	if err := d.db.TransactWithRetry(func(tx *sql.Tx) error {
+		tip, err := bestBlockHash(tx)
+		if err != nil {
+			return err
+		}
+
+		addrs, err = addresses(tx, tip)
+		if err != nil {
+			return err
+		}
+
+		balances := make(map[string]int64)
+		for _, addr := range addrs {
+			balances[addr.Address.String()] = 0
+		}
+
+		blocks, err := bestChain(tx, 0)
+		if err != nil {
+			return err
+		}
+
+		credit := func(a Address, amount int64) {
+			if _, ok := balances[a.String()]; ok {
+				balances[a.String()] += amount
+			}
+		}
+
+		for _, block := range blocks {
+			payout, err := block.Payout()
+			if err != nil {
+				return err
+			}
+
+			for i := range block.Transactions {
+				stx := &block.Transactions[i]
+				credit(stx.Source, -stx.RequiredBalance())
+				credit(stx.Destination, stx.Amount)
+
+				if err := addTx(tx, stx); err != nil {
+					return err
+				}
+
+				if _, err := tx.Exec(`
+					INSERT OR IGNORE INTO block_txs (block_hash, tx_hash)
+					VALUES (?, ?)
+				`, block.Hash, stx.Hash); err != nil {
+					return err
+				}
+			}
+			credit(block.RewardOutput.Destination, payout)
+		}
+
+		for i := range addrs {
+			addr := &addrs[i]
+			balance := balances[addr.Address.String()]
+			if balance != addr.Balance {
+				d.logger.Printf("cryptopuff: rescanned balance of %v is %v, but the chain state has %v\n", addr.Address, balance, addr.Balance)
+			}
+			addr.Balance = balance
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return addrs, nil
+}
+
+// addKey stores the PEM encoded private key for a.
+func addKey(tx *sql.Tx, a Address, b []byte) error {
+	_, err := tx.Exec(`
+		INSERT OR IGNORE INTO keys (address, private_key)
+		VALUES (?, ?)
+	`, a, b)
+	return err
+}
+
+// rsaVersion checks that addresses of the given version belong to RSA keys.
+func rsaVersion(version Version) error {
+	if version.KeyType() != KeyRSA {
+		return errors.Errorf("cryptopuff: %v addresses are for %v keys, not RSA", version, version.KeyType())
+	}
+	return nil
+}
+
+func (d *DB) AddKey(version Version, k *rsa.PrivateKey) (Address, error) {
+	if err := rsaVersion(version); err != nil {
+		return nil, err
+	}
+
+	a := AddressFromKey(version, &k.PublicKey)
+	if err := d.db.TransactWithRetry(func(tx *sql.Tx) error {
+		return addKey(tx, a, EncodePrivateKeyPEM(k))
+	}); err != nil {
+		return nil, err
+	}
+
+	d.keysMu.Lock()
+	d.keys = nil
+	d.keysMu.Unlock()
+	return a, nil
+}
+
+// AddKeys adds all of the keys in a single transaction, so either every key is
+// imported or none are.
+func (d *DB) AddKeys(version Version, keys []*rsa.PrivateKey) ([]Address, error) {
+	if err := rsaVersion(version); err != nil {
+		return nil, err
+	}
+
+	addrs := make([]Address, len(keys))
+	for i, k := range keys {
+		addrs[i] = AddressFromKey(version, &k.PublicKey)
+	}
+
+	if err := d.db.TransactWithRetry(func(tx *sql.Tx) error {
+		for i, k := range keys {
+			if err := addKey(tx, addrs[i], EncodePrivateKeyPEM(k)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	d.keysMu.Lock()
+	d.keys = nil
+	d.keysMu.Unlock()
+	return addrs, nil
+}
+
+// AddECDSAKey adds an ECDSA key at its V4 address.
+func (d *DB) AddECDSAKey(k *ecdsa.PrivateKey) (Address, error) {
+	addrs, err := d.AddECDSAKeys([]*ecdsa.PrivateKey{k})
+	if err != nil {
+		return nil, err
+	}
+	return addrs[0], nil
+}
+
+// AddECDSAKeys adds ECDSA keys, at V4 addresses, in a single transaction like
+// AddKeys.
+func (d *DB) AddECDSAKeys(keys []*ecdsa.PrivateKey) ([]Address, error) {
+	addrs := make([]Address, len(keys))
+	pems := make([][]byte, len(keys))
+	for i, k := range keys {
+		a, err := AddressFromECDSAKey(&k.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		b, err := EncodeECDSAPrivateKeyPEM(k)
+		if err != nil {
+			return nil, err
+		}
+		addrs[i], pems[i] = a, b
+	}
+
+	if err := d.db.TransactWithRetry(func(tx *sql.Tx) error {
+		for i := range keys {
+			if err := addKey(tx, addrs[i], pems[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	d.keysMu.Lock()
+	d.keys = nil
+	d.keysMu.Unlock()
+	return addrs, nil
+}
+
+// walletKey returns the key for a, of whichever type its version uses.
+func (d *DB) walletKey(a Address) (Key, error) {
+	var k Key
+	if err := d.db.TransactWithRetry(func(tx *sql.Tx) error {
+		var b []byte
+		if err := tx.QueryRow(`SELECT private_key FROM keys WHERE address = ?`, a).Scan(&b); err != nil {
+			return err
+		}
+
+		var err error
+		k, err = decodeWalletKeyPEM(a, b)
+		return err
+	}); err != nil {
+		return Key{}, err
+	}
+	return k, nil
+}
+
+func (d *DB) Key(a Address) (*rsa.PrivateKey, error) {
+	k, err := d.walletKey(a)
+	if err != nil {
+		return nil, err
+	}
+	if k.Key == nil {
+		return nil, errors.Errorf("cryptopuff: %v has an ECDSA key, not RSA", a)
+	}
+	return k.Key, nil
+}
+
+func (d *DB) ECDSAKey(a Address) (*ecdsa.PrivateKey, error) {
+	k, err := d.walletKey(a)
+	if err != nil {
+		return nil, err
+	}
+	if k.ECDSAKey == nil {
+		return nil, errors.Errorf("cryptopuff: %v has an RSA key, not ECDSA", a)
+	}
+	return k.ECDSAKey, nil
+}
+
+// RewardRotation determines how the miner picks a reward destination when
+// more than one miner address is configured.
+type RewardRotation int
+
+const (
+	RotationRoundRobin RewardRotation = iota
+	RotationRandom
+)
+
+func ParseRewardRotation(str string) (RewardRotation, error) {
+	switch str {
+	case "roundrobin":
+		return RotationRoundRobin, nil
+	case "random":
+		return RotationRandom, nil
+	default:
+		return 0, errors.Errorf("cryptopuff: unknown reward rotation %q", str)
+	}
+}
+
+func (r RewardRotation) String() string {
+	switch r {
+	case RotationRoundRobin:
+		return "roundrobin"
+	case RotationRandom:
+		return "random"
+	default:
+		return fmt.Sprintf("RewardRotation(%d)", int(r))
+	}
+}
+
+func (d *DB) MinerAddress() (Address, error) {
+	addrs, _, err := d.MinerAddresses()
+	if err != nil {
+		return nil, err
+	}
+	return addrs[0], nil
+}
+
+func (d *DB) MinerAddresses() ([]Address, RewardRotation, error) {
+	var (
+		addrs    []Address
+		rotation RewardRotation
+	)
+	if err := d.db.TransactWithRetry(func(tx *sql.Tx) error {
+		addrs = nil
+
+		if err := tx.QueryRow(`SELECT rotation FROM miner_rotation`).Scan(&rotation); err != nil {
+			return err
+		}
+
+		rows, err := tx.Query(`SELECT address FROM miner_address ORDER BY rowid`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var a Address
+			if err := rows.Scan(&a); err != nil {
+				return err
+			}
+			addrs = append(addrs, a)
+		}
+
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		if len(addrs) == 0 {
+			return sql.ErrNoRows
+		}
+		return nil
+	}); err != nil {
+		return nil, 0, err
+	}
+	return addrs, rotation, nil
+}
+
+func (d *DB) SetMinerAddress(a Address) error {
+	return d.SetMinerAddresses([]Address{a}, RotationRoundRobin)
+}
+
+// SetMinerAddresses replaces the block reward destinations. Every address's
+// key must be in the wallet or the miner keystore, or the rewards would be
+// unspendable by this node, and UnknownKeyError is returned otherwise.
+func (d *DB) SetMinerAddresses(addrs []Address, rotation RewardRotation) error {
+	if len(addrs) == 0 {
+		return errors.New("cryptopuff: at least one miner address is required")
+	}
+
+	return d.db.TransactWithRetry(func(tx *sql.Tx) error {
+		for _, a := range addrs {
+			ok, err := d.hasMinerKey(tx, a)
+			if err != nil {
+				return err
+			} else if !ok {
+				return UnknownKeyError{Address: a}
+			}
+		}
+
+		if _, err := tx.Exec(`DELETE FROM miner_address`); err != nil {
+			return err
+		}
+
+		for _, a := range addrs {
+			if _, err := tx.Exec(`INSERT INTO miner_address (address) VALUES (?)`, a); err != nil {
+				return err
+			}
+		}
+
+		_, err := tx.Exec(`UPDATE miner_rotation SET rotation = ?`, rotation)
+		return err
+	})
+}
+
+// EnsureMinerAddress checks that at least one miner address is set, that
+// every one is well-formed and, if requireKey is set, that the wallet or the
+// miner keystore holds its key. If not, a fresh key is generated and made the only miner address, which
+// is returned. It returns nil if the miner addresses were fine.
+func (d *DB) EnsureMinerAddress(requireKey bool) (Address, error) {
+	var fallback Address
+	if err := d.db.TransactWithRetry(func(tx *sql.Tx) error {
+		fallback = nil
+
+		ok, err := d.validMinerAddresses(tx, requireKey)
+		if err != nil || ok {
+			return err
+		}
+
+		// A key seeded with the time could be found by guessing when the
+		// node started, so use a secure source.
+		k, err := RSAGenerateKey(rand.Reader, DefaultKeyLength)
+		if err != nil {
+			return err
+		}
+
+		a := AddressFromKey(DefaultVersion, &k.PublicKey)
+		if err := addKey(tx, a, EncodePrivateKeyPEM(k)); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(`DELETE FROM miner_address`); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO miner_address (address) VALUES (?)`, a); err != nil {
+			return err
+		}
+
+		fallback = a
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if fallback != nil {
+		d.keysMu.Lock()
+		d.keys = nil
+		d.keysMu.Unlock()
+	}
+	return fallback, nil
+}
+
+// validMinerAddresses reports whether the miner addresses can be mined to.
+// The rows are read as strings so that a corrupt row is reported as invalid
+// rather than failing to scan.
+func (d *DB) validMinerAddresses(tx *sql.Tx, requireKey bool) (bool, error) {
+	rows, err := tx.Query(`SELECT address FROM miner_address`)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	var addrs []Address
+	for rows.Next() {
+		var str string
+		if err := rows.Scan(&str); err != nil {
+			return false, err
+		}
+
+		a, err := AddressFromString(str)
+		if err != nil {
+			return false, nil
+		}
+		addrs = append(addrs, a)
+	}
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+
+	if len(addrs) == 0 {
+		return false, nil
+	}
+
+	if requireKey {
+		for _, a := range addrs {
+			if ok, err := d.hasMinerKey(tx, a); err != nil || !ok {
+				return false, err
+			}
+		}
+	}
+	return true, nil
+}
+
+// hasMinerKey reports whether the key for a is in the wallet or the miner
+// keystore.
+func (d *DB) hasMinerKey(tx *sql.Tx, a Address) (bool, error) {
+	var unused int
+	err := tx.QueryRow(`SELECT 1 FROM keys WHERE address = ?`, a).Scan(&unused)
+	if err == nil {
+		return true, nil
+	} else if err != sql.ErrNoRows {
+		return false, err
+	}
+
+	if d.minerKeystore == nil {
+		return false, nil
+	}
+	return d.minerKeystore.HasKey(a)
+}
+
+// validTx checks that stx can be included on top of tip. credit is added to
+// the source's balance, for coins it is due from pending transactions.
+func validTx(tx *sql.Tx, stx *SignedTx, tip Hash, credit int64) error {
+	if err := stx.Valid(); err != nil {
+		return err
+	}
+
+	var balance int64
+	err := tx.QueryRow(`
+		SELECT balance
+		FROM balances
+		WHERE block_hash = ? AND address = ?
+	`, tip, stx.Source).Scan(&balance)
+	if err == sql.ErrNoRows {
+		balance = 0
+	} else if err != nil {
+		return err
+	}
+
+	immature, err := immatureBalance(tx, tip, stx.Source)
+	if err != nil {
+		return err
+	}
+
+	balance += credit
+
+	if balance == 0 {
+		funded, err := everFunded(tx, stx.Source)
+		if err != nil {
+			return err
+		}
+		if !funded {
+			return InvalidBlockError{Message: "cryptopuff: source address has never received any coins"}
+		}
+	}
+
+	if balance-immature < stx.RequiredBalance() {
+		if immature > 0 && balance >= stx.RequiredBalance() {
+			return InvalidBlockError{Message: fmt.Sprintf("cryptopuff: insufficient balance (%v coins, %v of them immature, %v required)", balance, immature, stx.RequiredBalance())}
+		}
+		return InvalidBlockError{Message: fmt.Sprintf("cryptopuff: insufficient balance (%v coins, %v required)", balance, stx.RequiredBalance())}
+	}
+
+	var unused int64
+	err = tx.QueryRow(`
+		SELECT 1
+		FROM included_txs
+		WHERE block_hash = ? AND tx_hash = ?
+	`, tip, stx.Hash).Scan(&unused)
+	if err == sql.ErrNoRows {
+		/* ok */
+	} else if err != nil {
+		return err
+	} else {
+		return InvalidBlockError{Message: "cryptopuff: transaction already included in blockchain"}
+	}
+
+	return nil
+}
+
+// immatureBalance returns the part of a's balance at tip that was paid out by
+// blocks that haven't reached CoinbaseMaturity.
+func immatureBalance(tx *sql.Tx, tip Hash, a Address) (int64, error) {
+	var immature int64
+	err := tx.QueryRow(`
+		SELECT COALESCE(SUM(amount), 0)
+		FROM immature_rewards
+		WHERE block_hash = ? AND address = ?
+	`, tip, a).Scan(&immature)
+	return immature, err
+}
+
+// everFunded reports whether a has ever held coins, as far as this node can
+// tell: it has a balance at some block, or has sent or received a
+// transaction. An address that hasn't is most likely a typo or from another
+// network.
+func everFunded(tx *sql.Tx, a Address) (bool, error) {
+	var unused int
+	err := tx.QueryRow(`
+		SELECT 1 FROM balances WHERE address = ?
+		UNION ALL
+		SELECT 1 FROM txs WHERE source = ? OR destination = ?
+		LIMIT 1
+	`, a, a, a).Scan(&unused)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func temporaryBalance(tx *sql.Tx, a Address) (int64, error) {
+	var balance int64
+	err := tx.QueryRow(`
+		SELECT balance
+		FROM temp_balances
+		WHERE address = ?
+	`, a).Scan(&balance)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return balance, nil
+}
+
+// pendingCredit returns what stx's source is due from the other pending
+// transactions, net of what it already spends in them, which is counted
+// towards its balance when accepting stx so that a pending output can be
+// spent before it is mined.
+func pendingCredit(tx *sql.Tx, tip Hash, stx *SignedTx) (int64, error) {
+	var credit int64
+	if err := tx.QueryRow(`
+		SELECT COALESCE(SUM(t.amount), 0)
+		FROM txs t
+		LEFT JOIN included_txs i ON i.tx_hash = t.hash AND i.block_hash = ?
+		WHERE i.tx_hash IS NULL AND t.destination = ? AND t.hash != ?
+	`, tip, stx.Source, stx.Hash).Scan(&credit); err != nil {
+		return 0, err
+	}
+
+	debit, err := pendingDebit(tx, tip, stx)
+	if err != nil {
+		return 0, err
+	}
+	return credit - debit, nil
+}
+
+// pendingDebit returns the total amount, including fees, that stx's source
+// is already spending in other pending transactions.
+func pendingDebit(tx *sql.Tx, tip Hash, stx *SignedTx) (int64, error) {
+	var debit int64
+	err := tx.QueryRow(`
+		SELECT COALESCE(SUM(t.amount + t.fee), 0)
+		FROM txs t
+		LEFT JOIN included_txs i ON i.tx_hash = t.hash AND i.block_hash = ?
+		WHERE i.tx_hash IS NULL AND t.source = ? AND t.hash != ?
+	`, tip, stx.Source, stx.Hash).Scan(&debit)
+	return debit, err
+}
+
+// bestBlockHash returns the hash of the block with the most cumulative work,
+// rather than simply the highest, so that a shorter chain mined at a higher
+// difficulty beats a longer, easier one. Ties are broken by picking the lowest
+// hash, so that every node picks the same tip regardless of the order it
+// received the blocks in. The same ordering is used wherever the tip is
+// selected.
+func bestBlockHash(tx *sql.Tx) (Hash, error) {
+	var tip Hash
+	err := tx.QueryRow(`
+		SELECT hash
+		FROM blocks
+		ORDER BY work DESC, hash ASC
+		LIMIT 1
+	`).Scan(&tip)
+	if err == sql.ErrNoRows {
+		return EmptyHash, ErrNoBlocks
+	} else if err != nil {
+		return EmptyHash, err
+	}
+	return tip, nil
+}
+
+func addTx(tx *sql.Tx, stx *SignedTx) error {
+	b, err := json.Marshal(stx)
+	if err != nil {
+		return err
+	}
+
+	var expiresAtHeight sql.NullInt64
+	if stx.ExpiresAtHeight != 0 {
+		expiresAtHeight = sql.NullInt64{Int64: stx.ExpiresAtHeight, Valid: true}
+	}
+
+	_, err = tx.Exec(`
+		INSERT OR IGNORE INTO txs (hash, source, destination, amount, fee, tx, expires_at_height)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, stx.Hash, stx.Source, stx.Destination, stx.Amount, stx.Fee, b, expiresAtHeight)
+	return err
+}
+
+// deleteExpiredTxs deletes the pending transactions that expire before the
+// block after tip, so can never be mined on top of it, returning the number
+// deleted. Transactions that have been included in any block are kept, as a
+// reorg may still need them.
+func deleteExpiredTxs(tx *sql.Tx, tip Hash) (int, error) {
+	r, err := tx.Exec(`
+		DELETE FROM txs
+		WHERE expires_at_height < (SELECT height + 1 FROM blocks WHERE hash = ?)
+		AND NOT EXISTS (
+			SELECT 1
+			FROM block_txs
+			WHERE tx_hash = txs.hash
+		)
+		AND NOT EXISTS (
+			SELECT 1
+			FROM included_txs
+			WHERE tx_hash = txs.hash
+		)
+	`, tip)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := r.RowsAffected()
+	return int(n), err
+}
+
+// deletePendingTx deletes a transaction from the mempool, unless it has been
+// included in any block. It reports whether the transaction was deleted.
+func deletePendingTx(tx *sql.Tx, hash Hash) (bool, error) {
+	r, err := tx.Exec(`
+		DELETE FROM txs
+		WHERE hash = ?
+		AND NOT EXISTS (
+			SELECT 1
+			FROM block_txs
+			WHERE tx_hash = ?
+		)
+		AND NOT EXISTS (
+			SELECT 1
+			FROM included_txs
+			WHERE tx_hash = ?
+		)
+	`, hash, hash, hash)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := r.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (d *DB) AddTx(stx *SignedTx) error {
+	return d.addPendingTx(stx, false)
+}
+
+// AddPrivateTx adds stx to the mempool for this node to mine, but never
+// relays it to peers. Its public key is then only revealed once it is mined,
+// rather than from the moment it is broadcast, shortening the window in which
+// the key can be attacked before the coins move. It takes longer to be mined,
+// as only this node will try.
+func (d *DB) AddPrivateTx(stx *SignedTx) error {
+	return d.addPendingTx(stx, true)
+}
+
+func (d *DB) addPendingTx(stx *SignedTx, private bool) error {
+	return d.db.TransactWithRetry(func(tx *sql.Tx) error {
+		tip, err := bestBlockHash(tx)
+		if err != nil {
+			return err
+		}
+
+		var credit int64
+		if d.relayOnlyValid {
+			debit, err := pendingDebit(tx, tip, stx)
+			if err != nil {
+				return err
+			}
+			credit = -debit
+		} else {
+			credit, err = pendingCredit(tx, tip, stx)
+			if err != nil {
+				return err
+			}
+		}
+
+		if err := validTx(tx, stx, tip, credit); err != nil {
+			return err
+		}
+
+		if err := stx.ValidDust(d.dustThreshold); err != nil {
+			return InvalidBlockError{Message: "cryptopuff: dust transaction", Cause: err}
+		}
+
+		if err := stx.ValidDestination(); err != nil {
+			return InvalidBlockError{Message: "cryptopuff: self-send", Cause: err}
+		}
+
+		var height int64
+		if err := tx.QueryRow(`SELECT height FROM blocks WHERE hash = ?`, tip).Scan(&height); err != nil {
+			return err
+		}
+		if err := stx.ValidExpiry(height + 1); err != nil {
+			return InvalidBlockError{Message: "cryptopuff: expired transaction", Cause: err}
+		}
+
+		if d.feeFloorCapacity > 0 {
+			n, err := pendingTxCount(tx, tip)
+			if err != nil {
+				return err
+			}
+			if floor := d.feeFloor(n); stx.Fee < floor {
+				return InvalidBlockError{Message: fmt.Sprintf("cryptopuff: fee %v below the current floor of %v, as %v transactions are pending", stx.Fee, floor, n)}
+			}
+		}
+
+		if d.maxPendingTxsPerSource > 0 {
+			if err := limitPendingTxsFromSource(tx, stx, tip, d.maxPendingTxsPerSource); err != nil {
+				return err
+			}
+		}
+
+		if d.maxMempoolTxs > 0 {
+			if err := limitMempool(tx, stx, tip, d.maxMempoolTxs); err != nil {
+				return err
+			}
+		}
+
+		if err := addTx(tx, stx); err != nil {
+			return err
+		}
+
+		if private {
+			// a transaction already seen in a block is public anyway
+			if _, err := tx.Exec(`
+				UPDATE txs SET private = 1
+				WHERE hash = ? AND NOT EXISTS (SELECT 1 FROM block_txs WHERE tx_hash = ?)
+			`, stx.Hash, stx.Hash); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// feeFloor returns the minimum fee for a new transaction when n transactions
+// are pending.
+func (d *DB) feeFloor(n int) int64 {
+	if d.feeFloorCapacity <= 0 {
+		return 0
+	}
+
+	occupancy := float64(n) / float64(d.feeFloorCapacity)
+	if occupancy >= 1 {
+		return d.maxFeeFloor
+	}
+	return int64(math.Ceil(float64(d.maxFeeFloor) * occupancy * occupancy))
+}
+
+// FeeEstimate returns the fee floor given the current size of the mempool.
+func (d *DB) FeeEstimate() (*FeeEstimate, error) {
+	var estimate *FeeEstimate
+	if err := d.db.TransactWithRetry(func(tx *sql.Tx) error {
+		tip, err := bestBlockHash(tx)
+		if err != nil {
+			return err
+		}
+
+		n, err := pendingTxCount(tx, tip)
+		if err != nil {
+			return err
+		}
+
+		estimate = &FeeEstimate{
+			Floor:      d.feeFloor(n),
+			PendingTxs: n,
+			Capacity:   d.feeFloorCapacity,
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return estimate, nil
+}
+
+func pendingTxCount(tx *sql.Tx, tip Hash) (int, error) {
+	var n int
+	err := tx.QueryRow(`
+		SELECT COUNT(*)
+		FROM txs t
+		LEFT JOIN included_txs i ON i.tx_hash = t.hash AND i.block_hash = ?
+		WHERE i.tx_hash IS NULL
+	`, tip).Scan(&n)
+	return n, err
+}
+
+// limitPendingTxsFromSource makes room for stx if its source already has the
+// maximum number of pending transactions, by evicting the source's lowest fee
+// pending transaction. If stx doesn't pay a higher fee than that transaction
+// it is rejected instead.
+//
+// There is no general replace-by-fee: a pending transaction is only ever
+// displaced by a higher fee transaction from the same source, and only once
+// the source is at its limit.
+func limitPendingTxsFromSource(tx *sql.Tx, stx *SignedTx, tip Hash, limit int) error {
+	var n int
+	if err := tx.QueryRow(`
+		SELECT COUNT(*)
+		FROM txs t
+		LEFT JOIN included_txs i ON i.tx_hash = t.hash AND i.block_hash = ?
+		WHERE i.tx_hash IS NULL AND t.source = ? AND t.hash != ?
+	`, tip, stx.Source, stx.Hash).Scan(&n); err != nil {
+		return err
+	}
+	if n < limit {
+		return nil
+	}
+
+	var (
+		lowest    Hash
+		lowestFee int64
+	)
+	if err := tx.QueryRow(`
+		SELECT t.hash, t.fee
+		FROM txs t
+		LEFT JOIN included_txs i ON i.tx_hash = t.hash AND i.block_hash = ?
+		WHERE i.tx_hash IS NULL AND t.source = ? AND t.hash != ?
+		ORDER BY t.fee ASC
+		LIMIT 1
+	`, tip, stx.Source, stx.Hash).Scan(&lowest, &lowestFee); err != nil {
+		return err
+	}
+
+	if stx.Fee > lowestFee {
+		deleted, err := deletePendingTx(tx, lowest)
+		if err != nil {
+			return err
+		}
+		if deleted {
+			return nil
+		}
+	}
+
+	return InvalidBlockError{Message: fmt.Sprintf("cryptopuff: source already has %v pending transactions", n)}
+}
+
+// limitMempool makes room for stx if the mempool already holds the maximum
+// number of pending transactions, by evicting the lowest fee one. If stx
+// doesn't pay a higher fee than that transaction it is rejected instead.
+// Transactions that have been included in any block are never evicted, so a
+// reorg can't lose them.
+func limitMempool(tx *sql.Tx, stx *SignedTx, tip Hash, limit int) error {
+	var n int
+	if err := tx.QueryRow(`
+		SELECT COUNT(*)
+		FROM txs t
+		LEFT JOIN included_txs i ON i.tx_hash = t.hash AND i.block_hash = ?
+		WHERE i.tx_hash IS NULL AND t.hash != ?
+	`, tip, stx.Hash).Scan(&n); err != nil {
+		return err
+	}
+	if n < limit {
+		return nil
+	}
+
+	var (
+		lowest    Hash
+		lowestFee int64
+	)
+	err := tx.QueryRow(`
+		SELECT t.hash, t.fee
+		FROM txs t
+		WHERE t.hash != ?
+		AND NOT EXISTS (SELECT 1 FROM block_txs WHERE tx_hash = t.hash)
+		AND NOT EXISTS (SELECT 1 FROM included_txs WHERE tx_hash = t.hash)
+		ORDER BY t.fee ASC
+		LIMIT 1
+	`, stx.Hash).Scan(&lowest, &lowestFee)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	if err == nil && stx.Fee > lowestFee {
+		deleted, err := deletePendingTx(tx, lowest)
+		if err != nil {
+			return err
+		}
+		if deleted {
+			return nil
+		}
+	}
+
+	return InvalidBlockError{Message: fmt.Sprintf("cryptopuff: mempool is full with %v pending transactions", n)}
+}
+
+func (d *DB) MyTxs() ([]PersonalTx, error) {
+	var ptxs []PersonalTx
+	if err := d.db.TransactModeWithRetry(database.Read, func(tx *sql.Tx) error {
+		tip, err := bestBlockHash(tx)
+		if err != nil {
+			return err
+		}
+
+		ptxs, err = myTxs(tx, tip, 0)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return ptxs, nil
+}
+
+// TxByHash returns any transaction the node knows about, whether pending or
+// included in the best chain, and if included the height of its block. It
+// returns ErrUnknownTx if the transaction is unknown, or is pending and was
+// broadcast privately, as its public key must stay hidden until it is mined.
+func (d *DB) TxByHash(hash Hash) (*PersonalTx, error) {
+	var ptx *PersonalTx
+	if err := d.db.TransactWithRetry(func(tx *sql.Tx) error {
+		tip, err := bestBlockHash(tx)
+		if err != nil {
+			return err
+		}
+
+		var (
+			b        []byte
+			private  bool
+			included bool
+			height   sql.NullInt64
+		)
+		// The transaction may also be in blocks on stale forks, so take the
+		// height from the best chain, walking back from the tip only as far
+		// as the lowest block it appears in.
+		err = tx.QueryRow(`
+			WITH RECURSIVE f (hash, previous_hash, height) AS (
+				SELECT hash, previous_hash, height
+				FROM blocks
+				WHERE hash = ?
+				UNION
+				SELECT b.hash, b.previous_hash, b.height
+				FROM blocks AS b
+				JOIN f ON f.previous_hash = b.hash
+				WHERE f.height > (
+					SELECT MIN(b.height)
+					FROM block_txs bt
+					JOIN blocks b ON b.hash = bt.block_hash
+					WHERE bt.tx_hash = ?
+				)
+			)
+			SELECT
+				t.tx,
+				t.private != 0,
+				i.tx_hash IS NOT NULL AS included,
+				(
+					SELECT f.height
+					FROM f
+					JOIN block_txs bt ON bt.block_hash = f.hash
+					WHERE bt.tx_hash = t.hash
+				)
+			FROM txs t
+			LEFT JOIN included_txs i ON i.tx_hash = t.hash AND i.block_hash = ?
+			WHERE t.hash = ?
+		`, tip, hash, tip, hash).Scan(&b, &private, &included, &height)
+		if err == sql.ErrNoRows {
+			return ErrUnknownTx
+		} else if err != nil {
+			return err
+		}
+		if private && !included {
+			return ErrUnknownTx
+		}
+
+		var stx SignedTx
+		if err := json.Unmarshal(b, &stx); err != nil {
+			return err
+		}
+		if err := stx.UpdateHash(); err != nil {
+			return err
+		}
+
+		ptx = &PersonalTx{SignedTx: stx, Included: included}
+		if included {
+			ptx.Height = height.Int64
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return ptx, nil
+}
+
+// myTxs returns the transactions to or from the wallet's addresses, pending
+// first and then most recently included. A limit of 0 returns all of them.
+func myTxs(tx *sql.Tx, tip Hash, limit int) ([]PersonalTx, error) {
+	if limit <= 0 {
+		limit = -1
+	}
+
+	rows, err := tx.Query(`
+		SELECT DISTINCT
+			t.tx,
+			i.tx_hash IS NOT NULL AS included,
+			b.height
+		FROM txs t
+		JOIN keys k ON k.address = t.source OR k.address = t.destination
+		LEFT JOIN included_txs i ON i.tx_hash = t.hash AND i.block_hash = ?
+		LEFT JOIN block_txs bt ON bt.tx_hash = t.hash
+		LEFT JOIN blocks b ON b.hash = bt.block_hash
+		ORDER BY included ASC, b.height DESC
+		LIMIT ?
+	`, tip, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ptxs []PersonalTx
+	for rows.Next() {
+		var (
+			b        []byte
+			included bool
+			height   sql.NullInt64
+		)
+		if err := rows.Scan(&b, &included, &height); err != nil {
+			return nil, err
+		}
+
+		var stx SignedTx
+		if err := json.Unmarshal(b, &stx); err != nil {
+			return nil, err
+		}
+		if err := stx.UpdateHash(); err != nil {
+			return nil, err
+		}
+		ptxs = append(ptxs, PersonalTx{
+			SignedTx: stx,
+			Included: included,
+			Height:   height.Int64,
+		})
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return ptxs, nil
+}
+
+// WalletSummary is a consistent snapshot of the wallet and chain, taken in a
+// single transaction so the balances and transactions reflect the same tip.
+type WalletSummary struct {
+	Tip        Hash
+	Height     int64
+	PendingTxs int
+	Addresses  []AddressState
+	Txs        []PersonalTx
+}
+
+// WalletSummary returns the wallet's balances, its txLimit most recent
+// transactions and basic chain stats.
+func (d *DB) WalletSummary(txLimit int) (*WalletSummary, error) {
+	var summary *WalletSummary
+	if err := d.db.TransactWithRetry(func(tx *sql.Tx) error {
+		summary = &WalletSummary{}
+
+		if err := tx.QueryRow(`
+			SELECT hash, height
+			FROM blocks
+			ORDER BY work DESC, hash ASC
+			LIMIT 1
+		`).Scan(&summary.Tip, &summary.Height); err == sql.ErrNoRows {
+			return ErrNoBlocks
+		} else if err != nil {
+			return err
+		}
+
+		var err error
+		summary.PendingTxs, err = pendingTxCount(tx, summary.Tip)
+		if err != nil {
+			return err
+		}
+
+		summary.Addresses, err = addresses(tx, summary.Tip)
+		if err != nil {
+			return err
+		}
+
+		summary.Txs, err = myTxs(tx, summary.Tip, txLimit)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+// NodeStatus is a one-line summary of a node: its best block, how many peers
+// and pending transactions it knows about, and its hash rate over the last
+// second.
+type NodeStatus struct {
+	Tip          Hash
+	Height       int64
+	Peers        int
+	PendingTxs   int
+	HashesPerSec uint64
+}
+
+// Status returns the node's best block and the number of peers and pending
+// transactions. HashesPerSec is left for the server to fill in.
+func (d *DB) Status() (*NodeStatus, error) {
+	var status *NodeStatus
+	if err := d.db.TransactWithRetry(func(tx *sql.Tx) error {
+		status = &NodeStatus{}
+
+		if err := tx.QueryRow(`
+			SELECT hash, height
+			FROM blocks
+			ORDER BY work DESC, hash ASC
+			LIMIT 1
+		`).Scan(&status.Tip, &status.Height); err == sql.ErrNoRows {
+			return ErrNoBlocks
+		} else if err != nil {
+			return err
+		}
+
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM peers`).Scan(&status.Peers); err != nil {
+			return err
+		}
+
+		var err error
+		status.PendingTxs, err = pendingTxCount(tx, status.Tip)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// RelayTxs returns the pending transactions to serve to peers: every one in
+// the mempool, or in strict relay mode only those still valid on top of the
+// best block. Private transactions are never relayed.
+func (d *DB) RelayTxs() ([]SignedTx, error) {
+	var stxs []SignedTx
+	if err := d.db.TransactWithRetry(func(tx *sql.Tx) error {
+		tip, err := bestBlockHash(tx)
+		if err != nil {
+			return err
+		}
+
+		var all []SignedTx
+		if d.relayOnlyValid {
+			all, err = fundedPendingTxs(tx, tip)
+		} else {
+			all, err = allPendingTxs(tx, tip)
+		}
+		if err != nil {
+			return err
+		}
+
+		private, err := privateTxs(tx)
+		if err != nil {
+			return err
+		}
+
+		stxs = nil
+		for _, stx := range all {
+			if !private[stx.Hash] {
+				stxs = append(stxs, stx)
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return stxs, nil
+}
+
+// fundedPendingTxs returns the unexpired pending transactions on top of tip
+// whose source's mature balance at tip covers every pending transaction it
+// has sent, without counting coins it is due from other pending
+// transactions. Their signatures were checked when they were added, so only
+// the balances are, and nothing is written: peers can call this as often as
+// they like.
+func fundedPendingTxs(tx *sql.Tx, tip Hash) ([]SignedTx, error) {
+	rows, err := tx.Query(`
+		WITH pending AS (
+			SELECT t.tx, t.source, t.amount + t.fee AS debit
+			FROM txs t
+			LEFT JOIN included_txs i ON i.tx_hash = t.hash AND i.block_hash = ?1
+			WHERE i.tx_hash IS NULL AND (
+				t.expires_at_height IS NULL OR
+				t.expires_at_height >= (SELECT height + 1 FROM blocks WHERE hash = ?1)
+			)
+		)
+		SELECT p.tx
+		FROM pending p
+		WHERE COALESCE((
+			SELECT b.balance
+			FROM balances b
+			WHERE b.block_hash = ?1 AND b.address = p.source
+		), 0) - COALESCE((
+			SELECT SUM(r.amount)
+			FROM immature_rewards r
+			WHERE r.block_hash = ?1 AND r.address = p.source
+		), 0) >= (
+			SELECT SUM(o.debit)
+			FROM pending o
+			WHERE o.source = p.source
+		)
+	`, tip)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stxs []SignedTx
+	for rows.Next() {
+		var b []byte
+		if err := rows.Scan(&b); err != nil {
+			return nil, err
+		}
+
+		var stx SignedTx
+		if err := json.Unmarshal(b, &stx); err != nil {
+			return nil, err
+		}
+		if err := stx.UpdateHash(); err != nil {
+			return nil, err
+		}
+		stxs = append(stxs, stx)
+	}
+	return stxs, rows.Err()
+}
+
+func privateTxs(tx *sql.Tx) (map[Hash]bool, error) {
+	rows, err := tx.Query(`SELECT hash FROM txs WHERE private != 0`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	private := make(map[Hash]bool)
+	for rows.Next() {
+		var hash Hash
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		private[hash] = true
+	}
+	return private, rows.Err()
+}
+
+func (d *DB) AllPendingTxs() ([]SignedTx, error) {
+	var stxs []SignedTx
+	if err := d.db.TransactWithRetry(func(tx *sql.Tx) error {
+		tip, err := bestBlockHash(tx)
+		if err != nil {
+			return err
+		}
+
+		stxs, err = allPendingTxs(tx, tip)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return stxs, nil
+}
+
+// allPendingTxs returns every pending transaction on top of tip, after deleting
+// those that have expired.
+func allPendingTxs(tx *sql.Tx, tip Hash) ([]SignedTx, error) {
+	if _, err := deleteExpiredTxs(tx, tip); err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(`
+		SELECT tx
+		FROM txs t
+		LEFT JOIN included_txs i ON i.tx_hash = t.hash AND i.block_hash = ?
+		WHERE i.tx_hash IS NULL
+	`, tip)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stxs []SignedTx
+	for rows.Next() {
+		var b []byte
+		if err := rows.Scan(&b); err != nil {
+			return nil, err
+		}
+
+		var stx SignedTx
+		if err := json.Unmarshal(b, &stx); err != nil {
+			return nil, err
+		}
+		if err := stx.UpdateHash(); err != nil {
+			return nil, err
+		}
+		stxs = append(stxs, stx)
+	}
+	return stxs, rows.Err()
+}
+
+func (d *DB) PendingTxs(tip Hash, limit int) ([]SignedTx, error) {
+	var stxs []SignedTx
+	if err := d.db.TransactWithRetry(func(tx *sql.Tx) error {
+		var err error
+		stxs, _, err = pendingTxs(tx, tip, limit, d.dustThreshold)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return stxs, nil
+}
+
+// PruneMempool deletes every pending transaction that is no longer valid on
+// top of the best block, returning the number deleted.
+func (d *DB) PruneMempool() (int, error) {
+	var pruned int
+	if err := d.db.TransactWithRetry(func(tx *sql.Tx) error {
+		tip, err := bestBlockHash(tx)
+		if err != nil {
+			return err
+		}
+
+		_, pruned, err = pendingTxs(tx, tip, 0, d.dustThreshold)
+		return err
+	}); err != nil {
+		return 0, err
+	}
+	return pruned, nil
+}
+
+// pendingTxs returns up to limit valid pending transactions on top of tip,
+// highest fee first, deleting any invalid ones it comes across. A limit of
+// zero checks every pending transaction. It also returns the number of
+// transactions deleted.
+func pendingTxs(tx *sql.Tx, tip Hash, limit int, dustThreshold int64) ([]SignedTx, int, error) {
+	expired, err := deleteExpiredTxs(tx, tip)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if _, err := tx.Exec(`DROP TABLE IF EXISTS temp_balances`); err != nil {
+		return nil, 0, err
+	}
+
+	if _, err := tx.Exec(`
+		CREATE TEMPORARY TABLE temp_balances (
+			address TEXT PRIMARY KEY NOT NULL,
+			balance INTEGER NOT NULL
+		)
+	`); err != nil {
+		return nil, 0, err
+	}
+
+	if _, err := tx.Exec(`
+		INSERT INTO temp_balances (address, balance)
+		SELECT b.address, b.balance - COALESCE((
+			SELECT SUM(r.amount)
+			FROM immature_rewards r
+			WHERE r.block_hash = b.block_hash AND r.address = b.address
+		), 0)
+		FROM balances b
+		WHERE b.block_hash = ?
+	`, tip); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := tx.Query(`
+		SELECT tx
+		FROM txs t
+		LEFT JOIN included_txs i ON i.tx_hash = t.hash AND i.block_hash = ?
+		WHERE i.tx_hash IS NULL
+		ORDER BY t.fee DESC
+	`, tip)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var candidates []SignedTx
+	for rows.Next() {
+		var b []byte
+		if err := rows.Scan(&b); err != nil {
+			return nil, 0, err
+		}
+
+		var stx SignedTx
+		if err := json.Unmarshal(b, &stx); err != nil {
+			return nil, 0, err
+		}
+		if err := stx.UpdateHash(); err != nil {
+			return nil, 0, err
+		}
+		candidates = append(candidates, stx)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	var stxs []SignedTx
+	pruned := expired
+	full := func() bool {
+		return limit > 0 && len(stxs) >= limit
+	}
+
+	// A transaction may spend the output of another pending transaction, so
+	// one that can't be funded yet is deferred and retried after the others
+	// have been applied. This ensures parents are selected before children.
+	// Each pass costs a query per candidate, so only maxPendingTxDepth passes
+	// are made; deeper descendants wait for their ancestors to be mined.
+	for pass := 0; pass < maxPendingTxDepth && len(candidates) > 0 && !full(); pass++ {
+		var deferred []SignedTx
+		for _, stx := range candidates {
+			if full() {
+				break
+			}
+
+			// Re-validate the transaction - the source balance could have
+			// changed.
+			err := stx.Valid()
+			if err == nil {
+				if dustErr := stx.ValidDust(dustThreshold); dustErr != nil {
+					err = InvalidBlockError{Message: "cryptopuff: dust transaction", Cause: dustErr}
+				}
+			}
+			if err == nil {
+				if destErr := stx.ValidDestination(); destErr != nil {
+					err = InvalidBlockError{Message: "cryptopuff: self-send", Cause: destErr}
+				}
+			}
+			if _, ok := err.(InvalidBlockError); ok {
+				if _, err := deletePendingTx(tx, stx.Hash); err != nil {
+					return nil, 0, err
+				}
+				pruned++
+				continue
+			} else if err != nil {
+				return nil, 0, err
+			}
+
+			balance, err := temporaryBalance(tx, stx.Source)
+			if err != nil {
+				return nil, 0, err
+			}
+			if balance < stx.RequiredBalance() {
+				deferred = append(deferred, stx)
+				continue
+			}
+			stxs = append(stxs, stx)
+
+			if _, err := tx.Exec(`
+				UPDATE temp_balances
+				SET balance = balance - ?
+				WHERE address = ?
+			`, stx.RequiredBalance(), stx.Source); err != nil {
+				return nil, 0, err
+			}
+
+			if _, err := tx.Exec(`
+				INSERT INTO temp_balances (address, balance)
+				VALUES (?, ?)
+				ON CONFLICT (address) DO UPDATE
+				SET balance = balance + excluded.balance
+			`, stx.Destination, stx.Amount); err != nil {
+				return nil, 0, err
+			}
+		}
+
+		if len(deferred) == len(candidates) {
+			// Nothing was selected, so none of the deferred transactions
+			// can ever be funded.
+			for _, stx := range deferred {
+				if _, err := deletePendingTx(tx, stx.Hash); err != nil {
+					return nil, 0, err
+				}
+				pruned++
+			}
+			break
+		}
+		candidates = deferred
+	}
+
+	if _, err := tx.Exec(`DROP TABLE temp_balances`); err != nil {
+		return nil, 0, err
+	}
+	return stxs, pruned, nil
+}
+
+// MempoolRankByFee returns the number of pending transactions paying a higher
+// fee than the transaction with the given hash.
+func (d *DB) MempoolRankByFee(hash Hash) (int, error) {
+	var rank int
+	if err := d.db.TransactWithRetry(func(tx *sql.Tx) error {
+		tip, err := bestBlockHash(tx)
+		if err != nil {
+			return err
+		}
+
+		var (
+			fee      int64
+			included bool
+		)
+		err = tx.QueryRow(`
+			SELECT t.fee, i.tx_hash IS NOT NULL
+			FROM txs t
+			LEFT JOIN included_txs i ON i.tx_hash = t.hash AND i.block_hash = ?
+			WHERE t.hash = ?
+		`, tip, hash).Scan(&fee, &included)
+		if err == sql.ErrNoRows {
+			return ErrUnknownTx
+		} else if err != nil {
+			return err
+		}
+		if included {
+			return ErrTxNotPending
+		}
+
+		return tx.QueryRow(`
+			SELECT COUNT(*)
+			FROM txs t
+			LEFT JOIN included_txs i ON i.tx_hash = t.hash AND i.block_hash = ?
+			WHERE i.tx_hash IS NULL AND t.fee > ?
+		`, tip, fee).Scan(&rank)
+	}); err != nil {
+		return 0, err
+	}
+	return rank, nil
+}
+
+// IncludingBlock returns the block in the best chain that includes the
+// transaction with the given hash.
+func (d *DB) IncludingBlock(hash Hash) (*Block, error) {
+	var b *Block
+	if err := d.db.TransactWithRetry(func(tx *sql.Tx) error {
+		b = nil
+
+		tip, err := bestBlockHash(tx)
+		if err != nil {
+			return err
+		}
+
+		var unused int64
+		err = tx.QueryRow(`SELECT 1 FROM txs WHERE hash = ?`, hash).Scan(&unused)
+		if err == sql.ErrNoRows {
+			return ErrUnknownTx
+		} else if err != nil {
+			return err
+		}
+
+		// Walk back from the tip only as far as the lowest block the
+		// transaction appears in.
+		var raw []byte
+		err = tx.QueryRow(`
+			WITH RECURSIVE f (hash, previous_hash, height) AS (
+				SELECT hash, previous_hash, height
+				FROM blocks
+				WHERE hash = ?
+				UNION
+				SELECT b.hash, b.previous_hash, b.height
+				FROM blocks AS b
+				JOIN f ON f.previous_hash = b.hash
+				WHERE f.height > (
+					SELECT MIN(b.height)
+					FROM block_txs bt
+					JOIN blocks b ON b.hash = bt.block_hash
+					WHERE bt.tx_hash = ?
+				)
+			)
+			SELECT b.block
+			FROM f
+			JOIN block_txs bt ON bt.block_hash = f.hash
+			JOIN blocks b ON b.hash = f.hash
+			WHERE bt.tx_hash = ?
+		`, tip, hash, hash).Scan(&raw)
+		if err == sql.ErrNoRows {
+			return ErrTxNotIncluded
+		} else if err != nil {
+			return err
+		}
+
+		b, err = DecodeBlock(raw)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// AverageBlockInterval returns the mean time between the timestamped blocks
+// among the last n blocks of the best chain, or zero if there are fewer than
+// two.
+func (d *DB) AverageBlockInterval(n int) (time.Duration, error) {
+	var interval time.Duration
+	if err := d.db.TransactWithRetry(func(tx *sql.Tx) error {
+		interval = 0
+
+		rows, err := tx.Query(`
+			WITH RECURSIVE f (previous_hash, block, depth) AS (
+				SELECT previous_hash, block, 1 FROM (
+					SELECT previous_hash, block
+					FROM blocks
+					ORDER BY work DESC, hash ASC
+					LIMIT 1
+				)
+				UNION ALL
+				SELECT b.previous_hash, b.block, f.depth + 1
+				FROM blocks AS b
+				JOIN f ON f.previous_hash = b.hash
+				WHERE f.depth < ?
+			)
+			SELECT block FROM f;
+		`, n)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		var newest, oldest *Block
+		for rows.Next() {
+			var raw []byte
+			if err := rows.Scan(&raw); err != nil {
+				return err
+			}
+
+			b, err := DecodeBlock(raw)
+			if err != nil {
+				return err
+			}
+			if b.Timestamp == 0 {
+				continue
+			}
+
+			if newest == nil {
+				newest = b
+			}
+			oldest = b
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		if newest == nil || newest.Height == oldest.Height {
+			return nil
+		}
+		interval = time.Duration(newest.Timestamp-oldest.Timestamp) * time.Second / time.Duration(newest.Height-oldest.Height)
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	return interval, nil
+}
+
+func (d *DB) Peers() ([]string, error) {
+	var peers []string
+	if err := d.db.TransactModeWithRetry(database.Read, func(tx *sql.Tx) error {
 		peers = nil
 
 		rows, err := tx.Query(`SELECT peer FROM peers`)
@@ -0,0 +1,1229 @@
+package cryptopuff
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func openTestDB(t testing.TB, opts ...DBOption) *DB {
+	d, err := OpenDB(filepath.Join(t.TempDir(), "test.db"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		d.Close()
+	})
+	return d
+}
+
+// testBlockNonce gives each block insertTestBlock creates a different hash.
+var testBlockNonce int64
+
+// insertTestBlock stores a block on top of previous at the given target
+// without mining or validating it, as if it had been added by AddBlock. Its
+// children are quick to mine with mineTestBlock if the target is low.
+func insertTestBlock(t *testing.T, d *DB, previous *Block, target Target) *Block {
+	testBlockNonce++
+	b := &Block{
+		PreviousHash: previous.Hash,
+		Height:       previous.Height + 1,
+		Nonce:        testBlockNonce,
+		RewardOutput: TxOutput{Destination: testRewardAddress, Amount: BlockSubsidy(previous.Height + 1)},
+		Timestamp:    time.Now().Add(-time.Hour).Unix(),
+		Target:       target,
+		Version:      BlockVersionForHeight(previous.Height + 1),
+	}
+	b.MerkleRoot = MerkleRoot(b.Version.HashAlgo(), nil)
+	if err := b.UpdateHash(); err != nil {
+		t.Fatal(err)
+	}
+	storeTestBlock(t, d, b)
+	return b
+}
+
+// storeTestBlock stores b, whose parent must already be stored, without
+// validating it.
+func storeTestBlock(t *testing.T, d *DB, b *Block) {
+	raw, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.db.Transact(func(tx *sql.Tx) error {
+		var previousWork int64
+		if err := tx.QueryRow(`SELECT work FROM blocks WHERE hash = ?`, b.PreviousHash).Scan(&previousWork); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO blocks (hash, previous_hash, height, block, miner, work)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, b.Hash, b.PreviousHash, b.Height, raw, b.RewardOutput.Destination, previousWork+b.Work()); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`
+			INSERT INTO balances (block_hash, address, balance)
+			SELECT ?, address, balance
+			FROM balances
+			WHERE block_hash = ?
+		`, b.Hash, b.PreviousHash)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// addTestChain mines and adds n blocks on top of previous, returning them
+// oldest first.
+func addTestChain(t *testing.T, d *DB, previous *Block, n int) []*Block {
+	var blocks []*Block
+	for i := 0; i < n; i++ {
+		b := mineTestBlock(t, previous, 0, nil)
+		if err := d.AddBlock(b); err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, b)
+		previous = b
+	}
+	return blocks
+}
+
+func assertBestBlock(t *testing.T, d *DB, want *Block) {
+	t.Helper()
+	best, err := d.BestBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if best.Hash != want.Hash {
+		t.Errorf("best block is %v at height %v, want %v at height %v", best.Hash, best.Height, want.Hash, want.Height)
+	}
+}
+
+func TestBestBlockMostWork(t *testing.T) {
+	d := openTestDB(t)
+
+	// The light chain is longer: four blocks of 2^8 work against two of 2^10.
+	light := insertTestBlock(t, d, GenesisBlock, MinTarget)
+	lightTip := addTestChain(t, d, light, 3)[2]
+	assertBestBlock(t, d, lightTip)
+
+	heavy := insertTestBlock(t, d, GenesisBlock, MinTarget+2)
+	heavyTip := addTestChain(t, d, heavy, 1)[0]
+	if heavyTip.Height >= lightTip.Height {
+		t.Fatalf("heavy tip height %v isn't below light tip height %v", heavyTip.Height, lightTip.Height)
+	}
+	assertBestBlock(t, d, heavyTip)
+
+	blocks, err := d.Blocks(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 3 || blocks[0].Hash != heavyTip.Hash || blocks[1].Hash != heavy.Hash || blocks[2].Hash != GenesisBlock.Hash {
+		t.Errorf("best chain has %v blocks from %v, want the heavy chain", len(blocks), blocks[0].Hash)
+	}
+}
+
+func TestBestBlockEqualWorkLowestHash(t *testing.T) {
+	d := openTestDB(t)
+
+	a := insertTestBlock(t, d, GenesisBlock, MinTarget)
+	b := insertTestBlock(t, d, GenesisBlock, MinTarget)
+
+	lowest := a
+	if string(b.Hash[:]) < string(a.Hash[:]) {
+		lowest = b
+	}
+	assertBestBlock(t, d, lowest)
+}
+
+func TestBestBlockEmptyChain(t *testing.T) {
+	d := openTestDB(t)
+	assertBestBlock(t, d, GenesisBlock)
+
+	// Nothing should empty the blocks table, but if it is, callers get
+	// ErrNoBlocks rather than sql.ErrNoRows.
+	if err := d.db.Transact(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`DELETE FROM blocks`)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := d.BestBlock(); err != ErrNoBlocks {
+		t.Errorf("BestBlock returned %v, %v, want ErrNoBlocks", b, err)
+	}
+	if _, err := d.PruneMempool(); err != ErrNoBlocks {
+		t.Errorf("PruneMempool returned %v, want ErrNoBlocks", err)
+	}
+}
+
+func TestBestBlockMoreWorkBeatsLowerHash(t *testing.T) {
+	d := openTestDB(t)
+
+	// Add lighter blocks until one's hash sorts before the heavier block's, so
+	// the hash tie-break alone would pick the wrong block.
+	heavy := insertTestBlock(t, d, GenesisBlock, MinTarget+1)
+	for {
+		light := insertTestBlock(t, d, GenesisBlock, MinTarget)
+		if string(light.Hash[:]) < string(heavy.Hash[:]) {
+			break
+		}
+	}
+	assertBestBlock(t, d, heavy)
+}
+
+// peerChain returns blocks newest first, as a peer sends them to AddBlocks.
+func peerChain(blocks ...*Block) []Block {
+	chain := make([]Block, len(blocks))
+	for i, b := range blocks {
+		chain[len(blocks)-1-i] = *b
+	}
+	return chain
+}
+
+// fundTestAddress credits an address in a block's balances, as if it had been
+// paid in an earlier block.
+func fundTestAddress(t *testing.T, d *DB, b *Block, a Address, amount int64) {
+	if err := d.db.Transact(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`INSERT INTO balances (block_hash, address, balance) VALUES (?, ?, ?)`, b.Hash, a, amount)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAddBlocksShorterHeavierChain(t *testing.T) {
+	d := openTestDB(t)
+
+	light := insertTestBlock(t, d, GenesisBlock, MinTarget)
+	lightTip := addTestChain(t, d, light, 4)[3]
+	heavy := insertTestBlock(t, d, GenesisBlock, MinTarget+2)
+	assertBestBlock(t, d, lightTip)
+
+	// Three blocks of 2^10 work against five of 2^8.
+	heavy2 := mineTestBlock(t, heavy, 0, nil)
+	heavy3 := mineTestBlock(t, heavy2, 0, nil)
+	if err := d.AddBlocks(peerChain(GenesisBlock, heavy, heavy2, heavy3)); err != nil {
+		t.Fatal(err)
+	}
+	assertBestBlock(t, d, heavy3)
+}
+
+func TestAddBlocksLongerLighterChain(t *testing.T) {
+	d := openTestDB(t)
+
+	heavy := insertTestBlock(t, d, GenesisBlock, MinTarget+2)
+	heavyTip := addTestChain(t, d, heavy, 2)[1]
+	light := insertTestBlock(t, d, GenesisBlock, MinTarget)
+
+	lightChain := []*Block{GenesisBlock, light}
+	for i := 0; i < 5; i++ {
+		lightChain = append(lightChain, mineTestBlock(t, lightChain[len(lightChain)-1], 0, nil))
+	}
+	if err := d.AddBlocks(peerChain(lightChain...)); err != nil {
+		t.Fatal(err)
+	}
+	assertBestBlock(t, d, heavyTip)
+
+	// The lighter chain isn't stored at all.
+	if _, err := d.BlockByHash(lightChain[len(lightChain)-1].Hash); err != ErrUnknownBlock {
+		t.Errorf("lighter chain's tip: got %v, want %v", err, ErrUnknownBlock)
+	}
+}
+
+// TestAddBlocksBatches checks that a long chain is committed in batches of
+// MaxInflightBlocks, so an invalid block only loses the batch it is in.
+func TestAddBlocksBatches(t *testing.T) {
+	d := openTestDB(t, MaxInflightBlocks(3))
+	first := insertTestBlock(t, d, GenesisBlock, MinTarget)
+
+	chain := []*Block{first}
+	for i := 1; i <= 8; i++ {
+		b := mineTestBlock(t, chain[i-1], 0, nil)
+		if i == 5 {
+			b.RewardOutput.Amount = MaxBlockReward + 1
+			remineTestBlock(t, b)
+		}
+		chain = append(chain, b)
+	}
+	if _, ok := errors.Cause(d.AddBlocks(peerChain(chain...))).(InvalidBlockError); !ok {
+		t.Fatal("chain with an invalid block was accepted")
+	}
+
+	// The first batch was committed before the invalid block was reached,
+	// but nothing from the second.
+	assertBestBlock(t, d, chain[3])
+	if _, err := d.BlockByHash(chain[4].Hash); err != ErrUnknownBlock {
+		t.Errorf("block in the invalid batch: got %v, want %v", err, ErrUnknownBlock)
+	}
+}
+
+// TestAddKeysRollback checks that a bundle is imported all-or-nothing, by
+// making the database reject the last key.
+func TestAddKeysRollback(t *testing.T) {
+	d := openTestDB(t)
+	keys := []*rsa.PrivateKey{testKey(t, 1), testKey(t, 2), testKey(t, 3)}
+	bad := AddressFromKey(V3, &keys[2].PublicKey)
+	if err := d.db.Transact(func(tx *sql.Tx) error {
+		_, err := tx.Exec(fmt.Sprintf(`
+			CREATE TRIGGER reject_key BEFORE INSERT ON keys
+			WHEN NEW.address = '%v'
+			BEGIN SELECT RAISE(ABORT, 'bad key'); END
+		`, bad))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if addrs, err := d.AddKeys(V3, keys); err == nil {
+		t.Fatalf("AddKeys returned %v, want an error", addrs)
+	}
+	for _, k := range keys {
+		if _, err := d.Key(AddressFromKey(V3, &k.PublicKey)); err != sql.ErrNoRows {
+			t.Errorf("Key(%v): %v, want the key rolled back", AddressFromKey(V3, &k.PublicKey), err)
+		}
+	}
+
+	addrs, err := d.AddKeys(V3, keys[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, a := range addrs {
+		if k, err := d.Key(a); err != nil {
+			t.Error(err)
+		} else if !k.Equal(keys[i]) {
+			t.Errorf("Key(%v) returned a different key", a)
+		}
+	}
+}
+
+func TestCoinbaseMaturity(t *testing.T) {
+	d := openTestDB(t)
+	k := testKey(t, 14)
+	miner := AddressFromKey(V3, &k.PublicKey)
+
+	// Payouts only mature from BlockVersion3, so start just below it.
+	start := insertTestBlock(t, d, &Block{Hash: GenesisBlock.Hash, Height: BlockVersion3Height - 2}, MinTarget)
+	rewarded := addTestChainTo(t, d, start, miner, 1)[0]
+	tip := addTestChain(t, d, rewarded, CoinbaseMaturity-2)
+	spend := []SignedTx{*signTestTx(t, k, TxVersion3, 10, 1)}
+
+	// The payout is still immature at the height before maturity.
+	early := mineTestBlock(t, tip[len(tip)-1], 0, spend)
+	if early.Height != rewarded.Height+CoinbaseMaturity-1 {
+		t.Fatalf("early block at height %v, want %v", early.Height, rewarded.Height+CoinbaseMaturity-1)
+	}
+	if err := d.AddBlock(early); err == nil || !strings.Contains(err.Error(), "immature") {
+		t.Errorf("block spending an immature payout: %v, want it rejected as immature", err)
+	}
+
+	// The next block is at a retarget height, and the chain was mined in
+	// far less time than it aims for.
+	matured := addTestChain(t, d, tip[len(tip)-1], 1)[0]
+	b := mineTestBlock(t, matured, 0, spend)
+	b.Target = matured.Target + 1
+	remineTestBlock(t, b)
+	if err := d.AddBlock(b); err != nil {
+		t.Fatalf("spending a payout at maturity: %v", err)
+	}
+	assertBestBlock(t, d, b)
+}
+
+func TestMaxPendingTxsPerSource(t *testing.T) {
+	d := openTestDB(t, MaxPendingTxsPerSource(3))
+	parent := insertTestBlock(t, d, GenesisBlock, MinTarget)
+
+	k := testKey(t, 30)
+	fundTestAddress(t, d, parent, AddressFromKey(V3, &k.PublicKey), 1000)
+	other := testKey(t, 31)
+	fundTestAddress(t, d, parent, AddressFromKey(V3, &other.PublicKey), 1000)
+
+	// Once the source has three pending transactions, each new one either
+	// evicts its cheapest or is rejected.
+	var flood []*SignedTx
+	for _, fee := range []int64{5, 2, 7, 3, 6, 1} {
+		stx := signTestTx(t, k, TxVersion3, 10, fee)
+		d.AddTx(stx)
+		flood = append(flood, stx)
+	}
+	survivors := map[Hash]bool{flood[0].Hash: true, flood[2].Hash: true, flood[4].Hash: true}
+	for _, stx := range flood {
+		_, err := d.TxByHash(stx.Hash)
+		if survivors[stx.Hash] && err != nil {
+			t.Errorf("transaction with fee %v: %v", stx.Fee, err)
+		} else if !survivors[stx.Hash] && err != ErrUnknownTx {
+			t.Errorf("transaction with fee %v: %v, want it evicted or rejected", stx.Fee, err)
+		}
+	}
+
+	// Other sources aren't affected.
+	if err := d.AddTx(signTestTx(t, other, TxVersion3, 10, 1)); err != nil {
+		t.Errorf("transaction from another source: %v", err)
+	}
+}
+
+func TestSelfSend(t *testing.T) {
+	d := openTestDB(t)
+	parent := insertTestBlock(t, d, GenesisBlock, MinTarget)
+	k := testKey(t, 95)
+	source := AddressFromKey(V3, &k.PublicKey)
+	fundTestAddress(t, d, parent, source, 100)
+
+	stx, err := Tx{
+		TxOutput: TxOutput{Destination: source, Amount: 10},
+		Source:   source,
+		Fee:      1,
+		Version:  TxVersion3,
+	}.Sign(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.AddTx(stx); err == nil {
+		t.Fatal("accepted a self-send")
+	} else if _, ok := err.(InvalidBlockError); !ok {
+		t.Errorf("self-send rejected with %v, want an InvalidBlockError", err)
+	}
+
+	// It is only policy, so a block containing one is valid and the source
+	// just pays the fee.
+	mined := mineTestBlock(t, parent, 0, []SignedTx{*stx})
+	if err := d.AddBlock(mined); err != nil {
+		t.Fatal(err)
+	}
+	if balances, err := d.BalancesAt(mined.Hash); err != nil {
+		t.Fatal(err)
+	} else if balances[source.String()] != 99 {
+		t.Errorf("source's balance is %v, want 99", balances[source.String()])
+	}
+
+	// Once that block goes stale the self-send is pending again, but isn't
+	// mined.
+	tip := addTestChain(t, d, parent, 2)[1]
+	stxs, err := d.PendingTxs(tip.Hash, txsPerMinedBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pending := range stxs {
+		if pending.Hash == stx.Hash {
+			t.Error("self-send offered to the miner")
+		}
+	}
+}
+
+func TestFeeFloor(t *testing.T) {
+	d := openTestDB(t, FeeFloor(4, 10))
+	parent := insertTestBlock(t, d, GenesisBlock, MinTarget)
+
+	var keys []*rsa.PrivateKey
+	for seed := int64(100); seed < 105; seed++ {
+		k := testKey(t, seed)
+		fundTestAddress(t, d, parent, AddressFromKey(V3, &k.PublicKey), 100)
+		keys = append(keys, k)
+	}
+	floor := func() int64 {
+		estimate, err := d.FeeEstimate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return estimate.Floor
+	}
+
+	// The floor rises with the square of the occupancy as the mempool
+	// fills, turning away cheaper transactions.
+	var pending []SignedTx
+	for i, want := range []int64{0, 1, 3, 6} {
+		if got := floor(); got != want {
+			t.Errorf("floor with %v pending is %v, want %v", i, got, want)
+		}
+		if want > 0 {
+			if err := d.AddTx(signTestTx(t, keys[i], TxVersion3, 10, want-1)); err == nil {
+				t.Errorf("accepted a fee of %v below the floor of %v", want-1, want)
+			}
+		}
+		stx := signTestTx(t, keys[i], TxVersion3, 10, want)
+		if err := d.AddTx(stx); err != nil {
+			t.Fatal(err)
+		}
+		pending = append(pending, *stx)
+	}
+	if got := floor(); got != 10 {
+		t.Errorf("floor at capacity is %v, want the maximum of 10", got)
+	}
+	if err := d.AddTx(signTestTx(t, keys[4], TxVersion3, 10, 9)); err == nil {
+		t.Error("accepted a fee below the maximum floor at capacity")
+	}
+
+	// Mining the pending transactions drains the mempool and the floor.
+	if err := d.AddBlock(mineTestBlock(t, parent, 0, pending)); err != nil {
+		t.Fatal(err)
+	}
+	if got := floor(); got != 0 {
+		t.Errorf("floor after draining is %v, want 0", got)
+	}
+}
+
+func TestRescan(t *testing.T) {
+	d := openTestDB(t)
+
+	k := testKey(t, 7)
+	a, err := d.AddKey(V3, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parent := insertTestBlock(t, d, GenesisBlock, MinTarget)
+	reward := mineTestBlockTo(t, parent, 0, a, nil)
+	if err := d.AddBlock(reward); err != nil {
+		t.Fatal(err)
+	}
+	stx := signTestTx(t, k, TxVersion3, 10, 1)
+	tip := mineTestBlock(t, reward, 0, []SignedTx{*stx})
+	if err := d.AddBlock(tip); err != nil {
+		t.Fatal(err)
+	}
+	want := reward.RewardOutput.Amount - stx.RequiredBalance()
+
+	// Lose the wallet's copy of the transaction, and make the chain state
+	// disagree with the chain, which Rescan must report but leave alone.
+	if err := d.db.Transact(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM block_txs WHERE tx_hash = ?`, stx.Hash); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM included_txs WHERE tx_hash = ?`, stx.Hash); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM txs WHERE hash = ?`, stx.Hash); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`UPDATE balances SET balance = 1000 WHERE block_hash = ? AND address = ?`, tip.Hash, a)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	addrs, err := d.Rescan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, addr := range addrs {
+		if addr.Address.Equal(a) {
+			found = true
+			if addr.Balance != want {
+				t.Errorf("rescanned balance = %v, want %v", addr.Balance, want)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("rescan didn't return wallet address %v", a)
+	}
+
+	addrs, err = d.Addresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range addrs {
+		if addr.Address.Equal(a) && addr.Balance != 1000 {
+			t.Errorf("balance after rescan = %v, want the chain state's 1000 left alone", addr.Balance)
+		}
+	}
+
+	ptxs, err := d.MyTxs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ptxs) != 1 || ptxs[0].Hash != stx.Hash {
+		t.Errorf("wallet transactions after rescan = %+v, want %v restored", ptxs, stx.Hash)
+	}
+}
+
+func TestDustThreshold(t *testing.T) {
+	k := testKey(t, 16)
+	dust, enough := signTestTx(t, k, TxVersion3, 4, 1), signTestTx(t, k, TxVersion3, 5, 1)
+
+	for _, strict := range []bool{false, true} {
+		d := openTestDB(t, DustThreshold(5), StrictDust(strict))
+		parent := insertTestBlock(t, d, GenesisBlock, MinTarget)
+		fundTestAddress(t, d, parent, dust.Source, 100)
+
+		if _, ok := errors.Cause(d.AddTx(dust)).(InvalidBlockError); !ok {
+			t.Errorf("strict %v: transaction below the dust threshold wasn't rejected", strict)
+		}
+		if err := d.AddTx(enough); err != nil {
+			t.Errorf("strict %v: transaction at the dust threshold: %v", strict, err)
+		}
+
+		// Only strict nodes reject blocks with dust mined by other nodes.
+		err := d.AddBlock(mineTestBlock(t, parent, 0, []SignedTx{*dust}))
+		if strict && err == nil {
+			t.Error("strict node accepted a block with dust")
+		} else if !strict && err != nil {
+			t.Errorf("block with dust: %v", err)
+		}
+	}
+}
+
+func TestAddBlockOnTipStale(t *testing.T) {
+	d := openTestDB(t)
+	first := insertTestBlock(t, d, GenesisBlock, MinTarget)
+
+	// The candidate is assembled on first, then a peer's block moves the tip
+	// before it is committed.
+	candidate := mineTestBlockTo(t, first, 0, Address{0x01}, nil)
+	tip := addTestChainTo(t, d, first, Address{0x02}, 1)[0]
+
+	if err := d.AddBlockOnTip(candidate); err != ErrStaleTip {
+		t.Errorf("AddBlockOnTip returned %v, want ErrStaleTip", err)
+	}
+	assertBestBlock(t, d, tip)
+	if _, err := d.BlockByHash(candidate.Hash); err == nil {
+		t.Error("stored the candidate as a fork")
+	}
+
+	// Assembled again on the new tip, it is added.
+	candidate = mineTestBlockTo(t, tip, 0, Address{0x01}, nil)
+	if err := d.AddBlockOnTip(candidate); err != nil {
+		t.Fatal(err)
+	}
+	assertBestBlock(t, d, candidate)
+}
+
+func TestMaxBlockRate(t *testing.T) {
+	d := openTestDB(t, MaxBlockRate(30))
+	first := insertTestBlock(t, d, GenesisBlock, MinTarget)
+
+	// mine returns blockRateWindow blocks on first, spaced apart by the
+	// given number of seconds, so the last is checked against first.
+	mine := func(addr Address, spacing int64) []*Block {
+		var blocks []*Block
+		for previous := first; len(blocks) < blockRateWindow; previous = blocks[len(blocks)-1] {
+			b := mineTestBlockTo(t, previous, 0, addr, nil)
+			b.Timestamp = first.Timestamp + 1 + int64(len(blocks))*spacing
+			remineTestBlock(t, b)
+			blocks = append(blocks, b)
+		}
+		return blocks
+	}
+
+	// At 30 blocks a minute, a window of blocks takes at least 200s.
+	for _, b := range mine(Address{0x01}, 3) {
+		if err := d.AddBlock(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	implausible := mine(Address{0x02}, 1)
+	last := implausible[len(implausible)-1]
+	for _, b := range implausible[:len(implausible)-1] {
+		if err := d.AddBlock(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := d.AddBlock(last)
+	if _, ok := err.(InvalidBlockError); !ok {
+		t.Errorf("block %vs after its ancestor %v blocks back: %v, want an InvalidBlockError", last.Timestamp-first.Timestamp, blockRateWindow, err)
+	}
+}
+
+func TestPendingTxSpendsPendingOutput(t *testing.T) {
+	d := openTestDB(t)
+
+	payer, payee := testKey(t, 10), testKey(t, 11)
+	parent := insertTestBlock(t, d, GenesisBlock, MinTarget)
+	fundTestAddress(t, d, parent, AddressFromKey(V3, &payer.PublicKey), 100)
+
+	payment, err := (&Tx{
+		TxOutput: TxOutput{Destination: AddressFromKey(V3, &payee.PublicKey), Amount: 50},
+		Source:   AddressFromKey(V3, &payer.PublicKey),
+		Fee:      1,
+		Version:  TxVersion3,
+	}).Sign(payer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.AddTx(payment); err != nil {
+		t.Fatal(err)
+	}
+
+	// The child pays a higher fee, so is considered before its parent.
+	child := signTestTx(t, payee, TxVersion3, 40, 5)
+	if err := d.AddTx(child); err != nil {
+		t.Fatalf("spending a pending output: %v", err)
+	}
+	// The child's spending counts against the pending output.
+	if err := d.AddTx(signTestTx(t, payee, TxVersion3, 20, 1)); err == nil {
+		t.Error("pending output was spent twice")
+	}
+
+	stxs, err := d.PendingTxs(parent.Hash, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stxs) != 2 || stxs[0].Hash != payment.Hash || stxs[1].Hash != child.Hash {
+		t.Fatalf("selected %v transactions, want the parent then the child", len(stxs))
+	}
+	b := mineTestBlock(t, parent, 0, stxs)
+	if err := d.AddBlock(b); err != nil {
+		t.Fatalf("block with a parent and child: %v", err)
+	}
+	assertBestBlock(t, d, b)
+}
+
+func TestTxByHashStaleFork(t *testing.T) {
+	d := openTestDB(t)
+
+	k := testKey(t, 6)
+	stx := signTestTx(t, k, TxVersion3, 10, 1)
+	parent := insertTestBlock(t, d, GenesisBlock, MinTarget)
+	fundTestAddress(t, d, parent, stx.Source, 100)
+
+	// The transaction is mined at height 2 on a fork that goes stale, and at
+	// height 3 on the best chain.
+	stale := mineTestBlock(t, parent, 0, []SignedTx{*stx})
+	if err := d.AddBlock(stale); err != nil {
+		t.Fatal(err)
+	}
+	best := addTestChain(t, d, parent, 1)[0]
+	best = mineTestBlock(t, best, 0, []SignedTx{*stx})
+	if err := d.AddBlock(best); err != nil {
+		t.Fatal(err)
+	}
+	best = addTestChain(t, d, best, 1)[0]
+	assertBestBlock(t, d, best)
+
+	ptx, err := d.TxByHash(stx.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ptx.Included || ptx.Height != 3 {
+		t.Errorf("transaction included = %v at height %v, want included at height 3", ptx.Included, ptx.Height)
+	}
+}
+
+func TestPruneBalancesFromBestBlock(t *testing.T) {
+	d := openTestDB(t, Archive(false), BalanceHistory(2))
+
+	// The best chain is two blocks of 2^11 work, and a longer fork has eight
+	// of 2^8.
+	heavy := insertTestBlock(t, d, GenesisBlock, MinTarget+3)
+	heavyTip := addTestChain(t, d, heavy, 1)[0]
+	light := insertTestBlock(t, d, GenesisBlock, MinTarget)
+	addTestChain(t, d, light, 7)
+	assertBestBlock(t, d, heavyTip)
+
+	if _, err := d.BalancesAt(heavyTip.Hash); err != nil {
+		t.Errorf("balances at the best block: %v", err)
+	}
+	addTestChain(t, d, heavyTip, 1)
+}
+
+func TestPrunedForkBelowHorizon(t *testing.T) {
+	d := openTestDB(t, Archive(false), BalanceHistory(2))
+	first := insertTestBlock(t, d, GenesisBlock, MinTarget)
+	chain := addTestChain(t, d, first, 5)
+
+	// chain[0] is four blocks below the tip, beyond the balance history.
+	fork := mineTestBlockTo(t, chain[0], 0, Address{0x56, 0x78}, nil)
+	if err := d.AddBlock(fork); errors.Cause(err) != ErrPruned {
+		t.Errorf("fork below the horizon: got error %v, want %v", err, ErrPruned)
+	}
+	if _, err := d.BalanceAt(testRewardAddress, chain[0].Height); err != ErrPruned {
+		t.Errorf("balance below the horizon: got error %v, want %v", err, ErrPruned)
+	}
+}
+
+func TestArchiveKeepsEveryHeight(t *testing.T) {
+	// Nodes are archive nodes unless asked to prune, whatever their balance
+	// history.
+	d := openTestDB(t, BalanceHistory(2))
+	first := insertTestBlock(t, d, GenesisBlock, MinTarget)
+	chain := append([]*Block{first}, addTestChain(t, d, first, 5)...)
+
+	for _, b := range chain {
+		if _, err := d.BalanceAt(testRewardAddress, b.Height); err != nil {
+			t.Errorf("balance at height %v: %v", b.Height, err)
+		}
+	}
+	if err := d.AddBlock(mineTestBlockTo(t, first, 0, Address{0x56, 0x78}, nil)); err != nil {
+		t.Errorf("fork off the oldest block: %v", err)
+	}
+}
+
+// TestBlockPayoutCredited pins the fee model: the miner is credited the
+// subsidy plus every transaction's fee, and each source is debited its amount
+// plus its fee.
+func TestBlockPayoutCredited(t *testing.T) {
+	d := openTestDB(t)
+	k1, k2 := testKey(t, 12), testKey(t, 13)
+	src1, src2 := AddressFromKey(V3, &k1.PublicKey), AddressFromKey(V3, &k2.PublicKey)
+	miner := Address{0x9a, 0xbc}
+
+	parent := insertTestBlock(t, d, GenesisBlock, MinTarget)
+	fundTestAddress(t, d, parent, src1, 100)
+	fundTestAddress(t, d, parent, src2, 100)
+
+	stxs := []SignedTx{*signTestTx(t, k1, TxVersion3, 10, 3), *signTestTx(t, k2, TxVersion3, 20, 7)}
+	b := mineTestBlockTo(t, parent, 0, miner, stxs)
+	if b.RewardOutput.Amount != BlockSubsidy(b.Height) {
+		t.Fatalf("block claims %v, want the subsidy %v", b.RewardOutput.Amount, BlockSubsidy(b.Height))
+	}
+	if payout, err := b.Payout(); err != nil {
+		t.Fatal(err)
+	} else if payout != BlockSubsidy(b.Height)+10 {
+		t.Errorf("Payout() = %v, want the subsidy plus 10 in fees", payout)
+	}
+	if err := d.AddBlock(b); err != nil {
+		t.Fatal(err)
+	}
+
+	balances, err := d.BalancesAt(b.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for a, want := range map[string]int64{
+		miner.String():             BlockSubsidy(b.Height) + 10,
+		testRewardAddress.String(): 30,
+		src1.String():              87,
+		src2.String():              73,
+	} {
+		if balances[a] != want {
+			t.Errorf("balance of %v is %v, want %v", a, balances[a], want)
+		}
+	}
+}
+
+func TestMaxMempoolTxsFlood(t *testing.T) {
+	d := openTestDB(t, MaxMempoolTxs(3))
+	parent := insertTestBlock(t, d, GenesisBlock, MinTarget)
+
+	var keys []*rsa.PrivateKey
+	for seed := int64(20); seed < 27; seed++ {
+		k := testKey(t, seed)
+		fundTestAddress(t, d, parent, AddressFromKey(V3, &k.PublicKey), 100)
+		keys = append(keys, k)
+	}
+
+	// The cheapest transaction was mined on a fork that went stale, so it
+	// is pending again but must not be evicted.
+	confirmed := signTestTx(t, keys[0], TxVersion3, 10, 1)
+	if err := d.AddBlock(mineTestBlockTo(t, parent, 0, Address{0x56, 0x78}, []SignedTx{*confirmed})); err != nil {
+		t.Fatal(err)
+	}
+	addTestChain(t, d, parent, 2)
+
+	// Once the mempool is full, each transaction either evicts a cheaper
+	// one or is rejected.
+	var flood []*SignedTx
+	for i, fee := range []int64{5, 2, 7, 3, 6, 4} {
+		stx := signTestTx(t, keys[i+1], TxVersion3, 10, fee)
+		d.AddTx(stx)
+		flood = append(flood, stx)
+	}
+
+	survivors := map[Hash]bool{confirmed.Hash: true, flood[2].Hash: true, flood[4].Hash: true}
+	for _, stx := range append(flood, confirmed) {
+		_, err := d.TxByHash(stx.Hash)
+		if survivors[stx.Hash] && err != nil {
+			t.Errorf("transaction with fee %v: %v", stx.Fee, err)
+		} else if !survivors[stx.Hash] && err != ErrUnknownTx {
+			t.Errorf("transaction with fee %v: %v, want it evicted or rejected", stx.Fee, err)
+		}
+	}
+}
+
+// TestWalletSummaryConsistent checks that a summary taken while blocks are
+// being added reports the balances at the same tip as its height.
+func TestWalletSummaryConsistent(t *testing.T) {
+	d := openTestDB(t)
+	first := insertTestBlock(t, d, GenesisBlock, MinTarget)
+	miner, err := d.AddKey(V3, testKey(t, 80))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var blocks []*Block
+	for previous := first; len(blocks) < 30; previous = blocks[len(blocks)-1] {
+		blocks = append(blocks, mineTestBlockTo(t, previous, 0, miner, nil))
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, b := range blocks {
+			if err := d.AddBlock(b); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+
+		summary, err := d.WalletSummary(10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want int64
+		for h := first.Height + 1; h <= summary.Height; h++ {
+			want += BlockSubsidy(h)
+		}
+		found := false
+		for _, a := range summary.Addresses {
+			if !a.Address.Equal(miner) {
+				continue
+			}
+			found = true
+			if a.Balance != want {
+				t.Fatalf("summary at height %v has balance %v, want %v", summary.Height, a.Balance, want)
+			}
+		}
+		if !found {
+			t.Fatalf("summary doesn't include the miner's address %v", miner)
+		}
+	}
+}
+
+func TestAddressActivity(t *testing.T) {
+	d := openTestDB(t)
+	k := testKey(t, 15)
+	a := AddressFromKey(V3, &k.PublicKey)
+	first := insertTestBlock(t, d, GenesisBlock, MinTarget)
+	fundTestAddress(t, d, first, a, 100)
+
+	// a mines a block, then spends in the next.
+	mined := addTestChainTo(t, d, first, a, 1)[0]
+	spent := mineTestBlock(t, mined, 0, []SignedTx{*signTestTx(t, k, TxVersion3, 10, 1)})
+	if err := d.AddBlock(spent); err != nil {
+		t.Fatal(err)
+	}
+	addTestChain(t, d, spent, 1)
+
+	activity, err := d.AddressActivity(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if activity.TxCount != 1 || activity.BlocksMined != 1 {
+		t.Errorf("%v transactions and %v blocks mined, want 1 of each", activity.TxCount, activity.BlocksMined)
+	}
+	if activity.FirstHeight == nil || *activity.FirstHeight != mined.Height || activity.LastHeight == nil || *activity.LastHeight != spent.Height {
+		t.Errorf("activity from height %v to %v, want %v to %v", activity.FirstHeight, activity.LastHeight, mined.Height, spent.Height)
+	}
+
+	// Heights are nil, rather than the genesis block's, without activity.
+	activity, err = d.AddressActivity(Address{0x9a})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if activity.TxCount != 0 || activity.BlocksMined != 0 || activity.FirstHeight != nil || activity.LastHeight != nil {
+		t.Errorf("unused address has activity %+v", activity)
+	}
+}
+
+func TestEverFunded(t *testing.T) {
+	d := openTestDB(t)
+
+	parent := insertTestBlock(t, d, GenesisBlock, MinTarget)
+	funded := Address{0x01, 0x01}
+	fundTestAddress(t, d, parent, funded, 100)
+
+	for _, test := range []struct {
+		a    Address
+		want bool
+	}{
+		{funded, true},
+		{Address{0x02, 0x02}, false},
+	} {
+		if err := d.db.Transact(func(tx *sql.Tx) error {
+			got, err := everFunded(tx, test.a)
+			if err != nil {
+				return err
+			}
+			if got != test.want {
+				t.Errorf("everFunded(%v) = %v, want %v", test.a, got, test.want)
+			}
+
+			// Every block's balances are kept, so a scan wouldn't scale.
+			var plan string
+			rows, err := tx.Query(`EXPLAIN QUERY PLAN SELECT 1 FROM balances WHERE address = ?`, test.a)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var id, parent, unused int
+				var detail string
+				if err := rows.Scan(&id, &parent, &unused, &detail); err != nil {
+					return err
+				}
+				plan += detail + "\n"
+			}
+			if !strings.Contains(plan, "balances_address") {
+				t.Errorf("balances lookup by address doesn't use an index:\n%v", plan)
+			}
+			return rows.Err()
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func isUnknownKey(err error) bool {
+	_, ok := errors.Cause(err).(UnknownKeyError)
+	return ok
+}
+
+func TestMinerKeystore(t *testing.T) {
+	ks, err := OpenKeystore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := ks.AddKey(testKey(t, 2), DefaultVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown := AddressFromKey(DefaultVersion, &testKey(t, 3).PublicKey)
+
+	// Without the keystore, its addresses are as unknown as any other.
+	d := openTestDB(t)
+	if err := d.SetMinerAddress(stored); !isUnknownKey(err) {
+		t.Errorf("SetMinerAddress without a keystore: %v, want UnknownKeyError", err)
+	}
+
+	d = openTestDB(t, MinerKeystore(ks))
+	if err := d.SetMinerAddress(unknown); !isUnknownKey(err) {
+		t.Errorf("SetMinerAddress of an address in neither: %v, want UnknownKeyError", err)
+	}
+	if err := d.SetMinerAddress(stored); err != nil {
+		t.Fatal(err)
+	}
+
+	// The keystore's key is enough for a node that requires miner keys.
+	if fallback, err := d.EnsureMinerAddress(true); err != nil {
+		t.Fatal(err)
+	} else if fallback != nil {
+		t.Errorf("replaced keystore miner address with %v", fallback)
+	}
+	if addrs, _, err := d.MinerAddresses(); err != nil {
+		t.Fatal(err)
+	} else if len(addrs) != 1 || !addrs[0].Equal(stored) {
+		t.Errorf("miner addresses are %v, want %v", addrs, stored)
+	}
+}
+
+func TestRelayTxsStrict(t *testing.T) {
+	d := openTestDB(t, RelayOnlyValid(true))
+
+	spent, funded := testKey(t, 8), testKey(t, 9)
+	parent := insertTestBlock(t, d, GenesisBlock, MinTarget)
+	fundTestAddress(t, d, parent, AddressFromKey(V3, &spent.PublicKey), 100)
+	fundTestAddress(t, d, parent, AddressFromKey(V3, &funded.PublicKey), 100)
+
+	stale := signTestTx(t, spent, TxVersion3, 80, 1)
+	valid := signTestTx(t, funded, TxVersion3, 80, 1)
+	for _, stx := range []*SignedTx{stale, valid} {
+		if err := d.AddTx(stx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A block spends most of stale's source's balance in another
+	// transaction, so stale can no longer be mined on top of it.
+	tip := mineTestBlock(t, parent, 0, []SignedTx{*signTestTx(t, spent, TxVersion3, 50, 1)})
+	if err := d.AddBlock(tip); err != nil {
+		t.Fatal(err)
+	}
+
+	stxs, err := d.RelayTxs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stxs) != 1 || stxs[0].Hash != valid.Hash {
+		t.Errorf("relayed %v transactions, want only %v", len(stxs), valid.Hash)
+	}
+
+	// Serving peers doesn't change the mempool.
+	if _, err := d.TxByHash(stale.Hash); err != nil {
+		t.Errorf("unrelayed transaction was deleted: %v", err)
+	}
+}
+
+func TestEnsureMinerAddress(t *testing.T) {
+	unknown := AddressFromKey(DefaultVersion, &testKey(t, 17).PublicKey)
+	for _, test := range []struct {
+		name       string
+		rows       []string
+		requireKey bool
+		fallback   bool
+	}{
+		{"missing", nil, false, true},
+		{"corrupt", []string{"not an address"}, false, true},
+		{"one corrupt", []string{unknown.String(), "not an address"}, false, true},
+		{"no key", []string{unknown.String()}, false, false},
+		{"no key required", []string{unknown.String()}, true, true},
+	} {
+		d := openTestDB(t)
+		if err := d.db.Transact(func(tx *sql.Tx) error {
+			if _, err := tx.Exec(`DELETE FROM miner_address`); err != nil {
+				return err
+			}
+			for _, row := range test.rows {
+				if _, err := tx.Exec(`INSERT INTO miner_address (address) VALUES (?)`, row); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		fallback, err := d.EnsureMinerAddress(test.requireKey)
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+		if !test.fallback {
+			if fallback != nil {
+				t.Errorf("%v: replaced a usable miner address with %v", test.name, fallback)
+			}
+			continue
+		}
+		if fallback == nil {
+			t.Errorf("%v: miner address wasn't replaced", test.name)
+			continue
+		}
+
+		// The fallback is the only miner address, and its key is in the
+		// wallet.
+		if addrs, _, err := d.MinerAddresses(); err != nil {
+			t.Fatal(err)
+		} else if len(addrs) != 1 || !addrs[0].Equal(fallback) {
+			t.Errorf("%v: miner addresses are %v, want %v", test.name, addrs, fallback)
+		}
+		if _, err := d.Key(fallback); err != nil {
+			t.Errorf("%v: %v", test.name, err)
+		}
+	}
+}
+
+func TestBlocksByMiner(t *testing.T) {
+	d := openTestDB(t)
+	miner, other := Address{0x01}, Address{0x02}
+	first := insertTestBlock(t, d, GenesisBlock, MinTarget)
+
+	mined := addTestChainTo(t, d, first, miner, 2)
+	mined = append(mined, addTestChainTo(t, d, addTestChainTo(t, d, mined[1], other, 1)[0], miner, 1)...)
+
+	// A shorter fork with a block mined to the same address stays stale.
+	stale := mineTestBlockTo(t, mined[0], 0, Address{0x04}, nil)
+	if err := d.AddBlock(stale); err != nil {
+		t.Fatal(err)
+	}
+	addTestChainTo(t, d, stale, miner, 1)
+	assertBestBlock(t, d, mined[2])
+
+	blocks, err := d.BlocksByMiner(miner, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []Hash
+	for _, b := range blocks {
+		got = append(got, b.Hash)
+	}
+	want := []Hash{mined[2].Hash, mined[1].Hash, mined[0].Hash}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("BlocksByMiner returned %v, want %v", got, want)
+	}
+
+	if blocks, err := d.BlocksByMiner(miner, 1, 1); err != nil {
+		t.Fatal(err)
+	} else if len(blocks) != 1 || blocks[0].Hash != mined[1].Hash {
+		t.Errorf("second page is %v blocks, want %v", len(blocks), mined[1].Hash)
+	}
+}
+
+func TestECDSAWalletKey(t *testing.T) {
+	d := openTestDB(t)
+	k := testECDSAKey(t)
+	a, err := d.AddECDSAKey(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, err := AddressFromECDSAKey(&k.PublicKey); err != nil {
+		t.Fatal(err)
+	} else if !a.Equal(want) {
+		t.Fatalf("AddECDSAKey returned %v, want %v", a, want)
+	}
+
+	if got, err := d.ECDSAKey(a); err != nil {
+		t.Fatal(err)
+	} else if !got.Equal(k) {
+		t.Error("ECDSAKey returned a different key")
+	}
+	if _, err := d.Key(a); err == nil {
+		t.Error("Key returned an RSA key for a v4 address")
+	}
+	if _, err := d.AddKey(V4, testKey(t, 1)); err == nil {
+		t.Error("AddKey accepted an RSA key for a v4 address")
+	}
+
+	keys, err := d.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, key := range keys {
+		if key.Address.Equal(a) {
+			found = true
+			if key.ECDSAKey == nil || !key.ECDSAKey.Equal(k) {
+				t.Error("Keys returned the wrong key for the v4 address")
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Keys didn't return v4 address %v", a)
+	}
+
+	addrs, err := d.Addresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range addrs {
+		if !addr.Address.Equal(a) {
+			continue
+		}
+		pub, err := x509.ParsePKIXPublicKey(addr.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !k.PublicKey.Equal(pub) {
+			t.Error("Addresses returned the wrong public key for the v4 address")
+		}
+	}
+
+	key, err := d.walletKey(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stx, err := key.SignTx(&Tx{
+		TxOutput: TxOutput{Destination: testRewardAddress, Amount: 10},
+		Source:   a,
+		Fee:      1,
+		Version:  TxVersion4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stx.ValidSignature(); err != nil {
+		t.Errorf("transaction signed by the wallet's v4 key: %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package cryptopuff
+
+import (
+	"time"
+)
+
+// Target is the number of leading zero bits a block's hash must have. Each
+// extra bit doubles the expected number of hashes needed to mine a block.
+type Target int
+
+const (
+	// DefaultTarget applies to blocks with a zero Target, i.e. those mined
+	// before difficulty adjustment was introduced and those that haven't
+	// passed a retarget since.
+	DefaultTarget Target = 22
+
+	// MinTarget and MaxTarget bound retargeting. MaxTarget keeps a block's
+	// work within an int64.
+	MinTarget Target = 8
+	MaxTarget Target = 48
+
+	// RetargetInterval is the number of blocks between difficulty
+	// adjustments. A block whose height is a multiple of it is mined at a
+	// target derived from the time its RetargetInterval ancestors took.
+	RetargetInterval = 100
+
+	// RetargetHeight is the first height at which the target is adjusted.
+	// Below it every block keeps a zero Target, as nodes that predate
+	// retargeting expect.
+	RetargetHeight = 50000
+
+	// TargetBlockInterval is the average time between blocks retargeting
+	// aims for.
+	TargetBlockInterval = time.Minute
+)
+
+// MeetsTarget reports whether the hash has at least t leading zero bits.
+func (h Hash) MeetsTarget(t Target) bool {
+	if t < 0 || int(t) > 8*len(h) {
+		return false
+	}
+	for i := 0; i < int(t); i++ {
+		if h[i/8]&(0x80>>uint(i%8)) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// RequiredTarget returns the target the block's hash must meet.
+func (b *Block) RequiredTarget() Target {
+	return b.Target.orDefault()
+}
+
+func (t Target) orDefault() Target {
+	if t == 0 {
+		return DefaultTarget
+	}
+	return t
+}
+
+// retargetWindow returns how many of a block's ancestors, starting with its
+// parent, TargetForHeight needs to compute the block's target.
+func retargetWindow(height int64) int {
+	if height >= RetargetHeight && height%RetargetInterval == 0 {
+		return RetargetInterval
+	}
+	return 1
+}
+
+// TargetForHeight returns the Target the next block must have, given its
+// ancestors newest first, starting with its parent. At a retarget height
+// (see RetargetInterval) the ancestors must include the RetargetInterval
+// blocks below it. The target moves by one bit at a time: up if those blocks
+// were mined in less than half the time TargetBlockInterval implies, down if
+// they took more than twice as long. Otherwise, or if the blocks aren't
+// timestamped, the parent's Target carries over, so chains that predate
+// retargeting keep a zero Target. Below RetargetHeight the parent's Target
+// always carries over.
+func TargetForHeight(blocks []Block) Target {
+	if len(blocks) == 0 {
+		return 0
+	}
+	parent := &blocks[0]
+
+	if retargetWindow(parent.Height+1) == 1 || len(blocks) < RetargetInterval {
+		return parent.Target
+	}
+
+	first := &blocks[RetargetInterval-1]
+	if parent.Timestamp == 0 || first.Timestamp == 0 {
+		return parent.Target
+	}
+
+	actual := time.Duration(parent.Timestamp-first.Timestamp) * time.Second
+	expected := (RetargetInterval - 1) * TargetBlockInterval
+
+	target := parent.RequiredTarget()
+	switch {
+	case actual < expected/2 && target < MaxTarget:
+		return target + 1
+	case actual > expected*2 && target > MinTarget:
+		return target - 1
+	default:
+		return parent.Target
+	}
+}
@@ -0,0 +1,90 @@
+package cryptopuff
+
+import (
+	"testing"
+	"time"
+)
+
+// retargetWindowBlocks returns the RetargetInterval ancestors of a block at
+// the given height, newest first, mined at target and spaced interval apart.
+func retargetWindowBlocks(height int64, target Target, interval time.Duration) []Block {
+	blocks := make([]Block, RetargetInterval)
+	timestamp := int64(1500000000)
+	for i := range blocks {
+		blocks[i] = Block{
+			Height:    height - 1 - int64(i),
+			Timestamp: timestamp - int64(i)*int64(interval/time.Second),
+			Target:    target,
+		}
+	}
+	return blocks
+}
+
+func TestTargetForHeight(t *testing.T) {
+	tests := []struct {
+		name     string
+		height   int64
+		target   Target
+		interval time.Duration
+		want     Target
+	}{
+		{"fast", RetargetHeight, 0, TargetBlockInterval / 4, DefaultTarget + 1},
+		{"slow", RetargetHeight, 0, TargetBlockInterval * 4, DefaultTarget - 1},
+		{"on time", RetargetHeight, 0, TargetBlockInterval, 0},
+		{"on time retargeted", RetargetHeight + RetargetInterval, 30, TargetBlockInterval, 30},
+		{"fast at maximum", RetargetHeight, MaxTarget, TargetBlockInterval / 4, MaxTarget},
+		{"slow at minimum", RetargetHeight, MinTarget, TargetBlockInterval * 4, MinTarget},
+		{"between retargets", RetargetHeight + 1, 30, TargetBlockInterval / 4, 30},
+		{"before activation", RetargetHeight - RetargetInterval, 0, TargetBlockInterval / 4, 0},
+	}
+	for _, test := range tests {
+		blocks := retargetWindowBlocks(test.height, test.target, test.interval)
+		if got := TargetForHeight(blocks); got != test.want {
+			t.Errorf("%v: TargetForHeight at height %v = %v, want %v", test.name, test.height, got, test.want)
+		}
+	}
+}
+
+func TestTargetForHeightUntimestamped(t *testing.T) {
+	blocks := retargetWindowBlocks(RetargetHeight, 0, TargetBlockInterval/4)
+	blocks[RetargetInterval-1].Timestamp = 0
+	if got := TargetForHeight(blocks); got != 0 {
+		t.Errorf("TargetForHeight = %v, want 0", got)
+	}
+}
+
+func TestTargetForHeightShortWindow(t *testing.T) {
+	blocks := retargetWindowBlocks(RetargetHeight, 30, TargetBlockInterval/4)
+	if got := TargetForHeight(blocks[:1]); got != 30 {
+		t.Errorf("TargetForHeight = %v, want 30", got)
+	}
+}
+
+func TestRetargetWindow(t *testing.T) {
+	tests := []struct {
+		height int64
+		want   int
+	}{
+		{RetargetHeight - RetargetInterval, 1},
+		{RetargetHeight - 1, 1},
+		{RetargetHeight, RetargetInterval},
+		{RetargetHeight + 1, 1},
+		{RetargetHeight + RetargetInterval, RetargetInterval},
+	}
+	for _, test := range tests {
+		if got := retargetWindow(test.height); got != test.want {
+			t.Errorf("retargetWindow(%v) = %v, want %v", test.height, got, test.want)
+		}
+	}
+}
+
+func TestMeetsTarget(t *testing.T) {
+	var h Hash
+	h[1] = 0x10
+	if !h.MeetsTarget(11) {
+		t.Error("hash with 11 leading zero bits doesn't meet target 11")
+	}
+	if h.MeetsTarget(12) {
+		t.Error("hash with 11 leading zero bits meets target 12")
+	}
+}
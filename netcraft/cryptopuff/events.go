@@ -0,0 +1,184 @@
+package cryptopuff
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	ChainEventConnect    = "connect"
+	ChainEventDisconnect = "disconnect"
+)
+
+// ChainEvent records a block joining (connect) or leaving (disconnect) the
+// best chain, with the change it made to the balance of each address, keyed
+// by address. Disconnect events carry the reverse of the block's deltas.
+// Replaying every event in Seq order reproduces the balances at the tip, so an
+// indexer can follow the chain by polling for events after the last Seq it
+// has seen.
+type ChainEvent struct {
+	Seq    int64
+	Type   string
+	Block  Hash
+	Height int64
+	Deltas map[string]int64
+}
+
+// ChainEvents returns up to limit events with a sequence number greater than
+// since, oldest first.
+func (d *DB) ChainEvents(since int64, limit int) ([]ChainEvent, error) {
+	var events []ChainEvent
+	if err := d.db.TransactWithRetry(func(tx *sql.Tx) error {
+		events = nil
+
+		rows, err := tx.Query(`
+			SELECT seq, type, block_hash, height, deltas
+			FROM chain_events
+			WHERE seq > ?
+			ORDER BY seq ASC
+			LIMIT ?
+		`, since, limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var (
+				e      ChainEvent
+				deltas []byte
+			)
+			if err := rows.Scan(&e.Seq, &e.Type, &e.Block, &e.Height, &deltas); err != nil {
+				return err
+			}
+			if err := json.Unmarshal(deltas, &e.Deltas); err != nil {
+				return err
+			}
+			events = append(events, e)
+		}
+
+		return rows.Err()
+	}); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// recordChainEvents appends the events for the best chain moving from the tip
+// of the last recorded event to the current best block: disconnects for the
+// old branch back to the fork point, newest first, then connects for the new
+// branch, oldest first. The first call connects the whole chain from the
+// genesis block.
+func recordChainEvents(tx *sql.Tx) error {
+	var last Hash
+	if err := tx.QueryRow(`SELECT hash FROM chain_events_tip`).Scan(&last); err != nil {
+		return err
+	}
+
+	tip, err := bestBlockHash(tx)
+	if err != nil {
+		return err
+	}
+	if tip == last {
+		return nil
+	}
+
+	if last == GenesisBlock.PreviousHash {
+		// nothing has been recorded yet
+		chain, err := chainFrom(tx, tip, 0)
+		if err != nil {
+			return err
+		}
+		for i := len(chain) - 1; i >= 0; i-- {
+			if err := addChainEvent(tx, ChainEventConnect, &chain[i], 1); err != nil {
+				return err
+			}
+		}
+		_, err = tx.Exec(`UPDATE chain_events_tip SET hash = ?`, tip)
+		return err
+	}
+
+	a, err := blockByHash(tx, last)
+	if err != nil {
+		return err
+	}
+	b, err := blockByHash(tx, tip)
+	if err != nil {
+		return err
+	}
+
+	var disconnected, connected []*Block
+	for a.Hash != b.Hash {
+		if a.Height >= b.Height {
+			disconnected = append(disconnected, a)
+			if a, err = blockByHash(tx, a.PreviousHash); err != nil {
+				return err
+			}
+		} else {
+			connected = append(connected, b)
+			if b, err = blockByHash(tx, b.PreviousHash); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, block := range disconnected {
+		if err := addChainEvent(tx, ChainEventDisconnect, block, -1); err != nil {
+			return err
+		}
+	}
+	for i := len(connected) - 1; i >= 0; i-- {
+		if err := addChainEvent(tx, ChainEventConnect, connected[i], 1); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`UPDATE chain_events_tip SET hash = ?`, tip)
+	return err
+}
+
+func addChainEvent(tx *sql.Tx, typ string, block *Block, sign int64) error {
+	deltas := make(map[string]int64)
+	credit := func(a Address, amount int64) {
+		deltas[a.String()] += sign * amount
+	}
+
+	payout, err := block.Payout()
+	if err != nil {
+		return err
+	}
+	credit(block.RewardOutput.Destination, payout)
+	for _, stx := range block.Transactions {
+		credit(stx.Source, -stx.RequiredBalance())
+		credit(stx.Destination, stx.Amount)
+	}
+	for a, delta := range deltas {
+		if delta == 0 {
+			delete(deltas, a)
+		}
+	}
+
+	b, err := json.Marshal(deltas)
+	if err != nil {
+		return errors.Wrap(err, "cryptopuff: failed to marshal balance deltas")
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO chain_events (type, block_hash, height, deltas)
+		VALUES (?, ?, ?, ?)
+	`, typ, block.Hash, block.Height, b)
+	return err
+}
+
+func blockByHash(tx *sql.Tx, hash Hash) (*Block, error) {
+	var raw []byte
+	err := tx.QueryRow(`SELECT block FROM blocks WHERE hash = ?`, hash).Scan(&raw)
+	if err == sql.ErrNoRows {
+		return nil, ErrUnknownBlock
+	} else if err != nil {
+		return nil, err
+	}
+	return DecodeBlock(raw)
+}
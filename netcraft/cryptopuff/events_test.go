@@ -0,0 +1,137 @@
+package cryptopuff
+
+import (
+	"database/sql"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// addTestChainTo mines and adds n blocks paying addr on top of previous,
+// returning them oldest first.
+func addTestChainTo(t *testing.T, d *DB, previous *Block, addr Address, n int) []*Block {
+	var blocks []*Block
+	for i := 0; i < n; i++ {
+		b := mineTestBlockTo(t, previous, 0, addr, nil)
+		if err := d.AddBlock(b); err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, b)
+		previous = b
+	}
+	return blocks
+}
+
+// assertChainEvents checks the log holds want, each an event's type and
+// block hash.
+func assertChainEvents(t *testing.T, d *DB, want []string) {
+	t.Helper()
+	events, err := d.ChainEvents(0, maxChainEvents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range events {
+		got = append(got, e.Type+" "+e.Block.String())
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("events:\n%v\nwant:\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestChainEvents(t *testing.T) {
+	d := openTestDB(t)
+	first := insertTestBlock(t, d, GenesisBlock, MinTarget)
+	main, fork := Address{0x01}, Address{0x02}
+
+	// The genesis block is connected when the log is created, and blocks
+	// stored without an event, like first, when the chain next moves.
+	chain := addTestChainTo(t, d, first, main, 2)
+	want := []string{
+		ChainEventConnect + " " + GenesisBlock.Hash.String(),
+		ChainEventConnect + " " + first.Hash.String(),
+		ChainEventConnect + " " + chain[0].Hash.String(),
+		ChainEventConnect + " " + chain[1].Hash.String(),
+	}
+	assertChainEvents(t, d, want)
+
+	// A longer fork off first reorganises the chain.
+	forked := addTestChainTo(t, d, first, fork, 3)
+	want = append(want,
+		ChainEventDisconnect+" "+chain[1].Hash.String(),
+		ChainEventDisconnect+" "+chain[0].Hash.String(),
+		ChainEventConnect+" "+forked[0].Hash.String(),
+		ChainEventConnect+" "+forked[1].Hash.String(),
+		ChainEventConnect+" "+forked[2].Hash.String(),
+	)
+	assertChainEvents(t, d, want)
+
+	// Replaying the events gives the balances at the tip, apart from
+	// first's reward, which insertTestBlock doesn't credit.
+	events, err := d.ChainEvents(0, maxChainEvents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed := make(map[string]int64)
+	for _, e := range events {
+		for a, delta := range e.Deltas {
+			replayed[a] += delta
+		}
+	}
+	balances, err := d.BalancesAt(forked[2].Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range []Address{main, fork} {
+		if replayed[a.String()] != balances[a.String()] {
+			t.Errorf("replayed balance of %v is %v, want %v", a, replayed[a.String()], balances[a.String()])
+		}
+	}
+	if balances[fork.String()] != 3*BlockSubsidy(2) {
+		t.Errorf("fork miner's balance is %v, want three rewards", balances[fork.String()])
+	}
+}
+
+// TestChainEventsBackfill checks that a log created on an existing database
+// covers the blocks added before it, and that opening the database again
+// doesn't repeat them.
+func TestChainEventsBackfill(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	open := func() *DB {
+		d, err := OpenDB(path, DBLogger(log.New(io.Discard, "", 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	d := open()
+	first := insertTestBlock(t, d, GenesisBlock, MinTarget)
+	chain := addTestChain(t, d, first, 2)
+
+	// Forget the log, as a database from before it existed would have.
+	if err := d.db.Transact(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM chain_events`); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`DELETE FROM chain_events_tip`)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+
+	// The second time, there is nothing to backfill.
+	for i := 0; i < 2; i++ {
+		d = open()
+		assertChainEvents(t, d, []string{
+			ChainEventConnect + " " + GenesisBlock.Hash.String(),
+			ChainEventConnect + " " + first.Hash.String(),
+			ChainEventConnect + " " + chain[0].Hash.String(),
+			ChainEventConnect + " " + chain[1].Hash.String(),
+		})
+		d.Close()
+	}
+}
@@ -0,0 +1,133 @@
+package cryptopuff
+
+import (
+	"math/big"
+
+	"github.com/pkg/errors"
+)
+
+// MaxFactorBits is the size of the largest modulus Factor256 will attempt.
+// The quadratic sieve's running time grows quickly with the size of the
+// modulus, so larger ones would take far too long to be worth trying.
+const MaxFactorBits = 256
+
+// rhoSteps caps the number of steps of Pollard's rho that Factor256 tries
+// before moving on to the quadratic sieve.
+const rhoSteps = 1 << 16
+
+// factorBatchSize is the number of steps whose differences are multiplied
+// together before taking a GCD, to avoid a GCD on every step.
+const factorBatchSize = 128
+
+var bigTwo = big.NewInt(2)
+
+// Factor256 splits n, a modulus of up to MaxFactorBits bits such as an RSA
+// key's, into two factors. It first spends a few steps on Brent's variant of
+// Pollard's rho algorithm, which quickly finds small factors, then falls back
+// to a self-initialising quadratic sieve, whose running time depends only on
+// the size of n. On one core that takes seconds for moduli of up to about 200
+// bits, a couple of minutes at 224 bits, and around half an hour for a
+// default 256-bit key.
+func Factor256(n *big.Int) (*big.Int, *big.Int, error) {
+	if n.Cmp(bigTwo) < 0 {
+		return nil, nil, errors.New("cryptopuff: nothing to factor")
+	}
+	if n.BitLen() > MaxFactorBits {
+		return nil, nil, errors.Errorf("cryptopuff: won't factor a %v-bit modulus, the limit is %v bits", n.BitLen(), MaxFactorBits)
+	}
+	if n.ProbablyPrime(20) {
+		return nil, nil, errors.New("cryptopuff: modulus is prime")
+	}
+	if n.Bit(0) == 0 {
+		return new(big.Int).Set(bigTwo), new(big.Int).Rsh(n, 1), nil
+	}
+	if r := new(big.Int).Sqrt(n); new(big.Int).Mul(r, r).Cmp(n) == 0 {
+		return r, new(big.Int).Set(r), nil
+	}
+
+	if d := rho(n, rhoSteps); d != nil {
+		return d, new(big.Int).Quo(n, d), nil
+	}
+
+	d, err := quadraticSieve(n)
+	if err != nil {
+		return nil, nil, err
+	}
+	return d, new(big.Int).Quo(n, d), nil
+}
+
+// rho returns a non-trivial factor of n found by Pollard's rho within budget
+// steps, or nil if it doesn't find one.
+func rho(n *big.Int, budget int) *big.Int {
+	for c := int64(1); budget > 0; c++ {
+		d, steps := brent(n, big.NewInt(c), budget)
+		budget -= steps
+		if d == nil || d.Cmp(n) == 0 {
+			// The sequence cycled without finding a factor, retry with a
+			// different polynomial.
+			continue
+		}
+		return d
+	}
+	return nil
+}
+
+// brent returns a non-trivial factor of n, or n itself if the sequence
+// x -> x^2 + c mod n cycles before one is found. It returns nil if it runs out
+// of steps, along with the number of steps taken.
+func brent(n, c *big.Int, budget int) (*big.Int, int) {
+	var (
+		x, ys, diff big.Int
+		y           = big.NewInt(2)
+		q           = big.NewInt(1)
+		d           = big.NewInt(1)
+		steps       int
+	)
+
+	step := func(v *big.Int) {
+		v.Mul(v, v)
+		v.Add(v, c)
+		v.Mod(v, n)
+		steps++
+	}
+
+	for r := 1; d.Cmp(bigOne) == 0; r *= 2 {
+		if steps >= budget {
+			return nil, steps
+		}
+
+		x.Set(y)
+		for i := 0; i < r; i++ {
+			step(y)
+		}
+
+		for k := 0; k < r && d.Cmp(bigOne) == 0; k += factorBatchSize {
+			ys.Set(y)
+			for i := 0; i < factorBatchSize && i < r-k; i++ {
+				step(y)
+				diff.Sub(&x, y)
+				diff.Abs(&diff)
+				q.Mul(q, &diff)
+				q.Mod(q, n)
+			}
+			d.GCD(nil, nil, q, n)
+		}
+	}
+
+	if d.Cmp(n) != 0 {
+		return d, steps
+	}
+
+	// The batched product hit zero mod n, so step one at a time from the
+	// start of the last batch to recover the factor.
+	for steps < budget {
+		step(&ys)
+		diff.Sub(&x, &ys)
+		diff.Abs(&diff)
+		d.GCD(nil, nil, &diff, n)
+		if d.Cmp(bigOne) != 0 {
+			return d, steps
+		}
+	}
+	return nil, steps
+}
@@ -0,0 +1,68 @@
+package cryptopuff
+
+import (
+	"math/big"
+	"testing"
+)
+
+func testBigInt(t *testing.T, s string) *big.Int {
+	n, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		t.Fatalf("invalid integer %q", s)
+	}
+	return n
+}
+
+func TestFactor256(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		p, q string
+	}{
+		{"even", "2", "170141183460469231731687303715884105757"},
+		{"square", "1208925819614629174607531", "1208925819614629174607531"},
+		// rho finds the small factor.
+		{"small factor", "1000003", "170141183460469231731687303715884105757"},
+		// rho gives up on two 80-bit factors, which need the sieve.
+		{"balanced", "604462909807314587365499", "1208925819614629174607531"},
+	} {
+		p, q := testBigInt(t, test.p), testBigInt(t, test.q)
+		n := new(big.Int).Mul(p, q)
+
+		a, b, err := Factor256(n)
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+		if a.Cmp(b) > 0 {
+			a, b = b, a
+		}
+		if a.Cmp(p) != 0 || b.Cmp(q) != 0 {
+			t.Errorf("%v: Factor256(%v) = %v, %v, want %v, %v", test.name, n, a, b, p, q)
+		}
+	}
+}
+
+func TestFactor256GivesUp(t *testing.T) {
+	tooLarge := new(big.Int).Lsh(big.NewInt(3), MaxFactorBits)
+	for _, n := range []*big.Int{
+		big.NewInt(1),
+		testBigInt(t, "170141183460469231731687303715884105757"),
+		tooLarge,
+	} {
+		if a, b, err := Factor256(n); err == nil {
+			t.Errorf("Factor256(%v) = %v, %v, want an error", n, a, b)
+		}
+	}
+}
+
+func TestRho(t *testing.T) {
+	n := new(big.Int).Mul(testBigInt(t, "604462909807314587365499"), testBigInt(t, "1208925819614629174607531"))
+	if d := rho(n, rhoSteps); d != nil {
+		t.Errorf("rho found %v within %v steps, which should take about 2^40", d, rhoSteps)
+	}
+
+	n = new(big.Int).Mul(big.NewInt(1000003), testBigInt(t, "170141183460469231731687303715884105757"))
+	if d := rho(n, rhoSteps); d == nil || d.Cmp(big.NewInt(1000003)) != 0 {
+		t.Errorf("rho found %v, want 1000003", d)
+	}
+}
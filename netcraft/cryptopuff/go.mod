@@ -1,12 +1,21 @@
 module gitlab.netcraft.com/netcraft/recruitment/cryptopuff
 
+// crypto/pbkdf2 needs Go 1.24.
+go 1.24
+
+// The default 256-bit keys are meant to be factorable, so they must still be
+// allowed to sign.
+godebug rsa1024min=0
+
 require (
 	github.com/JohnCGriffin/overflow v0.0.0-20170615021017-4d914c927216
 	github.com/go-chi/chi v3.3.3+incompatible
+	github.com/gorilla/websocket v1.4.2
 	github.com/mattn/go-sqlite3 v1.9.0
 	github.com/pkg/errors v0.8.0
 	github.com/russross/blackfriday v2.0.0+incompatible
 	github.com/shurcooL/sanitized_anchor_name v0.0.0-20170918181015-86672fcb3f95 // indirect
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	golang.org/x/net v0.0.0-20181017193950-04a2e542c03f // indirect
 	golang.org/x/text v0.3.0
 )
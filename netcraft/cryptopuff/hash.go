@@ -2,9 +2,12 @@ package cryptopuff
 
 import (
 	"crypto/md5"
+	"crypto/sha256"
 	"database/sql/driver"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"hash"
 
 	"github.com/pkg/errors"
 )
@@ -13,8 +16,63 @@ var EmptyHash Hash
 
 type Hash [md5.Size]byte
 
-func (h Hash) Valid() bool {
-	return h[0] == 0 && h[1] == 0 && h[2]&0xfc == 0
+// HashAlgo is the digest a Hash is computed with. Digests longer than a Hash
+// are truncated, so hashes made with either algorithm share the same type and
+// database columns. Even truncated, finding a SHA-256 collision takes around
+// 2^64 work, whereas MD5 collisions are practical.
+type HashAlgo int
+
+const (
+	HashMD5 HashAlgo = iota
+	HashSHA256
+)
+
+func (a HashAlgo) String() string {
+	switch a {
+	case HashMD5:
+		return "MD5"
+	case HashSHA256:
+		return "SHA-256"
+	default:
+		return fmt.Sprintf("HashAlgo(%d)", int(a))
+	}
+}
+
+// New returns a new hash.Hash computing the digest. Unknown algorithms fall
+// back to MD5; callers validate versions before hashing.
+func (a HashAlgo) New() hash.Hash {
+	if a == HashSHA256 {
+		return sha256.New()
+	}
+	return md5.New()
+}
+
+// Sum returns the digest of b, truncated to the size of a Hash.
+func (a HashAlgo) Sum(b []byte) Hash {
+	d := a.New()
+	d.Write(b)
+	return a.hash(d)
+}
+
+func (a HashAlgo) hash(d hash.Hash) Hash {
+	var h Hash
+	copy(h[:], d.Sum(nil))
+	return h
+}
+
+func HashFromString(str string) (Hash, error) {
+	var h Hash
+
+	v, err := hex.DecodeString(str)
+	if err != nil {
+		return EmptyHash, errors.Wrap(err, "cryptopuff: failed to hex decode hash")
+	}
+	if len(v) != md5.Size {
+		return EmptyHash, errors.Errorf("cryptopuff: invalid Hash length, expected %v, got %v", md5.Size, len(v))
+	}
+
+	copy(h[:], v)
+	return h, nil
 }
 
 func (h *Hash) Scan(value interface{}) error {
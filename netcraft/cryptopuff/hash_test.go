@@ -0,0 +1,151 @@
+package cryptopuff
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"testing"
+)
+
+// Hashes of a block and transaction created before timestamps were introduced,
+// computed before any of the changes to hashing. They must never change, or
+// nodes would no longer agree on the existing chain.
+const (
+	goldenGenesisHash = "0ec0d4c1a9a12b64bc48581fab6d76c1"
+	goldenTxHash      = "31690d1f83074e0cc00c1e9ff3712aa0"
+	goldenBlockHash   = "fc6e224d69d9556a8cdee4f9c0766846"
+)
+
+func legacyTestBlock(t *testing.T) *Block {
+	stx := SignedTx{
+		Tx: Tx{
+			TxOutput: TxOutput{Destination: Address{0x01, 0x02}, Amount: 10},
+			Source:   Address{0x03, 0x04},
+			Fee:      1,
+		},
+		ID:        TxID{0: 0xaa, 15: 0xbb},
+		Signature: []byte{0x05, 0x06, 0x07},
+		PublicKey: []byte{0x08, 0x09},
+	}
+	b := &Block{
+		PreviousHash: GenesisBlock.Hash,
+		Height:       1,
+		Nonce:        12345,
+		RewardOutput: TxOutput{Destination: Address{0x0a, 0x0b}, Amount: 100},
+		Transactions: []SignedTx{stx},
+	}
+	if err := b.UpdateHash(); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestLegacyHashes(t *testing.T) {
+	if got := GenesisBlock.Hash.String(); got != goldenGenesisHash {
+		t.Errorf("genesis block hash = %v, want %v", got, goldenGenesisHash)
+	}
+
+	b := legacyTestBlock(t)
+	if got := b.Transactions[0].Hash.String(); got != goldenTxHash {
+		t.Errorf("transaction hash = %v, want %v", got, goldenTxHash)
+	}
+	if got := b.Hash.String(); got != goldenBlockHash {
+		t.Errorf("block hash = %v, want %v", got, goldenBlockHash)
+	}
+}
+
+func TestLegacyHashesAfterDecoding(t *testing.T) {
+	raw, err := json.Marshal(legacyTestBlock(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := DecodeBlock(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := b.Transactions[0].Hash.String(); got != goldenTxHash {
+		t.Errorf("decoded transaction hash = %v, want %v", got, goldenTxHash)
+	}
+	if got := b.Hash.String(); got != goldenBlockHash {
+		t.Errorf("decoded block hash = %v, want %v", got, goldenBlockHash)
+	}
+}
+
+// sqlRoundTrip stores in in a nullable TEXT column, like the node's tables
+// use, and scans it back into out.
+func sqlRoundTrip(t *testing.T, in driver.Valuer, out sql.Scanner) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(`CREATE TABLE t (v TEXT NULL)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO t (v) VALUES (?)`, in); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow(`SELECT v FROM t`).Scan(out); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testHashRoundTrip(t *testing.T, h Hash) {
+	raw, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fromJSON Hash
+	if err := json.Unmarshal(raw, &fromJSON); err != nil {
+		t.Fatal(err)
+	}
+	if fromJSON != h {
+		t.Errorf("JSON round trip of %v gave %v", h, fromJSON)
+	}
+
+	var fromSQL Hash
+	sqlRoundTrip(t, h, &fromSQL)
+	if fromSQL != h {
+		t.Errorf("SQL round trip of %v gave %v", h, fromSQL)
+	}
+
+	fromString, err := HashFromString(h.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fromString != h {
+		t.Errorf("string round trip of %v gave %v", h, fromString)
+	}
+}
+
+func TestHashRoundTrip(t *testing.T) {
+	testHashRoundTrip(t, EmptyHash)
+	testHashRoundTrip(t, HashSHA256.Sum([]byte("cryptopuff")))
+	testHashRoundTrip(t, GenesisBlock.Hash)
+}
+
+func FuzzHashRoundTrip(f *testing.F) {
+	f.Add([]byte{})
+	f.Add(GenesisBlock.Hash[:])
+	f.Fuzz(func(t *testing.T, b []byte) {
+		var h Hash
+		copy(h[:], b)
+		testHashRoundTrip(t, h)
+	})
+}
+
+// FuzzHashUnmarshalJSON checks that any JSON a Hash accepts marshals back to
+// JSON that decodes to the same Hash.
+func FuzzHashUnmarshalJSON(f *testing.F) {
+	f.Add([]byte(`""`))
+	f.Add([]byte(`"0ec0d4c1a9a12b64bc48581fab6d76c1"`))
+	f.Add([]byte(`"0EC0D4C1A9A12B64BC48581FAB6D76C1"`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var h Hash
+		if err := json.Unmarshal(data, &h); err != nil {
+			return
+		}
+		testHashRoundTrip(t, h)
+	})
+}
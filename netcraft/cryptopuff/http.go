@@ -2,6 +2,9 @@ package cryptopuff
 
 import (
 	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"strings"
@@ -11,55 +14,118 @@ import (
 )
 
 const (
-	contentTypeJSON = "application/json"
-	contentTypePEM  = "application/x-pem-file"
+	contentTypeJSON       = "application/json"
+	contentTypePEM        = "application/x-pem-file"
+	contentTypePrometheus = "text/plain; version=0.0.4"
 
 	Timeout = 1 * time.Minute
 )
 
 var (
+	headerAuthorization   = http.CanonicalHeaderKey("Authorization")
 	headerContentType     = http.CanonicalHeaderKey("Content-Type")
 	headerWWWAuthenticate = http.CanonicalHeaderKey("WWW-Authenticate")
 	headerXPeer           = http.CanonicalHeaderKey("X-Peer")
+	headerXPeerToken      = http.CanonicalHeaderKey("X-Peer-Token")
 )
 
+// newJSONDecoder returns a decoder for blocks and transactions received from
+// peers. In strict mode, fields this version doesn't understand are rejected
+// instead of being silently dropped, as dropping them would change the hash.
+func newJSONDecoder(r io.Reader, strict bool) *json.Decoder {
+	dec := json.NewDecoder(r)
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	return dec
+}
+
+// throttle limits the number of requests served at once by every handler it
+// wraps, rejecting requests over the limit. Unlike chi's Throttle, a single
+// instance can be shared between several routes.
+func throttle(limit int) func(http.Handler) http.Handler {
+	sem := make(chan struct{}, limit)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case sem <- struct{}{}:
+				defer func() {
+					<-sem
+				}()
+				next.ServeHTTP(w, r)
+			default:
+				http.Error(w, "cryptopuff: too many concurrent requests", http.StatusServiceUnavailable)
+			}
+		})
+	}
+}
+
+// RPCError is returned when a node responds with a status other than 200 OK.
+// Message is the first line of the response body, which for errors from
+// another node is the reason it gave.
+type RPCError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("cryptopuff: invalid status code %v: %v", e.StatusCode, e.Message)
+}
+
+func newRPCError(resp *http.Response) error {
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return errors.Wrapf(err, "cryptopuff: failed to read first line of response with status code %v", resp.StatusCode)
+	}
+
+	return &RPCError{
+		StatusCode: resp.StatusCode,
+		Message:    strings.TrimRight(line, "\r\n"),
+	}
+}
+
 func httpGet(c *http.Client, url string) (*http.Response, error) {
-	resp, err := c.Get(url)
+	return httpGetContext(context.Background(), c, url)
+}
+
+func httpGetContext(ctx context.Context, c *http.Client, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
 	if err != nil {
 		return nil, err
 	}
 
 	if resp.StatusCode != http.StatusOK {
 		defer resp.Body.Close()
-
-		line, err := bufio.NewReader(resp.Body).ReadString('\n')
-		if err != nil {
-			return nil, errors.Wrap(err, "cryptopuff: failed to read first line of non-200 response")
-		}
-		line = strings.TrimRight(line, "\n")
-
-		return nil, errors.Errorf("cryptopuff: invalid status code %v: %v", resp.StatusCode, line)
+		return nil, newRPCError(resp)
 	}
 
 	return resp, nil
 }
 
 func httpPost(c *http.Client, url string, contentType string, body io.Reader) (*http.Response, error) {
-	resp, err := c.Post(url, contentType, body)
+	return httpPostContext(context.Background(), c, url, contentType, body)
+}
+
+func httpPostContext(ctx context.Context, c *http.Client, url string, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(headerContentType, contentType)
+
+	resp, err := c.Do(req)
 	if err != nil {
 		return nil, err
 	}
 
 	if resp.StatusCode != http.StatusOK {
 		defer resp.Body.Close()
-
-		line, err := bufio.NewReader(resp.Body).ReadString('\n')
-		if err != nil {
-			return nil, errors.Wrap(err, "cryptopuff: failed to read first line of non-200 response")
-		}
-		line = strings.TrimRight(line, "\n")
-
-		return nil, errors.Errorf("cryptopuff: invalid status code %v: %v", resp.StatusCode, line)
+		return nil, newRPCError(resp)
 	}
 
 	return resp, nil
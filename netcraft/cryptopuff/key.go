@@ -1,24 +1,140 @@
 package cryptopuff
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
 	"encoding/pem"
+	"fmt"
+	"math/big"
 	"math/rand"
 
 	"github.com/pkg/errors"
 )
 
 const (
-	DefaultKeyLength  = 256
-	privateKeyPemType = "RSA PRIVATE KEY"
+	DefaultKeyLength    = 256
+	privateKeyPemType   = "RSA PRIVATE KEY"
+	ecPrivateKeyPemType = "EC PRIVATE KEY"
 )
 
+// KeyType is the kind of key an address belongs to (see Version.KeyType).
+type KeyType int
+
+const (
+	KeyRSA KeyType = iota
+	// KeyECDSA keys are on the P-256 curve.
+	KeyECDSA
+)
+
+func (t KeyType) String() string {
+	switch t {
+	case KeyRSA:
+		return "RSA"
+	case KeyECDSA:
+		return "ECDSA"
+	default:
+		return fmt.Sprintf("KeyType(%d)", int(t))
+	}
+}
+
 func GenerateKey(bits int, seed int64) (*rsa.PrivateKey, error) {
 	r := rand.New(rand.NewSource(seed))
 	return RSAGenerateKey(r, bits)
 }
 
+// GenerateECDSAKey generates a P-256 key. Unlike GenerateKey it always uses a
+// secure source of randomness, as a seeded key would defeat the point.
+func GenerateECDSAKey() (*ecdsa.PrivateKey, error) {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: failed to generate ECDSA key")
+	}
+	return k, nil
+}
+
+func EncodeECDSAPrivateKeyPEM(k *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(k)
+	if err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: failed to marshal ECDSA key")
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  ecPrivateKeyPemType,
+		Bytes: der,
+	}), nil
+}
+
+func DecodeECDSAPrivateKeyPEM(b []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("cryptopuff: no PEM block found")
+	}
+
+	if block.Type != ecPrivateKeyPemType {
+		return nil, errors.New("cryptopuff: invalid PEM block type")
+	}
+
+	k, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if k.Curve != elliptic.P256() {
+		return nil, errors.New("cryptopuff: ECDSA key isn't on the P-256 curve")
+	}
+	return k, nil
+}
+
+// DecodeECDSAPrivateKeyPEMs decodes a bundle of one or more concatenated PEM
+// ECDSA private keys. It fails if any of the blocks can't be decoded.
+func DecodeECDSAPrivateKeyPEMs(b []byte) ([]*ecdsa.PrivateKey, error) {
+	var keys []*ecdsa.PrivateKey
+	for {
+		block, rest := pem.Decode(b)
+		if block == nil {
+			break
+		}
+
+		k, err := DecodeECDSAPrivateKeyPEM(b[:len(b)-len(rest)])
+		if err != nil {
+			return nil, errors.Wrapf(err, "cryptopuff: failed to parse key %v", len(keys)+1)
+		}
+		keys = append(keys, k)
+		b = rest
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("cryptopuff: no PEM block found")
+	}
+	return keys, nil
+}
+
+// decodeWalletKeyPEM decodes a key held for address a, which is an ECDSA key
+// for V4 addresses and an RSA key otherwise.
+func decodeWalletKeyPEM(a Address, b []byte) (Key, error) {
+	version, err := DetectVersion(a)
+	if err != nil {
+		return Key{}, err
+	}
+
+	if version.KeyType() == KeyECDSA {
+		k, err := DecodeECDSAPrivateKeyPEM(b)
+		if err != nil {
+			return Key{}, err
+		}
+		return Key{Address: a, ECDSAKey: k}, nil
+	}
+
+	k, err := DecodePrivateKeyPEM(b)
+	if err != nil {
+		return Key{}, err
+	}
+	return Key{Address: a, Key: k}, nil
+}
+
 func EncodePrivateKeyPEM(k *rsa.PrivateKey) []byte {
 	return pem.EncodeToMemory(&pem.Block{
 		Type:  privateKeyPemType,
@@ -36,5 +152,177 @@ func DecodePrivateKeyPEM(b []byte) (*rsa.PrivateKey, error) {
 		return nil, errors.New("cryptopuff: invalid PEM block type")
 	}
 
-	return x509.ParsePKCS1PrivateKey(block.Bytes)
+	return parsePKCS1PrivateKey(block.Bytes)
+}
+
+// DecodePrivateKeyPEMs decodes a bundle of one or more concatenated PEM
+// private keys. It fails if any of the blocks can't be decoded, and with an
+// error whose cause is ErrKeyEncrypted if any of them is encrypted.
+func DecodePrivateKeyPEMs(b []byte) ([]*rsa.PrivateKey, error) {
+	return DecryptPrivateKeyPEMs(b, nil)
+}
+
+func EncodePrivateKeyDER(k *rsa.PrivateKey) []byte {
+	return x509.MarshalPKCS1PrivateKey(k)
+}
+
+func DecodePrivateKeyDER(b []byte) (*rsa.PrivateKey, error) {
+	return parsePKCS1PrivateKey(b)
+}
+
+func parsePKCS1PrivateKey(b []byte) (*rsa.PrivateKey, error) {
+	k, err := x509.ParsePKCS1PrivateKey(b)
+	if err != nil {
+		return nil, err
+	}
+	if err := validatePrivateKey(k); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// validatePrivateKey checks a decoded key is consistent before it is stored or
+// used for signing. rsa.PrivateKey.Validate doesn't check that the primes are
+// actually prime, so a key with composite factors could pass it and then
+// produce signatures that don't verify.
+func validatePrivateKey(k *rsa.PrivateKey) error {
+	if err := k.Validate(); err != nil {
+		return errors.Wrap(err, "cryptopuff: invalid private key")
+	}
+	for _, p := range k.Primes {
+		if !p.ProbablyPrime(20) {
+			return errors.New("cryptopuff: invalid private key: factor of modulus isn't prime")
+		}
+	}
+	return nil
+}
+
+// ReconstructPrivateKey rebuilds the private key for pub from the two prime
+// factors of its modulus.
+func ReconstructPrivateKey(pub *rsa.PublicKey, p, q *big.Int) (*rsa.PrivateKey, error) {
+	if p.Cmp(bigOne) <= 0 || q.Cmp(bigOne) <= 0 {
+		return nil, errors.New("cryptopuff: factors must be greater than one")
+	}
+
+	var n big.Int
+	n.Mul(p, q)
+	if n.Cmp(pub.N) != 0 {
+		return nil, errors.New("cryptopuff: factors don't multiply to the public modulus")
+	}
+
+	var pMinus1 big.Int
+	pMinus1.Sub(p, bigOne)
+
+	var qMinus1 big.Int
+	qMinus1.Sub(q, bigOne)
+
+	var phi big.Int
+	phi.Mul(&pMinus1, &qMinus1)
+
+	var d big.Int
+	if d.ModInverse(big.NewInt(int64(pub.E)), &phi) == nil {
+		return nil, errors.New("cryptopuff: public exponent has no inverse for these factors")
+	}
+
+	k := &rsa.PrivateKey{
+		PublicKey: *pub,
+		D:         &d,
+		Primes:    []*big.Int{new(big.Int).Set(p), new(big.Int).Set(q)},
+	}
+	if err := validatePrivateKey(k); err != nil {
+		return nil, err
+	}
+	k.Precompute()
+	return k, nil
+}
+
+// jwk is the JSON Web Key (RFC 7517/7518) representation of an RSA private
+// key. All integers are unpadded base64url-encoded big-endian bytes.
+type jwk struct {
+	Kty string `json:"kty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	D   string `json:"d"`
+	P   string `json:"p"`
+	Q   string `json:"q"`
+	Dp  string `json:"dp"`
+	Dq  string `json:"dq"`
+	Qi  string `json:"qi"`
+}
+
+func EncodePrivateKeyJWK(k *rsa.PrivateKey) ([]byte, error) {
+	if len(k.Primes) != 2 {
+		return nil, errors.New("cryptopuff: JWK export requires a two-prime key")
+	}
+	k.Precompute()
+
+	b, err := json.Marshal(jwk{
+		Kty: "RSA",
+		N:   encodeJWKInt(k.N),
+		E:   encodeJWKInt(big.NewInt(int64(k.E))),
+		D:   encodeJWKInt(k.D),
+		P:   encodeJWKInt(k.Primes[0]),
+		Q:   encodeJWKInt(k.Primes[1]),
+		Dp:  encodeJWKInt(k.Precomputed.Dp),
+		Dq:  encodeJWKInt(k.Precomputed.Dq),
+		Qi:  encodeJWKInt(k.Precomputed.Qinv),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: failed to marshal JWK")
+	}
+	return b, nil
+}
+
+func DecodePrivateKeyJWK(b []byte) (*rsa.PrivateKey, error) {
+	var j jwk
+	if err := json.Unmarshal(b, &j); err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: failed to unmarshal JWK")
+	}
+
+	if j.Kty != "RSA" {
+		return nil, errors.Errorf("cryptopuff: invalid JWK key type %q", j.Kty)
+	}
+
+	var ints [5]*big.Int
+	for i, str := range []string{j.N, j.E, j.D, j.P, j.Q} {
+		v, err := decodeJWKInt(str)
+		if err != nil {
+			return nil, err
+		}
+		ints[i] = v
+	}
+
+	if !ints[1].IsInt64() || ints[1].Int64() > int64(^uint32(0)>>1) {
+		return nil, errors.New("cryptopuff: JWK public exponent too large")
+	}
+
+	k := &rsa.PrivateKey{
+		PublicKey: rsa.PublicKey{
+			N: ints[0],
+			E: int(ints[1].Int64()),
+		},
+		D:      ints[2],
+		Primes: []*big.Int{ints[3], ints[4]},
+	}
+	if err := validatePrivateKey(k); err != nil {
+		return nil, err
+	}
+	k.Precompute()
+	return k, nil
+}
+
+func encodeJWKInt(v *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(v.Bytes())
+}
+
+func decodeJWKInt(str string) (*big.Int, error) {
+	if str == "" {
+		return nil, errors.New("cryptopuff: missing JWK field")
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(str)
+	if err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: failed to base64 decode JWK field")
+	}
+	return new(big.Int).SetBytes(b), nil
 }
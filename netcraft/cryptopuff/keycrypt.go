@@ -0,0 +1,211 @@
+package cryptopuff
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	encryptedPrivateKeyPemType = "ENCRYPTED RSA PRIVATE KEY"
+
+	keyKDF              = "PBKDF2-SHA256"
+	keyCipher           = "AES-256-GCM"
+	keyKDFIterations    = 600000
+	maxKeyKDFIterations = 10000000
+	keySaltSize         = 16
+)
+
+// ErrKeyEncrypted is returned when decoding an encrypted PEM key without a
+// passphrase.
+var ErrKeyEncrypted = errors.New("cryptopuff: private key is encrypted, a passphrase is required")
+
+// EncodePrivateKeyPEMEncrypted encodes k as a PEM block encrypted with AES-256-GCM,
+// under a key derived from passphrase with PBKDF2-SHA256. The KDF parameters
+// are kept in the PEM headers, which are authenticated along with the key. It
+// replaces x509.EncryptPEMBlock, whose legacy format uses a weak KDF and can't
+// detect tampering.
+func EncodePrivateKeyPEMEncrypted(k *rsa.PrivateKey, passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("cryptopuff: passphrase must not be empty")
+	}
+
+	salt := make([]byte, keySaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: failed to generate salt")
+	}
+
+	aead, err := keyAEAD(passphrase, salt, keyKDFIterations)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: failed to generate nonce")
+	}
+
+	headers := map[string]string{
+		"KDF":        keyKDF,
+		"Iterations": strconv.Itoa(keyKDFIterations),
+		"Salt":       hex.EncodeToString(salt),
+		"Cipher":     keyCipher,
+		"Nonce":      hex.EncodeToString(nonce),
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:    encryptedPrivateKeyPemType,
+		Headers: headers,
+		Bytes:   aead.Seal(nil, nonce, x509.MarshalPKCS1PrivateKey(k), keyAdditionalData(headers)),
+	}), nil
+}
+
+// keyAdditionalData authenticates the PEM headers along with the key, so that
+// none of them can be altered or added without decryption failing. They are
+// sorted by name, as pem.Encode writes them.
+func keyAdditionalData(headers map[string]string) []byte {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b []byte
+	for _, name := range names {
+		b = append(b, name+": "+headers[name]+"\n"...)
+	}
+	return b
+}
+
+// DecryptPrivateKeyPEMs decodes a bundle of one or more concatenated PEM
+// private keys, decrypting any encrypted ones with passphrase. It fails if any
+// of the blocks can't be decoded.
+func DecryptPrivateKeyPEMs(b, passphrase []byte) ([]*rsa.PrivateKey, error) {
+	var keys []*rsa.PrivateKey
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+
+		k, err := decodePrivateKeyBlock(block, passphrase)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cryptopuff: failed to parse key %v", len(keys)+1)
+		}
+		keys = append(keys, k)
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("cryptopuff: no PEM block found")
+	}
+	return keys, nil
+}
+
+// DecodePrivateKeyPEMEncrypted decodes a PEM private key, decrypting it with
+// passphrase if it is encrypted. It is the single key counterpart of
+// DecryptPrivateKeyPEMs.
+func DecodePrivateKeyPEMEncrypted(b, passphrase []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("cryptopuff: no PEM block found")
+	}
+	return decodePrivateKeyBlock(block, passphrase)
+}
+
+// decodePrivateKeyBlock decodes a plain, encrypted or legacy encrypted PEM
+// private key.
+func decodePrivateKeyBlock(block *pem.Block, passphrase []byte) (*rsa.PrivateKey, error) {
+	switch block.Type {
+	case privateKeyPemType:
+		if x509.IsEncryptedPEMBlock(block) {
+			return decryptLegacyPrivateKeyPEM(block, passphrase)
+		}
+		return parsePKCS1PrivateKey(block.Bytes)
+	case encryptedPrivateKeyPemType:
+		return decryptPrivateKeyPEM(block, passphrase)
+	default:
+		return nil, errors.New("cryptopuff: invalid PEM block type")
+	}
+}
+
+func decryptPrivateKeyPEM(block *pem.Block, passphrase []byte) (*rsa.PrivateKey, error) {
+	if len(passphrase) == 0 {
+		return nil, ErrKeyEncrypted
+	}
+
+	if block.Headers["KDF"] != keyKDF || block.Headers["Cipher"] != keyCipher {
+		return nil, errors.Errorf("cryptopuff: unsupported key encryption %v with %v", block.Headers["Cipher"], block.Headers["KDF"])
+	}
+
+	iterations, err := strconv.Atoi(block.Headers["Iterations"])
+	if err != nil || iterations < 1 || iterations > maxKeyKDFIterations {
+		return nil, errors.New("cryptopuff: invalid KDF iterations")
+	}
+
+	salt, err := hex.DecodeString(block.Headers["Salt"])
+	if err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: failed to hex decode salt")
+	}
+
+	nonce, err := hex.DecodeString(block.Headers["Nonce"])
+	if err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: failed to hex decode nonce")
+	}
+
+	aead, err := keyAEAD(passphrase, salt, iterations)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, errors.New("cryptopuff: invalid nonce length")
+	}
+
+	der, err := aead.Open(nil, nonce, block.Bytes, keyAdditionalData(block.Headers))
+	if err != nil {
+		return nil, errors.New("cryptopuff: failed to decrypt key, wrong passphrase?")
+	}
+	return parsePKCS1PrivateKey(der)
+}
+
+// decryptLegacyPrivateKeyPEM decrypts a key encrypted in the legacy OpenSSL
+// format written by x509.EncryptPEMBlock and "openssl rsa -aes256", so keys
+// encrypted elsewhere can be imported. Keys are never exported in it.
+func decryptLegacyPrivateKeyPEM(block *pem.Block, passphrase []byte) (*rsa.PrivateKey, error) {
+	if len(passphrase) == 0 {
+		return nil, ErrKeyEncrypted
+	}
+
+	der, err := x509.DecryptPEMBlock(block, passphrase)
+	if err == x509.IncorrectPasswordError {
+		return nil, errors.New("cryptopuff: failed to decrypt key, wrong passphrase?")
+	} else if err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: failed to decrypt key")
+	}
+	return parsePKCS1PrivateKey(der)
+}
+
+func keyAEAD(passphrase, salt []byte, iterations int) (cipher.AEAD, error) {
+	key, err := pbkdf2.Key(sha256.New, string(passphrase), salt, iterations, 32)
+	if err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: failed to derive key")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: failed to create cipher")
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: failed to create cipher")
+	}
+	return aead, nil
+}
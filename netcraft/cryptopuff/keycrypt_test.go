@@ -0,0 +1,132 @@
+package cryptopuff
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+var testPassphrase = []byte("correct horse battery staple")
+
+func TestEncodePrivateKeyPEMEncryptedRoundTrip(t *testing.T) {
+	k := testKey(t, 1)
+	b, err := EncodePrivateKeyPEMEncrypted(k, testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := DecryptPrivateKeyPEMs(b, testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || !keys[0].Equal(k) {
+		t.Error("decrypted key differs")
+	}
+
+	if _, err := DecryptPrivateKeyPEMs(b, nil); errors.Cause(err) != ErrKeyEncrypted {
+		t.Errorf("decrypting without a passphrase: got %v, want ErrKeyEncrypted", err)
+	}
+	if _, err := DecryptPrivateKeyPEMs(b, []byte("wrong")); err == nil {
+		t.Error("decrypted with the wrong passphrase")
+	}
+}
+
+func TestEncodePrivateKeyPEMEncryptedHeadersAuthenticated(t *testing.T) {
+	b, err := EncodePrivateKeyPEMEncrypted(testKey(t, 1), testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tamper := range map[string]func(map[string]string){
+		"added": func(h map[string]string) { h["Comment"] = "tampered" },
+		// A leading zero doesn't change the number of iterations, so only
+		// the authentication of the headers catches it.
+		"altered": func(h map[string]string) { h["Iterations"] = "0" + h["Iterations"] },
+	} {
+		block, _ := pem.Decode(b)
+		if block == nil {
+			t.Fatal("no PEM block found")
+		}
+		tamper(block.Headers)
+
+		if _, err := DecryptPrivateKeyPEMs(pem.EncodeToMemory(block), testPassphrase); err == nil {
+			t.Errorf("decrypted key with %v header", name)
+		}
+	}
+}
+
+func TestDecodePrivateKeyPEMEncrypted(t *testing.T) {
+	k := testKey(t, 1)
+	b, err := EncodePrivateKeyPEMEncrypted(k, testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := DecodePrivateKeyPEMEncrypted(b, testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Equal(k) {
+		t.Error("decrypted key differs")
+	}
+
+	// Unencrypted keys still decode, with or without a passphrase.
+	for _, passphrase := range [][]byte{nil, testPassphrase} {
+		decoded, err := DecodePrivateKeyPEMEncrypted(EncodePrivateKeyPEM(k), passphrase)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !decoded.Equal(k) {
+			t.Error("decoded unencrypted key differs")
+		}
+	}
+}
+
+// encryptLegacyTestKey encrypts k in the legacy OpenSSL format, as
+// "openssl rsa -aes256" would.
+func encryptLegacyTestKey(t *testing.T, k *rsa.PrivateKey) []byte {
+	block, err := x509.EncryptPEMBlock(rand.Reader, privateKeyPemType, x509.MarshalPKCS1PrivateKey(k), testPassphrase, x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(block)
+}
+
+func TestDecodeLegacyEncryptedPrivateKeyPEM(t *testing.T) {
+	k := testKey(t, 1)
+	b := encryptLegacyTestKey(t, k)
+
+	decoded, err := DecodePrivateKeyPEMEncrypted(b, testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Equal(k) {
+		t.Error("decrypted legacy key differs")
+	}
+
+	if _, err := DecodePrivateKeyPEMEncrypted(b, nil); errors.Cause(err) != ErrKeyEncrypted {
+		t.Errorf("decrypting without a passphrase: got %v, want ErrKeyEncrypted", err)
+	}
+	if _, err := DecodePrivateKeyPEMEncrypted(b, []byte("wrong")); err == nil {
+		t.Error("decrypted legacy key with the wrong passphrase")
+	}
+
+	// A bundle may mix legacy, current and unencrypted keys.
+	other := testKey(t, 2)
+	current, err := EncodePrivateKeyPEMEncrypted(other, testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := DecryptPrivateKeyPEMs(bytes.Join([][]byte{b, current, EncodePrivateKeyPEM(k)}, nil), testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 || !keys[0].Equal(k) || !keys[1].Equal(other) || !keys[2].Equal(k) {
+		t.Error("decrypted bundle differs")
+	}
+}
@@ -0,0 +1,230 @@
+package cryptopuff
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const keystoreExt = ".pem"
+
+// Keystore keeps private keys in a local directory, one PEM file per address,
+// so a client can sign transactions itself and only ever send a node the
+// signed result.
+type Keystore struct {
+	dir string
+}
+
+// OpenKeystore opens the keystore in dir, creating it if it doesn't exist.
+func OpenKeystore(dir string) (*Keystore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: failed to create keystore directory")
+	}
+	return &Keystore{dir: dir}, nil
+}
+
+func (k *Keystore) path(a Address) string {
+	return filepath.Join(k.dir, hex.EncodeToString(a)+keystoreExt)
+}
+
+// AddKey stores the private key and returns its address. Adding a key that is
+// already present is a no-op.
+func (k *Keystore) AddKey(key *rsa.PrivateKey, version Version) (Address, error) {
+	if version.KeyType() != KeyRSA {
+		return nil, errors.Errorf("cryptopuff: %v addresses are for %v keys, not RSA", version, version.KeyType())
+	}
+
+	a := AddressFromKey(version, &key.PublicKey)
+	if err := k.writeKey(a, EncodePrivateKeyPEM(key)); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// writeKey stores the PEM encoded key for a, unless it is already present.
+func (k *Keystore) writeKey(a Address, b []byte) error {
+	f, err := os.OpenFile(k.path(a), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "cryptopuff: failed to create key file")
+	}
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return errors.Wrap(err, "cryptopuff: failed to write key file")
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return errors.Wrap(err, "cryptopuff: failed to write key file")
+	}
+	return nil
+}
+
+// AddKeys stores every key, removing any it stored if one fails so that the
+// import is all-or-nothing.
+func (k *Keystore) AddKeys(keys []*rsa.PrivateKey, version Version) ([]Address, error) {
+	var (
+		addrs []Address
+		added []Address
+	)
+	for _, key := range keys {
+		a := AddressFromKey(version, &key.PublicKey)
+		_, err := os.Stat(k.path(a))
+		exists := err == nil
+
+		if _, err := k.AddKey(key, version); err != nil {
+			for _, a := range added {
+				os.Remove(k.path(a))
+			}
+			return nil, err
+		}
+
+		if !exists {
+			added = append(added, a)
+		}
+		addrs = append(addrs, a)
+	}
+	return addrs, nil
+}
+
+// AddECDSAKey stores the ECDSA key and returns its V4 address.
+func (k *Keystore) AddECDSAKey(key *ecdsa.PrivateKey) (Address, error) {
+	a, err := AddressFromECDSAKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := EncodeECDSAPrivateKeyPEM(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := k.writeKey(a, b); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// AddECDSAKeys stores every ECDSA key, all-or-nothing like AddKeys.
+func (k *Keystore) AddECDSAKeys(keys []*ecdsa.PrivateKey) ([]Address, error) {
+	var (
+		addrs []Address
+		added []Address
+	)
+	rollback := func() {
+		for _, a := range added {
+			os.Remove(k.path(a))
+		}
+	}
+	for _, key := range keys {
+		a, err := AddressFromECDSAKey(&key.PublicKey)
+		if err != nil {
+			rollback()
+			return nil, err
+		}
+		_, err = os.Stat(k.path(a))
+		exists := err == nil
+
+		if _, err := k.AddECDSAKey(key); err != nil {
+			rollback()
+			return nil, err
+		}
+
+		if !exists {
+			added = append(added, a)
+		}
+		addrs = append(addrs, a)
+	}
+	return addrs, nil
+}
+
+// HasKey reports whether the keystore holds a key for a.
+func (k *Keystore) HasKey(a Address) (bool, error) {
+	_, err := os.Stat(k.path(a))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Wrap(err, "cryptopuff: failed to read key file")
+	}
+	return true, nil
+}
+
+// walletKey reads the key for a, of whichever type its version uses.
+func (k *Keystore) walletKey(a Address) (Key, error) {
+	b, err := ioutil.ReadFile(k.path(a))
+	if os.IsNotExist(err) {
+		return Key{}, errors.Errorf("cryptopuff: no key for address %v in keystore", a)
+	} else if err != nil {
+		return Key{}, errors.Wrap(err, "cryptopuff: failed to read key file")
+	}
+	return decodeWalletKeyPEM(a, b)
+}
+
+func (k *Keystore) Key(a Address) (*rsa.PrivateKey, error) {
+	key, err := k.walletKey(a)
+	if err != nil {
+		return nil, err
+	}
+	if key.Key == nil {
+		return nil, errors.Errorf("cryptopuff: %v has an ECDSA key, not RSA", a)
+	}
+	return key.Key, nil
+}
+
+func (k *Keystore) ECDSAKey(a Address) (*ecdsa.PrivateKey, error) {
+	key, err := k.walletKey(a)
+	if err != nil {
+		return nil, err
+	}
+	if key.ECDSAKey == nil {
+		return nil, errors.Errorf("cryptopuff: %v has an RSA key, not ECDSA", a)
+	}
+	return key.ECDSAKey, nil
+}
+
+// Addresses returns the addresses of every key in the keystore, sorted by
+// their file names.
+func (k *Keystore) Addresses() ([]Address, error) {
+	infos, err := ioutil.ReadDir(k.dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: failed to list keystore")
+	}
+
+	var names []string
+	for _, info := range infos {
+		if info.Mode().IsRegular() && strings.HasSuffix(info.Name(), keystoreExt) {
+			names = append(names, info.Name())
+		}
+	}
+	sort.Strings(names)
+
+	var addrs []Address
+	for _, name := range names {
+		b, err := hex.DecodeString(strings.TrimSuffix(name, keystoreExt))
+		if err != nil {
+			continue
+		}
+		if _, err := DetectVersion(b); err != nil {
+			continue
+		}
+		addrs = append(addrs, Address(b))
+	}
+	return addrs, nil
+}
+
+// SignTx signs the transaction with the key for its source address.
+func (k *Keystore) SignTx(tx *Tx) (*SignedTx, error) {
+	key, err := k.walletKey(tx.Source)
+	if err != nil {
+		return nil, err
+	}
+	return key.SignTx(tx)
+}
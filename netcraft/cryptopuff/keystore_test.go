@@ -0,0 +1,149 @@
+package cryptopuff
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeystoreAddAndLoad(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "keys")
+	ks, err := OpenKeystore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k := testKey(t, 1)
+	a, err := ks.AddKey(k, V3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := ks.AddKey(k, V3); err != nil || !again.Equal(a) {
+		t.Errorf("adding the key again returned %v, %v, want %v", again, err, a)
+	}
+	if _, err := ks.AddKey(k, V4); err == nil {
+		t.Error("added an RSA key for a v4 address")
+	}
+	ek := testECDSAKey(t)
+	ea, err := ks.AddECDSAKey(ek)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The keys are read back from disk by a keystore opened later.
+	ks, err = OpenKeystore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err := ks.Key(a); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(EncodePrivateKeyPEM(loaded), EncodePrivateKeyPEM(k)) {
+		t.Error("loaded RSA key differs")
+	}
+	if loaded, err := ks.ECDSAKey(ea); err != nil {
+		t.Fatal(err)
+	} else if !loaded.Equal(ek) {
+		t.Error("loaded ECDSA key differs")
+	}
+	if _, err := ks.Key(ea); err == nil {
+		t.Error("loaded an ECDSA key as RSA")
+	}
+	if _, err := ks.Key(AddressFromKey(V3, &testKey(t, 2).PublicKey)); err == nil {
+		t.Error("loaded a key that was never added")
+	}
+
+	addrs, err := ks.Addresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 2 {
+		t.Errorf("keystore lists %v addresses, want 2", len(addrs))
+	}
+	for _, want := range []Address{a, ea} {
+		if ok, err := ks.HasKey(want); err != nil || !ok {
+			t.Errorf("HasKey(%v) = %v, %v", want, ok, err)
+		}
+	}
+}
+
+// TestKeystorePermissions checks that the keys are only readable by their
+// owner, and that a key file is never overwritten.
+func TestKeystorePermissions(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "keys")
+	ks, err := OpenKeystore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := ks.AddKey(testKey(t, 1), V3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]os.FileMode{dir: 0700, ks.path(a): 0600} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := info.Mode().Perm(); perm != want {
+			t.Errorf("%v has permissions %v, want %v", path, perm, want)
+		}
+	}
+
+	b, err := os.ReadFile(ks.path(a))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.writeKey(a, EncodePrivateKeyPEM(testKey(t, 2))); err != nil {
+		t.Fatal(err)
+	}
+	if after, err := os.ReadFile(ks.path(a)); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(after, b) {
+		t.Error("key file was overwritten")
+	}
+}
+
+// TestKeystoreSignAndBroadcast signs a transaction locally and broadcasts it
+// to a node that never sees the key.
+func TestKeystoreSignAndBroadcast(t *testing.T) {
+	ks, err := OpenKeystore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := ks.AddKey(testKey(t, 1), V3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := openTestDB(t)
+	parent := insertTestBlock(t, d, GenesisBlock, MinTarget)
+	fundTestAddress(t, d, parent, a, 100)
+	peer, _ := testPeer(t, newTestServer(d).router)
+
+	stx, err := ks.SignTx(&Tx{
+		TxOutput: TxOutput{Destination: testRewardAddress, Amount: 10},
+		Source:   a,
+		Fee:      1,
+		Version:  TxVersion3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewRPCClient(peer, "").BroadcastTx(stx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.TxByHash(stx.Hash); err != nil {
+		t.Errorf("broadcast transaction: %v", err)
+	}
+	keys, err := d.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range keys {
+		if k.Address.Equal(a) {
+			t.Error("node's wallet has the key")
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package cryptopuff
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Leaves and interior nodes are hashed with different prefixes, so an
+// interior node can't be passed off as a transaction.
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
+func merkleLeaf(algo HashAlgo, txHash Hash) Hash {
+	return algo.Sum(append([]byte{merkleLeafPrefix}, txHash[:]...))
+}
+
+func merkleNode(algo HashAlgo, left, right Hash) Hash {
+	b := make([]byte, 0, 1+2*len(left))
+	b = append(b, merkleNodePrefix)
+	b = append(b, left[:]...)
+	b = append(b, right[:]...)
+	return algo.Sum(b)
+}
+
+// MerkleRoot returns the root of the Merkle tree over txHashes, hashed with
+// algo. When a level has an odd number of nodes the last one is carried up
+// unpaired, rather than paired with itself, so two different transaction
+// lists can't share a root. The root of an empty list is the hash of no data,
+// so it is never EmptyHash.
+func MerkleRoot(algo HashAlgo, txHashes []Hash) Hash {
+	if len(txHashes) == 0 {
+		return algo.Sum(nil)
+	}
+
+	level := make([]Hash, len(txHashes))
+	for i, h := range txHashes {
+		level[i] = merkleLeaf(algo, h)
+	}
+
+	for len(level) > 1 {
+		next := level[:0]
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+			} else {
+				next = append(next, merkleNode(algo, level[i], level[i+1]))
+			}
+		}
+		level = next
+	}
+	return level[0]
+}
+
+// merkleProof returns the siblings of the leaf at index, from the bottom of
+// the tree up, skipping levels at which the leaf's ancestor is carried up
+// unpaired.
+func merkleProof(algo HashAlgo, txHashes []Hash, index int) []Hash {
+	level := make([]Hash, len(txHashes))
+	for i, h := range txHashes {
+		level[i] = merkleLeaf(algo, h)
+	}
+
+	var proof []Hash
+	for len(level) > 1 {
+		if sibling := index ^ 1; sibling < len(level) {
+			proof = append(proof, level[sibling])
+		}
+
+		next := make([]Hash, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+			} else {
+				next = append(next, merkleNode(algo, level[i], level[i+1]))
+			}
+		}
+		level = next
+		index /= 2
+	}
+	return proof
+}
+
+// MerkleProof returns the Merkle branch proving that the transaction with the
+// given hash is included in the block, which VerifyMerkleProof checks against
+// the block's MerkleRoot. It returns ErrUnknownTx if the block doesn't include
+// the transaction.
+func (b *Block) MerkleProof(txHash Hash) ([]Hash, error) {
+	hashes := b.txHashes()
+	for i, h := range hashes {
+		if h == txHash {
+			return merkleProof(b.Version.HashAlgo(), hashes, i), nil
+		}
+	}
+	return nil, ErrUnknownTx
+}
+
+// VerifyMerkleProof checks that proof shows the transaction with the given
+// hash is at index in a list of count transactions with the given Merkle
+// root, hashed with algo (see BlockVersion.HashAlgo).
+func VerifyMerkleProof(algo HashAlgo, root, txHash Hash, index, count int, proof []Hash) error {
+	if index < 0 || index >= count {
+		return errors.Errorf("cryptopuff: proof index %v out of range", index)
+	}
+
+	h := merkleLeaf(algo, txHash)
+	for width := count; width > 1; width = (width + 1) / 2 {
+		sibling := index ^ 1
+		if sibling < width {
+			if len(proof) == 0 {
+				return errors.New("cryptopuff: Merkle proof too short")
+			}
+			if index%2 == 0 {
+				h = merkleNode(algo, h, proof[0])
+			} else {
+				h = merkleNode(algo, proof[0], h)
+			}
+			proof = proof[1:]
+		}
+		index /= 2
+	}
+
+	if len(proof) != 0 {
+		return errors.New("cryptopuff: Merkle proof too long")
+	}
+	if h != root {
+		return errors.New("cryptopuff: Merkle proof doesn't match root")
+	}
+	return nil
+}
+
+func (b *Block) txHashes() []Hash {
+	hashes := make([]Hash, len(b.Transactions))
+	for i, stx := range b.Transactions {
+		hashes[i] = stx.Hash
+	}
+	return hashes
+}
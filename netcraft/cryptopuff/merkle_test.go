@@ -0,0 +1,93 @@
+package cryptopuff
+
+import (
+	"testing"
+)
+
+func testTxHashes(n int) []Hash {
+	hashes := make([]Hash, n)
+	for i := range hashes {
+		hashes[i] = HashSHA256.Sum([]byte{byte(i)})
+	}
+	return hashes
+}
+
+func TestMerkleProof(t *testing.T) {
+	// Every count up to 9 has a level with an odd number of nodes somewhere
+	// except the powers of two.
+	for count := 1; count <= 9; count++ {
+		hashes := testTxHashes(count)
+		root := MerkleRoot(HashSHA256, hashes)
+		for i := range hashes {
+			proof := merkleProof(HashSHA256, hashes, i)
+			if err := VerifyMerkleProof(HashSHA256, root, hashes[i], i, count, proof); err != nil {
+				t.Errorf("transaction %v of %v: %v", i, count, err)
+			}
+
+			other := hashes[(i+1)%count]
+			if count > 1 && VerifyMerkleProof(HashSHA256, root, other, i, count, proof) == nil {
+				t.Errorf("transaction %v of %v: proof verified for another transaction", i, count)
+			}
+		}
+	}
+}
+
+func TestMerkleProofSingleTransaction(t *testing.T) {
+	hashes := testTxHashes(1)
+	proof := merkleProof(HashSHA256, hashes, 0)
+	if len(proof) != 0 {
+		t.Errorf("proof for the only transaction has %v hashes, want none", len(proof))
+	}
+	if err := VerifyMerkleProof(HashSHA256, MerkleRoot(HashSHA256, hashes), hashes[0], 0, 1, proof); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMerkleProofInvalid(t *testing.T) {
+	hashes := testTxHashes(5)
+	root := MerkleRoot(HashSHA256, hashes)
+	proof := merkleProof(HashSHA256, hashes, 2)
+
+	tampered := append([]Hash(nil), proof...)
+	tampered[0][0] ^= 1
+
+	tests := []struct {
+		name         string
+		index, count int
+		proof        []Hash
+	}{
+		{"negative index", -1, 5, proof},
+		{"index past count", 5, 5, proof},
+		{"zero count", 0, 0, proof},
+		{"wrong index", 3, 5, proof},
+		{"wrong count", 2, 4, proof},
+		{"too short", 2, 5, proof[:len(proof)-1]},
+		{"too long", 2, 5, append(append([]Hash(nil), proof...), root)},
+		{"tampered", 2, 5, tampered},
+	}
+	for _, test := range tests {
+		if VerifyMerkleProof(HashSHA256, root, hashes[2], test.index, test.count, test.proof) == nil {
+			t.Errorf("%v proof verified", test.name)
+		}
+	}
+}
+
+func TestBlockMerkleProof(t *testing.T) {
+	k := testKey(t, 6)
+	stxs := []SignedTx{*signTestTx(t, k, TxVersion3, 10, 1), *signTestTx(t, k, TxVersion3, 20, 2), *signTestTx(t, k, TxVersion3, 30, 3)}
+	b := mineTestBlock(t, testParent(t, 1), 0, stxs)
+
+	for i, stx := range b.Transactions {
+		proof, err := b.MerkleProof(stx.Hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := VerifyMerkleProof(b.Version.HashAlgo(), b.MerkleRoot, stx.Hash, i, len(b.Transactions), proof); err != nil {
+			t.Errorf("transaction %v: %v", i, err)
+		}
+	}
+
+	if _, err := b.MerkleProof(HashSHA256.Sum(nil)); err != ErrUnknownTx {
+		t.Errorf("proof for a transaction not in the block: got %v, want ErrUnknownTx", err)
+	}
+}
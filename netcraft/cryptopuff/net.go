@@ -4,6 +4,7 @@ import (
 	"net"
 	"os/exec"
 	"regexp"
+	"strings"
 
 	"github.com/pkg/errors"
 )
@@ -15,8 +16,54 @@ const (
 
 var srcIPRegex = regexp.MustCompile(`src ([0-9]+[.][0-9]+[.][0-9]+[.][0-9]+)`)
 
+// ipRouteGet and dialUDP are how DetectIP looks up the route to an address and
+// connects its UDP socket. Tests replace them.
+var (
+	ipRouteGet = func(dest string) ([]byte, error) {
+		return exec.Command("ip", "-o", "route", "get", dest).Output()
+	}
+	dialUDP = net.Dial
+)
+
+// CanonicalPeer normalises a peer's host:port address so that different
+// spellings of the same address compare equal: the host is lowercased, any
+// trailing dots (fully qualified domain names) are stripped and IP addresses
+// are written in their shortest form. Host aliases that would need a DNS
+// lookup, such as a hostname and its IP, are not merged.
+func CanonicalPeer(peer string) string {
+	peer = strings.ToLower(peer)
+
+	host, port, err := net.SplitHostPort(peer)
+	if err != nil {
+		return strings.TrimRight(peer, ".")
+	}
+
+	host = strings.TrimRight(host, ".")
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// DetectIP returns this host's source IP for traffic to the internet. It asks
+// the ip command, falling back to the local address of a UDP socket connected
+// to the same address where ip isn't installed, as on macOS and Windows.
+// Connecting a UDP socket doesn't send any packets.
 func DetectIP() (net.IP, error) {
-	b, err := exec.Command("ip", "-o", "route", "get", "8.8.8.8").Output()
+	ip, routeErr := detectIPRoute()
+	if routeErr == nil {
+		return ip, nil
+	}
+
+	ip, udpErr := detectIPUDP()
+	if udpErr == nil {
+		return ip, nil
+	}
+	return nil, errors.Errorf("cryptopuff: failed to detect IP: %v; %v", routeErr, udpErr)
+}
+
+func detectIPRoute() (net.IP, error) {
+	b, err := ipRouteGet("8.8.8.8")
 	if err != nil {
 		return nil, errors.Wrap(err, "cryptopuff: ip route failed")
 	}
@@ -32,3 +79,17 @@ func DetectIP() (net.IP, error) {
 	}
 	return ip, nil
 }
+
+func detectIPUDP() (net.IP, error) {
+	conn, err := dialUDP("udp", "8.8.8.8:80")
+	if err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: UDP dial failed")
+	}
+	defer conn.Close()
+
+	addr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok || addr.IP.IsUnspecified() {
+		return nil, errors.Errorf("cryptopuff: UDP socket has no local IP (%v)", conn.LocalAddr())
+	}
+	return addr.IP, nil
+}
@@ -0,0 +1,107 @@
+package cryptopuff
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// stubDetectIP replaces how DetectIP looks up routes and dials for the
+// duration of the test.
+func stubDetectIP(t *testing.T, route func(string) ([]byte, error), dial func(string, string) (net.Conn, error)) {
+	origRoute, origDial := ipRouteGet, dialUDP
+	t.Cleanup(func() {
+		ipRouteGet, dialUDP = origRoute, origDial
+	})
+	ipRouteGet, dialUDP = route, dial
+}
+
+func failDial(network, address string) (net.Conn, error) {
+	return nil, errors.New("network is unreachable")
+}
+
+// loopbackDial connects to the loopback address instead, so the socket's
+// local address is 127.0.0.1.
+func loopbackDial(network, address string) (net.Conn, error) {
+	return net.Dial(network, "127.0.0.1:9")
+}
+
+func TestDetectIPRoute(t *testing.T) {
+	stubDetectIP(t, func(dest string) ([]byte, error) {
+		return []byte(dest + " via 192.0.2.1 dev eth0 src 192.0.2.10 uid 0 \\    cache \n"), nil
+	}, failDial)
+
+	ip, err := DetectIP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := net.ParseIP("192.0.2.10"); !ip.Equal(want) {
+		t.Errorf("DetectIP = %v, want %v", ip, want)
+	}
+}
+
+func TestDetectIPRouteFailure(t *testing.T) {
+	for name, route := range map[string]func(string) ([]byte, error){
+		"not installed": func(string) ([]byte, error) {
+			return nil, errors.New(`exec: "ip": executable file not found in $PATH`)
+		},
+		"unparsable": func(string) ([]byte, error) {
+			return []byte("RTNETLINK answers: Network is unreachable\n"), nil
+		},
+	} {
+		stubDetectIP(t, route, loopbackDial)
+
+		ip, err := DetectIP()
+		if err != nil {
+			t.Errorf("%v: %v", name, err)
+			continue
+		}
+		if !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+			t.Errorf("%v: DetectIP = %v, want the UDP socket's 127.0.0.1", name, ip)
+		}
+	}
+}
+
+func TestDetectIPFailure(t *testing.T) {
+	stubDetectIP(t, func(string) ([]byte, error) {
+		return nil, errors.New("exit status 2")
+	}, failDial)
+
+	_, err := DetectIP()
+	if err == nil {
+		t.Fatal("DetectIP succeeded with no route or network")
+	}
+	for _, want := range []string{"exit status 2", "network is unreachable"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q doesn't mention %q", err, want)
+		}
+	}
+}
+
+func TestCanonicalPeer(t *testing.T) {
+	for want, variants := range map[string][]string{
+		"cryptopuff.netcraft.com:8080": {
+			"cryptopuff.netcraft.com:8080",
+			"cryptopuff.netcraft.com.:8080",
+			"CryptoPuff.Netcraft.COM:8080",
+			"CRYPTOPUFF.NETCRAFT.COM.:8080",
+		},
+		"[2001:db8::1]:8080": {
+			"[2001:db8::1]:8080",
+			"[2001:DB8:0::1]:8080",
+			"[2001:0db8:0000:0000:0000:0000:0000:0001]:8080",
+		},
+		"cryptopuff.netcraft.com": {
+			"cryptopuff.netcraft.com",
+			"CryptoPuff.Netcraft.com.",
+		},
+	} {
+		for _, peer := range variants {
+			if got := CanonicalPeer(peer); got != want {
+				t.Errorf("CanonicalPeer(%q) = %q, want %q", peer, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package cryptopuff
+
+import (
+	"sync"
+)
+
+const (
+	DefaultOrphanPoolSize = 100
+	MaxOrphanHeightAhead  = 1000
+)
+
+// orphanPool holds blocks received from peers whose parent we don't have yet,
+// so they can be connected once the parent arrives. It is bounded: when full,
+// the oldest orphan is evicted to make room for a new one.
+type orphanPool struct {
+	mu     sync.Mutex
+	size   int
+	blocks map[Hash]*Block
+	order  []Hash
+}
+
+func newOrphanPool(size int) *orphanPool {
+	return &orphanPool{
+		size:   size,
+		blocks: make(map[Hash]*Block),
+	}
+}
+
+func (o *orphanPool) add(b *Block) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.size <= 0 {
+		return
+	}
+
+	if _, ok := o.blocks[b.Hash]; ok {
+		return
+	}
+
+	for len(o.order) >= o.size {
+		delete(o.blocks, o.order[0])
+		o.order = o.order[1:]
+	}
+
+	o.blocks[b.Hash] = b
+	o.order = append(o.order, b.Hash)
+}
+
+func (o *orphanPool) takeChildren(parent Hash) []*Block {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var (
+		children []*Block
+		order    []Hash
+	)
+	for _, hash := range o.order {
+		b := o.blocks[hash]
+		if b.PreviousHash == parent {
+			children = append(children, b)
+			delete(o.blocks, hash)
+			continue
+		}
+		order = append(order, hash)
+	}
+	o.order = order
+	return children
+}
+
+// list returns the orphans, oldest first.
+func (o *orphanPool) list() []*Block {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	blocks := make([]*Block, 0, len(o.order))
+	for _, hash := range o.order {
+		blocks = append(blocks, o.blocks[hash])
+	}
+	return blocks
+}
+
+func (o *orphanPool) len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return len(o.order)
+}
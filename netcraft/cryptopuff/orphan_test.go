@@ -0,0 +1,32 @@
+package cryptopuff
+
+import (
+	"testing"
+)
+
+func TestOrphanPoolEvictsOldest(t *testing.T) {
+	o := newOrphanPool(3)
+	parent := testParent(t, 1)
+
+	var blocks []*Block
+	for i := 0; i < 10; i++ {
+		b := mineTestBlockTo(t, parent, 0, Address{byte(i)}, nil)
+		o.add(b)
+		o.add(b)
+		blocks = append(blocks, b)
+	}
+
+	kept := o.list()
+	if len(kept) != 3 {
+		t.Fatalf("pool holds %v orphans, want 3", len(kept))
+	}
+	for i, b := range kept {
+		if b.Hash != blocks[7+i].Hash {
+			t.Errorf("orphan %v is %v, want %v", i, b.Hash, blocks[7+i].Hash)
+		}
+	}
+
+	if children := o.takeChildren(parent.Hash); len(children) != 3 || o.len() != 0 {
+		t.Errorf("took %v children, leaving %v orphans", len(children), o.len())
+	}
+}
@@ -4,39 +4,96 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"time"
 
 	"github.com/pkg/errors"
+	"gitlab.netcraft.com/netcraft/recruitment/cryptopuff/retry"
 )
 
+// DefaultPeerRetries is the number of times NewPeerClient retries a GET that
+// failed with a network error or a 5xx status, so a single dropped connection
+// doesn't get a peer removed.
+const DefaultPeerRetries = 2
+
 type PeerClient struct {
-	client *http.Client
+	client  *http.Client
+	strict  bool
+	retries int
+	backoff func(try int) time.Duration
+}
+
+type PeerStatus struct {
+	Height int64
 }
 
 type xPeerTransport struct {
-	addr string
-	next http.RoundTripper
+	addr  string
+	token string
+	next  http.RoundTripper
 }
 
 func (x xPeerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	req.Header.Set(headerXPeer, x.addr)
+	if x.token != "" {
+		req.Header.Set(headerXPeerToken, x.token)
+	}
 	return x.next.RoundTrip(req)
 }
 
-func NewPeerClient(addr string) *PeerClient {
+// NewPeerClient returns a client that identifies itself to peers as addr. If
+// token is non-empty it is sent to authenticate to peers on closed networks.
+// It retries failed GETs DefaultPeerRetries times.
+func NewPeerClient(addr, token string) *PeerClient {
+	return NewPeerClientWithRetries(addr, token, DefaultPeerRetries)
+}
+
+// NewPeerClientWithRetries is like NewPeerClient but retries GETs, which are
+// safe to repeat, up to retries times, backing off between attempts. POSTs are
+// never retried, as a peer may have acted on one whose response was lost.
+func NewPeerClientWithRetries(addr, token string, retries int) *PeerClient {
+	if retries < 0 {
+		retries = 0
+	}
 	return &PeerClient{
+		retries: retries,
+		backoff: retry.BinaryExponentialBackoff(),
 		client: &http.Client{
 			Transport: xPeerTransport{
-				addr: addr,
-				next: http.DefaultTransport,
+				addr:  addr,
+				token: token,
+				next:  http.DefaultTransport,
 			},
 			Timeout: Timeout,
 		},
 	}
 }
 
+// get is httpGet, retried on network errors and 5xx statuses.
+func (c *PeerClient) get(url string) (*http.Response, error) {
+	for try := 0; ; try++ {
+		resp, err := httpGet(c.client, url)
+		if err == nil || try >= c.retries || !retryable(err) {
+			return resp, err
+		}
+		time.Sleep(c.backoff(try))
+	}
+}
+
+// retryable reports whether a failed request may succeed if repeated. Other
+// statuses, such as a peer rejecting an invalid request, are final.
+func retryable(err error) bool {
+	if rpcErr, ok := err.(*RPCError); ok {
+		return rpcErr.StatusCode >= http.StatusInternalServerError
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
 func (c *PeerClient) Ping(peer string) error {
-	resp, err := httpGet(c.client, fmt.Sprintf("http://%v/api/ping", peer))
+	resp, err := c.get(fmt.Sprintf("http://%v/api/ping", peer))
 	if err != nil {
 		return errors.Wrap(err, "cryptopuff: GET failed")
 	}
@@ -44,15 +101,40 @@ func (c *PeerClient) Ping(peer string) error {
 	return nil
 }
 
+// Status pings a peer and returns the height of its best block. Peers running
+// an older version respond with an empty body, in which case Height is -1.
+func (c *PeerClient) Status(peer string) (*PeerStatus, error) {
+	resp, err := c.get(fmt.Sprintf("http://%v/api/ping", peer))
+	if err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: GET failed")
+	}
+	defer resp.Body.Close()
+
+	status := PeerStatus{Height: -1}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil && err != io.EOF {
+		return nil, errors.Wrap(err, "cryptopuff: failed to unmarshal JSON")
+	}
+	return &status, nil
+}
+
+// sendPassword makes the client authenticate to peers with password, for
+// private networks where every node requires it.
+func (c *PeerClient) sendPassword(password string) {
+	c.client.Transport = basicAuthTransport{
+		password: password,
+		next:     c.client.Transport,
+	}
+}
+
 func (c *PeerClient) Peers(peer string) ([]string, error) {
-	resp, err := httpGet(c.client, fmt.Sprintf("http://%v/api/peers", peer))
+	resp, err := c.get(fmt.Sprintf("http://%v/api/peers", peer))
 	if err != nil {
 		return nil, errors.Wrap(err, "cryptopuff: GET failed")
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, errors.Errorf("cryptopuff: invalid status code: %v", resp.StatusCode)
+		return nil, newRPCError(resp)
 	}
 
 	var peers []string
@@ -75,25 +157,42 @@ func (c *PeerClient) AddPeer(peer string, addr string) error {
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return errors.Errorf("cryptopuff: invalid status code: %v", resp.StatusCode)
+		return newRPCError(resp)
 	}
 
 	return nil
 }
 
-func (c *PeerClient) Blocks(peer string) ([]Block, error) {
-	resp, err := httpGet(c.client, fmt.Sprintf("http://%v/api/blocks", peer))
+// Blocks returns up to limit blocks of the peer's best chain, oldest first,
+// starting at height from. Peers that predate paging ignore from and limit and
+// send their whole chain newest first, which is returned oldest first too, so
+// callers can tell it apart by the height of its first block.
+func (c *PeerClient) Blocks(peer string, from int64, limit int) ([]Block, error) {
+	blocks, err := c.blocks(fmt.Sprintf("http://%v/api/blocks?from=%d&limit=%d", peer, from, limit))
 	if err != nil {
-		return nil, errors.Wrap(err, "cryptopuff: GET faield")
+		return nil, err
+	}
+	if len(blocks) > 0 && blocks[0].Height != from {
+		for i, j := 0, len(blocks)-1; i < j; i, j = i+1, j-1 {
+			blocks[i], blocks[j] = blocks[j], blocks[i]
+		}
+	}
+	return blocks, nil
+}
+
+func (c *PeerClient) blocks(url string) ([]Block, error) {
+	resp, err := c.get(url)
+	if err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: GET failed")
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, errors.Errorf("cryptopuff: invalid status code: %v", resp.StatusCode)
+		return nil, newRPCError(resp)
 	}
 
 	var blocks []Block
-	if err := json.NewDecoder(resp.Body).Decode(&blocks); err != nil {
+	if err := newJSONDecoder(resp.Body, c.strict).Decode(&blocks); err != nil {
 		return nil, errors.Wrap(err, "cryptopuff: failed to unmarshal JSON")
 	}
 	for i := range blocks {
@@ -117,25 +216,25 @@ func (c *PeerClient) AddBlock(peer string, block *Block) error {
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return errors.Errorf("cryptopuff: invalid status code: %v", resp.StatusCode)
+		return newRPCError(resp)
 	}
 
 	return nil
 }
 
 func (c *PeerClient) Txs(peer string) ([]SignedTx, error) {
-	resp, err := httpGet(c.client, fmt.Sprintf("http://%v/api/txs", peer))
+	resp, err := c.get(fmt.Sprintf("http://%v/api/txs", peer))
 	if err != nil {
 		return nil, errors.Wrap(err, "cryptopuff: GET failed")
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, errors.Errorf("cryptopuff: invalid status code: %v", resp.StatusCode)
+		return nil, newRPCError(resp)
 	}
 
 	var stxs []SignedTx
-	if err := json.NewDecoder(resp.Body).Decode(&stxs); err != nil {
+	if err := newJSONDecoder(resp.Body, c.strict).Decode(&stxs); err != nil {
 		return nil, errors.Wrap(err, "cryptopuff: failed to unmarshal JSON")
 	}
 	for i := range stxs {
@@ -159,7 +258,7 @@ func (c *PeerClient) AddTx(peer string, tx *SignedTx) error {
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return errors.Errorf("cryptopuff: invalid status code: %v", resp.StatusCode)
+		return newRPCError(resp)
 	}
 
 	return nil
@@ -0,0 +1,53 @@
+package cryptopuff
+
+import "sync"
+
+const DefaultMaxPeerNotifications = 16
+
+// notifyQueueLength is the number of notifications that may wait for a free
+// worker before more are dropped.
+const notifyQueueLength = 1024
+
+// notifyPool bounds the number of outbound peer notifications (new peers,
+// transactions and blocks) in flight at once, across all broadcasts, by
+// running them on a fixed number of workers.
+type notifyPool struct {
+	workers int
+	queue   chan func()
+	start   sync.Once
+}
+
+func newNotifyPool(n int) *notifyPool {
+	if n < 1 {
+		n = 1
+	}
+	return &notifyPool{
+		workers: n,
+		queue:   make(chan func(), notifyQueueLength),
+	}
+}
+
+// Go queues f to run on one of the pool's workers, which are started on first
+// use. If the queue is full it drops f and returns false, so peers too slow to
+// keep up lose notifications rather than piling up goroutines or holding up
+// the caller.
+func (p *notifyPool) Go(f func()) bool {
+	p.start.Do(func() {
+		for i := 0; i < p.workers; i++ {
+			go p.work()
+		}
+	})
+
+	select {
+	case p.queue <- f:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *notifyPool) work() {
+	for f := range p.queue {
+		f()
+	}
+}
@@ -0,0 +1,62 @@
+package cryptopuff
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNotifyPoolConcurrency(t *testing.T) {
+	const workers = 3
+	p := newNotifyPool(workers)
+
+	var (
+		wg            sync.WaitGroup
+		running, most int32
+	)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		if !p.Go(func() {
+			defer wg.Done()
+			n := atomic.AddInt32(&running, 1)
+			for {
+				m := atomic.LoadInt32(&most)
+				if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&running, -1)
+		}) {
+			t.Fatal("notification dropped with room in the queue")
+		}
+	}
+	wg.Wait()
+
+	if most > workers {
+		t.Errorf("%v notifications ran at once, want at most %v", most, workers)
+	}
+}
+
+func TestNotifyPoolFull(t *testing.T) {
+	p := newNotifyPool(1)
+	block := make(chan struct{})
+	defer close(block)
+
+	started := make(chan struct{})
+	p.Go(func() {
+		close(started)
+		<-block
+	})
+	<-started
+
+	for i := 0; i < notifyQueueLength; i++ {
+		if !p.Go(func() {}) {
+			t.Fatalf("notification %v dropped with room in the queue", i)
+		}
+	}
+	if p.Go(func() {}) {
+		t.Error("notification queued beyond the queue's length")
+	}
+}
@@ -0,0 +1,96 @@
+package cryptopuff
+
+import (
+	"github.com/pkg/errors"
+)
+
+// InclusionProof shows that a transaction is included in a block. For blocks
+// with a Merkle root it is the Merkle branch from the transaction to the root,
+// so its size grows only with the logarithm of the number of transactions.
+// Blocks created before Merkle roots were introduced commit to a hash of their
+// whole transaction list, so their proofs have to carry the list instead.
+type InclusionProof struct {
+	Index        int
+	Count        int        `json:",omitempty"`
+	Branch       []Hash     `json:",omitempty"`
+	Transactions []SignedTx `json:",omitempty"`
+}
+
+// TxInclusion is returned by the proof endpoint: the transaction, the header
+// of the block including it and the proof linking the two.
+type TxInclusion struct {
+	Tx     SignedTx
+	Header BlockHeader
+	Proof  InclusionProof
+}
+
+func NewTxInclusion(b *Block, hash Hash) (*TxInclusion, error) {
+	header, err := b.Header()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, stx := range b.Transactions {
+		if stx.Hash != hash {
+			continue
+		}
+
+		proof := InclusionProof{Index: i}
+		if b.MerkleRoot != EmptyHash {
+			proof.Count = len(b.Transactions)
+			proof.Branch, err = b.MerkleProof(hash)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			proof.Transactions = b.Transactions
+		}
+		return &TxInclusion{
+			Tx:     stx,
+			Header: header,
+			Proof:  proof,
+		}, nil
+	}
+	return nil, ErrUnknownTx
+}
+
+// VerifyInclusion checks that stx is included in the block described by
+// header, and that the header's hash matches its fields and meets the
+// difficulty requirement. It doesn't check that the block is in the best
+// chain.
+func VerifyInclusion(header BlockHeader, stx *SignedTx, proof *InclusionProof) error {
+	if header.ComputeHash() != header.Hash {
+		return errors.New("cryptopuff: header hash doesn't match its fields")
+	}
+	if !header.Hash.MeetsTarget(header.Target.orDefault()) {
+		return errors.New("cryptopuff: header hash doesn't meet difficulty requirement")
+	}
+
+	if err := stx.UpdateHash(); err != nil {
+		return errors.Wrap(err, "cryptopuff: failed to update transaction hash")
+	}
+
+	if header.MerkleRoot != EmptyHash {
+		return VerifyMerkleProof(header.Version.HashAlgo(), header.MerkleRoot, stx.Hash, proof.Index, proof.Count, proof.Branch)
+	}
+
+	if proof.Index < 0 || proof.Index >= len(proof.Transactions) {
+		return errors.Errorf("cryptopuff: proof index %v out of range", proof.Index)
+	}
+	proven := proof.Transactions[proof.Index]
+	if err := proven.UpdateHash(); err != nil {
+		return errors.Wrap(err, "cryptopuff: failed to update transaction hash")
+	}
+	if proven.Hash != stx.Hash {
+		return errors.New("cryptopuff: transaction doesn't match proof")
+	}
+
+	txListHash, err := hashTxList(proof.Transactions)
+	if err != nil {
+		return err
+	}
+	if txListHash != header.TxListHash {
+		return errors.New("cryptopuff: proof doesn't match header transaction list hash")
+	}
+	return nil
+}
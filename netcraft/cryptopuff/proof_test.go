@@ -0,0 +1,123 @@
+package cryptopuff
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// mineLegacyTestBlock mines a block without a Merkle root, as blocks were
+// before Merkle roots were introduced.
+func mineLegacyTestBlock(t *testing.T, previous *Block, stxs []SignedTx) *Block {
+	b, err := NewBlock(previous, previous.Target, 0, testRewardAddress, stxs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Version = BlockVersion1
+	b.MerkleRoot = EmptyHash
+	for {
+		if err := b.UpdateHash(); err != nil {
+			t.Fatal(err)
+		}
+		if b.Hash.MeetsTarget(b.RequiredTarget()) {
+			return b
+		}
+		b.Nonce++
+	}
+}
+
+// roundTripInclusion builds the inclusion proof for the transaction at index
+// in b and passes it through JSON, as the proof endpoint does.
+func roundTripInclusion(t *testing.T, b *Block, index int) *TxInclusion {
+	inclusion, err := NewTxInclusion(b, b.Transactions[index].Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := json.Marshal(inclusion)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded TxInclusion
+	if err := json.Unmarshal(raw, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	return &decoded
+}
+
+func TestVerifyInclusion(t *testing.T) {
+	k := testKey(t, 7)
+	stxs := []SignedTx{*signTestTx(t, k, TxVersion3, 10, 1), *signTestTx(t, k, TxVersion3, 20, 2), *signTestTx(t, k, TxVersion3, 30, 3)}
+	parent := testParent(t, 1)
+
+	for _, b := range []*Block{mineTestBlock(t, parent, 0, stxs), mineLegacyTestBlock(t, parent, stxs)} {
+		for i := range b.Transactions {
+			inclusion := roundTripInclusion(t, b, i)
+			if err := VerifyInclusion(inclusion.Header, &inclusion.Tx, &inclusion.Proof); err != nil {
+				t.Errorf("version %v block, transaction %v: %v", b.Version, i, err)
+			}
+		}
+	}
+}
+
+func TestVerifyInclusionMerkleBranch(t *testing.T) {
+	k := testKey(t, 7)
+	var stxs []SignedTx
+	for i := 0; i < 20; i++ {
+		stxs = append(stxs, *signTestTx(t, k, TxVersion3, int64(10+i), 1))
+	}
+	b := mineTestBlock(t, testParent(t, 1), 0, stxs)
+
+	inclusion := roundTripInclusion(t, b, 13)
+	if len(inclusion.Proof.Transactions) != 0 {
+		t.Errorf("proof carries %v transactions, want none", len(inclusion.Proof.Transactions))
+	}
+	if got, want := len(inclusion.Proof.Branch), 5; got != want {
+		t.Errorf("proof has %v hashes, want %v", got, want)
+	}
+}
+
+func TestVerifyInclusionTampered(t *testing.T) {
+	k := testKey(t, 8)
+	stxs := []SignedTx{*signTestTx(t, k, TxVersion3, 10, 1), *signTestTx(t, k, TxVersion3, 20, 2), *signTestTx(t, k, TxVersion3, 30, 3)}
+	other := signTestTx(t, k, TxVersion3, 40, 4)
+	parent := testParent(t, 1)
+
+	// Each returns false if it doesn't apply to the kind of proof.
+	tests := []struct {
+		name   string
+		tamper func(*TxInclusion) bool
+	}{
+		{"other transaction", func(i *TxInclusion) bool { i.Tx = *other; return true }},
+		{"amount", func(i *TxInclusion) bool { i.Tx.Amount++; return true }},
+		{"index", func(i *TxInclusion) bool { i.Proof.Index = (i.Proof.Index + 1) % 3; return true }},
+		{"header height", func(i *TxInclusion) bool { i.Header.Height++; return true }},
+		{"header hash", func(i *TxInclusion) bool { i.Header.Hash[0] ^= 1; return true }},
+		{"header Merkle root", func(i *TxInclusion) bool { i.Header.MerkleRoot[0] ^= 1; return true }},
+		{"branch", func(i *TxInclusion) bool {
+			if len(i.Proof.Branch) == 0 {
+				return false
+			}
+			i.Proof.Branch[0][0] ^= 1
+			return true
+		}},
+		{"transaction list", func(i *TxInclusion) bool {
+			if len(i.Proof.Transactions) == 0 {
+				return false
+			}
+			i.Proof.Transactions[2] = *other
+			return true
+		}},
+	}
+
+	for _, b := range []*Block{mineTestBlock(t, parent, 0, stxs), mineLegacyTestBlock(t, parent, stxs)} {
+		for _, test := range tests {
+			inclusion := roundTripInclusion(t, b, 1)
+			if !test.tamper(inclusion) {
+				continue
+			}
+			if VerifyInclusion(inclusion.Header, &inclusion.Tx, &inclusion.Proof) == nil {
+				t.Errorf("version %v block: proof with tampered %v verified", b.Version, test.name)
+			}
+		}
+	}
+}
@@ -0,0 +1,678 @@
+package cryptopuff
+
+import (
+	"math"
+	"math/big"
+	"math/bits"
+	"math/rand"
+
+	"github.com/pkg/errors"
+)
+
+// qsParams are the quadratic sieve's parameters for moduli (times their
+// multiplier) of up to bits bits: the number of primes in the factor base and
+// half the width of the interval sieved for each polynomial.
+var qsParams = []struct {
+	bits   int
+	primes int
+	m      int
+}{
+	{64, 100, 1 << 13},
+	{96, 200, 1 << 14},
+	{128, 400, 1 << 15},
+	{160, 900, 1 << 15},
+	{192, 1800, 1 << 16},
+	{224, 3000, 1 << 16},
+	{264, 5500, 3 << 15},
+}
+
+const (
+	// qsLargePrimeMultiplier bounds the one prime outside the factor base
+	// that a partial relation may have, as a multiple of the largest prime in
+	// the base. Two partial relations with the same large prime combine into
+	// a full one.
+	qsLargePrimeMultiplier = 64
+
+	// qsSmallPrime is the smallest prime added to the sieve array. Smaller
+	// primes hit so many positions that sieving them costs more than it
+	// reveals, so the threshold allows for them instead.
+	qsSmallPrime = 30
+
+	// qsExtraRelations is how many more relations than factor base primes
+	// are collected, so the matrix has several dependencies to try.
+	qsExtraRelations = 64
+
+	// qsMaxRounds caps how many times the sieve collects more relations
+	// after every dependency found only a trivial factor.
+	qsMaxRounds = 4
+)
+
+// qsMultipliers are the small square-free multipliers knuthSchroeppel picks
+// from.
+var qsMultipliers = []int64{1, 2, 3, 5, 6, 7, 10, 11, 13, 14, 15, 17, 19, 21, 22, 23, 26, 29, 30, 31, 33, 34, 35, 37, 38, 39, 41, 42, 43, 46, 47, 51, 53, 55, 57, 58, 59, 61, 62, 65, 66, 67, 69, 70, 71, 73}
+
+// qsRelation records that x² is congruent to the product of factors (indices
+// into the factor base, where 0 stands for -1) times square² modulo n.
+type qsRelation struct {
+	x       *big.Int
+	factors []int
+	square  *big.Int
+}
+
+// qsFactorBase holds the primes p for which kn is a square mod p, with -1 at
+// index 0 for the sign and 2 at index 1.
+type qsFactorBase struct {
+	primes []int
+	bigs   []*big.Int
+	sqrts  []int // a square root of kn mod p
+	logs   []uint8
+}
+
+// quadraticSieve returns a non-trivial factor of n, which must be an odd
+// composite that isn't a perfect square, using the self-initialising
+// quadratic sieve with the single large prime variation.
+func quadraticSieve(n *big.Int) (*big.Int, error) {
+	k := knuthSchroeppel(n)
+	kn := new(big.Int).Mul(n, big.NewInt(k))
+
+	params := qsParams[len(qsParams)-1]
+	for _, p := range qsParams {
+		if kn.BitLen() <= p.bits {
+			params = p
+			break
+		}
+	}
+
+	fb, d := newQSFactorBase(n, kn, params.primes)
+	if d != nil {
+		return d, nil
+	}
+
+	s := &qsSieve{
+		n:         n,
+		kn:        kn,
+		fb:        fb,
+		m:         params.m,
+		rng:       rand.New(rand.NewSource(n.Int64())),
+		partials:  make(map[uint64]qsRelation),
+		usedA:     make(map[string]bool),
+		largeMax:  uint64(fb.primes[len(fb.primes)-1]) * qsLargePrimeMultiplier,
+		sieve:     make([]uint8, 2*params.m),
+		root1:     make([]int, len(fb.primes)),
+		root2:     make([]int, len(fb.primes)),
+		inA:       make([]bool, len(fb.primes)),
+		threshold: qsThreshold(kn, params.m, fb),
+	}
+
+	want := len(fb.primes) + qsExtraRelations
+	for round := 0; round < qsMaxRounds; round++ {
+		if err := s.collect(want); err != nil {
+			return nil, err
+		}
+		if d := s.solve(); d != nil {
+			return d, nil
+		}
+		want += qsExtraRelations
+	}
+	return nil, errors.New("cryptopuff: quadratic sieve found only trivial factors")
+}
+
+// knuthSchroeppel picks the multiplier k that makes small primes most likely
+// to divide the values sieved for kn, which is worth a few times the speed.
+func knuthSchroeppel(n *big.Int) int64 {
+	primes := smallPrimes(500)
+	best, bestScore := int64(1), math.Inf(-1)
+	for _, k := range qsMultipliers {
+		kn := new(big.Int).Mul(n, big.NewInt(k))
+		score := -0.5 * math.Log(float64(k))
+		switch new(big.Int).And(kn, big.NewInt(7)).Int64() {
+		case 1:
+			score += 2 * math.Ln2
+		case 5:
+			score += math.Ln2
+		case 3, 7:
+			score += 0.5 * math.Ln2
+		}
+		for _, p := range primes[1:] {
+			switch {
+			case k%int64(p) == 0:
+				score += math.Log(float64(p)) / float64(p)
+			case isQuadraticResidue(modSmall(kn, p), p):
+				score += 2 * math.Log(float64(p)) / float64(p-1)
+			}
+		}
+		if score > bestScore {
+			best, bestScore = k, score
+		}
+	}
+	return best
+}
+
+// newQSFactorBase returns the first size primes modulo which kn is a square.
+// If one of them divides n, it returns that instead.
+func newQSFactorBase(n, kn *big.Int, size int) (*qsFactorBase, *big.Int) {
+	fb := &qsFactorBase{
+		primes: []int{-1, 2},
+		bigs:   []*big.Int{big.NewInt(-1), big.NewInt(2)},
+		sqrts:  []int{0, 0},
+		logs:   []uint8{0, 1},
+	}
+
+	for limit := 4 * size * int(math.Log(float64(size))+2); len(fb.primes) < size; limit *= 2 {
+		fb.primes, fb.bigs, fb.sqrts, fb.logs = fb.primes[:2], fb.bigs[:2], fb.sqrts[:2], fb.logs[:2]
+		for _, p := range smallPrimes(limit)[1:] {
+			if len(fb.primes) == size {
+				break
+			}
+			if modSmall(n, p) == 0 {
+				if n.Cmp(big.NewInt(int64(p))) == 0 {
+					continue
+				}
+				return nil, big.NewInt(int64(p))
+			}
+			r := modSmall(kn, p)
+			if r == 0 || !isQuadraticResidue(r, p) {
+				continue
+			}
+
+			bp := big.NewInt(int64(p))
+			fb.primes = append(fb.primes, p)
+			fb.bigs = append(fb.bigs, bp)
+			fb.sqrts = append(fb.sqrts, int(new(big.Int).ModSqrt(big.NewInt(int64(r)), bp).Int64()))
+			fb.logs = append(fb.logs, uint8(math.Round(math.Log2(float64(p)))))
+		}
+	}
+	return fb, nil
+}
+
+// qsThreshold is the sieve value above which a position is worth trial
+// dividing: the size of the values sieved, less the large prime and an
+// allowance for the small primes that aren't sieved.
+func qsThreshold(kn *big.Int, m int, fb *qsFactorBase) uint8 {
+	largest := float64(fb.primes[len(fb.primes)-1]) * qsLargePrimeMultiplier
+	t := math.Log2(float64(m)) + float64(kn.BitLen())/2 - 0.5 - math.Log2(largest) - 4
+	if t < 0 {
+		return 0
+	}
+	return uint8(t)
+}
+
+// qsSieve is the state of a quadratic sieve as it collects relations.
+type qsSieve struct {
+	n, kn *big.Int
+	fb    *qsFactorBase
+	m     int
+	rng   *rand.Rand
+
+	relations []qsRelation
+	partials  map[uint64]qsRelation
+	usedA     map[string]bool
+	largeMax  uint64
+
+	sieve        []uint8
+	root1, root2 []int
+	inA          []bool
+	threshold    uint8
+}
+
+// collect sieves polynomials until there are at least want full relations.
+func (s *qsSieve) collect(want int) error {
+	for tries := 0; len(s.relations) < want; tries++ {
+		if tries > 1000 {
+			return errors.New("cryptopuff: quadratic sieve ran out of polynomials")
+		}
+		a, qs, ok := s.chooseA()
+		if !ok {
+			continue
+		}
+		tries = 0
+		s.sieveA(a, qs, want)
+	}
+	return nil
+}
+
+// chooseA picks a polynomial coefficient a close to sqrt(2kn)/m that is the
+// product of factor base primes and hasn't been used before, returning it
+// and the indices of its primes.
+func (s *qsSieve) chooseA() (*big.Int, []int, bool) {
+	fb := s.fb
+	logTarget := float64(s.kn.BitLen()+1)/2 - math.Log2(float64(s.m))
+
+	n := int(math.Round(logTarget / 11))
+	if n < 1 {
+		n = 1
+	}
+	logQ := logTarget / float64(n)
+
+	// Take the primes from the middle of the factor base: small ones would
+	// be skipped by the sieve anyway, and large ones hit it too rarely.
+	lo, hi := 2, len(fb.primes)
+	for lo < hi && math.Log2(float64(fb.primes[lo])) < logQ-1 {
+		lo++
+	}
+	for hi > lo && math.Log2(float64(fb.primes[hi-1])) > logQ+1 {
+		hi--
+	}
+	if hi-lo < n+2 {
+		lo, hi = 2, len(fb.primes)
+	}
+
+	a := big.NewInt(1)
+	var qs []int
+	for len(qs) < n-1 {
+		i := lo + s.rng.Intn(hi-lo)
+		if containsInt(qs, i) {
+			continue
+		}
+		qs = append(qs, i)
+		a.Mul(a, fb.bigs[i])
+	}
+
+	// Pick the last prime to bring a as close to the target as possible.
+	aLog := logBig(a)
+	last, lastDiff := -1, math.Inf(1)
+	for i := 2; i < len(fb.primes); i++ {
+		if containsInt(qs, i) {
+			continue
+		}
+		if d := math.Abs(aLog + math.Log2(float64(fb.primes[i])) - logTarget); d < lastDiff {
+			last, lastDiff = i, d
+		}
+	}
+	qs = append(qs, last)
+	a.Mul(a, fb.bigs[last])
+
+	key := a.String()
+	if s.usedA[key] {
+		return nil, nil, false
+	}
+	s.usedA[key] = true
+	return a, qs, true
+}
+
+// sieveA sieves the 2^(len(qs)-1) polynomials (ax+b)² - kn that share a,
+// stopping early if there are want relations.
+func (s *qsSieve) sieveA(a *big.Int, qs []int, want int) {
+	fb := s.fb
+
+	// b is a sum of ±bs[l] for every l, chosen so that b² = kn mod a.
+	bs := make([]*big.Int, len(qs))
+	b := new(big.Int)
+	for l, qi := range qs {
+		q := fb.bigs[qi]
+		g := new(big.Int).Quo(a, q)
+		gamma := int64(fb.sqrts[qi]) * modInverse(modSmall(g, fb.primes[qi]), fb.primes[qi]) % int64(fb.primes[qi])
+		if gamma > int64(fb.primes[qi])/2 {
+			gamma = int64(fb.primes[qi]) - gamma
+		}
+		bs[l] = g.Mul(g, big.NewInt(gamma))
+		b.Add(b, bs[l])
+	}
+
+	// Moving from one b to the next shifts the roots mod p by ±bainv[l][i].
+	bainv := make([][]int, len(qs))
+	for l := range bainv {
+		bainv[l] = make([]int, len(fb.primes))
+	}
+	for i := range s.inA {
+		s.inA[i] = false
+	}
+	for _, qi := range qs {
+		s.inA[qi] = true
+	}
+	for i := 2; i < len(fb.primes); i++ {
+		if s.inA[i] {
+			continue
+		}
+		p := fb.primes[i]
+		ainv := modInverse(modSmall(a, p), p)
+		for l := range bs {
+			bainv[l][i] = int(2 * int64(modSmall(bs[l], p)) * ainv % int64(p))
+		}
+		bmod := modSmall(b, p)
+		r1 := ainv * int64((fb.sqrts[i]-bmod+p)%p) % int64(p)
+		r2 := ainv * int64((2*p-fb.sqrts[i]-bmod)%p) % int64(p)
+		s.root1[i] = int((r1 + int64(s.m)) % int64(p))
+		s.root2[i] = int((r2 + int64(s.m)) % int64(p))
+	}
+
+	signs := make([]bool, len(qs))
+	for j := 0; ; j++ {
+		if j > 0 {
+			// Flip the sign of one bs[v] at a time, Gray code order, never
+			// the last one since -b gives the same values as b.
+			v := bits.TrailingZeros(uint(j))
+			if v >= len(qs)-1 {
+				return
+			}
+			signs[v] = !signs[v]
+			delta := new(big.Int).Lsh(bs[v], 1)
+			if signs[v] {
+				b.Sub(b, delta)
+			} else {
+				b.Add(b, delta)
+			}
+			for i := 2; i < len(fb.primes); i++ {
+				if s.inA[i] {
+					continue
+				}
+				p := fb.primes[i]
+				d := bainv[v][i]
+				if !signs[v] {
+					d = p - d
+				}
+				s.root1[i] = (s.root1[i] + d) % p
+				s.root2[i] = (s.root2[i] + d) % p
+			}
+		}
+
+		s.sievePolynomial(a, b, qs)
+		if len(s.relations) >= want || len(qs) == 1 {
+			return
+		}
+	}
+}
+
+// sievePolynomial sieves (ax+b)² - kn = a(ax² + 2bx + c) for x in [-m, m)
+// and records the relations it finds.
+func (s *qsSieve) sievePolynomial(a, b *big.Int, qs []int) {
+	fb := s.fb
+	for i := range s.sieve {
+		s.sieve[i] = 0
+	}
+	size := len(s.sieve)
+	for i := 2; i < len(fb.primes); i++ {
+		p := fb.primes[i]
+		if p < qsSmallPrime || s.inA[i] {
+			continue
+		}
+		lg := fb.logs[i]
+		for j := s.root1[i]; j < size; j += p {
+			s.sieve[j] += lg
+		}
+		if s.root2[i] != s.root1[i] {
+			for j := s.root2[i]; j < size; j += p {
+				s.sieve[j] += lg
+			}
+		}
+	}
+
+	// c = (b² - kn) / a, exactly since b² = kn mod a.
+	c := new(big.Int).Mul(b, b)
+	c.Sub(c, s.kn)
+	c.Quo(c, a)
+	b2 := new(big.Int).Lsh(b, 1)
+
+	var (
+		x, v, q, r big.Int
+	)
+	for j, l := range s.sieve {
+		if l < s.threshold {
+			continue
+		}
+
+		x.SetInt64(int64(j - s.m))
+		v.Mul(a, &x)
+		v.Add(&v, b2)
+		v.Mul(&v, &x)
+		v.Add(&v, c)
+		if v.Sign() == 0 {
+			continue
+		}
+
+		var factors []int
+		if v.Sign() < 0 {
+			factors = append(factors, 0)
+			v.Neg(&v)
+		}
+		for t := v.TrailingZeroBits(); t > 0; t-- {
+			factors = append(factors, 1)
+		}
+		v.Rsh(&v, v.TrailingZeroBits())
+
+		for i := 2; i < len(fb.primes); i++ {
+			if !s.inA[i] {
+				if rem := j % fb.primes[i]; rem != s.root1[i] && rem != s.root2[i] {
+					continue
+				}
+			}
+			for {
+				q.QuoRem(&v, fb.bigs[i], &r)
+				if r.Sign() != 0 {
+					break
+				}
+				v.Set(&q)
+				factors = append(factors, i)
+			}
+		}
+		factors = append(factors, qs...)
+
+		lhs := new(big.Int).Mul(a, &x)
+		lhs.Add(lhs, b)
+		lhs.Mod(lhs, s.n)
+
+		switch {
+		case v.IsInt64() && v.Int64() == 1:
+			s.relations = append(s.relations, qsRelation{x: lhs, factors: factors, square: big.NewInt(1)})
+		case v.IsUint64() && v.Uint64() < s.largeMax:
+			large := v.Uint64()
+			other, ok := s.partials[large]
+			if !ok {
+				s.partials[large] = qsRelation{x: lhs, factors: factors}
+				continue
+			}
+			lhs.Mul(lhs, other.x)
+			lhs.Mod(lhs, s.n)
+			s.relations = append(s.relations, qsRelation{
+				x:       lhs,
+				factors: append(factors, other.factors...),
+				square:  new(big.Int).SetUint64(large),
+			})
+		}
+	}
+}
+
+// solve looks for subsets of the relations whose products are squares on both
+// sides, x² = y² mod n, and returns the first non-trivial gcd(x - y, n).
+func (s *qsSieve) solve() *big.Int {
+	columns := len(s.fb.primes)
+
+	// Only the parity of each exponent matters.
+	odd := make([][]int, len(s.relations))
+	for r, rel := range s.relations {
+		counts := make(map[int]int)
+		for _, f := range rel.factors {
+			counts[f]++
+		}
+		for f, c := range counts {
+			if c%2 == 1 {
+				odd[r] = append(odd[r], f)
+			}
+		}
+	}
+
+	// Drop relations with a prime no other relation has, which can't be
+	// part of a square, until there are none left.
+	alive := make([]bool, len(s.relations))
+	for r := range alive {
+		alive[r] = true
+	}
+	for changed := true; changed; {
+		changed = false
+		weight := make([]int, columns)
+		for r, cols := range odd {
+			if alive[r] {
+				for _, c := range cols {
+					weight[c]++
+				}
+			}
+		}
+		for r, cols := range odd {
+			if !alive[r] {
+				continue
+			}
+			for _, c := range cols {
+				if weight[c] == 1 {
+					alive[r] = false
+					changed = true
+					break
+				}
+			}
+		}
+	}
+	var rows []int
+	for r := range alive {
+		if alive[r] {
+			rows = append(rows, r)
+		}
+	}
+
+	// Gaussian elimination over GF(2). Each row is its exponent parities
+	// followed by the set of relations that were added together to make it.
+	cw := (columns + 63) / 64
+	hw := (len(rows) + 63) / 64
+	matrix := make([][]uint64, len(rows))
+	for i, r := range rows {
+		row := make([]uint64, cw+hw)
+		for _, c := range odd[r] {
+			row[c/64] |= 1 << uint(c%64)
+		}
+		row[cw+i/64] |= 1 << uint(i%64)
+		matrix[i] = row
+	}
+
+	pivot := make([]bool, len(rows))
+	for c := 0; c < columns; c++ {
+		word, bit := c/64, uint64(1)<<uint(c%64)
+		p := -1
+		for i, row := range matrix {
+			if !pivot[i] && row[word]&bit != 0 {
+				p = i
+				break
+			}
+		}
+		if p < 0 {
+			continue
+		}
+		pivot[p] = true
+		prow := matrix[p]
+		for i, row := range matrix {
+			if i == p || row[word]&bit == 0 {
+				continue
+			}
+			for w := word; w < len(row); w++ {
+				row[w] ^= prow[w]
+			}
+		}
+	}
+
+	for i, row := range matrix {
+		if pivot[i] {
+			continue
+		}
+		var subset []int
+		for j := range rows {
+			if row[cw+j/64]&(1<<uint(j%64)) != 0 {
+				subset = append(subset, rows[j])
+			}
+		}
+		if d := s.factorFromSquares(subset); d != nil {
+			return d
+		}
+	}
+	return nil
+}
+
+// factorFromSquares combines relations whose product is a square into
+// x² = y² mod n and returns gcd(x - y, n) if it is a non-trivial factor.
+func (s *qsSieve) factorFromSquares(subset []int) *big.Int {
+	x := big.NewInt(1)
+	y := big.NewInt(1)
+	counts := make([]int, len(s.fb.primes))
+	for _, r := range subset {
+		rel := s.relations[r]
+		x.Mul(x, rel.x)
+		x.Mod(x, s.n)
+		y.Mul(y, rel.square)
+		y.Mod(y, s.n)
+		for _, f := range rel.factors {
+			counts[f]++
+		}
+	}
+	var e big.Int
+	for i := 1; i < len(counts); i++ {
+		if counts[i] == 0 {
+			continue
+		}
+		e.SetInt64(int64(counts[i] / 2))
+		y.Mul(y, new(big.Int).Exp(s.fb.bigs[i], &e, s.n))
+		y.Mod(y, s.n)
+	}
+
+	d := new(big.Int).Sub(x, y)
+	d.GCD(nil, nil, d.Abs(d), s.n)
+	if d.Cmp(bigOne) == 0 || d.Cmp(s.n) == 0 {
+		return nil
+	}
+	return d
+}
+
+// smallPrimes returns the primes below limit.
+func smallPrimes(limit int) []int {
+	composite := make([]bool, limit)
+	var primes []int
+	for i := 2; i < limit; i++ {
+		if composite[i] {
+			continue
+		}
+		primes = append(primes, i)
+		for j := i * i; j < limit; j += i {
+			composite[j] = true
+		}
+	}
+	return primes
+}
+
+// modSmall returns n mod p.
+func modSmall(n *big.Int, p int) int {
+	var m big.Int
+	return int(m.Mod(n, big.NewInt(int64(p))).Int64())
+}
+
+// isQuadraticResidue reports whether r is a non-zero square mod the odd prime
+// p, by Euler's criterion.
+func isQuadraticResidue(r, p int) bool {
+	return r != 0 && powMod(int64(r), int64(p-1)/2, int64(p)) == 1
+}
+
+func powMod(b, e, m int64) int64 {
+	result := int64(1)
+	b %= m
+	for ; e > 0; e >>= 1 {
+		if e&1 == 1 {
+			result = result * b % m
+		}
+		b = b * b % m
+	}
+	return result
+}
+
+// modInverse returns the inverse of a mod the prime p.
+func modInverse(a, p int) int64 {
+	return powMod(int64(a), int64(p-2), int64(p))
+}
+
+// logBig returns log2(n) for positive n.
+func logBig(n *big.Int) float64 {
+	f, _ := new(big.Float).SetInt(n).Float64()
+	return math.Log2(f)
+}
+
+func containsInt(s []int, v int) bool {
+	for _, x := range s {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
@@ -1,4 +1,6 @@
-package database
+// Package retry provides backoff policies shared by code that retries
+// transient failures, such as database deadlocks and peer requests.
+package retry
 
 import (
 	"math"
@@ -11,6 +13,8 @@ const (
 	scale = 10 * time.Millisecond
 )
 
+// BinaryExponentialBackoff returns a backoff that waits a random power of two
+// multiple of 10ms, never less than 2^try times it.
 func BinaryExponentialBackoff() func(try int) time.Duration {
 	return func(try int) time.Duration {
 		c := rand.Intn(cMax)
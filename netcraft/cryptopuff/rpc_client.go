@@ -2,19 +2,24 @@ package cryptopuff
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
 	"crypto/rsa"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 
+	"github.com/gorilla/websocket"
 	"github.com/pkg/errors"
 )
 
 type RPCClient struct {
-	client *http.Client
-	addr   string
+	client   *http.Client
+	addr     string
+	password string
 }
 
 type basicAuthTransport struct {
@@ -22,7 +27,11 @@ type basicAuthTransport struct {
 	next     http.RoundTripper
 }
 
+// RoundTrip adds the password to a copy of req, as a RoundTripper mustn't
+// modify the request. The copy keeps req's context, so cancelling it still
+// aborts the request.
 func (b basicAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
 	req.SetBasicAuth("", b.password)
 	return b.next.RoundTrip(req)
 }
@@ -36,19 +45,25 @@ func NewRPCClient(addr, password string) *RPCClient {
 			},
 			Timeout: Timeout,
 		},
-		addr: addr,
+		addr:     addr,
+		password: password,
 	}
 }
 
 func (c *RPCClient) Peers() ([]string, error) {
-	resp, err := httpGet(c.client, fmt.Sprintf("http://%v/api/peers", c.addr))
+	return c.PeersContext(context.Background())
+}
+
+// PeersContext is like Peers but uses ctx for the request.
+func (c *RPCClient) PeersContext(ctx context.Context) ([]string, error) {
+	resp, err := httpGetContext(ctx, c.client, fmt.Sprintf("http://%v/api/peers", c.addr))
 	if err != nil {
 		return nil, errors.Wrap(err, "cryptopuff: GET failed")
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, errors.Errorf("cryptopuff: invalid status code: %v", resp.StatusCode)
+		return nil, newRPCError(resp)
 	}
 
 	var peers []string
@@ -59,14 +74,97 @@ func (c *RPCClient) Peers() ([]string, error) {
 }
 
 func (c *RPCClient) Addresses() ([]AddressState, error) {
-	resp, err := httpGet(c.client, fmt.Sprintf("http://%v/api/addresses", c.addr))
+	return c.AddressesContext(context.Background())
+}
+
+// AddressesContext is like Addresses but uses ctx for the request.
+func (c *RPCClient) AddressesContext(ctx context.Context) ([]AddressState, error) {
+	resp, err := httpGetContext(ctx, c.client, fmt.Sprintf("http://%v/api/addresses", c.addr))
+	if err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: GET failed")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newRPCError(resp)
+	}
+
+	var addrs []AddressState
+	if err := json.NewDecoder(resp.Body).Decode(&addrs); err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: failed to unmarshal JSON")
+	}
+	return addrs, nil
+}
+
+// RichList returns the addresses with the highest balances at the node's best
+// block, highest first. A limit of 0 uses the node's default.
+func (c *RPCClient) RichList(limit int) ([]AddressState, error) {
+	return c.RichListContext(context.Background(), limit)
+}
+
+// RichListContext is like RichList but uses ctx for the request.
+func (c *RPCClient) RichListContext(ctx context.Context, limit int) ([]AddressState, error) {
+	u := fmt.Sprintf("http://%v/api/richlist", c.addr)
+	if limit > 0 {
+		u += fmt.Sprintf("?limit=%d", limit)
+	}
+
+	resp, err := httpGetContext(ctx, c.client, u)
+	if err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: GET failed")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newRPCError(resp)
+	}
+
+	var addrs []AddressState
+	if err := json.NewDecoder(resp.Body).Decode(&addrs); err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: failed to unmarshal JSON")
+	}
+	return addrs, nil
+}
+
+// Balance returns the balance of any address, not just those in the node's
+// wallet, at the node's best block.
+func (c *RPCClient) Balance(addr Address) (*AddressBalance, error) {
+	return c.BalanceContext(context.Background(), addr)
+}
+
+// BalanceContext is like Balance but uses ctx for the request.
+func (c *RPCClient) BalanceContext(ctx context.Context, addr Address) (*AddressBalance, error) {
+	resp, err := httpGetContext(ctx, c.client, fmt.Sprintf("http://%v/api/addresses/%v/balance", c.addr, url.PathEscape(addr.String())))
 	if err != nil {
 		return nil, errors.Wrap(err, "cryptopuff: GET failed")
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, errors.Errorf("cryptopuff: invalid status code: %v", resp.StatusCode)
+		return nil, newRPCError(resp)
+	}
+
+	var balance AddressBalance
+	if err := json.NewDecoder(resp.Body).Decode(&balance); err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: failed to unmarshal JSON")
+	}
+	return &balance, nil
+}
+
+func (c *RPCClient) Rescan() ([]AddressState, error) {
+	return c.RescanContext(context.Background())
+}
+
+// RescanContext is like Rescan but uses ctx for the request.
+func (c *RPCClient) RescanContext(ctx context.Context) ([]AddressState, error) {
+	resp, err := httpPostContext(ctx, c.client, fmt.Sprintf("http://%v/api/wallet/rescan", c.addr), contentTypeJSON, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: POST failed")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newRPCError(resp)
 	}
 
 	var addrs []AddressState
@@ -77,14 +175,19 @@ func (c *RPCClient) Addresses() ([]AddressState, error) {
 }
 
 func (c *RPCClient) MyTxs() ([]PersonalTx, error) {
-	resp, err := httpGet(c.client, fmt.Sprintf("http://%v/api/txs/mine", c.addr))
+	return c.MyTxsContext(context.Background())
+}
+
+// MyTxsContext is like MyTxs but uses ctx for the request.
+func (c *RPCClient) MyTxsContext(ctx context.Context) ([]PersonalTx, error) {
+	resp, err := httpGetContext(ctx, c.client, fmt.Sprintf("http://%v/api/txs/mine", c.addr))
 	if err != nil {
 		return nil, errors.Wrap(err, "cryptopuff: GET failed")
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, errors.Errorf("cryptopuff: invalid status code: %v", resp.StatusCode)
+		return nil, newRPCError(resp)
 	}
 
 	var txs []PersonalTx
@@ -99,17 +202,107 @@ func (c *RPCClient) MyTxs() ([]PersonalTx, error) {
 	return txs, nil
 }
 
+// PendingTxs returns the node's pending transactions, as relayed to its peers.
+// Transactions broadcast privately aren't included.
+func (c *RPCClient) PendingTxs() ([]SignedTx, error) {
+	return c.PendingTxsContext(context.Background())
+}
+
+// PendingTxsContext is like PendingTxs but uses ctx for the request.
+func (c *RPCClient) PendingTxsContext(ctx context.Context) ([]SignedTx, error) {
+	resp, err := httpGetContext(ctx, c.client, fmt.Sprintf("http://%v/api/txs", c.addr))
+	if err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: GET failed")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newRPCError(resp)
+	}
+
+	var stxs []SignedTx
+	if err := json.NewDecoder(resp.Body).Decode(&stxs); err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: failed to unmarshal JSON")
+	}
+	for i := range stxs {
+		if err := stxs[i].UpdateHash(); err != nil {
+			return nil, errors.Wrap(err, "cryptopuff: failed to update transaction hash")
+		}
+	}
+	return stxs, nil
+}
+
+// Status returns the node's best block, peer and pending transaction counts
+// and hash rate.
+func (c *RPCClient) Status() (*NodeStatus, error) {
+	return c.StatusContext(context.Background())
+}
+
+// StatusContext is like Status but uses ctx for the request.
+func (c *RPCClient) StatusContext(ctx context.Context) (*NodeStatus, error) {
+	resp, err := httpGetContext(ctx, c.client, fmt.Sprintf("http://%v/api/status", c.addr))
+	if err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: GET failed")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newRPCError(resp)
+	}
+
+	var status NodeStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: failed to unmarshal JSON")
+	}
+	return &status, nil
+}
+
+// Summary returns the wallet's balances, recent transactions and chain stats
+// in a single request.
+func (c *RPCClient) Summary() (*WalletSummary, error) {
+	return c.SummaryContext(context.Background())
+}
+
+// SummaryContext is like Summary but uses ctx for the request.
+func (c *RPCClient) SummaryContext(ctx context.Context) (*WalletSummary, error) {
+	resp, err := httpGetContext(ctx, c.client, fmt.Sprintf("http://%v/api/wallet/summary", c.addr))
+	if err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: GET failed")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newRPCError(resp)
+	}
+
+	var summary WalletSummary
+	if err := json.NewDecoder(resp.Body).Decode(&summary); err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: failed to unmarshal JSON")
+	}
+	for i := range summary.Txs {
+		if err := summary.Txs[i].UpdateHash(); err != nil {
+			return nil, errors.Wrap(err, "cryptopuff: failed to update transaction hash")
+		}
+	}
+	return &summary, nil
+}
+
 func (c *RPCClient) AddKey(k *rsa.PrivateKey, v Version) (Address, error) {
+	return c.AddKeyContext(context.Background(), k, v)
+}
+
+// AddKeyContext is like AddKey but uses ctx for the request.
+func (c *RPCClient) AddKeyContext(ctx context.Context, k *rsa.PrivateKey, v Version) (Address, error) {
 	b := EncodePrivateKeyPEM(k)
 
-	resp, err := httpPost(c.client, fmt.Sprintf("http://%v/api/keys?version=%v", c.addr, v), contentTypePEM, bytes.NewReader(b))
+	resp, err := httpPostContext(ctx, c.client, fmt.Sprintf("http://%v/api/keys?version=%d", c.addr, int(v)), contentTypePEM, bytes.NewReader(b))
 	if err != nil {
 		return nil, errors.Wrap(err, "cryptopuff: POST failed")
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, errors.Errorf("cryptopuff: invalid status code: %v", resp.StatusCode)
+		return nil, newRPCError(resp)
 	}
 
 	var a Address
@@ -119,15 +312,48 @@ func (c *RPCClient) AddKey(k *rsa.PrivateKey, v Version) (Address, error) {
 	return a, nil
 }
 
+func (c *RPCClient) AddKeys(keys []*rsa.PrivateKey, v Version) ([]Address, error) {
+	return c.AddKeysContext(context.Background(), keys, v)
+}
+
+// AddKeysContext is like AddKeys but uses ctx for the request.
+func (c *RPCClient) AddKeysContext(ctx context.Context, keys []*rsa.PrivateKey, v Version) ([]Address, error) {
+	var b []byte
+	for _, k := range keys {
+		b = append(b, EncodePrivateKeyPEM(k)...)
+	}
+
+	resp, err := httpPostContext(ctx, c.client, fmt.Sprintf("http://%v/api/keys/bundle?version=%d", c.addr, int(v)), contentTypePEM, bytes.NewReader(b))
+	if err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: POST failed")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newRPCError(resp)
+	}
+
+	var addrs []Address
+	if err := json.NewDecoder(resp.Body).Decode(&addrs); err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: failed to unmarshal JSON")
+	}
+	return addrs, nil
+}
+
 func (c *RPCClient) Key(addr Address) (*rsa.PrivateKey, error) {
-	resp, err := httpGet(c.client, fmt.Sprintf("http://%v/api/keys/%v", c.addr, url.PathEscape(addr.String())))
+	return c.KeyContext(context.Background(), addr)
+}
+
+// KeyContext is like Key but uses ctx for the request.
+func (c *RPCClient) KeyContext(ctx context.Context, addr Address) (*rsa.PrivateKey, error) {
+	resp, err := httpGetContext(ctx, c.client, fmt.Sprintf("http://%v/api/keys/%v", c.addr, url.PathEscape(addr.String())))
 	if err != nil {
 		return nil, errors.Wrap(err, "cryptopuff: GET failed")
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, errors.Errorf("cryptopuff: invalid status code: %v", resp.StatusCode)
+		return nil, newRPCError(resp)
 	}
 
 	b, err := ioutil.ReadAll(resp.Body)
@@ -142,39 +368,133 @@ func (c *RPCClient) Key(addr Address) (*rsa.PrivateKey, error) {
 	return k, nil
 }
 
+func (c *RPCClient) AddECDSAKeys(keys []*ecdsa.PrivateKey) ([]Address, error) {
+	return c.AddECDSAKeysContext(context.Background(), keys)
+}
+
+// AddECDSAKeysContext is like AddECDSAKeys but uses ctx for the request.
+func (c *RPCClient) AddECDSAKeysContext(ctx context.Context, keys []*ecdsa.PrivateKey) ([]Address, error) {
+	var b []byte
+	for _, k := range keys {
+		pem, err := EncodeECDSAPrivateKeyPEM(k)
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, pem...)
+	}
+
+	resp, err := httpPostContext(ctx, c.client, fmt.Sprintf("http://%v/api/keys/bundle?version=%d", c.addr, int(V4)), contentTypePEM, bytes.NewReader(b))
+	if err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: POST failed")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newRPCError(resp)
+	}
+
+	var addrs []Address
+	if err := json.NewDecoder(resp.Body).Decode(&addrs); err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: failed to unmarshal JSON")
+	}
+	return addrs, nil
+}
+
+func (c *RPCClient) ECDSAKey(addr Address) (*ecdsa.PrivateKey, error) {
+	return c.ECDSAKeyContext(context.Background(), addr)
+}
+
+// ECDSAKeyContext is like ECDSAKey but uses ctx for the request.
+func (c *RPCClient) ECDSAKeyContext(ctx context.Context, addr Address) (*ecdsa.PrivateKey, error) {
+	resp, err := httpGetContext(ctx, c.client, fmt.Sprintf("http://%v/api/keys/%v", c.addr, url.PathEscape(addr.String())))
+	if err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: GET failed")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newRPCError(resp)
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: failed to read response body")
+	}
+
+	k, err := DecodeECDSAPrivateKeyPEM(b)
+	if err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: failed to decode private key")
+	}
+	return k, nil
+}
+
 func (c *RPCClient) SetMinerAddress(addr Address) error {
+	return c.SetMinerAddressContext(context.Background(), addr)
+}
+
+// SetMinerAddressContext is like SetMinerAddress but uses ctx for the request.
+func (c *RPCClient) SetMinerAddressContext(ctx context.Context, addr Address) error {
 	b, err := json.Marshal(addr)
 	if err != nil {
 		return errors.Wrap(err, "cryptopuff: failed to marshal JSON")
 	}
 
-	resp, err := httpPost(c.client, fmt.Sprintf("http://%v/api/addresses/miner", c.addr), contentTypeJSON, bytes.NewReader(b))
+	resp, err := httpPostContext(ctx, c.client, fmt.Sprintf("http://%v/api/addresses/miner", c.addr), contentTypeJSON, bytes.NewReader(b))
 	if err != nil {
 		return errors.Wrap(err, "cryptopuff: POST failed")
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return errors.Errorf("cryptopuff: invalid status code: %v", resp.StatusCode)
+		return newRPCError(resp)
+	}
+
+	return nil
+}
+
+func (c *RPCClient) SetMinerAddresses(addrs []Address, rotation RewardRotation) error {
+	return c.SetMinerAddressesContext(context.Background(), addrs, rotation)
+}
+
+// SetMinerAddressesContext is like SetMinerAddresses but uses ctx for the request.
+func (c *RPCClient) SetMinerAddressesContext(ctx context.Context, addrs []Address, rotation RewardRotation) error {
+	b, err := json.Marshal(addrs)
+	if err != nil {
+		return errors.Wrap(err, "cryptopuff: failed to marshal JSON")
+	}
+
+	resp, err := httpPostContext(ctx, c.client, fmt.Sprintf("http://%v/api/addresses/miner?rotation=%v", c.addr, rotation), contentTypeJSON, bytes.NewReader(b))
+	if err != nil {
+		return errors.Wrap(err, "cryptopuff: POST failed")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return newRPCError(resp)
 	}
 
 	return nil
 }
 
 func (c *RPCClient) SignTx(tx *Tx) (*SignedTx, error) {
+	return c.SignTxContext(context.Background(), tx)
+}
+
+// SignTxContext is like SignTx but uses ctx for the request.
+func (c *RPCClient) SignTxContext(ctx context.Context, tx *Tx) (*SignedTx, error) {
 	b, err := json.Marshal(tx)
 	if err != nil {
 		return nil, errors.Wrap(err, "cryptopuff: failed to marshal JSON")
 	}
 
-	resp, err := httpPost(c.client, fmt.Sprintf("http://%v/api/txs/sign", c.addr), contentTypeJSON, bytes.NewReader(b))
+	resp, err := httpPostContext(ctx, c.client, fmt.Sprintf("http://%v/api/txs/sign", c.addr), contentTypeJSON, bytes.NewReader(b))
 	if err != nil {
 		return nil, errors.Wrap(err, "cryptopuff: POST failed")
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, errors.Errorf("cryptopuff: invalid status code: %v", resp.StatusCode)
+		return nil, newRPCError(resp)
 	}
 
 	var stx SignedTx
@@ -188,20 +508,188 @@ func (c *RPCClient) SignTx(tx *Tx) (*SignedTx, error) {
 }
 
 func (c *RPCClient) BroadcastTx(stx *SignedTx) error {
+	return c.BroadcastTxContext(context.Background(), stx)
+}
+
+// BroadcastTxContext is like BroadcastTx but uses ctx for the request.
+func (c *RPCClient) BroadcastTxContext(ctx context.Context, stx *SignedTx) error {
+	return c.broadcastTx(ctx, stx, false)
+}
+
+// BroadcastPrivateTx sends stx to the node to mine itself without relaying
+// it, so its public key stays hidden until it is mined.
+func (c *RPCClient) BroadcastPrivateTx(stx *SignedTx) error {
+	return c.BroadcastPrivateTxContext(context.Background(), stx)
+}
+
+// BroadcastPrivateTxContext is like BroadcastPrivateTx but uses ctx for the request.
+func (c *RPCClient) BroadcastPrivateTxContext(ctx context.Context, stx *SignedTx) error {
+	return c.broadcastTx(ctx, stx, true)
+}
+
+func (c *RPCClient) broadcastTx(ctx context.Context, stx *SignedTx, private bool) error {
 	b, err := json.Marshal(stx)
 	if err != nil {
 		return errors.Wrap(err, "cryptopuff: failed to marshal JSON")
 	}
 
-	resp, err := httpPost(c.client, fmt.Sprintf("http://%v/api/txs/broadcast", c.addr), contentTypeJSON, bytes.NewReader(b))
+	resp, err := httpPostContext(ctx, c.client, fmt.Sprintf("http://%v/api/txs/broadcast?private=%v", c.addr, private), contentTypeJSON, bytes.NewReader(b))
 	if err != nil {
 		return errors.Wrap(err, "crypotpuff: POST failed")
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return errors.Errorf("cryptopuff: invalid status code: %v", resp.StatusCode)
+		return newRPCError(resp)
 	}
 
 	return nil
 }
+
+func (c *RPCClient) Block(hash Hash) (*Block, error) {
+	return c.BlockContext(context.Background(), hash)
+}
+
+// BlockContext is like Block but uses ctx for the request.
+func (c *RPCClient) BlockContext(ctx context.Context, hash Hash) (*Block, error) {
+	resp, err := httpGetContext(ctx, c.client, fmt.Sprintf("http://%v/api/blocks/%v", c.addr, hash))
+	if err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: GET failed")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newRPCError(resp)
+	}
+
+	var block Block
+	if err := json.NewDecoder(resp.Body).Decode(&block); err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: failed to unmarshal JSON")
+	}
+	if err := block.UpdateHash(); err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: failed to update block hash")
+	}
+	if block.Hash != hash {
+		return nil, errors.Errorf("cryptopuff: node returned block %v instead of %v", block.Hash, hash)
+	}
+	return &block, nil
+}
+
+// Tx returns a transaction known to the node, and whether it has been mined
+// yet, so a sender can poll for confirmation after BroadcastTx.
+func (c *RPCClient) Tx(hash Hash) (*PersonalTx, error) {
+	return c.TxContext(context.Background(), hash)
+}
+
+// TxContext is like Tx but uses ctx for the request.
+func (c *RPCClient) TxContext(ctx context.Context, hash Hash) (*PersonalTx, error) {
+	resp, err := httpGetContext(ctx, c.client, fmt.Sprintf("http://%v/api/txs/%v", c.addr, hash))
+	if err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: GET failed")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newRPCError(resp)
+	}
+
+	var ptx PersonalTx
+	if err := json.NewDecoder(resp.Body).Decode(&ptx); err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: failed to unmarshal JSON")
+	}
+	if err := ptx.UpdateHash(); err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: failed to update transaction hash")
+	}
+	if ptx.Hash != hash {
+		return nil, errors.Errorf("cryptopuff: node returned transaction %v instead of %v", ptx.Hash, hash)
+	}
+	return &ptx, nil
+}
+
+func (c *RPCClient) TxProof(hash Hash) (*TxInclusion, error) {
+	return c.TxProofContext(context.Background(), hash)
+}
+
+// TxProofContext is like TxProof but uses ctx for the request.
+func (c *RPCClient) TxProofContext(ctx context.Context, hash Hash) (*TxInclusion, error) {
+	resp, err := httpGetContext(ctx, c.client, fmt.Sprintf("http://%v/api/txs/%v/proof", c.addr, hash))
+	if err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: GET failed")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newRPCError(resp)
+	}
+
+	var inclusion TxInclusion
+	if err := json.NewDecoder(resp.Body).Decode(&inclusion); err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: failed to unmarshal JSON")
+	}
+	return &inclusion, nil
+}
+
+func (c *RPCClient) TxETA(hash Hash) (*TxETA, error) {
+	return c.TxETAContext(context.Background(), hash)
+}
+
+// TxETAContext is like TxETA but uses ctx for the request.
+func (c *RPCClient) TxETAContext(ctx context.Context, hash Hash) (*TxETA, error) {
+	resp, err := httpGetContext(ctx, c.client, fmt.Sprintf("http://%v/api/txs/%v/eta", c.addr, hash))
+	if err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: GET failed")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newRPCError(resp)
+	}
+
+	var eta TxETA
+	if err := json.NewDecoder(resp.Body).Decode(&eta); err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: failed to unmarshal JSON")
+	}
+	return &eta, nil
+}
+
+// Subscribe opens a WebSocket to the node and returns a channel of the events
+// it pushes. The channel is closed when ctx is done or the connection fails.
+func (c *RPCClient) Subscribe(ctx context.Context) (<-chan Event, error) {
+	u := url.URL{Scheme: "ws", Host: c.addr, Path: "/api/subscribe"}
+	header := http.Header{}
+	header.Set(headerAuthorization, "Basic "+base64.StdEncoding.EncodeToString([]byte(":"+c.password)))
+
+	conn, resp, err := websocket.DefaultDialer.DialContext(ctx, u.String(), header)
+	if err == websocket.ErrBadHandshake {
+		defer resp.Body.Close()
+		return nil, newRPCError(resp)
+	} else if err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: failed to connect")
+	}
+
+	events := make(chan Event, eventBufferSize)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		conn.Close()
+	}()
+	go func() {
+		defer close(events)
+		defer close(done)
+		for {
+			var e Event
+			if err := conn.ReadJSON(&e); err != nil {
+				return
+			}
+			select {
+			case events <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
@@ -0,0 +1,52 @@
+package cryptopuff
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestRPCErrorMessage(t *testing.T) {
+	s := NewServer("", "", "secret", nil, openTestDB(t), ServerLogger(log.New(io.Discard, "", 0)), Miners(0))
+	peer, _ := testPeer(t, s.router)
+	client := NewRPCClient(peer, "secret")
+
+	unknown := Hash{0x01}
+	for _, test := range []struct {
+		name    string
+		call    func() error
+		status  int
+		message string
+	}{
+		{
+			"unknown transaction",
+			func() error {
+				_, err := client.TxETA(unknown)
+				return err
+			},
+			http.StatusNotFound,
+			"cryptopuff: unknown transaction " + unknown.String(),
+		},
+		{
+			"wrong password",
+			func() error {
+				return NewRPCClient(peer, "wrong").SetMinerAddresses([]Address{{0x01}}, RotationRoundRobin)
+			},
+			http.StatusUnauthorized,
+			"cryptopuff: invalid password",
+		},
+	} {
+		err := test.call()
+		rpcErr, ok := errors.Cause(err).(*RPCError)
+		if !ok {
+			t.Errorf("%v: error %v isn't an RPCError", test.name, err)
+			continue
+		}
+		if rpcErr.StatusCode != test.status || rpcErr.Message != test.message {
+			t.Errorf("%v: got status %v and message %q, want %v and %q", test.name, rpcErr.StatusCode, rpcErr.Message, test.status, test.message)
+		}
+	}
+}
@@ -2,15 +2,20 @@ package cryptopuff
 
 import (
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
-	"crypto/sha256"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
 	"crypto/x509"
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"runtime"
+	"sync"
 
 	"github.com/pkg/errors"
 )
@@ -20,18 +25,113 @@ import (
 // part of a normal cryptocurrency, nor is it designed to contain any
 // vulnerabilities. To save time: ignore this file!
 
+// maxConcurrentProofRequests caps the number of address proof requests being
+// served at once, as each one performs an RSA signature per key.
+const maxConcurrentProofRequests = 2
+
+// maxChallengesPerProofRequest caps the number of challenges in a batch proof
+// request.
+const maxChallengesPerProofRequest = 16
+
+const (
+	minChallengeLength = 16
+	maxChallengeLength = 64
+	proofNonceSize     = 16
+)
+
+// validChallenge stops the proof endpoint being used to sign arbitrary data:
+// challenges must be a sensible length and not all zero.
+func validChallenge(challenge []byte) error {
+	if len(challenge) < minChallengeLength || len(challenge) > maxChallengeLength {
+		return errors.Errorf("cryptopuff: challenge must be between %v and %v bytes", minChallengeLength, maxChallengeLength)
+	}
+	for _, b := range challenge {
+		if b != 0 {
+			return nil
+		}
+	}
+	return errors.New("cryptopuff: challenge is all zero")
+}
+
+func newProofNonce() ([]byte, error) {
+	nonce := make([]byte, proofNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: failed to generate proof nonce")
+	}
+	return nonce, nil
+}
+
+// proofPayload is what is actually signed: the challenge followed by the
+// server's nonce, so the same challenge signed twice gives different proofs.
+func proofPayload(challenge, nonce []byte) []byte {
+	payload := make([]byte, 0, len(challenge)+len(nonce))
+	payload = append(payload, challenge...)
+	return append(payload, nonce...)
+}
+
+// proofDigests are the digests address proofs may use, strongest first.
+var proofDigests = []crypto.Hash{crypto.SHA512, crypto.SHA384, crypto.SHA256, crypto.SHA224}
+
+// proofDigest returns the strongest digest a PSS signature by k can hold,
+// which needs the encoded message to be at least two bytes longer than the
+// digest. The default 256-bit keys only fit SHA-224.
+func proofDigest(k *rsa.PublicKey) crypto.Hash {
+	emLen := (k.N.BitLen() - 1 + 7) / 8
+	for _, h := range proofDigests {
+		if emLen >= h.Size()+2 {
+			return h
+		}
+	}
+	return crypto.SHA224
+}
+
+func digestProofPayload(h crypto.Hash, challenge, nonce []byte) []byte {
+	d := h.New()
+	d.Write(proofPayload(challenge, nonce))
+	return d.Sum(nil)
+}
+
+// Key is a wallet key. ECDSAKey is set instead of Key for V4 addresses.
 type Key struct {
-	Address Address
-	Key     *rsa.PrivateKey
+	Address  Address
+	Key      *rsa.PrivateKey
+	ECDSAKey *ecdsa.PrivateKey
 }
 
-func (k Key) SignAddressProof(challenge []byte) (*AddressProof, error) {
-	// XXX(gpe): deliberately use a different hashing algorithm so people can't
-	// exploit this endpoint to sign transactions on demand. Ideally we'd use
-	// SHA-256 but that's too long for a 256-bit RSA key to sign!
-	hash := sha256.Sum224(challenge)
+// publicKeyDER returns the PKCS #1 encoding of an RSA public key, or the PKIX
+// encoding of an ECDSA one: the forms their addresses hash.
+func (k Key) publicKeyDER() ([]byte, error) {
+	if k.ECDSAKey != nil {
+		der, err := x509.MarshalPKIXPublicKey(&k.ECDSAKey.PublicKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "cryptopuff: failed to marshal public key")
+		}
+		return der, nil
+	}
+	return x509.MarshalPKCS1PublicKey(&k.Key.PublicKey), nil
+}
 
-	signature, err := rsa.SignPSS(rand.Reader, k.Key, crypto.SHA224, hash[:], nil)
+// SignTx signs the transaction with whichever kind of key this is.
+func (k Key) SignTx(tx *Tx) (*SignedTx, error) {
+	if k.ECDSAKey != nil {
+		return tx.SignECDSA(k.ECDSAKey)
+	}
+	return tx.Sign(k.Key)
+}
+
+func (k Key) SignAddressProof(challenge, nonce []byte) (*AddressProof, error) {
+	if k.ECDSAKey != nil {
+		return k.signECDSAAddressProof(challenge, nonce)
+	}
+
+	// XXX(gpe): sign a digest of the challenge and our own nonce, never the
+	// challenge alone, so people can't exploit this endpoint to sign
+	// transactions on demand. The digest is the strongest the key can hold
+	// (see proofDigest): SHA-224 for a default 256-bit key, up to SHA-512 for
+	// larger ones.
+	h := proofDigest(&k.Key.PublicKey)
+
+	signature, err := rsa.SignPSS(rand.Reader, k.Key, h, digestProofPayload(h, challenge, nonce), nil)
 	if err != nil {
 		return nil, errors.Wrap(err, "cryptopuff: failed to sign address proof challenge")
 	}
@@ -40,6 +140,32 @@ func (k Key) SignAddressProof(challenge []byte) (*AddressProof, error) {
 		Signature: signature,
 		Address:   k.Address,
 		PublicKey: x509.MarshalPKCS1PublicKey(&k.Key.PublicKey),
+		Nonce:     nonce,
+		Digest:    h.String(),
+	}, nil
+}
+
+// signECDSAAddressProof signs a proof for a V4 address. P-256 signatures have
+// no length limit to work around, so they always use SHA-256.
+func (k Key) signECDSAAddressProof(challenge, nonce []byte) (*AddressProof, error) {
+	h := crypto.SHA256
+
+	signature, err := ecdsa.SignASN1(rand.Reader, k.ECDSAKey, digestProofPayload(h, challenge, nonce))
+	if err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: failed to sign address proof challenge")
+	}
+
+	pub, err := k.publicKeyDER()
+	if err != nil {
+		return nil, err
+	}
+
+	return &AddressProof{
+		Signature: signature,
+		Address:   k.Address,
+		PublicKey: pub,
+		Nonce:     nonce,
+		Digest:    h.String(),
 	}, nil
 }
 
@@ -47,33 +173,125 @@ type AddressProof struct {
 	Signature []byte
 	Address   Address
 	PublicKey []byte
+
+	// Nonce is the proofNonceSize random bytes the node appended to the
+	// challenge before signing it.
+	Nonce []byte
+
+	// Digest names the hash signed, which is always the strongest the key
+	// supports. Proofs without it used SHA-224.
+	Digest string `json:",omitempty"`
 }
 
+// Verify checks that a proves ownership of its address by signing challenge.
+// It can't tell whether a has been seen before: use ProofNonces to reject
+// replayed proofs.
 func (a AddressProof) Verify(challenge []byte) error {
+	if len(a.Nonce) != proofNonceSize {
+		return errors.Errorf("cryptopuff: proof nonce must be %v bytes", proofNonceSize)
+	}
+
+	version, err := DetectVersion(a.Address)
+	if err != nil {
+		return err
+	}
+	if version.KeyType() == KeyECDSA {
+		return a.verifyECDSA(challenge)
+	}
+
 	k, err := x509.ParsePKCS1PublicKey(a.PublicKey)
 	if err != nil {
 		return errors.Wrap(err, "cryptopuff: failed to parse public key")
 	}
+	if !AddressFromKey(version, k).Equal(a.Address) {
+		return errors.Errorf("cryptopuff: %v address doesn't match public key", version)
+	}
 
-	addressV1 := AddressFromKey(V1, k)
-	addressV2 := AddressFromKey(V2, k)
-	if !addressV1.Equal(a.Address) && !addressV2.Equal(a.Address) {
-		return errors.New("cryptopuff: address doesn't match public key")
+	h := proofDigest(k)
+	digest := a.Digest
+	if digest == "" {
+		digest = crypto.SHA224.String()
+	}
+	if digest != h.String() {
+		return errors.Errorf("cryptopuff: proof uses %v, expected %v for a %v-bit key", digest, h, k.N.BitLen())
 	}
 
-	hash := sha256.Sum224(challenge)
-	if err := rsa.VerifyPSS(k, crypto.SHA224, hash[:], a.Signature, nil); err != nil {
+	if err := rsa.VerifyPSS(k, h, digestProofPayload(h, challenge, a.Nonce), a.Signature, nil); err != nil {
 		return errors.Wrap(err, "cryptopuff: invalid signature")
 	}
 	return nil
 }
 
+func (a AddressProof) verifyECDSA(challenge []byte) error {
+	pub, err := x509.ParsePKIXPublicKey(a.PublicKey)
+	if err != nil {
+		return errors.Wrap(err, "cryptopuff: failed to parse public key")
+	}
+	k, ok := pub.(*ecdsa.PublicKey)
+	if !ok || k.Curve != elliptic.P256() {
+		return errors.New("cryptopuff: public key isn't a P-256 ECDSA key")
+	}
+
+	addr, err := AddressFromECDSAKey(k)
+	if err != nil {
+		return err
+	}
+	if !addr.Equal(a.Address) {
+		return errors.Errorf("cryptopuff: %v address doesn't match public key", V4)
+	}
+
+	h := crypto.SHA256
+	if a.Digest != h.String() {
+		return errors.Errorf("cryptopuff: proof uses %v, expected %v for an ECDSA key", a.Digest, h)
+	}
+
+	if !ecdsa.VerifyASN1(k, digestProofPayload(h, challenge, a.Nonce), a.Signature) {
+		return errors.New("cryptopuff: invalid signature")
+	}
+	return nil
+}
+
+// ProofNonces remembers the nonces of the address proofs it has verified, so a
+// proof captured in transit can't be replayed. It is safe for concurrent use.
+type ProofNonces struct {
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+// Verify verifies p like AddressProof.Verify, and also rejects it if a proof
+// for the same address with the same nonce was verified before.
+func (n *ProofNonces) Verify(p AddressProof, challenge []byte) error {
+	if err := p.Verify(challenge); err != nil {
+		return err
+	}
+
+	key := p.Address.String() + "/" + hex.EncodeToString(p.Nonce)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.seen[key] {
+		return errors.New("cryptopuff: proof nonce reused")
+	}
+	if n.seen == nil {
+		n.seen = make(map[string]bool)
+	}
+	n.seen[key] = true
+	return nil
+}
+
 func (d *DB) Keys() ([]Key, error) {
+	d.keysMu.Lock()
+	defer d.keysMu.Unlock()
+
+	if d.keys != nil {
+		return append([]Key(nil), d.keys...), nil
+	}
+
 	var keys []Key
 	if err := d.db.TransactWithRetry(func(tx *sql.Tx) error {
 		keys = nil
 
-		rows, err := tx.Query(`SELECT address, private_key FROM keys`)
+		rows, err := tx.Query(`SELECT address, private_key FROM keys ORDER BY address`)
 		if err != nil {
 			return err
 		}
@@ -88,22 +306,21 @@ func (d *DB) Keys() ([]Key, error) {
 				return err
 			}
 
-			k, err := DecodePrivateKeyPEM(b)
+			k, err := decodeWalletKeyPEM(a, b)
 			if err != nil {
 				return err
 			}
 
-			keys = append(keys, Key{
-				Address: a,
-				Key:     k,
-			})
+			keys = append(keys, k)
 		}
 
 		return rows.Err()
 	}); err != nil {
 		return nil, err
 	}
-	return keys, nil
+
+	d.keys = keys
+	return append([]Key(nil), keys...), nil
 }
 
 func (d *DB) Score(addrs map[string][]Address) (map[string]int64, error) {
@@ -179,6 +396,63 @@ func (s *Server) addressProofs(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("cryptopuff: failed to hex decode challenge: %v", err), http.StatusBadRequest)
 		return
 	}
+	if err := validChallenge(challenge); err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: invalid challenge: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	keys, err := s.db.Keys()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to select keys: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	proofs, err := signAddressProofs(keys, challenge)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to sign address proof: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(headerContentType, contentTypeJSON)
+	if err := json.NewEncoder(w).Encode(proofs); err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to marshal JSON: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// ChallengeProofs holds the address proofs for one challenge of a batch proof
+// request. Challenge is hex encoded.
+type ChallengeProofs struct {
+	Challenge string
+	Proofs    []AddressProof
+}
+
+// batchAddressProofs signs several hex encoded challenges, given as a JSON
+// array, in one request. The results are in the same order as the challenges.
+func (s *Server) batchAddressProofs(w http.ResponseWriter, r *http.Request) {
+	var challengeStrs []string
+	if err := json.NewDecoder(r.Body).Decode(&challengeStrs); err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to unmarshal JSON: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(challengeStrs) > maxChallengesPerProofRequest {
+		http.Error(w, fmt.Sprintf("cryptopuff: too many challenges (maximum %v)", maxChallengesPerProofRequest), http.StatusBadRequest)
+		return
+	}
+
+	challenges := make([][]byte, len(challengeStrs))
+	for i, str := range challengeStrs {
+		challenge, err := hex.DecodeString(str)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("cryptopuff: failed to hex decode challenge %v: %v", i, err), http.StatusBadRequest)
+			return
+		}
+		if err := validChallenge(challenge); err != nil {
+			http.Error(w, fmt.Sprintf("cryptopuff: invalid challenge %v: %v", i, err), http.StatusBadRequest)
+			return
+		}
+		challenges[i] = challenge
+	}
 
 	keys, err := s.db.Keys()
 	if err != nil {
@@ -186,19 +460,65 @@ func (s *Server) addressProofs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var proofs []AddressProof
-	for _, key := range keys {
-		proof, err := key.SignAddressProof(challenge)
+	results := make([]ChallengeProofs, len(challenges))
+	for i, challenge := range challenges {
+		proofs, err := signAddressProofs(keys, challenge)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("cryptopuff: failed to sign address proof: %v", err), http.StatusInternalServerError)
 			return
 		}
-		proofs = append(proofs, *proof)
+		results[i] = ChallengeProofs{
+			Challenge: challengeStrs[i],
+			Proofs:    proofs,
+		}
 	}
 
 	w.Header().Set(headerContentType, contentTypeJSON)
-	if err := json.NewEncoder(w).Encode(proofs); err != nil {
+	if err := json.NewEncoder(w).Encode(results); err != nil {
 		http.Error(w, fmt.Sprintf("cryptopuff: failed to marshal JSON: %v", err), http.StatusInternalServerError)
 		return
 	}
 }
+
+// signAddressProofs signs the challenge with every key, spreading the work
+// across at most one goroutine per CPU. The proofs are returned in the same
+// order as the keys, and share a fresh nonce.
+func signAddressProofs(keys []Key, challenge []byte) ([]AddressProof, error) {
+	nonce, err := newProofNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		proofs = make([]AddressProof, len(keys))
+		errs   = make([]error, len(keys))
+		sem    = make(chan struct{}, runtime.NumCPU())
+		wg     sync.WaitGroup
+	)
+	for i := range keys {
+		i := i
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			proof, err := keys[i].SignAddressProof(challenge, nonce)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			proofs[i] = *proof
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return proofs, nil
+}
@@ -0,0 +1,351 @@
+package cryptopuff
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestBatchAddressProofs(t *testing.T) {
+	d := openTestDB(t)
+	if _, err := d.AddKey(V3, testKey(t, 1)); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := d.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{db: d}
+
+	challenges := [][]byte{
+		bytes.Repeat([]byte{0x01}, minChallengeLength),
+		bytes.Repeat([]byte{0x02}, maxChallengeLength),
+	}
+	strs := make([]string, len(challenges))
+	for i, challenge := range challenges {
+		strs[i] = hex.EncodeToString(challenge)
+	}
+	body, err := json.Marshal(strs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	s.batchAddressProofs(w, httptest.NewRequest(http.MethodPost, "/api/addresses/proofs", bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %v: %v", w.Code, w.Body)
+	}
+	var results []ChallengeProofs
+	if err := json.NewDecoder(w.Body).Decode(&results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(challenges) {
+		t.Fatalf("got proofs for %v challenges, want %v", len(results), len(challenges))
+	}
+
+	for i, result := range results {
+		if result.Challenge != strs[i] {
+			t.Errorf("result %v is for challenge %v, want %v", i, result.Challenge, strs[i])
+		}
+		if len(result.Proofs) != len(keys) {
+			t.Errorf("challenge %v has %v proofs, want one per key (%v)", i, len(result.Proofs), len(keys))
+		}
+		for j, proof := range result.Proofs {
+			if !proof.Address.Equal(keys[j].Address) {
+				t.Errorf("challenge %v proof %v is for %v, want %v", i, j, proof.Address, keys[j].Address)
+			}
+			if err := proof.Verify(challenges[i]); err != nil {
+				t.Errorf("challenge %v proof %v: %v", i, j, err)
+			}
+			// A proof must not also pass for another challenge in the batch.
+			if err := proof.Verify(challenges[1-i]); err == nil {
+				t.Errorf("challenge %v proof %v also verifies against challenge %v", i, j, 1-i)
+			}
+		}
+	}
+}
+
+func TestBatchAddressProofsInvalidChallenge(t *testing.T) {
+	s := &Server{db: openTestDB(t)}
+	for _, body := range []string{
+		`["` + hex.EncodeToString(bytes.Repeat([]byte{0x01}, minChallengeLength)) + `", "00"]`,
+		`["` + strings.Repeat("00", minChallengeLength) + `"]`,
+		`["zz"]`,
+		`[` + strings.TrimSuffix(strings.Repeat(`"`+strings.Repeat("01", minChallengeLength)+`",`, maxChallengesPerProofRequest+1), ",") + `]`,
+	} {
+		w := httptest.NewRecorder()
+		s.batchAddressProofs(w, httptest.NewRequest(http.MethodPost, "/api/addresses/proofs", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%.40v...: status %v, want %v", body, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestECDSAAddressProof(t *testing.T) {
+	k := testECDSAKey(t)
+	a, err := AddressFromECDSAKey(&k.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := Key{Address: a, ECDSAKey: k}
+
+	challenge := bytes.Repeat([]byte{0x01}, minChallengeLength)
+	nonce, err := newProofNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof, err := key.SignAddressProof(challenge, nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := proof.Verify(challenge); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tamper := range map[string]func(*AddressProof){
+		"nonce":  func(p *AddressProof) { p.Nonce = append([]byte{p.Nonce[0] ^ 0xff}, p.Nonce[1:]...) },
+		"digest": func(p *AddressProof) { p.Digest = "" },
+		"address": func(p *AddressProof) {
+			other, err := AddressFromECDSAKey(&testECDSAKey(t).PublicKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.Address = other
+		},
+		"rsa key": func(p *AddressProof) { p.PublicKey = x509.MarshalPKCS1PublicKey(&testKey(t, 1).PublicKey) },
+	} {
+		tampered := *proof
+		tamper(&tampered)
+		if err := tampered.Verify(challenge); err == nil {
+			t.Errorf("proof with tampered %v verified", name)
+		}
+	}
+}
+
+func TestAddECDSAKeys(t *testing.T) {
+	s := &Server{db: openTestDB(t)}
+
+	keys := []*ecdsa.PrivateKey{testECDSAKey(t), testECDSAKey(t)}
+	var pems [][]byte
+	for _, k := range keys {
+		b, err := EncodeECDSAPrivateKeyPEM(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pems = append(pems, b)
+	}
+
+	w := httptest.NewRecorder()
+	s.addKey(w, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/api/keys?version=%d", int(V4)), bytes.NewReader(pems[0])))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %v: %v", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	s.addKeys(w, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/api/keys/bundle?version=%d", int(V4)), bytes.NewReader(bytes.Join(pems, nil))))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %v: %v", w.Code, w.Body)
+	}
+	var addrs []Address
+	if err := json.NewDecoder(w.Body).Decode(&addrs); err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != len(keys) {
+		t.Fatalf("added %v keys, want %v", len(addrs), len(keys))
+	}
+
+	w = httptest.NewRecorder()
+	s.addKey(w, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/api/keys?version=%d", int(V4)), bytes.NewReader(EncodePrivateKeyPEM(testKey(t, 1)))))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("adding an RSA key at a v4 address: status %v, want %v", w.Code, http.StatusBadRequest)
+	}
+
+	keyset, err := s.db.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge := bytes.Repeat([]byte{0x01}, minChallengeLength)
+	proofs, err := signAddressProofs(keyset, challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, proof := range proofs {
+		if err := proof.Verify(challenge); err != nil {
+			t.Errorf("proof for %v: %v", keyset[i].Address, err)
+		}
+	}
+
+	body, err := json.Marshal(Tx{
+		TxOutput: TxOutput{Destination: testRewardAddress, Amount: 10},
+		Source:   addrs[1],
+		Fee:      1,
+		Version:  TxVersion4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	s.signTx(w, httptest.NewRequest(http.MethodPost, "/api/txs/sign", bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %v: %v", w.Code, w.Body)
+	}
+	var stx SignedTx
+	if err := json.NewDecoder(w.Body).Decode(&stx); err != nil {
+		t.Fatal(err)
+	}
+	if err := stx.ValidSignature(); err != nil {
+		t.Errorf("transaction signed by the node's v4 key: %v", err)
+	}
+}
+
+func TestAddressProofNonce(t *testing.T) {
+	k := testKey(t, 1)
+	key := Key{Address: AddressFromKey(V3, &k.PublicKey), Key: k}
+	challenge := bytes.Repeat([]byte{0x01}, minChallengeLength)
+
+	for _, nonce := range [][]byte{nil, make([]byte, proofNonceSize-1)} {
+		proof, err := key.SignAddressProof(challenge, nonce)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := proof.Verify(challenge); err == nil {
+			t.Errorf("proof with a %v-byte nonce verified", len(nonce))
+		}
+	}
+
+	nonce, err := newProofNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof, err := key.SignAddressProof(challenge, nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var nonces ProofNonces
+	if err := nonces.Verify(*proof, challenge); err != nil {
+		t.Fatal(err)
+	}
+	if err := nonces.Verify(*proof, challenge); err == nil {
+		t.Error("replayed proof verified")
+	}
+
+	// A fresh nonce makes a fresh proof.
+	if nonce, err = newProofNonce(); err != nil {
+		t.Fatal(err)
+	}
+	if proof, err = key.SignAddressProof(challenge, nonce); err != nil {
+		t.Fatal(err)
+	}
+	if err := nonces.Verify(*proof, challenge); err != nil {
+		t.Errorf("proof with a new nonce: %v", err)
+	}
+}
+
+func TestAddressProofDigest(t *testing.T) {
+	challenge := bytes.Repeat([]byte{0x01}, minChallengeLength)
+	nonce, err := newProofNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		bits int
+		want crypto.Hash
+	}{
+		{DefaultKeyLength, crypto.SHA224},
+		{512, crypto.SHA384},
+		{1024, crypto.SHA512},
+	} {
+		k, err := GenerateKey(test.bits, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := Key{Address: AddressFromKey(V3, &k.PublicKey), Key: k}
+		proof, err := key.SignAddressProof(challenge, nonce)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if proof.Digest != test.want.String() {
+			t.Errorf("%v-bit key signs with %v, want %v", test.bits, proof.Digest, test.want)
+		}
+		if err := proof.Verify(challenge); err != nil {
+			t.Errorf("%v-bit key: %v", test.bits, err)
+		}
+
+		// Claiming the weaker digest of a default key doesn't verify.
+		if test.want != crypto.SHA224 {
+			weak := *proof
+			weak.Digest = crypto.SHA224.String()
+			if err := weak.Verify(challenge); err == nil {
+				t.Errorf("%v-bit key's proof verified as %v", test.bits, weak.Digest)
+			}
+		}
+	}
+}
+
+func TestKeysOrdered(t *testing.T) {
+	d := openTestDB(t)
+	addrs := func() []string {
+		keys, err := d.Keys()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var addrs []string
+		for _, k := range keys {
+			addrs = append(addrs, k.Address.String())
+		}
+		return addrs
+	}
+
+	for _, seed := range []int64{5, 1, 4, 2} {
+		if _, err := d.AddKey(V3, testKey(t, seed)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first := addrs()
+	if !sort.StringsAreSorted(first) {
+		t.Errorf("keys aren't in address order: %v", first)
+	}
+
+	// Adding a key invalidates the cache, and the new key takes its place
+	// in the order.
+	if _, err := d.AddKey(V3, testKey(t, 3)); err != nil {
+		t.Fatal(err)
+	}
+	second := addrs()
+	if len(second) != len(first)+1 || !sort.StringsAreSorted(second) {
+		t.Errorf("keys after adding one: %v", second)
+	}
+	if third := addrs(); strings.Join(third, ",") != strings.Join(second, ",") {
+		t.Errorf("keys changed order between calls: %v, then %v", second, third)
+	}
+}
+
+func BenchmarkAddressProofs(b *testing.B) {
+	d := openTestDB(b)
+	for i := int64(0); i < 100; i++ {
+		if _, err := d.AddKey(V3, testKey(b, i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	s := &Server{db: d}
+	target := "/api/addresses/proofs?challenge=" + hex.EncodeToString(bytes.Repeat([]byte{0x01}, 32))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		s.addressProofs(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != http.StatusOK {
+			b.Fatalf("status %v: %v", w.Code, w.Body)
+		}
+	}
+}
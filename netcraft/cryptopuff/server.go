@@ -1,16 +1,22 @@
 package cryptopuff
 
 import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
 	"net/http"
 	"net/url"
+	"os"
 	"runtime"
+	"sort"
 	"strconv"
-	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -19,37 +25,173 @@ import (
 	"github.com/pkg/errors"
 )
 
+const DefaultMempoolPruneInterval = time.Minute
+
+const (
+	txsPerMinedBlock      = 10
+	etaIntervalSampleSize = 100
+	walletSummaryTxs      = 20
+	maxMinerBlocks        = 100
+	maxChainEvents        = 1000
+	maxRichList           = 100
+)
+
 type Server struct {
 	addr, extAddr    string
 	password         string
-	blockReward      int64
 	wellKnownPeers   map[string]struct{}
 	client           *PeerClient
 	router           chi.Router
 	db               *DB
+	orphans          *orphanPool
+	notify           *notifyPool
+	webhook          *webhook
+	events           *eventHub
+	logger           *log.Logger
+	pruneInterval    time.Duration
+	miners           int
+	strictDecoding   bool
+	requireMinerKey  bool
+	requireAuth      bool
+	peerToken        string
+	peerHeightsMu    sync.Mutex
+	peerHeights      map[string]int64
 	bestBlockVersion uint64
 	hashesPerSec     uint64
+	lastHashesPerSec uint64
+	rewardIndex      uint64
+	syncing          uint32
+	received         receivedCounters
+
+	// Lifetime totals, reported by Stats.
+	started     time.Time
+	totalHashes uint64
+	blocksMined uint64
+	txsRelayed  uint64
+	txsPruned   uint64
+}
+
+type ServerOption func(*Server)
+
+// receivedCounters counts the blocks and transactions received from peers,
+// whether pushed to us or fetched, and whether or not they were valid.
+type receivedCounters struct {
+	blocks uint64
+	txs    uint64
 }
 
-func NewServer(addr, extAddr, password string, blockReward int64, peers []string, db *DB) *Server {
+func NewServer(addr, extAddr, password string, peers []string, db *DB, opts ...ServerOption) *Server {
 	server := &Server{
-		addr:           addr,
-		extAddr:        strings.ToLower(extAddr),
-		password:       password,
-		blockReward:    blockReward,
-		wellKnownPeers: createWellKnownPeers(peers),
-		client:         NewPeerClient(extAddr),
-		router:         chi.NewRouter(),
-		db:             db,
+		addr:            addr,
+		extAddr:         CanonicalPeer(extAddr),
+		password:        password,
+		wellKnownPeers:  createWellKnownPeers(peers),
+		router:          chi.NewRouter(),
+		db:              db,
+		orphans:         newOrphanPool(DefaultOrphanPoolSize),
+		notify:          newNotifyPool(DefaultMaxPeerNotifications),
+		events:          newEventHub(),
+		logger:          log.New(os.Stderr, "", log.LstdFlags),
+		pruneInterval:   DefaultMempoolPruneInterval,
+		miners:          runtime.NumCPU(),
+		requireMinerKey: true,
+		peerHeights:     make(map[string]int64),
+		started:         time.Now(),
+	}
+
+	for _, opt := range opts {
+		opt(server)
 	}
+
+	server.client = NewPeerClient(extAddr, server.peerToken)
+	server.client.strict = server.strictDecoding
+	if server.requireAuth && server.peerToken == "" {
+		server.client.sendPassword(password)
+	}
+
 	server.routes()
 	return server
 }
 
+func OrphanPoolSize(n int) ServerOption {
+	return func(s *Server) {
+		s.orphans = newOrphanPool(n)
+	}
+}
+
+// MaxPeerNotifications sets the number of concurrent outbound requests used to
+// relay new peers, transactions and blocks.
+func MaxPeerNotifications(n int) ServerOption {
+	return func(s *Server) {
+		s.notify = newNotifyPool(n)
+	}
+}
+
+// Miners sets the number of goroutines mining blocks, which defaults to the
+// number of CPUs. Zero disables mining, for nodes that only sync and relay.
+func Miners(n int) ServerOption {
+	return func(s *Server) {
+		s.miners = n
+	}
+}
+
+// MempoolPruneInterval sets how often invalid pending transactions are pruned
+// from the mempool, independently of mining. Zero disables pruning.
+func MempoolPruneInterval(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.pruneInterval = d
+	}
+}
+
+// StrictDecoding makes the server reject blocks and transactions from peers
+// that contain fields this version doesn't understand, such as those added by
+// a newer protocol version, rather than ignoring the fields.
+func StrictDecoding(strict bool) ServerOption {
+	return func(s *Server) {
+		s.strictDecoding = strict
+	}
+}
+
+// RequireMinerKey sets whether the wallet must hold the keys for the miner
+// addresses at startup. Serve replaces the miner addresses with a freshly
+// generated one if they are missing, malformed or, when required, unspendable.
+func RequireMinerKey(require bool) ServerOption {
+	return func(s *Server) {
+		s.requireMinerKey = require
+	}
+}
+
+// RequireAuthForReads makes every endpoint require the password, not just the
+// wallet ones, turning the node private. Unless a peer token is set, the
+// server then sends its password to peers too, so every node in the network
+// must share the same password.
+func RequireAuthForReads(require bool) ServerOption {
+	return func(s *Server) {
+		s.requireAuth = require
+	}
+}
+
+// PeerToken requires peers to send token on the endpoints used for syncing,
+// and sends it to other peers. Unlike the password, it doesn't give access to
+// the wallet, so it can be shared with the operators of other nodes.
+func PeerToken(token string) ServerOption {
+	return func(s *Server) {
+		s.peerToken = token
+	}
+}
+
+// ServerLogger sets the logger used by the server, which defaults to logging to
+// stderr.
+func ServerLogger(l *log.Logger) ServerOption {
+	return func(s *Server) {
+		s.logger = l
+	}
+}
+
 func createWellKnownPeers(peers []string) map[string]struct{} {
 	m := make(map[string]struct{})
 	for _, peer := range peers {
-		m[strings.ToLower(peer)] = struct{}{}
+		m[CanonicalPeer(peer)] = struct{}{}
 	}
 	return m
 }
@@ -57,23 +199,58 @@ func createWellKnownPeers(peers []string) map[string]struct{} {
 func (s *Server) routes() {
 	s.router.Use(middleware.GetHead)
 
-	s.router.Get("/api/ping", s.ping)
-	s.router.Get("/api/peers", s.peers)
-	s.router.Post("/api/peers", s.addPeer)
-	s.router.Get("/api/blocks", s.blocks)
-	s.router.Post("/api/blocks", s.addBlock)
-	s.router.Get("/api/txs", s.txs)
-	s.router.Post("/api/txs", s.addTx)
-	s.router.Get("/api/addresses", s.addresses)
-	s.router.Get("/api/addresses/proofs", s.addressProofs)
+	s.router.Group(func(r chi.Router) {
+		r.Use(s.checkPeer)
+
+		r.Get("/api/ping", s.ping)
+		r.Get("/api/peers", s.peers)
+		r.Post("/api/peers", s.addPeer)
+		r.Get("/api/blocks", s.blocks)
+		r.Post("/api/blocks", s.addBlock)
+		r.Get("/api/txs", s.txs)
+		r.Post("/api/txs", s.addTx)
+	})
+
+	s.router.Group(func(r chi.Router) {
+		if s.requireAuth {
+			r.Use(s.checkPassword)
+		}
+
+		r.Get("/api/blocks/{hash}", s.block)
+		r.Get("/api/txs/{hash}", s.tx)
+		r.Get("/api/txs/{hash}/eta", s.txETA)
+		r.Get("/api/fees", s.fees)
+		r.Get("/api/status", s.status)
+		r.Get("/api/txs/{hash}/proof", s.txProof)
+		r.Get("/api/addresses", s.addresses)
+		r.Get("/api/balances", s.balancesAt)
+		r.Get("/api/events", s.chainEvents)
+		r.Get("/api/richlist", s.richList)
+		r.Get("/api/subscribe", s.subscribe)
+		r.Get("/api/addresses/{address}", s.addressActivity)
+		r.Get("/api/addresses/{address}/balance", s.balanceAt)
+		r.Get("/api/addresses/{address}/blocks", s.blocksByMiner)
+		r.Get("/metrics", s.metrics)
+
+		r.Group(func(r chi.Router) {
+			// Single and batch proof requests share the same limit.
+			r.Use(throttle(maxConcurrentProofRequests))
+
+			r.Get("/api/addresses/proofs", s.addressProofs)
+			r.Post("/api/addresses/proofs", s.batchAddressProofs)
+		})
+	})
 
 	s.router.Group(func(r chi.Router) {
 		r.Use(s.checkPassword)
 
 		r.Post("/api/addresses/miner", s.setMinerAddress)
 		r.Post("/api/keys", s.addKey)
+		r.Post("/api/keys/bundle", s.addKeys)
 		r.Get("/api/keys/{address}", s.key)
 		r.Get("/api/txs/mine", s.myTxs)
+		r.Get("/api/wallet/summary", s.walletSummary)
+		r.Post("/api/wallet/rescan", s.rescan)
 		r.Post("/api/txs/sign", s.signTx)
 		r.Post("/api/txs/broadcast", s.broadcastTx)
 	})
@@ -91,8 +268,38 @@ func (s *Server) checkPassword(next http.Handler) http.Handler {
 	})
 }
 
+// checkPeer authenticates requests to the endpoints peers use for syncing.
+// They are open unless a peer token is set, or all endpoints require the
+// password.
+func (s *Server) checkPeer(next http.Handler) http.Handler {
+	if s.peerToken != "" {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token := r.Header.Get(headerXPeerToken)
+			if subtle.ConstantTimeCompare([]byte(token), []byte(s.peerToken)) != 1 {
+				http.Error(w, "cryptopuff: invalid peer token", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	if s.requireAuth {
+		return s.checkPassword(next)
+	}
+	return next
+}
+
 func (s *Server) ping(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
+	best, err := s.db.BestBlock()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to select best block: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(headerContentType, contentTypeJSON)
+	if err := json.NewEncoder(w).Encode(PeerStatus{Height: best.Height}); err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to marshal JSON: %v", err), http.StatusInternalServerError)
+		return
+	}
 }
 
 func (s *Server) peers(w http.ResponseWriter, r *http.Request) {
@@ -138,7 +345,7 @@ func (s *Server) addPeer(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) validateAndAddPeer(peer string) error {
-	peer = strings.ToLower(peer)
+	peer = CanonicalPeer(peer)
 	if peer == s.extAddr {
 		return nil
 	}
@@ -153,13 +360,13 @@ func (s *Server) validateAndAddPeer(peer string) error {
 
 	go func() {
 		if err := s.client.Ping(peer); err != nil {
-			log.Printf("ignoring peer %v, ping failed: %v\n", peer, err)
+			s.logger.Printf("ignoring peer %v, ping failed: %v\n", peer, err)
 			return
 		}
 
 		created, err := s.db.AddPeer(peer)
 		if err != nil {
-			log.Printf("failed to add peer to database: %v\n", err)
+			s.logger.Printf("failed to add peer to database: %v\n", err)
 			return
 		}
 		if !created {
@@ -168,7 +375,7 @@ func (s *Server) validateAndAddPeer(peer string) error {
 
 		peers, err := s.db.Peers()
 		if err != nil {
-			log.Printf("failed to select peers: %v\n", err)
+			s.logger.Printf("failed to select peers: %v\n", err)
 			return
 		}
 		for _, p := range peers {
@@ -177,15 +384,17 @@ func (s *Server) validateAndAddPeer(peer string) error {
 			}
 
 			p := p
-			go func() {
+			if !s.notify.Go(func() {
 				if err := s.client.AddPeer(p, peer); err != nil {
-					log.Printf("failed to notify peer %v about new peer %v: %v\n", p, peer, err)
+					s.logger.Printf("failed to notify peer %v about new peer %v: %v\n", p, peer, err)
 				}
-			}()
+			}) {
+				s.logger.Printf("dropped notification to peer %v about new peer %v, too many are queued\n", p, peer)
+			}
 		}
 
 		if err := s.fullPeerSync(peer); err != nil {
-			log.Printf("full peer sync with new peer failed: %v\n", err)
+			s.logger.Printf("full peer sync with new peer failed: %v\n", err)
 		}
 	}()
 	return nil
@@ -200,8 +409,10 @@ func (s *Server) fullPeerSync(peer string) error {
 		return errors.Wrapf(err, "cryptopuff: failed to fetch peers from %v", peer)
 	}
 
-	if err := s.fetchBlocks(peer); err != nil {
-		return errors.Wrapf(err, "cryptopuff: failed to fetch blocks from %v", peer)
+	if s.peerAhead(peer) {
+		if err := s.fetchBlocks(peer); err != nil {
+			return errors.Wrapf(err, "cryptopuff: failed to fetch blocks from %v", peer)
+		}
 	}
 
 	if err := s.fetchTxs(peer); err != nil {
@@ -211,8 +422,93 @@ func (s *Server) fullPeerSync(peer string) error {
 	return nil
 }
 
+func (s *Server) setPeerHeight(peer string, height int64) {
+	s.peerHeightsMu.Lock()
+	defer s.peerHeightsMu.Unlock()
+
+	if height < 0 {
+		delete(s.peerHeights, peer)
+		return
+	}
+	s.peerHeights[peer] = height
+}
+
+// peerAhead reports whether the peer's last reported tip is higher than ours.
+// Peers that haven't reported a height are assumed to be ahead.
+func (s *Server) peerAhead(peer string) bool {
+	s.peerHeightsMu.Lock()
+	height, ok := s.peerHeights[peer]
+	s.peerHeightsMu.Unlock()
+	if !ok {
+		return true
+	}
+
+	best, err := s.db.BestBlock()
+	if err != nil {
+		s.logger.Printf("failed to select best block: %v\n", err)
+		return true
+	}
+	return height > best.Height
+}
+
+// blocks serves the best chain in one of two modes.
+//
+// With ?from=<height> it pages through the best chain oldest first, starting
+// at that height, and ?limit= is the page size: at most MaxBlocksRange, which
+// is also the default.
+//
+// Otherwise it walks a chain newest first, as peers that predate paging
+// expect: the best chain, or with ?tip=<hash> the chain ending at that block,
+// so competing forks can be compared. ?limit= is then how many blocks to walk
+// back from the tip, by default all of them.
 func (s *Server) blocks(w http.ResponseWriter, r *http.Request) {
-	blocks, err := s.db.Blocks()
+	var (
+		blocks []Block
+		limit  int
+		err    error
+	)
+	query := r.URL.Query()
+	if str := query.Get("limit"); str != "" {
+		limit, err = strconv.Atoi(str)
+		if err != nil || limit < 1 {
+			http.Error(w, "cryptopuff: limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if fromStr := query.Get("from"); fromStr != "" {
+		if query.Get("tip") != "" {
+			http.Error(w, "cryptopuff: from and tip can't be combined", http.StatusBadRequest)
+			return
+		}
+		var from int64
+		from, err = strconv.ParseInt(fromStr, 10, 64)
+		if err != nil || from < 0 {
+			http.Error(w, "cryptopuff: from must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		if limit > MaxBlocksRange {
+			http.Error(w, fmt.Sprintf("cryptopuff: limit must be at most %v when paging", MaxBlocksRange), http.StatusBadRequest)
+			return
+		}
+
+		blocks, err = s.db.BlocksRange(from, limit)
+	} else if tipStr := query.Get("tip"); tipStr != "" {
+		var tip Hash
+		tip, err = HashFromString(tipStr)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("cryptopuff: failed to decode tip hash: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		blocks, err = s.db.ChainFrom(tip, limit)
+		if err == ErrUnknownBlock {
+			http.Error(w, fmt.Sprintf("cryptopuff: unknown block %v", tip), http.StatusNotFound)
+			return
+		}
+	} else {
+		blocks, err = s.db.Blocks(limit)
+	}
 	if err != nil {
 		http.Error(w, fmt.Sprintf("cryptopuff: failed to select blocks: %v", err), http.StatusInternalServerError)
 		return
@@ -225,26 +521,132 @@ func (s *Server) blocks(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// fetchBlocks downloads the peer's best chain from the highest block it has
+// in common with ours, MaxBlocksRange blocks at a time, adding each page as it
+// arrives.
 func (s *Server) fetchBlocks(peer string) error {
-	blocks, err := s.client.Blocks(peer)
+	pending, legacy, err := s.fetchCommonBlock(peer)
+	if err != nil {
+		return err
+	}
+	if legacy {
+		// the peer sent its whole chain
+		_, err := s.addFetchedBlocks(pending)
+		return err
+	}
+
+	for {
+		last := pending[len(pending)-1]
+		page, err := s.client.Blocks(peer, last.Height+1, MaxBlocksRange)
+		if err != nil {
+			return errors.Wrap(err, "cryptopuff: failed to download blocks")
+		}
+		atomic.AddUint64(&s.received.blocks, uint64(len(page)))
+		if len(page) == 0 {
+			return nil
+		}
+		if page[0].Height != last.Height+1 || page[0].PreviousHash != last.Hash {
+			return errors.New("cryptopuff: peer's chain changed during download")
+		}
+
+		// AddBlocks ignores a fork until it has more work than our chain, so
+		// its blocks are kept until enough of it has been downloaded.
+		pending = append(pending, page...)
+		added, err := s.addFetchedBlocks(pending)
+		if err != nil {
+			return err
+		}
+		if added {
+			pending = pending[len(pending)-1:]
+		}
+
+		if len(page) < MaxBlocksRange {
+			return nil
+		}
+	}
+}
+
+// fetchCommonBlock returns the highest block of our best chain that is also
+// in the peer's, looking a block at a time at ever larger steps back from our
+// tip. Peers that predate paging send their whole chain instead, which is
+// returned with legacy set.
+func (s *Server) fetchCommonBlock(peer string) (blocks []Block, legacy bool, err error) {
+	best, err := s.db.BestBlock()
 	if err != nil {
-		return errors.Wrap(err, "cryptopuff: failed to download blocks")
+		return nil, false, errors.Wrap(err, "cryptopuff: failed to select best block")
+	}
+
+	from := best.Height
+	for back := int64(1); ; back *= 2 {
+		page, err := s.client.Blocks(peer, from, 1)
+		if err != nil {
+			return nil, false, errors.Wrap(err, "cryptopuff: failed to download blocks")
+		}
+		atomic.AddUint64(&s.received.blocks, uint64(len(page)))
+		if len(page) > 0 && page[0].Height != from {
+			return page, true, nil
+		}
+
+		if len(page) == 1 {
+			if _, err := s.db.BlockByHash(page[0].Hash); err == nil {
+				return page, false, nil
+			} else if err != ErrUnknownBlock {
+				return nil, false, errors.Wrap(err, "cryptopuff: failed to select block")
+			}
+		}
+
+		if from == 0 {
+			return nil, false, errors.New("cryptopuff: peer's chain has a different genesis block")
+		}
+		from -= back
+		if from < 0 {
+			from = 0
+		}
+	}
+}
+
+// addFetchedBlocks adds blocks downloaded from a peer, given oldest first, and
+// reports whether the newest of them was added.
+func (s *Server) addFetchedBlocks(blocks []Block) (bool, error) {
+	newestFirst := make([]Block, len(blocks))
+	for i := range blocks {
+		newestFirst[len(blocks)-1-i] = blocks[i]
+	}
+	if err := s.db.AddBlocks(newestFirst); err != nil {
+		return false, errors.Wrap(err, "cryptopuff: failed to add blocks to database")
 	}
 
-	if err := s.db.AddBlocks(blocks); err != nil {
-		return errors.Wrap(err, "cryptopuff: failed to add blocks to database")
+	newest := blocks[len(blocks)-1].Hash
+	if _, err := s.db.BlockByHash(newest); err == ErrUnknownBlock {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Wrap(err, "cryptopuff: failed to select block")
 	}
 
-	atomic.AddUint64(&s.bestBlockVersion, 1)
-	return nil
+	for i := range blocks {
+		s.connectOrphans(blocks[i].Hash)
+	}
+	s.blockAdded()
+	return true, nil
+}
+
+func (s *Server) connectOrphans(parent Hash) {
+	for _, orphan := range s.orphans.takeChildren(parent) {
+		if err := s.db.AddBlock(orphan); err != nil {
+			s.logger.Printf("failed to connect orphan block %v: %v\n", orphan.Hash, err)
+			continue
+		}
+		s.connectOrphans(orphan.Hash)
+	}
 }
 
 func (s *Server) addBlock(w http.ResponseWriter, r *http.Request) {
 	var b Block
-	if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+	if err := newJSONDecoder(r.Body, s.strictDecoding).Decode(&b); err != nil {
 		http.Error(w, fmt.Sprintf("cryptopuff: failed to unmarshal JSON: %v", err), http.StatusBadRequest)
 		return
 	}
+	atomic.AddUint64(&s.received.blocks, 1)
 	if err := b.UpdateHash(); err != nil {
 		http.Error(w, fmt.Sprintf("cryptopuff: failed to update block hash: %v", err), http.StatusInternalServerError)
 		return
@@ -252,19 +654,34 @@ func (s *Server) addBlock(w http.ResponseWriter, r *http.Request) {
 
 	err := s.db.AddBlock(&b)
 	if err == ErrUnknownParent {
+		best, err := s.db.BestBlock()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("cryptopuff: failed to select best block: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if b.Height > best.Height+MaxOrphanHeightAhead {
+			http.Error(w, fmt.Sprintf("cryptopuff: orphan block height %v too far ahead of tip %v", b.Height, best.Height), http.StatusBadRequest)
+			return
+		}
+		s.orphans.add(&b)
+
 		peer := r.Header.Get(headerXPeer)
 		go func() {
 			if err := s.fetchBlocks(peer); err != nil {
-				log.Printf("failed to fetch missing parent blocks from %v: %v\n", peer, err)
+				s.logger.Printf("failed to fetch missing parent blocks from %v: %v\n", peer, err)
 			}
 		}()
 		return
+	} else if _, ok := err.(InvalidBlockError); ok {
+		http.Error(w, fmt.Sprintf("cryptopuff: invalid block: %v", err), http.StatusBadRequest)
+		return
 	} else if err != nil {
 		http.Error(w, fmt.Sprintf("cryptopuff: failed to add block to database: %v", err), http.StatusInternalServerError)
 		return
 	}
+	s.connectOrphans(b.Hash)
 
-	atomic.AddUint64(&s.bestBlockVersion, 1)
+	s.blockAdded()
 }
 
 func (s *Server) addresses(w http.ResponseWriter, r *http.Request) {
@@ -281,52 +698,43 @@ func (s *Server) addresses(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (s *Server) setMinerAddress(w http.ResponseWriter, r *http.Request) {
-	var addr Address
-	if err := json.NewDecoder(r.Body).Decode(&addr); err != nil {
-		http.Error(w, fmt.Sprintf("cryptopuff: failed to unmarshal JSON: %v", err), http.StatusBadRequest)
-		return
-	}
-
-	if err := s.db.SetMinerAddress(addr); err != nil {
-		http.Error(w, fmt.Sprintf("cryptopuff: failed to set miner address: %v", err), http.StatusInternalServerError)
-		return
-	}
+// AddressBalance is the balance of an address at a height of the best chain.
+type AddressBalance struct {
+	Address Address
+	Height  int64
+	Balance int64
 }
 
-func (s *Server) addKey(w http.ResponseWriter, r *http.Request) {
-	v, err := strconv.Atoi(r.URL.Query().Get("version"))
-	if err != nil {
-		http.Error(w, fmt.Sprintf("cryptopuff: failed to convert version to int: %v", err), http.StatusBadRequest)
-		return
-	}
-
-	b, err := ioutil.ReadAll(r.Body)
+func (s *Server) addressActivity(w http.ResponseWriter, r *http.Request) {
+	addrStr, err := url.PathUnescape(chi.URLParam(r, "address"))
 	if err != nil {
-		http.Error(w, fmt.Sprintf("cryptopuff: failed to read body: %v", err), http.StatusBadRequest)
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to unescape address: %v", err), http.StatusBadRequest)
 		return
 	}
 
-	k, err := DecodePrivateKeyPEM(b)
+	addr, err := AddressFromString(addrStr)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("cryptopuff: failed to decode private key: %v", err), http.StatusBadRequest)
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to decode address: %v", err), http.StatusBadRequest)
 		return
 	}
 
-	a, err := s.db.AddKey(Version(v), k)
+	activity, err := s.db.AddressActivity(addr)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("cryptopuff: failed to add key to the database: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to select activity for address %v: %v", addr, err), http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set(headerContentType, contentTypeJSON)
-	if err := json.NewEncoder(w).Encode(a); err != nil {
+	if err := json.NewEncoder(w).Encode(activity); err != nil {
 		http.Error(w, fmt.Sprintf("cryptopuff: failed to marshal JSON: %v", err), http.StatusInternalServerError)
 		return
 	}
 }
 
-func (s *Server) key(w http.ResponseWriter, r *http.Request) {
+// blocksByMiner serves the blocks in the best chain whose reward was paid to
+// the address, highest first. ?limit= (at most maxMinerBlocks, the default)
+// and ?offset= page through them.
+func (s *Server) blocksByMiner(w http.ResponseWriter, r *http.Request) {
 	addrStr, err := url.PathUnescape(chi.URLParam(r, "address"))
 	if err != nil {
 		http.Error(w, fmt.Sprintf("cryptopuff: failed to unescape address: %v", err), http.StatusBadRequest)
@@ -339,127 +747,670 @@ func (s *Server) key(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	key, err := s.db.Key(addr)
+	limit := maxMinerBlocks
+	if str := r.URL.Query().Get("limit"); str != "" {
+		limit, err = strconv.Atoi(str)
+		if err != nil || limit < 1 || limit > maxMinerBlocks {
+			http.Error(w, fmt.Sprintf("cryptopuff: limit must be between 1 and %v", maxMinerBlocks), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var offset int
+	if str := r.URL.Query().Get("offset"); str != "" {
+		offset, err = strconv.Atoi(str)
+		if err != nil || offset < 0 {
+			http.Error(w, "cryptopuff: offset must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	blocks, err := s.db.BlocksByMiner(addr, limit, offset)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("cryptopuff: failed to select key for address %v: %v", addr, err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to select blocks mined by %v: %v", addr, err), http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set(headerContentType, contentTypePEM)
-	if _, err := w.Write(EncodePrivateKeyPEM(key)); err != nil {
+	w.Header().Set(headerContentType, contentTypeJSON)
+	if err := json.NewEncoder(w).Encode(blocks); err != nil {
 		http.Error(w, fmt.Sprintf("cryptopuff: failed to marshal JSON: %v", err), http.StatusInternalServerError)
 		return
 	}
 }
 
-func (s *Server) txs(w http.ResponseWriter, r *http.Request) {
-	stxs, err := s.db.AllPendingTxs()
+// richList serves the addresses with the highest balances, highest first.
+// ?limit= (at most maxRichList, the default) bounds the number returned.
+func (s *Server) richList(w http.ResponseWriter, r *http.Request) {
+	limit := maxRichList
+	if str := r.URL.Query().Get("limit"); str != "" {
+		var err error
+		limit, err = strconv.Atoi(str)
+		if err != nil || limit < 1 || limit > maxRichList {
+			http.Error(w, fmt.Sprintf("cryptopuff: limit must be between 1 and %v", maxRichList), http.StatusBadRequest)
+			return
+		}
+	}
+
+	addrs, err := s.db.RichList(limit)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("cryptopuff: failed to select pending transactions: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to select balances: %v", err), http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set(headerContentType, contentTypeJSON)
-	if err := json.NewEncoder(w).Encode(stxs); err != nil {
+	if err := json.NewEncoder(w).Encode(addrs); err != nil {
 		http.Error(w, fmt.Sprintf("cryptopuff: failed to marshal JSON: %v", err), http.StatusInternalServerError)
 		return
 	}
 }
 
-func (s *Server) addTx(w http.ResponseWriter, r *http.Request) {
-	var stx SignedTx
-	if err := json.NewDecoder(r.Body).Decode(&stx); err != nil {
-		http.Error(w, fmt.Sprintf("cryptopuff: failed to unmarshal JSON: %v", err), http.StatusBadRequest)
-		return
+// chainEvents serves the chain events after ?since=<seq> (default 0), oldest
+// first. ?limit= (at most maxChainEvents, the default) bounds the number
+// returned, so a consumer pages through by passing the last Seq it received.
+func (s *Server) chainEvents(w http.ResponseWriter, r *http.Request) {
+	var (
+		since int64
+		err   error
+	)
+	if str := r.URL.Query().Get("since"); str != "" {
+		since, err = strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("cryptopuff: failed to parse since: %v", err), http.StatusBadRequest)
+			return
+		}
 	}
-	if err := stx.UpdateHash(); err != nil {
-		http.Error(w, fmt.Sprintf("cryptopuff: failed to update transaction hash", err), http.StatusInternalServerError)
-		return
+
+	limit := maxChainEvents
+	if str := r.URL.Query().Get("limit"); str != "" {
+		limit, err = strconv.Atoi(str)
+		if err != nil || limit < 1 || limit > maxChainEvents {
+			http.Error(w, fmt.Sprintf("cryptopuff: limit must be between 1 and %v", maxChainEvents), http.StatusBadRequest)
+			return
+		}
 	}
 
-	if err := s.db.AddTx(&stx); err != nil {
-		http.Error(w, fmt.Sprintf("cryptopuff: failed to add transaction to the database: %v", err), http.StatusInternalServerError)
+	events, err := s.db.ChainEvents(since, limit)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to select chain events: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	atomic.AddUint64(&s.bestBlockVersion, 1)
-}
-
-func (s *Server) fetchTxs(peer string) error {
-	stxs, err := s.client.Txs(peer)
-	if err != nil {
-		return errors.Wrap(err, "cryptopuff: failed to download transactions")
+	w.Header().Set(headerContentType, contentTypeJSON)
+	if err := json.NewEncoder(w).Encode(events); err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to marshal JSON: %v", err), http.StatusInternalServerError)
+		return
 	}
+}
 
-	for _, stx := range stxs {
-		err := s.db.AddTx(&stx)
-		if _, ok := err.(InvalidBlockError); ok {
-			continue
-		} else if err != nil {
-			return errors.Wrap(err, "cryptopuff: failed to add transaction to the database")
+// balancesAt serves every non-zero balance at the best block, or with
+// ?tip=<hash> at that block.
+func (s *Server) balancesAt(w http.ResponseWriter, r *http.Request) {
+	tip := EmptyHash
+	if tipStr := r.URL.Query().Get("tip"); tipStr != "" {
+		var err error
+		tip, err = HashFromString(tipStr)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("cryptopuff: failed to decode tip hash: %v", err), http.StatusBadRequest)
+			return
 		}
 	}
 
-	atomic.AddUint64(&s.bestBlockVersion, 1)
-	return nil
-}
-
-func (s *Server) myTxs(w http.ResponseWriter, r *http.Request) {
-	ptxs, err := s.db.MyTxs()
-	if err != nil {
-		http.Error(w, fmt.Sprintf("cryptopuff: failed to select my transactions: %v", err), http.StatusInternalServerError)
+	balances, err := s.db.BalancesAt(tip)
+	if err == ErrUnknownBlock {
+		http.Error(w, fmt.Sprintf("cryptopuff: unknown block %v", tip), http.StatusNotFound)
+		return
+	} else if err == ErrPruned {
+		http.Error(w, fmt.Sprintf("cryptopuff: balances at block %v have been pruned, run an archive node to query them", tip), http.StatusGone)
+		return
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to select balances: %v", err), http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set(headerContentType, contentTypeJSON)
-	if err := json.NewEncoder(w).Encode(ptxs); err != nil {
+	if err := json.NewEncoder(w).Encode(balances); err != nil {
 		http.Error(w, fmt.Sprintf("cryptopuff: failed to marshal JSON: %v", err), http.StatusInternalServerError)
 		return
 	}
 }
 
-func (s *Server) signTx(w http.ResponseWriter, r *http.Request) {
-	var tx Tx
-	if err := json.NewDecoder(r.Body).Decode(&tx); err != nil {
-		http.Error(w, fmt.Sprintf("cryptopuff: failed to unmarshal JSON: %v", err), http.StatusBadRequest)
+func (s *Server) balanceAt(w http.ResponseWriter, r *http.Request) {
+	addrStr, err := url.PathUnescape(chi.URLParam(r, "address"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to unescape address: %v", err), http.StatusBadRequest)
 		return
 	}
 
-	key, err := s.db.Key(tx.Source)
+	addr, err := AddressFromString(addrStr)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("cryptopuff: failed to select private key for address %v: %v", tx.Source, err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to decode address: %v", err), http.StatusBadRequest)
 		return
 	}
 
-	stx, err := tx.Sign(key)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("cryptopuff: failed to sign transaction: %v", err), http.StatusInternalServerError)
+	var (
+		height  int64
+		balance int64
+	)
+	if str := r.URL.Query().Get("height"); str != "" {
+		height, err = strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("cryptopuff: failed to parse height: %v", err), http.StatusBadRequest)
+			return
+		}
+		balance, err = s.db.BalanceAt(addr, height)
+	} else {
+		var tip *Block
+		tip, err = s.db.BestBlock()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("cryptopuff: failed to select best block: %v", err), http.StatusInternalServerError)
+			return
+		}
+		height = tip.Height
+		balance, err = s.db.Balance(addr)
+	}
+	if err == ErrNoSuchHeight {
+		http.Error(w, fmt.Sprintf("cryptopuff: no block at height %v", height), http.StatusNotFound)
+		return
+	} else if err == ErrPruned {
+		http.Error(w, fmt.Sprintf("cryptopuff: balances at height %v have been pruned, run an archive node to query them", height), http.StatusGone)
+		return
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to select balance: %v", err), http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set(headerContentType, contentTypeJSON)
-	if err := json.NewEncoder(w).Encode(stx); err != nil {
+	if err := json.NewEncoder(w).Encode(AddressBalance{Address: addr, Height: height, Balance: balance}); err != nil {
 		http.Error(w, fmt.Sprintf("cryptopuff: failed to marshal JSON: %v", err), http.StatusInternalServerError)
 		return
 	}
 }
 
-func (s *Server) broadcastTx(w http.ResponseWriter, r *http.Request) {
-	var stx SignedTx
-	if err := json.NewDecoder(r.Body).Decode(&stx); err != nil {
-		http.Error(w, fmt.Sprintf("cryptopuff: failed to unmarshal JSON: %v", err), http.StatusBadRequest)
+func (s *Server) rescan(w http.ResponseWriter, r *http.Request) {
+	addrs, err := s.db.Rescan()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to rescan wallet: %v", err), http.StatusInternalServerError)
 		return
 	}
+
+	w.Header().Set(headerContentType, contentTypeJSON)
+	if err := json.NewEncoder(w).Encode(addrs); err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to marshal JSON: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Server) setMinerAddress(w http.ResponseWriter, r *http.Request) {
+	var raw json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to unmarshal JSON: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// accept either a single address (for older clients) or an array
+	var addrs []Address
+	if err := json.Unmarshal(raw, &addrs); err != nil {
+		var addr Address
+		if err := json.Unmarshal(raw, &addr); err != nil {
+			http.Error(w, fmt.Sprintf("cryptopuff: failed to unmarshal JSON: %v", err), http.StatusBadRequest)
+			return
+		}
+		addrs = []Address{addr}
+	}
+	if len(addrs) == 0 {
+		http.Error(w, "cryptopuff: at least one miner address is required", http.StatusBadRequest)
+		return
+	}
+
+	rotation := RotationRoundRobin
+	if str := r.URL.Query().Get("rotation"); str != "" {
+		var err error
+		rotation, err = ParseRewardRotation(str)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("cryptopuff: failed to parse rotation: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := s.db.SetMinerAddresses(addrs, rotation); err != nil {
+		status := http.StatusInternalServerError
+		if _, ok := err.(UnknownKeyError); ok {
+			status = http.StatusBadRequest
+		}
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to set miner address: %v", err), status)
+		return
+	}
+}
+
+func (s *Server) addKey(w http.ResponseWriter, r *http.Request) {
+	v, err := strconv.Atoi(r.URL.Query().Get("version"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to convert version to int: %v", err), http.StatusBadRequest)
+		return
+	}
+	if v < int(V1) || v > int(V4) {
+		http.Error(w, fmt.Sprintf("cryptopuff: unknown address version %v", v), http.StatusBadRequest)
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to read body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var a Address
+	if Version(v).KeyType() == KeyECDSA {
+		var k *ecdsa.PrivateKey
+		k, err = DecodeECDSAPrivateKeyPEM(b)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("cryptopuff: failed to decode private key: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		a, err = s.db.AddECDSAKey(k)
+	} else {
+		var k *rsa.PrivateKey
+		k, err = DecodePrivateKeyPEM(b)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("cryptopuff: failed to decode private key: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		a, err = s.db.AddKey(Version(v), k)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to add key to the database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(headerContentType, contentTypeJSON)
+	if err := json.NewEncoder(w).Encode(a); err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to marshal JSON: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Server) addKeys(w http.ResponseWriter, r *http.Request) {
+	v, err := strconv.Atoi(r.URL.Query().Get("version"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to convert version to int: %v", err), http.StatusBadRequest)
+		return
+	}
+	if v < int(V1) || v > int(V4) {
+		http.Error(w, fmt.Sprintf("cryptopuff: unknown address version %v", v), http.StatusBadRequest)
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to read body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var addrs []Address
+	if Version(v).KeyType() == KeyECDSA {
+		var keys []*ecdsa.PrivateKey
+		keys, err = DecodeECDSAPrivateKeyPEMs(b)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("cryptopuff: failed to decode private keys: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		addrs, err = s.db.AddECDSAKeys(keys)
+	} else {
+		var keys []*rsa.PrivateKey
+		keys, err = DecodePrivateKeyPEMs(b)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("cryptopuff: failed to decode private keys: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		addrs, err = s.db.AddKeys(Version(v), keys)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to add keys to the database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(headerContentType, contentTypeJSON)
+	if err := json.NewEncoder(w).Encode(addrs); err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to marshal JSON: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Server) key(w http.ResponseWriter, r *http.Request) {
+	addrStr, err := url.PathUnescape(chi.URLParam(r, "address"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to unescape address: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	addr, err := AddressFromString(addrStr)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to decode address: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	key, err := s.db.walletKey(addr)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to select key for address %v: %v", addr, err), http.StatusInternalServerError)
+		return
+	}
+
+	var b []byte
+	if key.ECDSAKey != nil {
+		b, err = EncodeECDSAPrivateKeyPEM(key.ECDSAKey)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("cryptopuff: failed to encode key for address %v: %v", addr, err), http.StatusInternalServerError)
+			return
+		}
+	} else {
+		b = EncodePrivateKeyPEM(key.Key)
+	}
+
+	w.Header().Set(headerContentType, contentTypePEM)
+	if _, err := w.Write(b); err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to marshal JSON: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Server) txs(w http.ResponseWriter, r *http.Request) {
+	stxs, err := s.db.RelayTxs()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to select pending transactions: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(headerContentType, contentTypeJSON)
+	if err := json.NewEncoder(w).Encode(stxs); err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to marshal JSON: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Server) addTx(w http.ResponseWriter, r *http.Request) {
+	var stx SignedTx
+	if err := newJSONDecoder(r.Body, s.strictDecoding).Decode(&stx); err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to unmarshal JSON: %v", err), http.StatusBadRequest)
+		return
+	}
+	atomic.AddUint64(&s.received.txs, 1)
 	if err := stx.UpdateHash(); err != nil {
 		http.Error(w, fmt.Sprintf("cryptopuff: failed to update transaction hash: %v", err), http.StatusInternalServerError)
 		return
 	}
 
 	if err := s.db.AddTx(&stx); err != nil {
-		http.Error(w, fmt.Sprintf("cryptopuff: failed to add transaction to the database: %v", err), http.StatusInternalServerError)
+		status := http.StatusInternalServerError
+		if _, ok := err.(InvalidBlockError); ok {
+			status = http.StatusBadRequest
+		}
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to add transaction to the database: %v", err), status)
 		return
 	}
+
+	atomic.AddUint64(&s.bestBlockVersion, 1)
+}
+
+func (s *Server) fetchTxs(peer string) error {
+	stxs, err := s.client.Txs(peer)
+	if err != nil {
+		return errors.Wrap(err, "cryptopuff: failed to download transactions")
+	}
+	atomic.AddUint64(&s.received.txs, uint64(len(stxs)))
+
+	for _, stx := range stxs {
+		err := s.db.AddTx(&stx)
+		if _, ok := err.(InvalidBlockError); ok {
+			continue
+		} else if err != nil {
+			return errors.Wrap(err, "cryptopuff: failed to add transaction to the database")
+		}
+	}
+
 	atomic.AddUint64(&s.bestBlockVersion, 1)
+	return nil
+}
+
+func (s *Server) txProof(w http.ResponseWriter, r *http.Request) {
+	hash, err := HashFromString(chi.URLParam(r, "hash"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to decode hash: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	block, err := s.db.IncludingBlock(hash)
+	if err == ErrUnknownTx || err == ErrTxNotIncluded {
+		http.Error(w, fmt.Sprintf("cryptopuff: transaction %v not found in blockchain", hash), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to select including block: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	inclusion, err := NewTxInclusion(block, hash)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to build inclusion proof: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(headerContentType, contentTypeJSON)
+	if err := json.NewEncoder(w).Encode(inclusion); err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to marshal JSON: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Server) block(w http.ResponseWriter, r *http.Request) {
+	hash, err := HashFromString(chi.URLParam(r, "hash"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to decode hash: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	block, err := s.db.BlockByHash(hash)
+	if err == ErrUnknownBlock {
+		http.Error(w, fmt.Sprintf("cryptopuff: unknown block %v", hash), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to select block: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(headerContentType, contentTypeJSON)
+	if err := json.NewEncoder(w).Encode(block); err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to marshal JSON: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Server) tx(w http.ResponseWriter, r *http.Request) {
+	hash, err := HashFromString(chi.URLParam(r, "hash"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to decode hash: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	ptx, err := s.db.TxByHash(hash)
+	if err == ErrUnknownTx {
+		http.Error(w, fmt.Sprintf("cryptopuff: unknown transaction %v", hash), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to select transaction: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(headerContentType, contentTypeJSON)
+	if err := json.NewEncoder(w).Encode(ptx); err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to marshal JSON: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Server) txETA(w http.ResponseWriter, r *http.Request) {
+	hash, err := HashFromString(chi.URLParam(r, "hash"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to decode hash: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var eta TxETA
+	rank, err := s.db.MempoolRankByFee(hash)
+	if err == ErrUnknownTx {
+		http.Error(w, fmt.Sprintf("cryptopuff: unknown transaction %v", hash), http.StatusNotFound)
+		return
+	} else if err == ErrTxNotPending {
+		/* already mined, leave eta zeroed */
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to rank transaction: %v", err), http.StatusInternalServerError)
+		return
+	} else {
+		interval, err := s.db.AverageBlockInterval(etaIntervalSampleSize)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("cryptopuff: failed to calculate block interval: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		eta.Pending = true
+		eta.Rank = rank
+		eta.Blocks = int64(rank/txsPerMinedBlock) + 1
+		eta.Seconds = eta.Blocks * int64(interval/time.Second)
+	}
+
+	w.Header().Set(headerContentType, contentTypeJSON)
+	if err := json.NewEncoder(w).Encode(eta); err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to marshal JSON: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Server) status(w http.ResponseWriter, r *http.Request) {
+	status, err := s.db.Status()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to select status: %v", err), http.StatusInternalServerError)
+		return
+	}
+	// Only the logger may reset the counter, so report the rate it last saw.
+	status.HashesPerSec = atomic.LoadUint64(&s.lastHashesPerSec)
+
+	w.Header().Set(headerContentType, contentTypeJSON)
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to marshal JSON: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Server) fees(w http.ResponseWriter, r *http.Request) {
+	estimate, err := s.db.FeeEstimate()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to estimate fees: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(headerContentType, contentTypeJSON)
+	if err := json.NewEncoder(w).Encode(estimate); err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to marshal JSON: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Server) myTxs(w http.ResponseWriter, r *http.Request) {
+	ptxs, err := s.db.MyTxs()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to select my transactions: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(headerContentType, contentTypeJSON)
+	if err := json.NewEncoder(w).Encode(ptxs); err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to marshal JSON: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Server) walletSummary(w http.ResponseWriter, r *http.Request) {
+	summary, err := s.db.WalletSummary(walletSummaryTxs)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to select wallet summary: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(headerContentType, contentTypeJSON)
+	if err := json.NewEncoder(w).Encode(summary); err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to marshal JSON: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Server) signTx(w http.ResponseWriter, r *http.Request) {
+	var tx Tx
+	if err := json.NewDecoder(r.Body).Decode(&tx); err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to unmarshal JSON: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	key, err := s.db.walletKey(tx.Source)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to select private key for address %v: %v", tx.Source, err), http.StatusInternalServerError)
+		return
+	}
+
+	stx, err := key.SignTx(&tx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to sign transaction: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(headerContentType, contentTypeJSON)
+	if err := json.NewEncoder(w).Encode(stx); err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to marshal JSON: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// broadcastTx adds a transaction to the mempool and relays it to every peer,
+// or with ?private=true keeps it for this node to mine (see DB.AddPrivateTx).
+func (s *Server) broadcastTx(w http.ResponseWriter, r *http.Request) {
+	var private bool
+	if str := r.URL.Query().Get("private"); str != "" {
+		var err error
+		private, err = strconv.ParseBool(str)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("cryptopuff: failed to parse private: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var stx SignedTx
+	if err := json.NewDecoder(r.Body).Decode(&stx); err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to unmarshal JSON: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := stx.UpdateHash(); err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to update transaction hash: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	add := s.db.AddTx
+	if private {
+		add = s.db.AddPrivateTx
+	}
+	if err := add(&stx); err != nil {
+		status := http.StatusInternalServerError
+		if _, ok := err.(InvalidBlockError); ok {
+			status = http.StatusBadRequest
+		}
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to add transaction to the database: %v", err), status)
+		return
+	}
+	atomic.AddUint64(&s.bestBlockVersion, 1)
+	if private {
+		return
+	}
+	atomic.AddUint64(&s.txsRelayed, 1)
 
 	peers, err := s.db.Peers()
 	if err != nil {
@@ -468,74 +1419,120 @@ func (s *Server) broadcastTx(w http.ResponseWriter, r *http.Request) {
 	}
 	for _, peer := range peers {
 		peer := peer
-		go func() {
+		if !s.notify.Go(func() {
 			if err := s.client.AddTx(peer, &stx); err != nil {
-				log.Printf("cryptopuff: failed to notify peer %v about new transaction %v: %v\n", peer, stx.Hash, err)
+				s.logger.Printf("cryptopuff: failed to notify peer %v about new transaction %v: %v\n", peer, stx.Hash, err)
 			}
-		}()
+		}) {
+			s.logger.Printf("dropped notification to peer %v about new transaction %v, too many are queued\n", peer, stx.Hash)
+		}
 	}
 }
 
 func (s *Server) mine() {
 	rand.Seed(time.Now().UnixNano())
 
-newBestBlock:
 	for {
-		addr, err := s.db.MinerAddress()
-		if err != nil {
-			log.Fatalf("miner failed to get miner address: %v\n", err)
+		if err := s.mineBlock(); err == ErrNoBlocks {
+			s.logger.Printf("miner waiting for a best block: %v\n", err)
+			time.Sleep(time.Second)
+		} else if err != nil {
+			s.logger.Fatalf("miner %v\n", err)
 		}
+	}
+}
 
-		version := atomic.LoadUint64(&s.bestBlockVersion)
-		block, err := s.db.BestBlock()
-		if err != nil {
-			log.Fatalf("miner failed to get best block: %v\n", err)
+// mineBlock mines a block on the best block and relays it to peers. If the
+// best block changes first, it gives up without an error so that the miner
+// starts again on the new one.
+func (s *Server) mineBlock() error {
+	addr, err := s.nextMinerAddress()
+	if err != nil {
+		return errors.Wrap(err, "failed to get miner address")
+	}
+
+	version := atomic.LoadUint64(&s.bestBlockVersion)
+	block, err := s.db.BestBlock()
+	if err == ErrNoBlocks {
+		return err
+	} else if err != nil {
+		return errors.Wrap(err, "failed to get best block")
+	}
+
+	stxs, err := s.db.PendingTxs(block.Hash, txsPerMinedBlock)
+	if err != nil {
+		return errors.Wrap(err, "failed to get pending transactions")
+	}
+
+	target, err := s.db.NextTarget(block)
+	if err != nil {
+		return errors.Wrap(err, "failed to get target")
+	}
+
+	s.logger.Printf("current tip: hash=%v, height=%v, next target=%v bits\n", block.Hash, block.Height, target.orDefault())
+
+	var next *Block
+	for {
+		if version != atomic.LoadUint64(&s.bestBlockVersion) {
+			return nil
 		}
 
-		stxs, err := s.db.PendingTxs(block.Hash, 10)
+		var err error
+		next, err = NewBlock(block, target, rand.Int63(), addr, stxs)
 		if err != nil {
-			log.Fatalf("miner failed to get pending transactions: %v\n", err)
+			return errors.Wrap(err, "failed to create new block")
+		}
+		if next.Hash.MeetsTarget(next.RequiredTarget()) {
+			break
 		}
 
-		log.Printf("current tip: hash=%v, height=%v\n", block.Hash, block.Height)
+		//time.Sleep(5 * time.Microsecond)
 
-		var next *Block
-		for {
-			if version != atomic.LoadUint64(&s.bestBlockVersion) {
-				continue newBestBlock
-			}
-
-			var err error
-			next, err = NewBlock(block, rand.Int63(), addr, s.blockReward, stxs)
-			if err != nil {
-				log.Fatalf("miner failed to create new block: %v\n", err)
-			}
-			if next.Hash.Valid() {
-				break
-			}
+		atomic.AddUint64(&s.hashesPerSec, 1)
+		atomic.AddUint64(&s.totalHashes, 1)
+	}
 
-			//time.Sleep(5 * time.Microsecond)
+	if err := s.db.AddBlockOnTip(next); err == ErrStaleTip {
+		s.logger.Printf("miner discarding block %v: tip changed during assembly\n", next.Hash)
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "failed to add block to the database")
+	}
+	atomic.AddUint64(&s.rewardIndex, 1)
+	s.blockAdded()
+	atomic.AddUint64(&s.blocksMined, 1)
 
-			atomic.AddUint64(&s.hashesPerSec, 1)
+	peers, err := s.db.Peers()
+	if err != nil {
+		return errors.Wrap(err, "failed to select peers")
+	}
+	for _, peer := range peers {
+		peer := peer
+		if !s.notify.Go(func() {
+			if err := s.client.AddBlock(peer, next); err != nil {
+				s.logger.Printf("failed to notify peer %v about new block %v: %v\n", peer, next.Hash, err)
+			}
+		}) {
+			s.logger.Printf("dropped notification to peer %v about new block %v, too many are queued\n", peer, next.Hash)
 		}
+	}
+	return nil
+}
 
-		if err := s.db.AddBlock(next); err != nil {
-			log.Fatalf("miner failed to add block to the database: %v\n", err)
-		}
-		atomic.AddUint64(&s.bestBlockVersion, 1)
+// nextMinerAddress picks the reward destination for the next block. With
+// round-robin rotation the destination advances each time a block is mined.
+func (s *Server) nextMinerAddress() (Address, error) {
+	addrs, rotation, err := s.db.MinerAddresses()
+	if err != nil {
+		return nil, err
+	}
 
-		peers, err := s.db.Peers()
-		if err != nil {
-			log.Fatalf("miner failed to select peers: %v\n", err)
-		}
-		for _, peer := range peers {
-			peer := peer
-			go func() {
-				if err := s.client.AddBlock(peer, next); err != nil {
-					log.Printf("failed to notify peer %v about new block %v: %v\n", peer, next.Hash, err)
-				}
-			}()
-		}
+	switch rotation {
+	case RotationRandom:
+		return addrs[rand.Intn(len(addrs))], nil
+	default:
+		i := atomic.LoadUint64(&s.rewardIndex)
+		return addrs[i%uint64(len(addrs))], nil
 	}
 }
 
@@ -544,24 +1541,166 @@ func (s *Server) periodicFullPeerSync() {
 	for range t.C {
 		peers, err := s.db.Peers()
 		if err != nil {
-			log.Fatalf("full peer sync scheduler failed to select peers: %v\n", err)
+			s.logger.Fatalf("full peer sync scheduler failed to select peers: %v\n", err)
 		}
 
-		for _, peer := range peers {
-			peer := peer
-			go func() {
-				_, wellKnown := s.wellKnownPeers[peer]
-				if err := s.client.Ping(peer); err != nil && !wellKnown {
+		go s.syncPeers(peers)
+	}
+}
+
+// syncPeers pings every peer to learn its tip height, then syncs with them in
+// order of decreasing height, so the peer most likely to have blocks we lack
+// goes first. It does nothing if the previous sync is still running, as a
+// slow peer can hold one up for longer than the sync interval.
+func (s *Server) syncPeers(peers []string) {
+	if !atomic.CompareAndSwapUint32(&s.syncing, 0, 1) {
+		s.logger.Println("skipping full peer sync, the previous one is still running")
+		return
+	}
+	defer atomic.StoreUint32(&s.syncing, 0)
+
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		live []string
+	)
+	for _, peer := range peers {
+		peer := peer
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			_, wellKnown := s.wellKnownPeers[peer]
+			status, err := s.client.Status(peer)
+			if err != nil {
+				s.setPeerHeight(peer, -1)
+				if !wellKnown {
 					if err := s.db.RemovePeer(peer); err != nil {
-						log.Printf("failed to remove unresponsive peer %v from the database: %v\n", peer, err)
-						return
+						s.logger.Printf("failed to remove unresponsive peer %v from the database: %v\n", peer, err)
 					}
+					return
 				}
+			} else {
+				s.setPeerHeight(peer, status.Height)
+			}
 
-				if err := s.fullPeerSync(peer); err != nil {
-					log.Printf("full peer sync with existing peer failed: %v\n", err)
-				}
-			}()
+			mu.Lock()
+			live = append(live, peer)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	s.peerHeightsMu.Lock()
+	sort.SliceStable(live, func(i, j int) bool {
+		hi, ok := s.peerHeights[live[i]]
+		if !ok {
+			hi = -1
+		}
+		hj, ok := s.peerHeights[live[j]]
+		if !ok {
+			hj = -1
+		}
+		return hi > hj
+	})
+	s.peerHeightsMu.Unlock()
+
+	for _, peer := range live {
+		if err := s.fullPeerSync(peer); err != nil {
+			s.logger.Printf("full peer sync with existing peer failed: %v\n", err)
+		}
+	}
+}
+
+// SyncOnce downloads the chain from the highest of the well-known peers until
+// this node reaches the tip that peer reported, and returns the resulting
+// height. Unlike Serve it neither mines, listens for requests nor announces
+// itself to peers, so it can be used to provision a node and then exit.
+func (s *Server) SyncOnce() (int64, error) {
+	var (
+		target int64 = -1
+		source string
+	)
+	for peer := range s.wellKnownPeers {
+		status, err := s.client.Status(peer)
+		if err != nil {
+			s.logger.Printf("ignoring peer %v, status failed: %v\n", peer, err)
+			continue
+		}
+		s.setPeerHeight(peer, status.Height)
+
+		if status.Height > target {
+			target = status.Height
+			source = peer
+		}
+	}
+	if source == "" {
+		return 0, errors.New("cryptopuff: no well-known peers reachable")
+	}
+
+	for {
+		best, err := s.db.BestBlock()
+		if err != nil {
+			return 0, errors.Wrap(err, "cryptopuff: failed to select best block")
+		}
+		if best.Height >= target {
+			return best.Height, nil
+		}
+
+		if err := s.fetchBlocks(source); err != nil {
+			return 0, errors.Wrapf(err, "cryptopuff: failed to fetch blocks from %v", source)
+		}
+
+		after, err := s.db.BestBlock()
+		if err != nil {
+			return 0, errors.Wrap(err, "cryptopuff: failed to select best block")
+		}
+		if after.Height == best.Height {
+			return 0, errors.Errorf("cryptopuff: sync from %v stalled at height %v, short of %v", source, after.Height, target)
+		}
+	}
+}
+
+// metrics reports counters and gauges in the Prometheus text format. None of
+// them are secret, so unless every endpoint requires the password this
+// doesn't either.
+func (s *Server) metrics(w http.ResponseWriter, r *http.Request) {
+	status, err := s.db.Status()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cryptopuff: failed to select status: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set(headerContentType, contentTypePrometheus)
+	writeMetric(w, "cryptopuff_db_retries_total", "counter", "Database transactions retried after a deadlock.", s.db.RetryCount())
+	writeMetric(w, "cryptopuff_blocks_received_total", "counter", "Blocks received from peers, including invalid ones.", atomic.LoadUint64(&s.received.blocks))
+	writeMetric(w, "cryptopuff_txs_received_total", "counter", "Transactions received from peers, including invalid ones.", atomic.LoadUint64(&s.received.txs))
+	writeMetric(w, "cryptopuff_hashes_per_second", "gauge", "Hashes computed by the miners in the last second.", atomic.LoadUint64(&s.lastHashesPerSec))
+	writeMetric(w, "cryptopuff_height", "gauge", "Height of the best block.", status.Height)
+	writeMetric(w, "cryptopuff_peers", "gauge", "Number of known peers.", status.Peers)
+	writeMetric(w, "cryptopuff_pending_txs", "gauge", "Number of transactions in the mempool.", status.PendingTxs)
+}
+
+func writeMetric(w io.Writer, name, typ, help string, value interface{}) {
+	fmt.Fprintf(w, "# HELP %v %v\n", name, help)
+	fmt.Fprintf(w, "# TYPE %v %v\n", name, typ)
+	fmt.Fprintf(w, "%v %v\n", name, value)
+}
+
+func (s *Server) periodicMempoolPrune() {
+	t := time.NewTicker(s.pruneInterval)
+	for range t.C {
+		n, err := s.db.PruneMempool()
+		if err == ErrNoBlocks {
+			continue
+		} else if err != nil {
+			s.logger.Printf("failed to prune mempool: %v\n", err)
+			continue
+		}
+
+		if n > 0 {
+			atomic.AddUint64(&s.txsPruned, uint64(n))
+			s.logger.Printf("pruned %v invalid transaction(s) from the mempool\n", n)
 		}
 	}
 }
@@ -570,18 +1709,104 @@ func (s *Server) printHashesPerSec() {
 	t := time.NewTicker(time.Second)
 	for range t.C {
 		h := atomic.SwapUint64(&s.hashesPerSec, 0)
-		log.Printf("hashes per second: %v\n", h)
+		atomic.StoreUint64(&s.lastHashesPerSec, h)
+		s.logger.Printf("hashes per second: %v\n", h)
 	}
 }
 
+// SessionStats summarises a node's activity since it was created.
+type SessionStats struct {
+	Uptime      time.Duration
+	BlocksMined uint64
+	Hashes      uint64
+	TxsRelayed  uint64
+	TxsPruned   uint64
+}
+
+func (s SessionStats) HashesPerSec() float64 {
+	if s.Uptime <= 0 {
+		return 0
+	}
+	return float64(s.Hashes) / s.Uptime.Seconds()
+}
+
+func (s *Server) Stats() SessionStats {
+	return SessionStats{
+		Uptime:      time.Since(s.started),
+		BlocksMined: atomic.LoadUint64(&s.blocksMined),
+		Hashes:      atomic.LoadUint64(&s.totalHashes),
+		TxsRelayed:  atomic.LoadUint64(&s.txsRelayed),
+		TxsPruned:   atomic.LoadUint64(&s.txsPruned),
+	}
+}
+
+// SaveState persists the in-memory state that would otherwise be lost on
+// shutdown, which is the orphan pool. Pending transactions are already kept in
+// the database.
+func (s *Server) SaveState() error {
+	orphans := s.orphans.list()
+	if err := s.db.SaveOrphans(orphans); err != nil {
+		return errors.Wrap(err, "cryptopuff: failed to save orphan blocks")
+	}
+	s.logger.Printf("saved %v orphan block(s)\n", len(orphans))
+	return nil
+}
+
+// restoreState reloads the state saved by SaveState. Orphans whose parent has
+// arrived in the meantime are connected straight away.
+func (s *Server) restoreState() error {
+	orphans, err := s.db.TakeOrphans()
+	if err != nil {
+		return errors.Wrap(err, "cryptopuff: failed to load orphan blocks")
+	}
+
+	for _, b := range orphans {
+		err := s.db.AddBlock(b)
+		if err == ErrUnknownParent {
+			s.orphans.add(b)
+			continue
+		} else if err != nil {
+			s.logger.Printf("failed to add saved orphan block %v: %v\n", b.Hash, err)
+			continue
+		}
+		s.connectOrphans(b.Hash)
+	}
+
+	if len(orphans) > 0 {
+		s.logger.Printf("restored %v orphan block(s)\n", len(orphans))
+	}
+	return nil
+}
+
 func (s *Server) Serve() error {
-	log.Printf("this machine has %v cores\n", runtime.NumCPU())
+	s.logger.Printf("this machine has %v cores, mining with %v goroutine(s)\n", runtime.NumCPU(), s.miners)
+
+	if err := s.restoreState(); err != nil {
+		return err
+	}
+
+	fallback, err := s.db.EnsureMinerAddress(s.requireMinerKey)
+	if err != nil {
+		return errors.Wrap(err, "cryptopuff: failed to check miner addresses")
+	}
+	if fallback != nil {
+		s.logger.Printf("WARNING: miner addresses were missing, malformed or had no key in the wallet, mining to new address %v instead\n", fallback)
+	}
 
-	go s.mine()
-	go s.mine()
-	go s.mine()
+	for i := 0; i < s.miners; i++ {
+		go s.mine()
+	}
 	go s.periodicFullPeerSync()
-	go s.printHashesPerSec()
+	go s.watchEvents()
+	if s.webhook != nil {
+		go s.deliverWebhooks()
+	}
+	if s.pruneInterval > 0 {
+		go s.periodicMempoolPrune()
+	}
+	if s.miners > 0 {
+		go s.printHashesPerSec()
+	}
 
 	for peer := range s.wellKnownPeers {
 		if err := s.validateAndAddPeer(peer); err != nil {
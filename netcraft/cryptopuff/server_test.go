@@ -0,0 +1,954 @@
+package cryptopuff
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestServer(d *DB, opts ...ServerOption) *Server {
+	opts = append([]ServerOption{ServerLogger(log.New(io.Discard, "", 0)), Miners(0)}, opts...)
+	return NewServer("", "", "", nil, d, opts...)
+}
+
+// testPeer serves h to the test, returning its address and the query of every
+// request it received for blocks.
+func testPeer(t *testing.T, h http.Handler) (string, func() []url.Values) {
+	var (
+		mu      sync.Mutex
+		queries []url.Values
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/blocks" {
+			mu.Lock()
+			queries = append(queries, r.URL.Query())
+			mu.Unlock()
+		}
+		h.ServeHTTP(w, r)
+	}))
+	t.Cleanup(ts.Close)
+
+	return strings.TrimPrefix(ts.URL, "http://"), func() []url.Values {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]url.Values(nil), queries...)
+	}
+}
+
+// testSyncChain returns a peer with a chain longer than MaxBlocksRange, oldest
+// first, and a node sharing its first block.
+func testSyncChain(t *testing.T) (*DB, []*Block, *Server) {
+	src := openTestDB(t)
+	first := insertTestBlock(t, src, GenesisBlock, MinTarget)
+	chain := append([]*Block{first}, addTestChain(t, src, first, MaxBlocksRange+20)...)
+
+	dst := openTestDB(t)
+	storeTestBlock(t, dst, first)
+	return src, chain, newTestServer(dst)
+}
+
+func TestFetchBlocksPages(t *testing.T) {
+	src, chain, s := testSyncChain(t)
+	peer, queries := testPeer(t, newTestServer(src).router)
+
+	if err := s.fetchBlocks(peer); err != nil {
+		t.Fatal(err)
+	}
+	assertBestBlock(t, s.db, chain[len(chain)-1])
+
+	// One block to find the common height, then a full page and the rest.
+	qs := queries()
+	if len(qs) != 3 {
+		t.Fatalf("%v requests for blocks, want 3: %v", len(qs), qs)
+	}
+	for i, want := range []string{"1", "2", strconv.Itoa(MaxBlocksRange + 2)} {
+		if got := qs[i].Get("from"); got != want {
+			t.Errorf("request %v from height %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestFetchBlocksFromCommonHeight(t *testing.T) {
+	src, chain, s := testSyncChain(t)
+	peer, queries := testPeer(t, newTestServer(src).router)
+
+	// The node has most of the peer's chain, then a fork of its own.
+	common := chain[MaxBlocksRange-10]
+	for _, b := range chain[1 : MaxBlocksRange-9] {
+		if err := s.db.AddBlock(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	addTestChain(t, s.db, common, 5)
+
+	if err := s.fetchBlocks(peer); err != nil {
+		t.Fatal(err)
+	}
+	assertBestBlock(t, s.db, chain[len(chain)-1])
+
+	for _, q := range queries() {
+		from, err := strconv.ParseInt(q.Get("from"), 10, 64)
+		if err != nil {
+			t.Fatalf("request without a height: %v", q)
+		}
+		if q.Get("limit") != "1" && from <= common.Height {
+			t.Errorf("downloaded a page from height %v, below the common height %v", from, common.Height)
+		}
+	}
+}
+
+func TestFetchBlocksLegacyPeer(t *testing.T) {
+	src, chain, s := testSyncChain(t)
+
+	// Peers that predate paging send the whole chain, newest first.
+	peer, queries := testPeer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.URL.RawQuery = ""
+		newTestServer(src).blocks(w, r)
+	}))
+
+	if err := s.fetchBlocks(peer); err != nil {
+		t.Fatal(err)
+	}
+	assertBestBlock(t, s.db, chain[len(chain)-1])
+	if qs := queries(); len(qs) != 1 {
+		t.Errorf("downloaded the chain %v times, want once", len(qs))
+	}
+}
+
+func TestAddBlockInvalidTx(t *testing.T) {
+	d := openTestDB(t)
+	first := insertTestBlock(t, d, GenesisBlock, MinTarget)
+	s := newTestServer(d)
+
+	good, bad := testKey(t, 70), testKey(t, 71)
+	fundTestAddress(t, d, first, AddressFromKey(V3, &good.PublicKey), 100)
+	fundTestAddress(t, d, first, AddressFromKey(V3, &bad.PublicKey), 5)
+	stxs := []SignedTx{*signTestTx(t, good, TxVersion3, 10, 1), *signTestTx(t, bad, TxVersion3, 10, 1)}
+	b := mineTestBlock(t, first, 0, stxs)
+
+	body, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	s.addBlock(w, httptest.NewRequest(http.MethodPost, "/api/blocks", bytes.NewReader(body)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status %v, want %v", w.Code, http.StatusBadRequest)
+	}
+	want := fmt.Sprintf("invalid transaction 1 (%v) in block %v at height %v", stxs[1].Hash, b.Hash, b.Height)
+	if !strings.Contains(w.Body.String(), want) {
+		t.Errorf("error %q doesn't contain %q", w.Body, want)
+	}
+	assertBestBlock(t, d, first)
+}
+
+func TestAddBlockOrphans(t *testing.T) {
+	d := openTestDB(t)
+	first := insertTestBlock(t, d, GenesisBlock, MinTarget)
+	s := newTestServer(d, OrphanPoolSize(2))
+
+	post := func(b *Block) int {
+		body, err := json.Marshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		s.addBlock(w, httptest.NewRequest(http.MethodPost, "/api/blocks", strings.NewReader(string(body))))
+		return w.Code
+	}
+
+	// Blocks that arrive before their parents connect once it does.
+	chain := []*Block{mineTestBlock(t, first, 0, nil)}
+	for i := 0; i < 2; i++ {
+		chain = append(chain, mineTestBlock(t, chain[len(chain)-1], 0, nil))
+	}
+	for _, b := range []*Block{chain[2], chain[1], chain[0]} {
+		if code := post(b); code != http.StatusOK {
+			t.Fatalf("block at height %v: status %v", b.Height, code)
+		}
+	}
+	assertBestBlock(t, d, chain[2])
+	if n := s.orphans.len(); n != 0 {
+		t.Errorf("%v orphans left after connecting", n)
+	}
+
+	// A flood of unconnectable blocks is bounded by the pool size.
+	unknown := testParent(t, first.Height)
+	for i := 0; i < 10; i++ {
+		post(mineTestBlockTo(t, unknown, 0, Address{byte(i)}, nil))
+	}
+	if n := s.orphans.len(); n != 2 {
+		t.Errorf("pool holds %v orphans after a flood, want 2", n)
+	}
+
+	// Orphans claiming to be far ahead of the tip are rejected outright.
+	far := testParent(t, chain[2].Height+MaxOrphanHeightAhead)
+	if code := post(mineTestBlock(t, far, 0, nil)); code != http.StatusBadRequest {
+		t.Errorf("orphan far ahead of the tip: status %v, want %v", code, http.StatusBadRequest)
+	}
+}
+
+func TestPeerToken(t *testing.T) {
+	s := NewServer("", "", "secret", nil, openTestDB(t), ServerLogger(log.New(io.Discard, "", 0)), PeerToken("token"))
+	peer, _ := testPeer(t, s.router)
+
+	get := func(path, token, password string) int {
+		req, err := http.NewRequest(http.MethodGet, "http://"+peer+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set(headerXPeerToken, token)
+		}
+		if password != "" {
+			req.SetBasicAuth("", password)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// The wallet password is no substitute for the peer token, and the other
+	// way round.
+	for _, path := range []string{"/api/ping", "/api/peers", "/api/blocks", "/api/txs"} {
+		for _, test := range []struct {
+			token, password string
+			want            int
+		}{
+			{"", "", http.StatusUnauthorized},
+			{"wrong", "", http.StatusUnauthorized},
+			{"", "secret", http.StatusUnauthorized},
+			{"token", "", http.StatusOK},
+		} {
+			if got := get(path, test.token, test.password); got != test.want {
+				t.Errorf("GET %v with token %q and password %q: status %v, want %v", path, test.token, test.password, got, test.want)
+			}
+		}
+	}
+	if got := get("/api/txs/mine", "token", ""); got != http.StatusUnauthorized {
+		t.Errorf("GET /api/txs/mine with only the peer token: status %v, want %v", got, http.StatusUnauthorized)
+	}
+	if got := get("/api/txs/mine", "", "secret"); got != http.StatusOK {
+		t.Errorf("GET /api/txs/mine with the password: status %v, want %v", got, http.StatusOK)
+	}
+
+	// Peers send their token.
+	if _, err := NewPeerClient("", "").Status(peer); err == nil {
+		t.Error("peer without the token could read the node's status")
+	}
+	if _, err := NewPeerClient("", "token").Status(peer); err != nil {
+		t.Errorf("peer with the token: %v", err)
+	}
+}
+
+func TestAddPeerVariants(t *testing.T) {
+	peer, _ := testPeer(t, newTestServer(openTestDB(t)).router)
+	_, port, err := net.SplitHostPort(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := openTestDB(t)
+	s := newTestServer(d)
+	for _, host := range []string{"localhost", "LocalHost.", "LOCALHOST"} {
+		if err := s.validateAndAddPeer(net.JoinHostPort(host, port)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Peers are added once they answer a ping, in the background.
+	want := net.JoinHostPort("localhost", port)
+	var peers []string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if peers, err = d.Peers(); err != nil {
+			t.Fatal(err)
+		} else if len(peers) > 0 {
+			break
+		}
+	}
+	if len(peers) != 1 || peers[0] != want {
+		t.Errorf("peers are %v, want only %v", peers, want)
+	}
+}
+
+func TestSyncPeersHighestFirst(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		synced []string
+		blocks = make(map[string]int)
+	)
+	// peer serves d, recording the order peers are synced with, which starts
+	// by announcing ourselves, and which are asked for blocks.
+	peer := func(d *DB) string {
+		var addr string
+		addr, _ = testPeer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			if r.Method == http.MethodPost && r.URL.Path == "/api/peers" {
+				synced = append(synced, addr)
+			} else if r.URL.Path == "/api/blocks" {
+				blocks[addr]++
+			}
+			mu.Unlock()
+			newTestServer(d).router.ServeHTTP(w, r)
+		}))
+		return addr
+	}
+
+	// The node and the low peer have the first block, and the high peer two
+	// more.
+	low, high := openTestDB(t), openTestDB(t)
+	first := insertTestBlock(t, high, GenesisBlock, MinTarget)
+	chain := addTestChain(t, high, first, 2)
+	storeTestBlock(t, low, first)
+	s := newTestServer(openTestDB(t))
+	storeTestBlock(t, s.db, first)
+
+	lowAddr, highAddr := peer(low), peer(high)
+	s.syncPeers([]string{lowAddr, highAddr})
+	assertBestBlock(t, s.db, chain[len(chain)-1])
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(synced) != 2 || synced[0] != highAddr {
+		t.Errorf("synced with %v, want the high peer %v first", synced, highAddr)
+	}
+	if blocks[lowAddr] != 0 {
+		t.Errorf("asked the low peer for blocks %v times, after catching up with the high peer", blocks[lowAddr])
+	}
+}
+
+func TestSyncPeersOverlapping(t *testing.T) {
+	var pings int32
+	started, release := make(chan struct{}), make(chan struct{})
+	d := openTestDB(t)
+	peer, _ := testPeer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/ping" && atomic.AddInt32(&pings, 1) == 1 {
+			close(started)
+			<-release
+		}
+		newTestServer(d).router.ServeHTTP(w, r)
+	}))
+	s := newTestServer(openTestDB(t))
+
+	done := make(chan struct{})
+	go func() {
+		s.syncPeers([]string{peer})
+		close(done)
+	}()
+	<-started
+
+	// A sync started while the first is stuck returns without contacting
+	// the peer.
+	s.syncPeers([]string{peer})
+	if n := atomic.LoadInt32(&pings); n != 1 {
+		t.Errorf("peer was pinged %v times during the first sync, want once", n)
+	}
+	close(release)
+	<-done
+
+	s.syncPeers([]string{peer})
+	if n := atomic.LoadInt32(&pings); n != 2 {
+		t.Errorf("peer was pinged %v times, want a second sync once the first finished", n)
+	}
+}
+
+func TestTxETA(t *testing.T) {
+	d := openTestDB(t)
+	parent := insertTestBlock(t, d, GenesisBlock, MinTarget)
+
+	// One transaction is mined and the rest, with fees 1 to 12, are
+	// pending, so the cheapest waits behind more than a block's worth.
+	var stxs []*SignedTx
+	for fee := int64(0); fee <= 12; fee++ {
+		k := testKey(t, 40+fee)
+		fundTestAddress(t, d, parent, AddressFromKey(V3, &k.PublicKey), 100)
+		stxs = append(stxs, signTestTx(t, k, TxVersion3, 10, fee))
+	}
+	mined, err := NewBlock(parent, parent.Target, 0, testRewardAddress, []SignedTx{*stxs[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mined.Timestamp = parent.Timestamp + 60
+	remineTestBlock(t, mined)
+	next, err := NewBlock(mined, mined.Target, 0, testRewardAddress, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next.Timestamp = mined.Timestamp + 60
+	remineTestBlock(t, next)
+	for _, b := range []*Block{mined, next} {
+		if err := d.AddBlock(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, stx := range stxs[1:] {
+		if err := d.AddTx(stx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	const perBlock = 60
+	s := newTestServer(d)
+	for _, test := range []struct {
+		name string
+		stx  *SignedTx
+		want TxETA
+	}{
+		{"highest fee", stxs[12], TxETA{Pending: true, Rank: 0, Blocks: 1, Seconds: perBlock}},
+		{"last in the first block", stxs[3], TxETA{Pending: true, Rank: 9, Blocks: 1, Seconds: perBlock}},
+		{"lowest fee", stxs[1], TxETA{Pending: true, Rank: 11, Blocks: 2, Seconds: 2 * perBlock}},
+		{"mined", stxs[0], TxETA{}},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/api/txs/"+test.stx.Hash.String()+"/eta", nil)
+		s.router.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("%v: status %v: %v", test.name, w.Code, w.Body)
+			continue
+		}
+		var got TxETA
+		if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("%v: ETA is %+v, want %+v", test.name, got, test.want)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/txs/"+EmptyHash.String()+"/eta", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown transaction: status %v, want %v", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestAddKeysBundleBadKey(t *testing.T) {
+	d := openTestDB(t)
+	s := newTestServer(d)
+	keys := []*rsa.PrivateKey{testKey(t, 1), testKey(t, 2), testKey(t, 3)}
+
+	bad := EncodePrivateKeyPEM(keys[1])
+	bad[len(bad)/2] ^= 1
+	bundle := bytes.Join([][]byte{EncodePrivateKeyPEM(keys[0]), bad, EncodePrivateKeyPEM(keys[2])}, nil)
+
+	w := httptest.NewRecorder()
+	s.addKeys(w, httptest.NewRequest(http.MethodPost, "/api/keys/bundle?version=3", bytes.NewReader(bundle)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status %v, want %v: %v", w.Code, http.StatusBadRequest, w.Body)
+	}
+	for _, k := range keys {
+		if _, err := d.Key(AddressFromKey(V3, &k.PublicKey)); err == nil {
+			t.Errorf("imported %v from a bundle with a bad key", AddressFromKey(V3, &k.PublicKey))
+		}
+	}
+}
+
+func TestMinerAddressRotation(t *testing.T) {
+	d := openTestDB(t)
+	parent := insertTestBlock(t, d, GenesisBlock, MinTarget)
+	s := newTestServer(d)
+
+	var addrs []Address
+	for seed := int64(1); seed <= 3; seed++ {
+		a, err := d.AddKey(V3, testKey(t, seed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs = append(addrs, a)
+	}
+	b, err := json.Marshal(addrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	s.setMinerAddress(w, httptest.NewRequest(http.MethodPost, "/api/addresses/miner?rotation="+RotationRoundRobin.String(), bytes.NewReader(b)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %v: %v", w.Code, w.Body)
+	}
+
+	// Mine blocks the way the miner does, advancing the rotation after each.
+	var got []string
+	for i := 0; i < 2*len(addrs); i++ {
+		a, err := s.nextMinerAddress()
+		if err != nil {
+			t.Fatal(err)
+		}
+		parent = mineTestBlockTo(t, parent, 0, a, nil)
+		if err := d.AddBlockOnTip(parent); err != nil {
+			t.Fatal(err)
+		}
+		atomic.AddUint64(&s.rewardIndex, 1)
+		got = append(got, parent.RewardOutput.Destination.String())
+	}
+
+	var want []string
+	for i := 0; i < 2; i++ {
+		for _, a := range addrs {
+			want = append(want, a.String())
+		}
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("blocks paid %v, want %v", got, want)
+	}
+
+	// A single address, as older clients send, is mined to every time.
+	w = httptest.NewRecorder()
+	s.setMinerAddress(w, httptest.NewRequest(http.MethodPost, "/api/addresses/miner", strings.NewReader(`"`+addrs[1].String()+`"`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %v: %v", w.Code, w.Body)
+	}
+	for i := 0; i < 2; i++ {
+		if a, err := s.nextMinerAddress(); err != nil {
+			t.Fatal(err)
+		} else if !a.Equal(addrs[1]) {
+			t.Errorf("mined to %v, want %v", a, addrs[1])
+		}
+		atomic.AddUint64(&s.rewardIndex, 1)
+	}
+}
+
+func TestMiningStats(t *testing.T) {
+	d := openTestDB(t)
+	first := insertTestBlock(t, d, GenesisBlock, MinTarget)
+	s := newTestServer(d)
+
+	// The per-second hash count is reset every second, but the session's
+	// totals keep growing.
+	var hashes uint64
+	for i := 0; i < 3; i++ {
+		if err := s.mineBlock(); err != nil {
+			t.Fatal(err)
+		}
+		hashes += atomic.SwapUint64(&s.hashesPerSec, 0)
+	}
+
+	stats := s.Stats()
+	if stats.BlocksMined != 3 {
+		t.Errorf("mined %v blocks, want 3", stats.BlocksMined)
+	}
+	if stats.Hashes != hashes {
+		t.Errorf("computed %v hashes, want %v", stats.Hashes, hashes)
+	}
+	if best, err := d.BestBlock(); err != nil {
+		t.Fatal(err)
+	} else if best.Height != first.Height+3 {
+		t.Errorf("best block is at height %v, want %v", best.Height, first.Height+3)
+	}
+}
+
+func TestPeriodicMempoolPrune(t *testing.T) {
+	d := openTestDB(t)
+	first := insertTestBlock(t, d, GenesisBlock, MinTarget)
+
+	k := testKey(t, 50)
+	fundTestAddress(t, d, first, AddressFromKey(V3, &k.PublicKey), 100)
+	stx, err := Tx{
+		TxOutput:        TxOutput{Destination: testRewardAddress, Amount: 10},
+		Source:          AddressFromKey(V3, &k.PublicKey),
+		Fee:             1,
+		Version:         TxVersion3,
+		ExpiresAtHeight: first.Height + 1,
+	}.Sign(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.AddTx(stx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Blocks that leave the transaction out take the chain past its expiry,
+	// and with no miner running only the timer removes it.
+	addTestChain(t, d, first, 2)
+	if _, err := d.TxByHash(stx.Hash); err != nil {
+		t.Fatalf("expired transaction pruned before the timer ran: %v", err)
+	}
+	s := newTestServer(d, MempoolPruneInterval(10*time.Millisecond))
+	go s.periodicMempoolPrune()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadUint64(&s.txsPruned) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := s.Stats().TxsPruned; n != 1 {
+		t.Errorf("pruned %v transactions, want 1", n)
+	}
+	if _, err := d.TxByHash(stx.Hash); err != ErrUnknownTx {
+		t.Errorf("expired transaction: %v, want it pruned", err)
+	}
+}
+
+// withExtraField returns v's JSON with a field this version doesn't know.
+func withExtraField(t *testing.T, v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return `{"FutureField":1,` + strings.TrimPrefix(string(b), "{")
+}
+
+func TestStrictDecoding(t *testing.T) {
+	for _, strict := range []bool{true, false} {
+		d := openTestDB(t)
+		first := insertTestBlock(t, d, GenesisBlock, MinTarget)
+		k := testKey(t, 60)
+		fundTestAddress(t, d, first, AddressFromKey(V3, &k.PublicKey), 100)
+		s := newTestServer(d, StrictDecoding(strict))
+
+		wantStatus := http.StatusOK
+		if strict {
+			wantStatus = http.StatusBadRequest
+		}
+
+		b := mineTestBlock(t, first, 0, nil)
+		w := httptest.NewRecorder()
+		s.addBlock(w, httptest.NewRequest(http.MethodPost, "/api/blocks", strings.NewReader(withExtraField(t, b))))
+		if w.Code != wantStatus {
+			t.Errorf("strict %v: block with an unknown field: status %v, want %v: %v", strict, w.Code, wantStatus, w.Body)
+		}
+		if _, err := d.BlockByHash(b.Hash); (err == nil) == strict {
+			t.Errorf("strict %v: looking up the block: %v", strict, err)
+		}
+
+		stx := signTestTx(t, k, TxVersion3, 10, 1)
+		w = httptest.NewRecorder()
+		s.addTx(w, httptest.NewRequest(http.MethodPost, "/api/txs", strings.NewReader(withExtraField(t, stx))))
+		if w.Code != wantStatus {
+			t.Errorf("strict %v: transaction with an unknown field: status %v, want %v: %v", strict, w.Code, wantStatus, w.Body)
+		}
+		if _, err := d.TxByHash(stx.Hash); (err == nil) == strict {
+			t.Errorf("strict %v: looking up the transaction: %v", strict, err)
+		}
+	}
+}
+
+func TestBlocksForkTip(t *testing.T) {
+	d := openTestDB(t)
+	first := insertTestBlock(t, d, GenesisBlock, MinTarget)
+	main := addTestChainTo(t, d, first, Address{0x01}, 3)
+	fork := addTestChainTo(t, d, first, Address{0x02}, 2)
+	assertBestBlock(t, d, main[2])
+
+	// hashes lists the blocks' hashes, tip first.
+	hashes := func(blocks []Block) string {
+		var hs []string
+		for _, b := range blocks {
+			if err := b.UpdateHash(); err != nil {
+				t.Fatal(err)
+			}
+			hs = append(hs, b.Hash.String())
+		}
+		return strings.Join(hs, " ")
+	}
+
+	s := newTestServer(d)
+	for _, test := range []struct {
+		tip  *Block
+		want []Block
+	}{
+		{main[2], []Block{*main[2], *main[1], *main[0], *first, *GenesisBlock}},
+		{fork[1], []Block{*fork[1], *fork[0], *first, *GenesisBlock}},
+	} {
+		want := hashes(test.want)
+
+		chain, err := d.ChainFrom(test.tip.Hash, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hashes(chain); got != want {
+			t.Errorf("ChainFrom(%v) = %v, want %v", test.tip.Hash, got, want)
+		}
+
+		w := httptest.NewRecorder()
+		s.blocks(w, httptest.NewRequest(http.MethodGet, "/api/blocks?tip="+test.tip.Hash.String(), nil))
+		var blocks []Block
+		if err := json.NewDecoder(w.Body).Decode(&blocks); err != nil {
+			t.Fatal(err)
+		}
+		if got := hashes(blocks); got != want {
+			t.Errorf("GET /api/blocks?tip=%v returned %v, want %v", test.tip.Hash, got, want)
+		}
+	}
+}
+
+func TestBalancesSnapshotSupply(t *testing.T) {
+	d := openTestDB(t)
+	first := insertTestBlock(t, d, GenesisBlock, MinTarget)
+	k := testKey(t, 90)
+	fundTestAddress(t, d, first, AddressFromKey(V3, &k.PublicKey), 100)
+
+	supply := func(balances map[string]int64) int64 {
+		var total int64
+		for _, balance := range balances {
+			total += balance
+		}
+		return total
+	}
+	before, err := d.BalancesAt(first.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Transactions and their fees move coins around, and only the
+	// subsidies add to the supply.
+	b := mineTestBlockTo(t, first, 0, Address{0x01}, []SignedTx{*signTestTx(t, k, TxVersion3, 30, 5)})
+	if err := d.AddBlock(b); err != nil {
+		t.Fatal(err)
+	}
+	tip := addTestChainTo(t, d, b, Address{0x02}, 2)[1]
+	want := supply(before)
+	for h := first.Height + 1; h <= tip.Height; h++ {
+		want += BlockSubsidy(h)
+	}
+
+	s := newTestServer(d)
+	for _, query := range []string{"", "?tip=" + tip.Hash.String()} {
+		w := httptest.NewRecorder()
+		s.balancesAt(w, httptest.NewRequest(http.MethodGet, "/api/balances"+query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%q: status %v: %v", query, w.Code, w.Body)
+		}
+		var balances map[string]int64
+		if err := json.NewDecoder(w.Body).Decode(&balances); err != nil {
+			t.Fatal(err)
+		}
+		if got := supply(balances); got != want {
+			t.Errorf("%q: balances sum to %v, want the supply of %v", query, got, want)
+		}
+		for a, balance := range balances {
+			if balance == 0 {
+				t.Errorf("%q: snapshot includes %v with a zero balance", query, a)
+			}
+		}
+	}
+}
+
+func TestRequireAuthForReads(t *testing.T) {
+	quiet := ServerLogger(log.New(io.Discard, "", 0))
+	s := NewServer("", "", "secret", nil, openTestDB(t), quiet, RequireAuthForReads(true))
+	peer, _ := testPeer(t, s.router)
+
+	for _, path := range []string{"/api/ping", "/api/blocks", "/api/txs", "/api/addresses"} {
+		for _, password := range []string{"", "wrong", "secret"} {
+			req, err := http.NewRequest(http.MethodGet, "http://"+peer+path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if password != "" {
+				req.SetBasicAuth("", password)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			want := http.StatusUnauthorized
+			if password == "secret" {
+				want = http.StatusOK
+			}
+			if resp.StatusCode != want {
+				t.Errorf("GET %v with password %q: status %v, want %v", path, password, resp.StatusCode, want)
+			}
+		}
+	}
+
+	// Nodes on the same private network send the password to each other.
+	if _, err := NewPeerClient("", "").Status(peer); err == nil {
+		t.Error("peer without the password could read the node's status")
+	}
+	other := NewServer("", "", "secret", nil, openTestDB(t), quiet, RequireAuthForReads(true))
+	if _, err := other.client.Status(peer); err != nil {
+		t.Errorf("peer with the password: %v", err)
+	}
+}
+
+func TestSaveStateKeepsOrphans(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	open := func() *DB {
+		d, err := OpenDB(path, DBLogger(log.New(io.Discard, "", 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { d.Close() })
+		return d
+	}
+
+	d := open()
+	first := insertTestBlock(t, d, GenesisBlock, MinTarget)
+	chain := []*Block{mineTestBlock(t, first, 0, nil)}
+	for len(chain) < 3 {
+		chain = append(chain, mineTestBlock(t, chain[len(chain)-1], 0, nil))
+	}
+
+	// The node shuts down while waiting for chain[0].
+	s := newTestServer(d)
+	s.orphans.add(chain[2])
+	s.orphans.add(chain[1])
+	if err := s.SaveState(); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+
+	d = open()
+	s = newTestServer(d)
+	if err := s.restoreState(); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.orphans.len(); n != 2 {
+		t.Fatalf("restored %v orphans, want 2", n)
+	}
+
+	// Once the parent arrives the restored orphans connect without being
+	// fetched again.
+	if err := d.AddBlock(chain[0]); err != nil {
+		t.Fatal(err)
+	}
+	s.connectOrphans(chain[0].Hash)
+	assertBestBlock(t, d, chain[2])
+
+	// The saved state was taken, so a second restart doesn't restore the
+	// orphans again.
+	d.Close()
+	s = newTestServer(open())
+	if err := s.restoreState(); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.orphans.len(); n != 0 {
+		t.Errorf("restored %v orphans a second time", n)
+	}
+}
+
+func TestAddKeyInvalid(t *testing.T) {
+	d := openTestDB(t)
+	s := newTestServer(d)
+	before, err := d.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, b := range corruptTestKeyPEMs(testKey(t, 1)) {
+		w := httptest.NewRecorder()
+		s.addKey(w, httptest.NewRequest(http.MethodPost, "/api/keys?version=3", bytes.NewReader(b)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%v: status %v, want %v: %v", name, w.Code, http.StatusBadRequest, w.Body)
+		}
+	}
+
+	if after, err := d.Keys(); err != nil {
+		t.Fatal(err)
+	} else if len(after) != len(before) {
+		t.Errorf("wallet has %v keys after importing invalid ones, want %v", len(after), len(before))
+	}
+}
+
+func TestSyncOnce(t *testing.T) {
+	src, chain, _ := testSyncChain(t)
+	high, _ := testPeer(t, newTestServer(src).router)
+
+	// A peer that is behind is ignored in favour of the highest.
+	low := openTestDB(t)
+	storeTestBlock(t, low, chain[0])
+	lowPeer, _ := testPeer(t, newTestServer(low).router)
+
+	d := openTestDB(t)
+	storeTestBlock(t, d, chain[0])
+	s := NewServer("", "", "", []string{lowPeer, high}, d, ServerLogger(log.New(io.Discard, "", 0)), Miners(0))
+	height, err := s.SyncOnce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tip := chain[len(chain)-1]
+	if height != tip.Height {
+		t.Errorf("synced to height %v, want %v", height, tip.Height)
+	}
+	assertBestBlock(t, d, tip)
+
+	s = NewServer("", "", "", []string{"127.0.0.1:1"}, openTestDB(t), ServerLogger(log.New(io.Discard, "", 0)), Miners(0))
+	s.client.backoff = func(int) time.Duration { return 0 }
+	if _, err := s.SyncOnce(); err == nil {
+		t.Error("synced without a reachable peer")
+	}
+}
+
+func TestBlocksHandler(t *testing.T) {
+	d := openTestDB(t)
+	first := insertTestBlock(t, d, GenesisBlock, MinTarget)
+	chain := append([]*Block{GenesisBlock, first}, addTestChain(t, d, first, 4)...)
+	s := newTestServer(d)
+
+	heights := func(from, to int64) []int64 {
+		var hs []int64
+		for h := from; h != to; {
+			hs = append(hs, h)
+			if from < to {
+				h++
+			} else {
+				h--
+			}
+		}
+		return append(hs, to)
+	}
+	for _, test := range []struct {
+		query string
+		want  []int64
+	}{
+		// from pages oldest first, limit is the page size
+		{"from=2&limit=2", heights(2, 3)},
+		{"from=3", heights(3, 5)},
+		{fmt.Sprintf("from=0&limit=%d", MaxBlocksRange), heights(0, 5)},
+		// otherwise limit is how far to walk back from the tip
+		{"limit=2", heights(5, 4)},
+		{"", heights(5, 0)},
+		{"tip=" + chain[3].Hash.String() + "&limit=2", heights(3, 2)},
+		{"tip=" + chain[3].Hash.String(), heights(3, 0)},
+	} {
+		w := httptest.NewRecorder()
+		s.blocks(w, httptest.NewRequest(http.MethodGet, "/api/blocks?"+test.query, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("%q: status %v: %v", test.query, w.Code, w.Body)
+			continue
+		}
+		var blocks []Block
+		if err := json.NewDecoder(w.Body).Decode(&blocks); err != nil {
+			t.Fatal(err)
+		}
+		var got []int64
+		for _, b := range blocks {
+			got = append(got, b.Height)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%q returned heights %v, want %v", test.query, got, test.want)
+		}
+	}
+
+	for query, want := range map[string]int{
+		"limit=0": http.StatusBadRequest,
+		"from=-1": http.StatusBadRequest,
+		"from=0&limit=" + strconv.Itoa(MaxBlocksRange+1): http.StatusBadRequest,
+		"from=0&tip=" + chain[3].Hash.String():           http.StatusBadRequest,
+		"tip=" + EmptyHash.String():                      http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		s.blocks(w, httptest.NewRequest(http.MethodGet, "/api/blocks?"+query, nil))
+		if w.Code != want {
+			t.Errorf("%q: status %v, want %v", query, w.Code, want)
+		}
+	}
+}
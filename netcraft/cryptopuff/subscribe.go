@@ -0,0 +1,139 @@
+package cryptopuff
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// eventPollInterval is how often the server checks bestBlockVersion for
+	// changes to push to subscribers.
+	eventPollInterval = 100 * time.Millisecond
+
+	// eventBufferSize is the number of events queued for each subscriber.
+	// Events for a subscriber whose queue is full are dropped, so a slow
+	// client can never hold up the miners.
+	eventBufferSize = 16
+)
+
+// Event is pushed to subscribers whenever the best block or the mempool may
+// have changed. Version increases with every change, but changes less than
+// eventPollInterval apart share one event, so Versions are usually not
+// consecutive. Each event carries the whole state rather than a delta, but
+// events are dropped for a client more than eventBufferSize behind, so one
+// that falls behind should fetch the status again once it has caught up.
+type Event struct {
+	Version    uint64
+	Tip        Hash
+	Height     int64
+	PendingTxs int
+}
+
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[chan Event]struct{})}
+}
+
+func (h *eventHub) subscribe() chan Event {
+	ch := make(chan Event, eventBufferSize)
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch
+}
+
+func (h *eventHub) unsubscribe(ch chan Event) {
+	h.mu.Lock()
+	delete(h.subs, ch)
+	h.mu.Unlock()
+}
+
+func (h *eventHub) empty() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs) == 0
+}
+
+func (h *eventHub) publish(e Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// watchEvents publishes an Event each time bestBlockVersion changes. Changes
+// in quick succession are coalesced into one event.
+func (s *Server) watchEvents() {
+	var last uint64
+	t := time.NewTicker(eventPollInterval)
+	for range t.C {
+		version := atomic.LoadUint64(&s.bestBlockVersion)
+		if version == last || s.events.empty() {
+			continue
+		}
+
+		status, err := s.db.Status()
+		if err != nil {
+			s.logger.Printf("failed to select status for subscribers: %v\n", err)
+			continue
+		}
+		last = version
+
+		s.events.publish(Event{
+			Version:    version,
+			Tip:        status.Tip,
+			Height:     status.Height,
+			PendingTxs: status.PendingTxs,
+		})
+	}
+}
+
+var upgrader = websocket.Upgrader{}
+
+func (s *Server) subscribe(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already replied with an error.
+		return
+	}
+	defer conn.Close()
+
+	ch := s.events.subscribe()
+	defer s.events.unsubscribe(ch)
+
+	// Clients don't send anything, but reading is needed to handle control
+	// frames and to notice when the connection is closed.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case e := <-ch:
+			conn.SetWriteDeadline(time.Now().Add(Timeout))
+			if err := conn.WriteJSON(e); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
@@ -2,21 +2,109 @@ package cryptopuff
 
 import (
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/md5"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 
 	"github.com/JohnCGriffin/overflow"
 	"github.com/pkg/errors"
 )
 
+type TxVersion int
+
+const (
+	TxVersion1 TxVersion = iota
+	TxVersion2
+	// TxVersion3 transactions are hashed with SHA-256 rather than MD5, so
+	// two of them can't be crafted to share a hash.
+	TxVersion3
+	// TxVersion4 transactions sign their ID along with the rest of the
+	// transaction, and their hash leaves out the signature. Older versions
+	// hash the unsigned ID and the signature too, so anyone relaying one can
+	// change its hash without invalidating it, and get the same payment mined
+	// twice.
+	TxVersion4
+)
+
+// HashAlgo returns the digest transactions of the given version are hashed
+// with.
+func (v TxVersion) HashAlgo() HashAlgo {
+	if v >= TxVersion3 {
+		return HashSHA256
+	}
+	return HashMD5
+}
+
+// SignatureAlgorithm identifies the digest a transaction signature was made
+// over. Algorithms are ordered from weakest to strongest.
+type SignatureAlgorithm int
+
+const (
+	MD5WithPSS SignatureAlgorithm = iota
+	SHA256WithPSS
+	// ECDSAWithSHA256 is the only algorithm accepted from V4 addresses, and
+	// is never accepted from the others.
+	ECDSAWithSHA256
+)
+
+func (a SignatureAlgorithm) String() string {
+	switch a {
+	case MD5WithPSS:
+		return "MD5-PSS"
+	case SHA256WithPSS:
+		return "SHA256-PSS"
+	case ECDSAWithSHA256:
+		return "ECDSA-SHA256"
+	default:
+		return fmt.Sprintf("SignatureAlgorithm(%d)", int(a))
+	}
+}
+
+func (a SignatureAlgorithm) digest(b []byte) (crypto.Hash, []byte, error) {
+	switch a {
+	case MD5WithPSS:
+		hash := md5.Sum(b)
+		return crypto.MD5, hash[:], nil
+	case SHA256WithPSS:
+		hash := sha256.Sum256(b)
+		return crypto.SHA256, hash[:], nil
+	default:
+		return 0, nil, errors.Errorf("cryptopuff: unknown signature algorithm %v", a)
+	}
+}
+
+// RequiredSignatureAlgorithm returns the weakest signature algorithm accepted
+// for transactions of the given version.
+func RequiredSignatureAlgorithm(v TxVersion) (SignatureAlgorithm, error) {
+	switch v {
+	case TxVersion1:
+		return MD5WithPSS, nil
+	case TxVersion2, TxVersion3, TxVersion4:
+		return SHA256WithPSS, nil
+	default:
+		return 0, errors.Errorf("cryptopuff: unknown transaction version %d", int(v))
+	}
+}
+
 type Tx struct {
 	TxOutput
-	Source Address
-	Fee    int64
+	Source  Address
+	Fee     int64
+	Version TxVersion `json:",omitempty"`
+
+	// ExpiresAtHeight is the height of the last block the transaction may be
+	// included in, after which it is dropped from the mempool rather than
+	// lingering there forever. It is signed along with the rest of the
+	// transaction. Zero, as for every transaction created before it was
+	// introduced, means it never expires.
+	ExpiresAtHeight int64 `json:",omitempty"`
 }
 
 type TxOutput struct {
@@ -38,32 +126,114 @@ func (t Tx) ValidAmounts() error {
 	return nil
 }
 
+// ValidDestination returns an error if the transaction pays its own source,
+// which only burns the fee. It is mempool policy rather than a consensus rule:
+// blocks containing such transactions are still accepted, so nodes that
+// predate it don't fork, but they are neither relayed nor mined.
+func (t Tx) ValidDestination() error {
+	if t.Destination.Equal(t.Source) {
+		return errors.New("cryptopuff: source and destination are the same")
+	}
+	return nil
+}
+
+// ValidDust returns an error if the transaction's output is below threshold.
+func (t Tx) ValidDust(threshold int64) error {
+	if t.Amount < threshold {
+		return errors.Errorf("cryptopuff: amount %v below dust threshold %v", t.Amount, threshold)
+	}
+	return nil
+}
+
+// ValidExpiry returns an error if the transaction has expired by the time a
+// block at the given height is mined.
+func (t Tx) ValidExpiry(height int64) error {
+	if t.ExpiresAtHeight != 0 && height > t.ExpiresAtHeight {
+		return errors.Errorf("cryptopuff: transaction expired at height %v", t.ExpiresAtHeight)
+	}
+	return nil
+}
+
 func (t Tx) RequiredBalance() int64 {
 	return t.Fee + t.Amount
 }
 
-func (t Tx) Sign(k *rsa.PrivateKey) (*SignedTx, error) {
-	b, err := json.Marshal(t)
+// message returns what a signature over the transaction covers: from
+// TxVersion4 onwards its ID as well as the transaction itself.
+func (t Tx) message(id TxID) ([]byte, error) {
+	var v interface{} = t
+	if t.Version >= TxVersion4 {
+		v = struct {
+			Tx
+			ID TxID
+		}{t, id}
+	}
+
+	b, err := json.Marshal(v)
 	if err != nil {
 		return nil, errors.Wrap(err, "cryptopuff: failed to marshal JSON")
 	}
-	hash := md5.Sum(b)
+	return b, nil
+}
+
+func (t Tx) Sign(k *rsa.PrivateKey) (*SignedTx, error) {
+	id, err := newTxID()
+	if err != nil {
+		return nil, err
+	}
+	b, err := t.message(id)
+	if err != nil {
+		return nil, err
+	}
 
-	sig, err := rsa.SignPSS(rand.Reader, k, crypto.MD5, hash[:], nil)
+	alg, err := RequiredSignatureAlgorithm(t.Version)
+	if err != nil {
+		return nil, err
+	}
+	hashFunc, hash, err := alg.digest(b)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := rsa.SignPSS(rand.Reader, k, hashFunc, hash, nil)
 	if err != nil {
 		return nil, errors.Wrap(err, "cryptopuff: failed to sign transaction")
 	}
 
-	var id TxID
-	if _, err := rand.Read(id[:]); err != nil {
-		return nil, errors.Wrap(err, "cryptopuff: failed to generate TxID")
+	return t.signed(id, sig, alg, x509.MarshalPKCS1PublicKey(&k.PublicKey))
+}
+
+// SignECDSA signs a transaction from a V4 address.
+func (t Tx) SignECDSA(k *ecdsa.PrivateKey) (*SignedTx, error) {
+	id, err := newTxID()
+	if err != nil {
+		return nil, err
+	}
+	b, err := t.message(id)
+	if err != nil {
+		return nil, err
 	}
 
+	hash := sha256.Sum256(b)
+	sig, err := ecdsa.SignASN1(rand.Reader, k, hash[:])
+	if err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: failed to sign transaction")
+	}
+
+	pub, err := x509.MarshalPKIXPublicKey(&k.PublicKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "cryptopuff: failed to marshal public key")
+	}
+	return t.signed(id, sig, ECDSAWithSHA256, pub)
+}
+
+func (t Tx) signed(id TxID, sig []byte, alg SignatureAlgorithm, pub []byte) (*SignedTx, error) {
 	stx := &SignedTx{
 		Tx:        t,
 		ID:        id,
 		Signature: sig,
-		PublicKey: x509.MarshalPKCS1PublicKey(&k.PublicKey),
+		Algorithm: alg,
+		PublicKey: pub,
 	}
 	if err := stx.UpdateHash(); err != nil {
 		return nil, errors.Wrap(err, "cryptopuff: failed to update transaction hash")
@@ -75,6 +245,14 @@ const TxIDSize = 16
 
 type TxID [TxIDSize]byte
 
+func newTxID() (TxID, error) {
+	var id TxID
+	if _, err := rand.Read(id[:]); err != nil {
+		return id, errors.Wrap(err, "cryptopuff: failed to generate TxID")
+	}
+	return id, nil
+}
+
 func (t TxID) MarshalJSON() ([]byte, error) {
 	b, err := json.Marshal(hex.EncodeToString(t[:]))
 	if err != nil {
@@ -110,42 +288,119 @@ type SignedTx struct {
 	Hash      Hash `json:"-"`
 	ID        TxID
 	Signature []byte
+	Algorithm SignatureAlgorithm `json:",omitempty"`
+
+	// PublicKey is needed to verify the signature, as an address is only a
+	// truncated hash of the key. It is PKCS#1 encoded for RSA keys and PKIX
+	// encoded for ECDSA keys. A transaction reveals its source's key to
+	// every node it is relayed to. Until the transaction is mined an RSA key
+	// can be factored and a competing, higher fee transaction signed, so
+	// broadcasting privately (see DB.AddPrivateTx) keeps it hidden until then.
 	PublicKey []byte
 }
 
+// UpdateHash sets Hash from the transaction's contents. From TxVersion4
+// onwards only the signed contents and the public key are hashed, so
+// re-signing a transaction, whose signature is randomised, can't change it.
 func (s *SignedTx) UpdateHash() error {
-	raw, err := json.Marshal(s)
+	raw, err := json.Marshal(s.hashed())
 	if err != nil {
 		return errors.Wrap(err, "cryptopuff: failed to marshal JSON")
 	}
-	s.Hash = Hash(md5.Sum(raw))
+	s.Hash = s.Tx.Version.HashAlgo().Sum(raw)
 	return nil
 }
 
+func (s *SignedTx) hashed() interface{} {
+	if s.Tx.Version < TxVersion4 {
+		return s
+	}
+	return struct {
+		Tx
+		ID        TxID
+		PublicKey []byte
+	}{s.Tx, s.ID, s.PublicKey}
+}
+
 func (s SignedTx) ValidSignature() error {
+	version, err := DetectVersion(s.Tx.Source)
+	if err != nil {
+		return err
+	}
+	if version.KeyType() == KeyECDSA {
+		return s.validECDSASignature()
+	}
+	if s.Algorithm == ECDSAWithSHA256 {
+		return errors.Errorf("cryptopuff: %v signature from %v address", s.Algorithm, version)
+	}
+
 	k, err := x509.ParsePKCS1PublicKey(s.PublicKey)
 	if err != nil {
 		return errors.Wrap(err, "cryptopuff: failed to parse public key")
 	}
+	if !AddressFromKey(version, k).Equal(s.Tx.Source) {
+		return errors.Errorf("cryptopuff: %v address doesn't match public key", version)
+	}
 
-	addressV1 := AddressFromKey(V1, k)
-	addressV2 := AddressFromKey(V2, k)
-	if !addressV1.Equal(s.Tx.Source) && !addressV2.Equal(s.Tx.Source) {
-		return errors.New("cryptopuff: address doesn't match public key")
+	// The algorithm is chosen by the sender, so it must not be trusted on its
+	// own: a transaction version that mandates SHA-256 must never be
+	// accepted with an MD5 signature, which could be forged with a collision.
+	required, err := RequiredSignatureAlgorithm(s.Tx.Version)
+	if err != nil {
+		return err
+	}
+	if s.Algorithm < required {
+		return errors.Errorf("cryptopuff: %v signature is weaker than %v required by transaction version %d", s.Algorithm, required, int(s.Tx.Version))
 	}
 
-	b, err := json.Marshal(s.Tx)
+	b, err := s.Tx.message(s.ID)
 	if err != nil {
-		return errors.Wrap(err, "cryptopuff: failed to marshal JSON")
+		return err
+	}
+	hashFunc, hash, err := s.Algorithm.digest(b)
+	if err != nil {
+		return err
 	}
-	hash := md5.Sum(b)
 
-	if err := rsa.VerifyPSS(k, crypto.MD5, hash[:], s.Signature, nil); err != nil {
+	if err := rsa.VerifyPSS(k, hashFunc, hash, s.Signature, nil); err != nil {
 		return errors.Wrap(err, "cryptopuff: invalid signature")
 	}
 	return nil
 }
 
+func (s SignedTx) validECDSASignature() error {
+	if s.Algorithm != ECDSAWithSHA256 {
+		return errors.Errorf("cryptopuff: %v signature from %v address, expected %v", s.Algorithm, V4, ECDSAWithSHA256)
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(s.PublicKey)
+	if err != nil {
+		return errors.Wrap(err, "cryptopuff: failed to parse public key")
+	}
+	k, ok := pub.(*ecdsa.PublicKey)
+	if !ok || k.Curve != elliptic.P256() {
+		return errors.New("cryptopuff: public key isn't a P-256 ECDSA key")
+	}
+
+	a, err := AddressFromECDSAKey(k)
+	if err != nil {
+		return err
+	}
+	if !a.Equal(s.Tx.Source) {
+		return errors.Errorf("cryptopuff: %v address doesn't match public key", V4)
+	}
+
+	b, err := s.Tx.message(s.ID)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(b)
+	if !ecdsa.VerifyASN1(k, hash[:], s.Signature) {
+		return errors.New("cryptopuff: invalid signature")
+	}
+	return nil
+}
+
 func (s SignedTx) Valid() error {
 	if err := s.ValidAmounts(); err != nil {
 		return InvalidBlockError{Message: "cryptopuff: invalid amounts", Cause: err}
@@ -163,3 +418,22 @@ type PersonalTx struct {
 	Included bool
 	Height   int64
 }
+
+// TxETA estimates how long a pending transaction will take to be mined,
+// assuming miners pick the highest fee transactions first. Seconds is zero if
+// the block interval can't be determined.
+type TxETA struct {
+	Pending bool
+	Rank    int
+	Blocks  int64
+	Seconds int64
+}
+
+// FeeEstimate describes the fee a new transaction must pay to be accepted
+// into the mempool, which rises with the number of pending transactions.
+// Capacity is zero if the node doesn't have a fee floor.
+type FeeEstimate struct {
+	Floor      int64
+	PendingTxs int
+	Capacity   int
+}
@@ -0,0 +1,311 @@
+package cryptopuff
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"testing"
+)
+
+// testKey returns a deterministic key. DefaultKeyLength is too short for
+// SHA-256 PSS signatures.
+func testKey(t testing.TB, seed int64) *rsa.PrivateKey {
+	k, err := GenerateKey(1024, seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// signTestTx signs a transaction of the given version from k's V3 address.
+func signTestTx(t testing.TB, k *rsa.PrivateKey, version TxVersion, amount, fee int64) *SignedTx {
+	tx := Tx{
+		TxOutput: TxOutput{Destination: testRewardAddress, Amount: amount},
+		Source:   AddressFromKey(V3, &k.PublicKey),
+		Fee:      fee,
+		Version:  version,
+	}
+	stx, err := tx.Sign(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stx
+}
+
+// resignTestTx signs stx's transaction and ID again. PSS signatures are
+// randomised, so the new signature differs from the original.
+func resignTestTx(t testing.TB, k *rsa.PrivateKey, stx *SignedTx) *SignedTx {
+	b, err := stx.Tx.message(stx.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashFunc, hash, err := stx.Algorithm.digest(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := rsa.SignPSS(rand.Reader, k, hashFunc, hash, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resigned, err := stx.Tx.signed(stx.ID, sig, stx.Algorithm, stx.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(resigned.Signature, stx.Signature) {
+		t.Fatal("signing again gave the same signature")
+	}
+	return resigned
+}
+
+// TestDefaultKeyLengthSigns checks that the default keys, too short to be
+// allowed to sign by default since Go 1.24, can (see the godebug in go.mod).
+func TestDefaultKeyLengthSigns(t *testing.T) {
+	k, err := GenerateKey(DefaultKeyLength, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := Tx{
+		TxOutput: TxOutput{Destination: testRewardAddress, Amount: 10},
+		Source:   AddressFromKey(DefaultVersion, &k.PublicKey),
+		Fee:      1,
+		Version:  TxVersion1,
+	}
+	stx, err := tx.Sign(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stx.ValidSignature(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSignatureAlgorithmDowngrade(t *testing.T) {
+	k := testKey(t, 1)
+	for _, test := range []struct {
+		version TxVersion
+		alg     SignatureAlgorithm
+		valid   bool
+	}{
+		{TxVersion1, MD5WithPSS, true},
+		{TxVersion1, SHA256WithPSS, true},
+		{TxVersion3, SHA256WithPSS, true},
+		{TxVersion4, SHA256WithPSS, true},
+		// a genuine MD5 signature can't stand in for the SHA-256 one the
+		// version requires
+		{TxVersion3, MD5WithPSS, false},
+		{TxVersion4, MD5WithPSS, false},
+	} {
+		stx := *signTestTx(t, k, test.version, 10, 1)
+		stx.Algorithm = test.alg
+		err := resignTestTx(t, k, &stx).ValidSignature()
+		if test.valid && err != nil {
+			t.Errorf("version %d with %v: %v", int(test.version), test.alg, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("version %d accepted a %v signature", int(test.version), test.alg)
+		}
+	}
+
+	// RSA signatures can't claim to be ECDSA ones either.
+	stx := signTestTx(t, k, TxVersion3, 10, 1)
+	stx.Algorithm = ECDSAWithSHA256
+	if err := stx.ValidSignature(); err == nil {
+		t.Errorf("accepted a %v signature from a v3 address", ECDSAWithSHA256)
+	}
+}
+
+func TestTxVersion4HashLeavesOutSignature(t *testing.T) {
+	k := testKey(t, 1)
+	stx := signTestTx(t, k, TxVersion4, 10, 1)
+	resigned := resignTestTx(t, k, stx)
+
+	if resigned.Hash != stx.Hash {
+		t.Errorf("signatures over the same transaction give different hashes %v and %v", stx.Hash, resigned.Hash)
+	}
+	for _, s := range []*SignedTx{stx, resigned} {
+		if err := s.ValidSignature(); err != nil {
+			t.Errorf("signature %x: %v", s.Signature, err)
+		}
+	}
+}
+
+func TestTxVersion3HashCoversSignature(t *testing.T) {
+	k := testKey(t, 1)
+	stx := signTestTx(t, k, TxVersion3, 10, 1)
+	resigned := resignTestTx(t, k, stx)
+
+	if resigned.Hash == stx.Hash {
+		t.Errorf("signatures over the same transaction give the same hash %v", stx.Hash)
+	}
+}
+
+func TestTxVersion4ForgedSignature(t *testing.T) {
+	k := testKey(t, 1)
+	stx := signTestTx(t, k, TxVersion4, 10, 1)
+
+	forged := *stx
+	forged.Signature = append([]byte(nil), stx.Signature...)
+	forged.Signature[0] ^= 0xff
+	if err := forged.UpdateHash(); err != nil {
+		t.Fatal(err)
+	}
+	if forged.Hash != stx.Hash {
+		t.Fatalf("forged signature changes the hash from %v to %v", stx.Hash, forged.Hash)
+	}
+	if err := forged.ValidSignature(); err == nil {
+		t.Error("forged signature is valid")
+	}
+}
+
+// TestBlockValidTxVersion4Signatures checks that blocks sharing a hash but
+// carrying different signatures are each validated, even once one of them
+// has been cached.
+func TestBlockValidTxVersion4Signatures(t *testing.T) {
+	k := testKey(t, 2)
+	stx := signTestTx(t, k, TxVersion4, 10, 1)
+	resigned := resignTestTx(t, k, stx)
+
+	parent := testParent(t, 1)
+	b := mineTestBlock(t, parent, 0, []SignedTx{*stx})
+	if err := b.Valid([]Block{*parent}); err != nil {
+		t.Fatal(err)
+	}
+
+	other := *b
+	other.Transactions = []SignedTx{*resigned}
+	if err := other.UpdateHash(); err != nil {
+		t.Fatal(err)
+	}
+	if other.Hash != b.Hash {
+		t.Fatalf("re-signed block hash %v differs from %v", other.Hash, b.Hash)
+	}
+	if err := other.Valid([]Block{*parent}); err != nil {
+		t.Errorf("re-signed block: %v", err)
+	}
+
+	for name, tamper := range map[string]func(*SignedTx){
+		"forged":   func(s *SignedTx) { s.Signature[len(s.Signature)-1] ^= 0xff },
+		"stripped": func(s *SignedTx) { s.Signature = nil },
+	} {
+		tampered := *b
+		stx := *stx
+		stx.Signature = append([]byte(nil), stx.Signature...)
+		tamper(&stx)
+		tampered.Transactions = []SignedTx{stx}
+		if err := tampered.UpdateHash(); err != nil {
+			t.Fatal(err)
+		}
+		if tampered.Hash != b.Hash {
+			t.Fatalf("%v block hash %v differs from %v", name, tampered.Hash, b.Hash)
+		}
+		if _, ok := tampered.Valid([]Block{*parent}).(InvalidBlockError); !ok {
+			t.Errorf("%v signature in a validated block wasn't rejected", name)
+		}
+	}
+}
+
+func TestTxIDRoundTrip(t *testing.T) {
+	id, err := newTxID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []TxID{{}, id} {
+		raw, err := json.Marshal(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fromJSON TxID
+		if err := json.Unmarshal(raw, &fromJSON); err != nil {
+			t.Fatal(err)
+		}
+		if fromJSON != id {
+			t.Errorf("JSON round trip of %v gave %v", id, fromJSON)
+		}
+	}
+}
+
+func FuzzTxIDUnmarshalJSON(f *testing.F) {
+	f.Add([]byte(`"00000000000000000000000000000000"`))
+	f.Add([]byte(`"aa"`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var id TxID
+		if err := json.Unmarshal(data, &id); err != nil {
+			return
+		}
+		raw, err := json.Marshal(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var again TxID
+		if err := json.Unmarshal(raw, &again); err != nil {
+			t.Fatal(err)
+		}
+		if again != id {
+			t.Errorf("JSON round trip of %v gave %v", id, again)
+		}
+	})
+}
+
+// testSignedTxRoundTrip checks that a transaction decoded from its JSON
+// encoding, the form it is relayed and stored in, hashes and encodes the same.
+func testSignedTxRoundTrip(t *testing.T, stx *SignedTx) {
+	if err := stx.UpdateHash(); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := json.Marshal(stx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded SignedTx
+	if err := json.Unmarshal(raw, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if err := decoded.UpdateHash(); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Hash != stx.Hash {
+		t.Errorf("decoded transaction hash %v differs from %v", decoded.Hash, stx.Hash)
+	}
+
+	again, err := json.Marshal(&decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again, raw) {
+		t.Errorf("decoded transaction encodes as %s, want %s", again, raw)
+	}
+}
+
+func TestSignedTxRoundTrip(t *testing.T) {
+	k := testKey(t, 1)
+	for _, version := range []TxVersion{TxVersion1, TxVersion2, TxVersion3, TxVersion4} {
+		stx := signTestTx(t, k, version, 10, 1)
+		testSignedTxRoundTrip(t, stx)
+
+		stx.ExpiresAtHeight = 100
+		testSignedTxRoundTrip(t, stx)
+	}
+	testSignedTxRoundTrip(t, &SignedTx{})
+}
+
+func FuzzSignedTxRoundTrip(f *testing.F) {
+	f.Add([]byte{0x01, 0x02}, []byte{0x03, 0x04}, int64(10), int64(1), 0, int64(0), []byte{0xaa}, []byte{0x05}, 0, []byte{0x08})
+	f.Add([]byte{}, []byte(nil), int64(-1), int64(0), 4, int64(100), []byte(nil), []byte(nil), 2, []byte(nil))
+	f.Fuzz(func(t *testing.T, dest, source []byte, amount, fee int64, version int, expires int64, id, sig []byte, alg int, pub []byte) {
+		stx := &SignedTx{
+			Tx: Tx{
+				TxOutput:        TxOutput{Destination: dest, Amount: amount},
+				Source:          source,
+				Fee:             fee,
+				Version:         TxVersion(version),
+				ExpiresAtHeight: expires,
+			},
+			Signature: sig,
+			Algorithm: SignatureAlgorithm(alg),
+			PublicKey: pub,
+		}
+		copy(stx.ID[:], id)
+		testSignedTxRoundTrip(t, stx)
+	})
+}
@@ -0,0 +1,207 @@
+package cryptopuff
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	WebhookEventBlock   = "block"
+	WebhookEventPayment = "payment"
+
+	// maxWebhookBlocks caps how far back a reorg is searched for blocks that
+	// haven't been notified yet.
+	maxWebhookBlocks = 100
+
+	webhookAttempts = 5
+	webhookBackoff  = time.Second
+
+	// webhookQueueSize caps the number of events waiting to be delivered.
+	// Events are dropped rather than holding up new blocks if the receiver
+	// falls this far behind.
+	webhookQueueSize = 1000
+)
+
+// WebhookEvent is POSTed as JSON to the webhook URL. Block events are sent
+// for every block that joins the best chain, and payment events for every
+// transaction in it to or from a wallet address, in which case TxHash and Tx
+// are set.
+type WebhookEvent struct {
+	Event  string
+	Block  Hash
+	Height int64
+	TxHash *Hash     `json:",omitempty"`
+	Tx     *SignedTx `json:",omitempty"`
+}
+
+type webhook struct {
+	url    string
+	events map[string]bool
+	client *http.Client
+
+	// mu serialises notify, so each block is only reported once.
+	mu       sync.Mutex
+	notified *hashSet
+
+	// queue holds events in the order they happened, for deliverWebhooks to
+	// send one at a time.
+	queue chan WebhookEvent
+}
+
+// Webhook POSTs the given events (WebhookEventBlock and/or
+// WebhookEventPayment) to url as the best chain changes.
+func Webhook(url string, events []string) ServerOption {
+	return func(s *Server) {
+		w := &webhook{
+			url:      url,
+			events:   make(map[string]bool),
+			client:   &http.Client{Timeout: Timeout},
+			notified: newHashSet(maxWebhookBlocks),
+			queue:    make(chan WebhookEvent, webhookQueueSize),
+		}
+		for _, event := range events {
+			w.events[event] = true
+		}
+		s.webhook = w
+	}
+}
+
+// blockAdded is called whenever blocks may have been added to the best
+// chain. It wakes up the miners and sends any webhook events.
+func (s *Server) blockAdded() {
+	atomic.AddUint64(&s.bestBlockVersion, 1)
+
+	if s.webhook != nil {
+		if err := s.notifyWebhook(); err != nil {
+			s.logger.Printf("failed to compute webhook events: %v\n", err)
+		}
+	}
+}
+
+// notifyWebhook works out which blocks have joined the best chain since the
+// last call, including after a reorg, and queues events for them.
+func (s *Server) notifyWebhook() error {
+	w := s.webhook
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	best, err := s.db.BestBlock()
+	if err != nil {
+		return err
+	}
+	if w.notified.contains(best.Hash) {
+		return nil
+	}
+
+	var blocks []Block
+	if w.notified.len() == 0 {
+		// nothing has been notified since startup, so only report the tip
+		blocks = []Block{*best}
+	} else {
+		chain, err := s.db.ChainAbove(best.Hash, best.Height-maxWebhookBlocks)
+		if err != nil {
+			return err
+		}
+		for _, b := range chain {
+			if w.notified.contains(b.Hash) {
+				break
+			}
+			blocks = append(blocks, b)
+		}
+	}
+
+	keys, err := s.db.Keys()
+	if err != nil {
+		return err
+	}
+	wallet := make(map[string]bool)
+	for _, k := range keys {
+		wallet[k.Address.String()] = true
+	}
+
+	var events []WebhookEvent
+	for i := len(blocks) - 1; i >= 0; i-- {
+		b := &blocks[i]
+		w.notified.add(b.Hash)
+
+		if w.events[WebhookEventBlock] {
+			events = append(events, WebhookEvent{Event: WebhookEventBlock, Block: b.Hash, Height: b.Height})
+		}
+
+		if w.events[WebhookEventPayment] {
+			for j := range b.Transactions {
+				stx := &b.Transactions[j]
+				if !wallet[stx.Source.String()] && !wallet[stx.Destination.String()] {
+					continue
+				}
+
+				hash := stx.Hash
+				events = append(events, WebhookEvent{
+					Event:  WebhookEventPayment,
+					Block:  b.Hash,
+					Height: b.Height,
+					TxHash: &hash,
+					Tx:     stx,
+				})
+			}
+		}
+	}
+
+	for _, event := range events {
+		select {
+		case w.queue <- event:
+		default:
+			s.logger.Printf("webhook queue full, dropping %v event for block %v\n", event.Event, event.Block)
+		}
+	}
+	return nil
+}
+
+// deliverWebhooks sends queued webhook events one at a time, so that they
+// arrive in the order they happened even when deliveries are retried.
+func (s *Server) deliverWebhooks() {
+	for event := range s.webhook.queue {
+		if err := s.webhook.deliver(event); err != nil {
+			s.logger.Printf("failed to deliver %v webhook for block %v: %v\n", event.Event, event.Block, err)
+		}
+	}
+}
+
+// deliver POSTs the event, retrying with exponential backoff if the request
+// fails or the receiver doesn't respond with a 2xx status.
+func (w *webhook) deliver(event WebhookEvent) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "cryptopuff: failed to marshal JSON")
+	}
+
+	backoff := webhookBackoff
+	for try := 1; ; try++ {
+		err = w.post(b)
+		if err == nil || try == webhookAttempts {
+			return err
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (w *webhook) post(b []byte) error {
+	resp, err := w.client.Post(w.url, contentTypeJSON, bytes.NewReader(b))
+	if err != nil {
+		return errors.Wrap(err, "cryptopuff: POST failed")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("cryptopuff: invalid status code: %v", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package cryptopuff
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhookPayment(t *testing.T) {
+	received := make(chan WebhookEvent, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event WebhookEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Error(err)
+		}
+		received <- event
+	}))
+	defer hook.Close()
+
+	d := openTestDB(t)
+	s := newTestServer(d, Webhook(hook.URL, []string{WebhookEventBlock, WebhookEventPayment}))
+	go s.deliverWebhooks()
+
+	k := testKey(t, 8)
+	a, err := d.AddKey(V3, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parent := insertTestBlock(t, d, GenesisBlock, MinTarget)
+	reward := mineTestBlockTo(t, parent, 0, a, nil)
+	if err := d.AddBlock(reward); err != nil {
+		t.Fatal(err)
+	}
+	s.blockAdded()
+
+	stx := signTestTx(t, k, TxVersion3, 10, 1)
+	tip := mineTestBlock(t, reward, 0, []SignedTx{*stx})
+	if err := d.AddBlock(tip); err != nil {
+		t.Fatal(err)
+	}
+	s.blockAdded()
+
+	want := []WebhookEvent{
+		{Event: WebhookEventBlock, Block: reward.Hash, Height: reward.Height},
+		{Event: WebhookEventBlock, Block: tip.Hash, Height: tip.Height},
+		{Event: WebhookEventPayment, Block: tip.Hash, Height: tip.Height, TxHash: &stx.Hash},
+	}
+	for i, w := range want {
+		var got WebhookEvent
+		select {
+		case got = <-received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for event %v", i)
+		}
+
+		if got.Event != w.Event || got.Block != w.Block || got.Height != w.Height {
+			t.Errorf("event %v is %v for block %v at height %v, want %v for block %v at height %v", i, got.Event, got.Block, got.Height, w.Event, w.Block, w.Height)
+		}
+		if w.TxHash == nil {
+			continue
+		}
+		if got.TxHash == nil || *got.TxHash != *w.TxHash {
+			t.Errorf("event %v has transaction hash %v, want %v", i, got.TxHash, *w.TxHash)
+		}
+		if got.Tx == nil || got.Tx.Amount != stx.Amount || !got.Tx.Source.Equal(a) {
+			t.Errorf("event %v has transaction %+v, want %+v", i, got.Tx, stx)
+		}
+	}
+
+	select {
+	case event := <-received:
+		t.Errorf("unexpected %v event for block %v", event.Event, event.Block)
+	case <-time.After(100 * time.Millisecond):
+	}
+}